@@ -0,0 +1,323 @@
+package logic
+
+import (
+	"errors"
+	e "pleasesign/errlogger"
+	"strings"
+	"time"
+)
+
+// certDateLayout is the layout of the datetimes stored in the db.
+const certDateLayout = "2006-01-02 15:04:05"
+
+/*
+  certBundle holds the translation of a certificate into a language. Text
+  maps the English text of the default template, along with the statuses of
+  a document, to the translation. Text without a translation is written in
+  English, as are the bodies of events which are stored in English.
+*/
+type certBundle struct {
+	DateFormat string
+	Text       map[string]string
+}
+
+// certBundles are the languages a certificate can be rendered in.
+var certBundles = map[string]certBundle{
+	"en": {DateFormat: certDateLayout},
+	"de": {
+		DateFormat: "02.01.2006 15:04:05",
+		Text: map[string]string{
+			"Certificate of Authenticity":            "Echtheitszertifikat",
+			"Document Details":                       "Dokumentdetails",
+			"Recipient Details":                      "Empfängerdetails",
+			"Document Events":                        "Dokumentereignisse",
+			"Title":                                  "Titel",
+			"Message to recipients":                  "Nachricht an die Empfänger",
+			"Void Reason":                            "Stornierungsgrund",
+			"Type":                                   "Typ",
+			"Pages":                                  "Seiten",
+			"Created":                                "Erstellt",
+			"Authentication":                         "Authentifizierung",
+			"Date signed":                            "Unterzeichnet am",
+			"Session ID":                             "Sitzungs-ID",
+			"IP address":                             "IP-Adresse",
+			"Location signed":                        "Ort der Unterzeichnung",
+			"complete":                               "abgeschlossen",
+			"void":                                   "storniert",
+			"Certificate generated on {generated}.":  "Zertifikat erstellt am {generated}.",
+			"All times on this document are in UTC.": "Alle Zeiten in diesem Dokument sind in UTC angegeben.",
+			"All times on this document are in {timezone}, with UTC in brackets.": "Alle Zeiten in diesem Dokument sind in {timezone} angegeben, mit UTC in Klammern.",
+			"Verify this certificate at {verify_url}":                             "Prüfen Sie dieses Zertifikat unter {verify_url}",
+			"MD5 of the signed document: {document_sum}":                          "MD5 des unterzeichneten Dokuments: {document_sum}",
+		},
+	},
+	"fr": {
+		DateFormat: "02/01/2006 15:04:05",
+		Text: map[string]string{
+			"Certificate of Authenticity":            "Certificat d'authenticité",
+			"Document Details":                       "Détails du document",
+			"Recipient Details":                      "Détails des destinataires",
+			"Document Events":                        "Événements du document",
+			"Title":                                  "Titre",
+			"Message to recipients":                  "Message aux destinataires",
+			"Status":                                 "Statut",
+			"Void Reason":                            "Motif d'annulation",
+			"Created":                                "Créé le",
+			"Authentication":                         "Authentification",
+			"Date signed":                            "Date de signature",
+			"Session ID":                             "ID de session",
+			"IP address":                             "Adresse IP",
+			"Location signed":                        "Lieu de signature",
+			"Browser":                                "Navigateur",
+			"complete":                               "terminé",
+			"void":                                   "annulé",
+			"Certificate generated on {generated}.":  "Certificat généré le {generated}.",
+			"All times on this document are in UTC.": "Toutes les heures de ce document sont en UTC.",
+			"All times on this document are in {timezone}, with UTC in brackets.": "Toutes les heures de ce document sont en {timezone}, avec l'heure UTC entre parenthèses.",
+			"Verify this certificate at {verify_url}":                             "Vérifiez ce certificat sur {verify_url}",
+			"MD5 of the signed document: {document_sum}":                          "MD5 du document signé : {document_sum}",
+		},
+	},
+	"es": {
+		DateFormat: "02/01/2006 15:04:05",
+		Text: map[string]string{
+			"Certificate of Authenticity":            "Certificado de autenticidad",
+			"Document Details":                       "Detalles del documento",
+			"Recipient Details":                      "Detalles de los destinatarios",
+			"Document Events":                        "Eventos del documento",
+			"Title":                                  "Título",
+			"Message to recipients":                  "Mensaje a los destinatarios",
+			"Status":                                 "Estado",
+			"Void Reason":                            "Motivo de anulación",
+			"Type":                                   "Tipo",
+			"Pages":                                  "Páginas",
+			"Created":                                "Creado",
+			"Authentication":                         "Autenticación",
+			"Date signed":                            "Fecha de firma",
+			"Session ID":                             "ID de sesión",
+			"IP address":                             "Dirección IP",
+			"Location signed":                        "Lugar de firma",
+			"Browser":                                "Navegador",
+			"complete":                               "completado",
+			"void":                                   "anulado",
+			"Certificate generated on {generated}.":  "Certificado generado el {generated}.",
+			"All times on this document are in UTC.": "Todas las horas de este documento están en UTC.",
+			"All times on this document are in {timezone}, with UTC in brackets.": "Todas las horas de este documento están en {timezone}, con UTC entre paréntesis.",
+			"Verify this certificate at {verify_url}":                             "Verifique este certificado en {verify_url}",
+			"MD5 of the signed document: {document_sum}":                          "MD5 del documento firmado: {document_sum}",
+		},
+	},
+	"it": {
+		DateFormat: "02/01/2006 15:04:05",
+		Text: map[string]string{
+			"Certificate of Authenticity":            "Certificato di autenticità",
+			"Document Details":                       "Dettagli del documento",
+			"Recipient Details":                      "Dettagli dei destinatari",
+			"Document Events":                        "Eventi del documento",
+			"Title":                                  "Titolo",
+			"Message to recipients":                  "Messaggio ai destinatari",
+			"Status":                                 "Stato",
+			"Void Reason":                            "Motivo dell'annullamento",
+			"Type":                                   "Tipo",
+			"Pages":                                  "Pagine",
+			"Created":                                "Creato",
+			"Authentication":                         "Autenticazione",
+			"Date signed":                            "Data di firma",
+			"Session ID":                             "ID sessione",
+			"IP address":                             "Indirizzo IP",
+			"Location signed":                        "Luogo di firma",
+			"complete":                               "completato",
+			"void":                                   "annullato",
+			"Certificate generated on {generated}.":  "Certificato generato il {generated}.",
+			"All times on this document are in UTC.": "Tutti gli orari di questo documento sono in UTC.",
+			"All times on this document are in {timezone}, with UTC in brackets.": "Tutti gli orari di questo documento sono in {timezone}, con l'ora UTC tra parentesi.",
+			"Verify this certificate at {verify_url}":                             "Verifica questo certificato su {verify_url}",
+			"MD5 of the signed document: {document_sum}":                          "MD5 del documento firmato: {document_sum}",
+		},
+	},
+	"nl": {
+		DateFormat: "02-01-2006 15:04:05",
+		Text: map[string]string{
+			"Certificate of Authenticity":            "Certificaat van echtheid",
+			"Document Details":                       "Documentgegevens",
+			"Recipient Details":                      "Ontvangergegevens",
+			"Document Events":                        "Documentgebeurtenissen",
+			"Message to recipients":                  "Bericht aan de ontvangers",
+			"Void Reason":                            "Reden van annulering",
+			"Pages":                                  "Pagina's",
+			"Created":                                "Aangemaakt",
+			"Authentication":                         "Authenticatie",
+			"Date signed":                            "Datum ondertekend",
+			"Session ID":                             "Sessie-ID",
+			"IP address":                             "IP-adres",
+			"Location signed":                        "Locatie ondertekening",
+			"complete":                               "voltooid",
+			"void":                                   "geannuleerd",
+			"Certificate generated on {generated}.":  "Certificaat gegenereerd op {generated}.",
+			"All times on this document are in UTC.": "Alle tijden in dit document zijn in UTC.",
+			"All times on this document are in {timezone}, with UTC in brackets.": "Alle tijden in dit document zijn in {timezone}, met UTC tussen haakjes.",
+			"Verify this certificate at {verify_url}":                             "Controleer dit certificaat op {verify_url}",
+			"MD5 of the signed document: {document_sum}":                          "MD5 van het ondertekende document: {document_sum}",
+		},
+	},
+}
+
+// certLanguage returns the language of a locale, eg. de for de-AT, and
+// false if certificates cannot be rendered in the language.
+func certLanguage(locale string) (string, bool) {
+	lang := strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == "" {
+		return "en", true
+	}
+	_, ok := certBundles[lang]
+	return lang, ok
+}
+
+// CertOptions are the language and timezone a certificate is rendered in,
+// set by the sender of the document.
+type CertOptions struct {
+	Locale   string `db:"locale"`   // eg. de or de-AT.
+	Timezone string `db:"timezone"` // An IANA timezone, eg. Europe/Berlin.
+}
+
+// certFormat translates the text and formats the times of a certificate.
+type certFormat struct {
+	bundle   certBundle
+	location *time.Location
+	rfc3339  bool // Formats the times for machines, as RFC 3339 in UTC.
+}
+
+/*
+  newCertFormat returns the format of the options. An unsupported locale is
+  rendered in English, while an unknown timezone is returned as an error
+  along with a format in UTC.
+*/
+func newCertFormat(o CertOptions) (certFormat, error) {
+	lang, ok := certLanguage(o.Locale)
+	if !ok {
+		lang = "en"
+	}
+	f := certFormat{bundle: certBundles[lang], location: time.UTC}
+	if o.Timezone == "" || o.Timezone == "Local" {
+		return f, nil
+	}
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return f, err
+	}
+	f.location = loc
+	return f, nil
+}
+
+// text returns the translation of the text.
+func (f certFormat) text(s string) string {
+	if t, ok := f.bundle.Text[s]; ok {
+		return t
+	}
+	return s
+}
+
+// formatTime returns the time in the timezone of the format followed by
+// the time in UTC, or only the time in UTC if the timezone is UTC.
+func (f certFormat) formatTime(t time.Time) string {
+	if f.rfc3339 {
+		return t.UTC().Format(time.RFC3339)
+	}
+	utc := t.UTC().Format(f.bundle.DateFormat) + " UTC"
+	if f.location == time.UTC {
+		return utc
+	}
+	return t.In(f.location).Format(f.bundle.DateFormat+" MST") + " (" + utc + ")"
+}
+
+// formatDate formats a datetime from the db, which is in UTC. Values which
+// are not a datetime are returned as-is.
+func (f certFormat) formatDate(s string) string {
+	for _, layout := range []string{certDateLayout, time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return f.formatTime(t)
+		}
+	}
+	return s
+}
+
+// timeNote returns the note explaining the timezone of the times.
+func (f certFormat) timeNote() string {
+	if f.location == time.UTC {
+		return f.text("All times on this document are in UTC.")
+	}
+	note := f.text("All times on this document are in {timezone}, with UTC in brackets.")
+	return strings.Replace(note, "{timezone}", f.location.String(), 1)
+}
+
+// localise returns the template with its titles, labels and text translated.
+func (f certFormat) localise(t CertTemplate) CertTemplate {
+	fields := func(in []CertField) []CertField {
+		out := make([]CertField, len(in))
+		for i, fd := range in {
+			out[i] = CertField{Label: f.text(fd.Label), Value: f.text(fd.Value)}
+		}
+		return out
+	}
+
+	t.Title = f.text(t.Title)
+	t.Subtitle = f.text(t.Subtitle)
+	sections := make([]CertSection, len(t.Sections))
+	for i, s := range t.Sections {
+		s.Title = f.text(s.Title)
+		s.Fields = fields(s.Fields)
+		s.Unsigned = fields(s.Unsigned)
+		sections[i] = s
+	}
+	t.Sections = sections
+	t.Footer = fields(t.Footer)
+	t.Verification = fields(t.Verification)
+	return t
+}
+
+/*
+  certFormat returns the format of the certificate of a document, from the
+  options of the user who sent it. A failure to load the options is logged
+  and the certificate is rendered in English and UTC, as the certificate
+  must still be generated.
+*/
+func (lc Lgc) certFormat(documentID string, db DataCaller) certFormat {
+	var o CertOptions
+	q := `SELECT user.locale, user.timezone FROM documents
+          JOIN user ON user.id = documents.user_id WHERE documents.id = ?;`
+	if err := db.Get(&o, q, documentID); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRCERTFORMAT " + documentID, E: err})
+	}
+	f, err := newCertFormat(o)
+	if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRCERTFORMAT1 " + documentID, E: err})
+	}
+	return f
+}
+
+/*
+  UpdateCertOptions sets the language and timezone of the certificates of
+  the documents sent by the current user. An empty timezone is UTC.
+*/
+func (lc Lgc) UpdateCertOptions(db DataCaller, ls LogicStore, in *CertOptions) error {
+	lang, ok := certLanguage(in.Locale)
+	if !ok {
+		return errors.New("Certificates are not available in this language.")
+	}
+	tz := strings.TrimSpace(in.Timezone)
+	if tz == "" {
+		tz = "UTC"
+	}
+	if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+		return errors.New("This timezone is not recognised.")
+	}
+
+	q := `UPDATE user SET locale = ?, timezone = ? WHERE id = ?;`
+	if _, err := db.Exec(q, lang, tz, ls.GetCurrentUser().Id); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRCERTOPTIONS", E: err})
+	}
+	return nil
+}
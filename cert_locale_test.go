@@ -0,0 +1,132 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"go/build"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the times are written in the timezone of the format alongside UTC,
+// in the date format of the language.
+func TestCertFormatTimes(t *testing.T) {
+	f, err := newCertFormat(CertOptions{Locale: "de-AT", Timezone: "Europe/Berlin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "14.03.2026 10:30:00 CET (14.03.2026 09:30:00 UTC)"
+	if got := f.formatDate("2026-03-14 09:30:00"); got != want {
+		t.Errorf("formatDate expected %q, got %q.", want, got)
+	}
+	if got := f.formatDate("2026-07-01T09:30:00Z"); !strings.HasPrefix(got, "01.07.2026 11:30:00 CEST") {
+		t.Errorf("formatDate did not use summer time, got %q.", got)
+	}
+	if got := f.timeNote(); !strings.Contains(got, "Europe/Berlin") {
+		t.Errorf("timeNote did not name the timezone, got %q.", got)
+	}
+
+	if got := certUTC.formatDate("2026-03-14 09:30:00"); got != "2026-03-14 09:30:00 UTC" {
+		t.Errorf("formatDate returned the wrong UTC time, got %q.", got)
+	}
+	if got := certUTC.formatDate("unknown"); got != "unknown" {
+		t.Errorf("formatDate changed a value that is not a date, got %q.", got)
+	}
+
+	// An unknown timezone is an error, and unsupported languages are in
+	// English.
+	if _, err := newCertFormat(CertOptions{Timezone: "Mars/Olympus"}); err == nil {
+		t.Error("newCertFormat accepted an unknown timezone.")
+	}
+	if f, _ := newCertFormat(CertOptions{Locale: "xx"}); f.text("Document Details") != "Document Details" {
+		t.Error("newCertFormat did not fall back to English.")
+	}
+}
+
+// Test the template and the status are translated, leaving the values the
+// fields refer to in place.
+func TestCertLocalise(t *testing.T) {
+	f, _ := newCertFormat(CertOptions{Locale: "fr"})
+	tmpl := f.localise(DefaultCertTemplate())
+	if tmpl.Title != "Certificat d'authenticité" || tmpl.Sections[0].Title != "Détails du document" {
+		t.Errorf("localise did not translate the titles, got %q %q.", tmpl.Title, tmpl.Sections[0].Title)
+	}
+	if DefaultCertTemplate().Sections[0].Title != "Document Details" {
+		t.Error("localise changed the default template.")
+	}
+
+	data := newCertData(documentDetail{id: "A", status: "void", voidReason: "Typo", pages: 3}, nil, nil, f, time.Now())
+	want := "ID: A\nStatut: annulé\nMotif d'annulation: Typo\nPages: 3"
+	if got := certLines(tmpl.Sections[0].Fields, data.Document); got != want {
+		t.Errorf("certLines expected %q, got %q.", want, got)
+	}
+	if l, _ := tmpl.Footer[1].line(data.Footer); !strings.HasPrefix(l, "Certificat généré le ") {
+		t.Errorf("The footer was not translated, got %q.", l)
+	}
+}
+
+// Test names outside of Latin-1 can be written with an embedded font. The
+// font is the one bundled with gofpdf.
+func TestRenderCertificateUnicode(t *testing.T) {
+	fonts, _ := filepath.Glob(filepath.Join(build.Default.GOPATH,
+		"pkg/mod/github.com/jung-kurt/gofpdf@*/font/DejaVuSansCondensed.ttf"))
+	if len(fonts) == 0 {
+		t.Skip("The gofpdf fonts are not available.")
+	}
+
+	tmpl := DefaultCertTemplate()
+	tmpl.Logo = CertLogo{}
+	tmpl.Font, tmpl.FontFile = "Unicode", fonts[0]
+	f, _ := newCertFormat(CertOptions{Locale: "de", Timezone: "Asia/Tokyo"})
+	r := recipientDetail{name: "Ирина 山田", email: "a@b.com"}
+	data := newCertData(documentDetail{id: "A", status: "complete"}, []recipientDetail{r}, nil, f, time.Now())
+
+	var out bytes.Buffer
+	if err := renderCertificate(f.localise(tmpl), data).Output(&out); err != nil {
+		t.Fatalf("renderCertificate returned an error, got %v.", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("/FontFile2")) {
+		t.Error("renderCertificate did not embed the font.")
+	}
+
+	// A missing font is an error rather than a certificate without names.
+	tmpl.FontFile = "/missing.ttf"
+	if err := renderCertificate(tmpl, data).Output(&out); err == nil {
+		t.Error("renderCertificate did not return an error for a missing font.")
+	}
+}
+
+// Test the options are validated before they are stored against the user.
+func TestUpdateCertOptions(t *testing.T) {
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	var stored []interface{}
+	db := &MockDb{
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			stored = args
+			return nil, nil
+		},
+	}
+	lc := Lgc{}
+
+	for _, in := range []CertOptions{{Locale: "ja"}, {Locale: "de", Timezone: "Europe/Nowhere"}, {Timezone: "Local"}} {
+		if err := lc.UpdateCertOptions(db, ls, &in); err == nil {
+			t.Errorf("UpdateCertOptions accepted %+v.", in)
+		}
+	}
+	if stored != nil {
+		t.Errorf("UpdateCertOptions stored invalid options, got %v.", stored)
+	}
+
+	if err := lc.UpdateCertOptions(db, ls, &CertOptions{Locale: "nl_BE", Timezone: "Europe/Brussels"}); err != nil {
+		t.Fatalf("UpdateCertOptions returned an error, got %v.", err)
+	}
+	if len(stored) != 3 || stored[0] != "nl" || stored[1] != "Europe/Brussels" || stored[2] != "1" {
+		t.Errorf("UpdateCertOptions stored the wrong options, got %v.", stored)
+	}
+}
@@ -0,0 +1,188 @@
+package logic
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+/*
+  CertSigner holds the key and X.509 certificate used to sign certificates
+  of authenticity. The key never needs to leave the signer, so it can be
+  held in a file (PEMSigner) for local testing, or in KMS (KMSSigner) in
+  production. Sign is called with a SHA-256 digest.
+*/
+type CertSigner interface {
+	crypto.Signer
+	// Certificates returns the certificate of the key followed by the rest
+	// of its chain, which are embedded in the signature.
+	Certificates() []*x509.Certificate
+}
+
+// certSigning holds the signer used for certificates of authenticity.
+var certSigning struct {
+	sync.RWMutex
+	signer CertSigner
+	master bool
+}
+
+// SetCertSigner sets the signer used for certificates of authenticity. When
+// master is true the completed master document is signed as well. A nil
+// signer leaves certificates unsigned, as does a failure to sign, which is
+// logged.
+func SetCertSigner(s CertSigner, master bool) {
+	certSigning.Lock()
+	certSigning.signer = s
+	certSigning.master = master
+	certSigning.Unlock()
+}
+
+// certSigner returns the signer for certificates, and whether the master
+// document should be signed.
+func certSigner() (CertSigner, bool) {
+	certSigning.RLock()
+	defer certSigning.RUnlock()
+	return certSigning.signer, certSigning.master
+}
+
+// parseCertChain returns every certificate in the PEM data, in order.
+func parseCertChain(b []byte) ([]*x509.Certificate, error) {
+	var out []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return out, nil
+}
+
+// PEMSigner is a CertSigner with the key and certificate read from PEM
+// files. This is intended for local testing.
+type PEMSigner struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+}
+
+// NewPEMSigner returns a PEMSigner for the PEM encoded certificate chain and
+// private key (PKCS#1, PKCS#8 or EC). The key must match the certificate.
+func NewPEMSigner(certPEM []byte, keyPEM []byte) (*PEMSigner, error) {
+	chain, err := parseCertChain(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no private key found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(chain[0].PublicKey) {
+		return nil, errors.New("the private key does not match the certificate")
+	}
+	return &PEMSigner{key: signer, chain: chain}, nil
+}
+
+// LoadPEMSigner returns a PEMSigner for the certificate and key files.
+func LoadPEMSigner(certPath string, keyPath string) (*PEMSigner, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewPEMSigner(certPEM, keyPEM)
+}
+
+func (p *PEMSigner) Public() crypto.PublicKey {
+	return p.key.Public()
+}
+func (p *PEMSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return p.key.Sign(rand, digest, opts)
+}
+func (p *PEMSigner) Certificates() []*x509.Certificate {
+	return p.chain
+}
+
+// KMSSigner is a CertSigner with the key held in KMS, which signs digests
+// with the asymmetric KMS key. The certificate issued for the key is held
+// alongside it.
+type KMSSigner struct {
+	keyID  string
+	chain  []*x509.Certificate
+	client kmsiface.KMSAPI
+}
+
+// NewKMSSigner returns a KMSSigner for the KMS key id (or alias) and the PEM
+// encoded certificate chain issued for it.
+func NewKMSSigner(keyID string, certPEM []byte) (*KMSSigner, error) {
+	chain, err := parseCertChain(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	client := kms.New(session.New(), &aws.Config{Region: aws.String("ap-southeast-2")})
+	return &KMSSigner{keyID: keyID, chain: chain, client: client}, nil
+}
+
+func (k *KMSSigner) Public() crypto.PublicKey {
+	return k.chain[0].PublicKey
+}
+func (k *KMSSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	alg := kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256
+	if _, ok := k.Public().(*ecdsa.PublicKey); ok {
+		alg = kms.SigningAlgorithmSpecEcdsaSha256
+	}
+	out, err := k.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(k.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(alg),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Signature, nil
+}
+func (k *KMSSigner) Certificates() []*x509.Certificate {
+	return k.chain
+}
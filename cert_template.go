@@ -0,0 +1,644 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jung-kurt/gofpdf"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kinds of section on a certificate of authenticity.
+const (
+	CertSectionDocument   = "document"   // The details of the document.
+	CertSectionRecipients = "recipients" // Each recipient and their session.
+	CertSectionEvents     = "events"     // Each event of the document.
+)
+
+// CertColour is an RGB colour used on a certificate.
+type CertColour struct {
+	R, G, B int
+}
+
+// CertStyle is the font and colour of text on a certificate.
+type CertStyle struct {
+	Size   float64
+	Bold   bool
+	Colour CertColour
+}
+
+// CertLogo is the logo at the top left of a certificate, either a file or
+// an image held in memory. Negative dimensions are a resolution in dpi, as
+// gofpdf expects, and a zero dimension keeps the aspect ratio.
+type CertLogo struct {
+	Path   string
+	Data   []byte
+	Type   string // The type of the Data, PNG, JPG or GIF.
+	Width  float64
+	Height float64
+}
+
+/*
+  CertField is a line of a section. The value may refer to the values of the
+  document, recipient or event in braces, eg. "{long}, {lat}", and the line
+  is left out when any of the values it refers to are empty. Without a
+  label only the value is written.
+*/
+type CertField struct {
+	Label string
+	Value string
+}
+
+// CertSection is a section of a certificate, with its heading.
+type CertSection struct {
+	Kind    string
+	Title   string
+	Heading CertStyle   // Overrides the heading style of the template when set.
+	Fields  []CertField // For recipients, the lines of a recipient who signed.
+	// Unsigned are the lines of a recipient without a session, for
+	// recipients of a voided document.
+	Unsigned []CertField
+	// Signature draws the signature of each recipient beside their lines.
+	Signature bool
+	Rule      bool // Draws a line beneath the section.
+}
+
+/*
+  CertTemplate is the layout of a certificate of authenticity: the logo and
+  title along the top, the sections with their fields, and the footer.
+  DefaultCertTemplate is used for documents without branding, while
+  documents of an enterprise with branding use its logo and colours.
+*/
+type CertTemplate struct {
+	Font string
+	// FontFile and BoldFontFile are TrueType fonts embedded as the Font,
+	// so names in any script can be written. Without them Font is a core
+	// font, which only has the Latin-1 characters.
+	FontFile      string
+	BoldFontFile  string
+	Logo          CertLogo
+	Title         string
+	Subtitle      string
+	TitleX        float64 // The left of the area the title is centred in, clear of the logo.
+	TitleStyle    CertStyle
+	SubtitleStyle CertStyle
+	Heading       CertStyle
+	Body          CertStyle // The document details and recipient names.
+	Detail        CertStyle // The recipient details and events.
+	Footnote      CertStyle
+	RuleColour    CertColour
+	Sections      []CertSection
+	Footer        []CertField
+	// QRSize is the width of the QR code linking to the verification of
+	// the certificate, drawn beneath the footer with the Verification
+	// lines beside it. No QR code is drawn when it is zero.
+	QRSize       float64
+	Verification []CertField
+}
+
+// DefaultCertTemplate returns the template of the certificate used for
+// documents without branding.
+func DefaultCertTemplate() CertTemplate {
+	font := "Helvetica"
+	if config.CertFont() != "" {
+		font = "Unicode"
+	}
+	return CertTemplate{
+		Font:          font,
+		FontFile:      config.CertFont(),
+		BoldFontFile:  config.CertBoldFont(),
+		Logo:          CertLogo{Path: config.LogoPath(), Width: -250, Height: -250},
+		Title:         "Certificate of Authenticity",
+		Subtitle:      "v1",
+		TitleX:        210,
+		TitleStyle:    CertStyle{Size: 23, Bold: true},
+		SubtitleStyle: CertStyle{Size: 20},
+		Heading:       CertStyle{Size: 18},
+		Body:          CertStyle{Size: 12},
+		Detail:        CertStyle{Size: 10},
+		Footnote:      CertStyle{Size: 8},
+		RuleColour:    CertColour{200, 200, 200},
+		Sections: []CertSection{
+			{
+				Kind:  CertSectionDocument,
+				Title: "Document Details",
+				Fields: []CertField{
+					{"ID", "{id}"},
+					{"Title", "{title}"},
+					{"Message to recipients", "{message}"},
+					{"Status", "{status}"},
+					{"Void Reason", "{void_reason}"},
+					{"Type", "{type}"},
+					{"Pages", "{pages}"},
+					{"Created", "{created}"},
+				},
+				Rule: true,
+			},
+			{
+				Kind:  CertSectionRecipients,
+				Title: "Recipient Details",
+				Fields: []CertField{
+					{"ID", "{id}({email})"},
+					{"Authentication", "{security}"},
+					{"Date signed", "{signed}"},
+					{"Session ID", "{session}"},
+					{"IP address", "{ip}"},
+					{"Location signed", "{long}, {lat}"},
+					{"Browser", "{browser}"},
+				},
+				Unsigned:  []CertField{{"", "{email}"}},
+				Signature: true,
+				Rule:      true,
+			},
+			{
+				Kind:    CertSectionEvents,
+				Title:   "Document Events",
+				Heading: CertStyle{Size: 16},
+				Fields:  []CertField{{"", "{date} - {body}"}},
+			},
+		},
+		Footer: []CertField{
+			{"", "{time_note}"},
+			{"", "Certificate generated on {generated}."},
+		},
+		QRSize: 70,
+		Verification: []CertField{
+			{"", "Verify this certificate at {verify_url}"},
+			{"", "MD5 of the signed document: {document_sum}"},
+		},
+	}
+}
+
+// certValueRe matches the values referred to by a field.
+var certValueRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// line returns the line of the field, or false if a value it refers to is
+// empty.
+func (f CertField) line(values map[string]string) (string, bool) {
+	ok := true
+	v := certValueRe.ReplaceAllStringFunc(f.Value, func(m string) string {
+		s := values[m[1:len(m)-1]]
+		if s == "" {
+			ok = false
+		}
+		return s
+	})
+	if f.Label != "" {
+		v = f.Label + ": " + v
+	}
+	return v, ok
+}
+
+// certLines returns the lines of the fields which have every value.
+func certLines(fields []CertField, values map[string]string) string {
+	var out []string
+	for _, f := range fields {
+		if l, ok := f.line(values); ok {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// certRecipient is a recipient written on the certificate.
+type certRecipient struct {
+	Name   string
+	Values map[string]string
+	Thumb  string // The path of the signature, empty if there is none.
+	Signed bool   // True if the recipient had an agreed session.
+}
+
+// certData holds the values written on a certificate.
+type certData struct {
+	Document   map[string]string
+	Recipients []certRecipient
+	Events     []map[string]string
+	Footer     map[string]string // Also holds the values of the verification lines.
+	Verify     string            // The link in the QR code, none is drawn if empty.
+}
+
+// newCertData returns the values of the document, its recipients and
+// events for the certificate, with the status and times in the format.
+func newCertData(doc documentDetail, recipients []recipientDetail, events []eventDetail, f certFormat, now time.Time) certData {
+	out := certData{
+		Document: map[string]string{
+			"id":      doc.id,
+			"title":   doc.title,
+			"message": doc.message,
+			"status":  f.text(doc.status),
+			"type":    doc.docType,
+			"pages":   strconv.Itoa(doc.pages),
+			"created": doc.date,
+		},
+		Footer: map[string]string{
+			"generated": f.formatTime(now),
+			"time_note": f.timeNote(),
+		},
+	}
+	if doc.status == "void" {
+		out.Document["void_reason"] = doc.voidReason
+	}
+
+	for _, r := range recipients {
+		cr := certRecipient{
+			Name:   r.name,
+			Thumb:  r.thumb,
+			Signed: r.sessionid != "",
+			Values: map[string]string{
+				"id":       r.id,
+				"email":    r.email,
+				"security": r.security,
+				"session":  r.sessionid,
+				"ip":       r.ip,
+				"browser":  r.useragent,
+			},
+		}
+		// The date is only shown with the signature.
+		if r.thumb != "" {
+			cr.Values["signed"] = r.date
+		}
+		if r.geolat != 0 && r.geolong != 0 {
+			cr.Values["long"] = fmt.Sprint(r.geolong)
+			cr.Values["lat"] = fmt.Sprint(r.geolat)
+		}
+		out.Recipients = append(out.Recipients, cr)
+	}
+
+	for _, ev := range events {
+		out.Events = append(out.Events, map[string]string{"date": ev.Date, "body": ev.Body})
+	}
+	return out
+}
+
+/*
+  renderCertificate lays out the certificate of authenticity from the
+  template. Any error drawing the certificate, such as a missing image or
+  font, is held by the returned pdf until it is output.
+*/
+func renderCertificate(t CertTemplate, data certData) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "pt", "A4", ".")
+
+	// Embed the fonts of the template. Core fonts are encoded as cp1252, so
+	// the text is translated from UTF-8, and characters outside of it are
+	// lost.
+	text := func(s string) string { return s }
+	if t.FontFile != "" {
+		bold := t.BoldFontFile
+		if bold == "" {
+			bold = t.FontFile
+		}
+		for style, file := range map[string]string{"": t.FontFile, "B": bold} {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				pdf.SetError(err)
+				return pdf
+			}
+			pdf.AddUTF8FontFromBytes(t.Font, style, b)
+		}
+	} else {
+		text = pdf.UnicodeTranslatorFromDescriptor("")
+	}
+
+	pdf.AddPage()
+	left, _ := pdf.GetXY()
+	pageW, _ := pdf.GetPageSize()
+	_, _, right, _ := pdf.GetMargins()
+
+	setStyle := func(s CertStyle) {
+		style := ""
+		if s.Bold {
+			style = "B"
+		}
+		pdf.SetFont(t.Font, style, s.Size)
+		pdf.SetTextColor(s.Colour.R, s.Colour.G, s.Colour.B)
+	}
+
+	// Add the logo to the top left, and the title and subtitle along the
+	// top, centred in the space beside the logo.
+	switch {
+	case len(t.Logo.Data) > 0:
+		opt := gofpdf.ImageOptions{ImageType: t.Logo.Type}
+		pdf.RegisterImageOptionsReader("logo", opt, bytes.NewReader(t.Logo.Data))
+		pdf.ImageOptions("logo", 15, 19, t.Logo.Width, t.Logo.Height, false, opt, 0, "")
+	case t.Logo.Path != "":
+		pdf.Image(t.Logo.Path, 15, 19, t.Logo.Width, t.Logo.Height, false, "", 0, "")
+	}
+	titleW := pageW - right - t.TitleX
+	setStyle(t.TitleStyle)
+	pdf.SetX(t.TitleX)
+	pdf.CellFormat(titleW, 39, text(t.Title), "", 0, "C", false, 0, "")
+	pdf.Ln(25)
+	if t.Subtitle != "" {
+		setStyle(t.SubtitleStyle)
+		pdf.SetX(t.TitleX)
+		pdf.CellFormat(titleW, 39, text(t.Subtitle), "", 0, "C", false, 0, "")
+	}
+
+	// Move down to beneath the top banner.
+	pdf.SetY(122)
+	for _, s := range t.Sections {
+		heading := t.Heading
+		if s.Heading.Size > 0 {
+			heading = s.Heading
+		}
+		setStyle(heading)
+		pdf.SetX(left + 15)
+		pdf.WriteAligned(0, 10, text(s.Title), "L")
+		pdf.Ln(20)
+
+		switch s.Kind {
+		case CertSectionDocument:
+			setStyle(t.Body)
+			pdf.SetX(left + 20)
+			pdf.MultiCell(0, 17, text(certLines(s.Fields, data.Document)), "", "", false)
+		case CertSectionRecipients:
+			for i, r := range data.Recipients {
+				setStyle(t.Body)
+				pdf.SetX(left + 20)
+				pdf.WriteAligned(0, 20, text(r.Name), "L")
+				setStyle(t.Detail)
+				fields := s.Unsigned
+				if r.Signed {
+					fields = s.Fields
+					// Draw the signature beside the details of the
+					// recipient.
+					if s.Signature && r.Thumb != "" {
+						pdf.SetX(325)
+						x, y := pdf.GetXY()
+						pdf.Image(r.Thumb, x+21, y+12, 140, 0, false, "", 0, "")
+					}
+				}
+				pdf.Ln(20)
+				pdf.SetX(left + 20)
+				pdf.MultiCell(0, 17, text(certLines(fields, r.Values)), "", "", false)
+				if i+1 != len(data.Recipients) {
+					pdf.Ln(30)
+				}
+			}
+		case CertSectionEvents:
+			setStyle(t.Detail)
+			for _, ev := range data.Events {
+				pdf.SetX(left + 20)
+				pdf.MultiCell(500, 12, text(certLines(s.Fields, ev)), "", "", false)
+				pdf.Ln(5)
+			}
+		}
+
+		if s.Rule {
+			pdf.Ln(20)
+			y := pdf.GetY()
+			pdf.SetDrawColor(t.RuleColour.R, t.RuleColour.G, t.RuleColour.B)
+			pdf.Line(0, y, pageW, y)
+			pdf.Ln(20)
+		}
+	}
+
+	pdf.Ln(20)
+	setStyle(t.Footnote)
+	for _, f := range t.Footer {
+		if l, ok := f.line(data.Footer); ok {
+			pdf.MultiCell(500, 12, text(l), "", "", false)
+		}
+	}
+
+	// Draw the QR code linking to the verification of the certificate on
+	// the same page, with the verification lines beside it.
+	if data.Verify != "" && t.QRSize > 0 {
+		q, err := newQRCode([]byte(data.Verify))
+		if err != nil {
+			pdf.SetError(err)
+			return pdf
+		}
+		pdf.Ln(15)
+		_, pageH := pdf.GetPageSize()
+		_, bottom := pdf.GetAutoPageBreak()
+		if pdf.GetY()+t.QRSize > pageH-bottom {
+			pdf.AddPage()
+		}
+		x, y := left, pdf.GetY()
+		m := t.QRSize / float64(q.size)
+		pdf.SetFillColor(0, 0, 0)
+		for r, row := range q.modules {
+			// Draw each run of dark modules as one rectangle.
+			for c := 0; c < len(row); c++ {
+				if !row[c] {
+					continue
+				}
+				start := c
+				for c+1 < len(row) && row[c+1] {
+					c++
+				}
+				pdf.Rect(x+float64(start)*m, y+float64(r)*m, float64(c-start+1)*m, m, "F")
+			}
+		}
+
+		setStyle(t.Footnote)
+		pdf.SetY(y + 4)
+		for _, f := range t.Verification {
+			if l, ok := f.line(data.Footer); ok {
+				pdf.SetX(x + t.QRSize + 15)
+				pdf.MultiCell(0, 12, text(l), "", "", false)
+			}
+		}
+		pdf.SetY(y + t.QRSize)
+	}
+	return pdf
+}
+
+// certBranding is the branding of the enterprise or user of a document.
+type certBranding struct {
+	LogoURL sql.NullString `db:"logo_url"`
+	Colours sql.NullString `db:"colour_scheme"`
+}
+
+// certColourRe matches the hex colours of a colour scheme.
+var certColourRe = regexp.MustCompile(`#?([0-9a-fA-F]{6})\b`)
+
+// parseColourScheme returns the hex colours of a colour scheme in order,
+// whether they are comma separated or held in JSON.
+func parseColourScheme(scheme string) []CertColour {
+	var out []CertColour
+	for _, m := range certColourRe.FindAllStringSubmatch(scheme, -1) {
+		v, _ := strconv.ParseUint(m[1], 16, 32)
+		out = append(out, CertColour{int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff)})
+	}
+	return out
+}
+
+/*
+  brandedCertTemplate returns the default template with the branding
+  applied. The first colour of the colour scheme is used for the title and
+  headings, and the second for the rules. The logo replaces the PleaseSign
+  logo, scaled to the height of the banner.
+*/
+func brandedCertTemplate(logo []byte, logoType string, scheme string) CertTemplate {
+	t := DefaultCertTemplate()
+	if len(logo) > 0 {
+		t.Logo = CertLogo{Data: logo, Type: logoType, Height: 60}
+	}
+	colours := parseColourScheme(scheme)
+	if len(colours) > 0 {
+		t.TitleStyle.Colour = colours[0]
+		t.SubtitleStyle.Colour = colours[0]
+		t.Heading.Colour = colours[0]
+		for i := range t.Sections {
+			t.Sections[i].Heading.Colour = colours[0]
+		}
+	}
+	if len(colours) > 1 {
+		t.RuleColour = colours[1]
+	}
+	return t
+}
+
+// maxLogoSize is the largest logo fetchLogo downloads, in bytes.
+const maxLogoSize = 2 << 20
+
+// maxCachedLogos is the number of logos held by fetchLogo before the cache
+// is emptied, and logoCacheTime is how long a logo is held, so a logo
+// replaced at the same url is shown once it expires.
+const (
+	maxCachedLogos = 256
+	logoCacheTime  = time.Hour
+)
+
+// logoHosts returns the hosts logos are served from, and logoClient is the
+// client logos are downloaded with.
+var (
+	logoHosts  = config.LogoHosts
+	logoClient = &http.Client{
+		Timeout: 20 * time.Second,
+		// A redirect is followed only to another allowed host.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkLogoURL(req.URL)
+		},
+	}
+)
+
+// cachedLogo is a logo downloaded by fetchLogo.
+type cachedLogo struct {
+	data    []byte
+	typ     string
+	fetched time.Time
+}
+
+// logoCache holds the logos downloaded by fetchLogo, by url.
+var logoCache struct {
+	sync.RWMutex
+	logos map[string]cachedLogo
+}
+
+// checkLogoURL returns an error if the logo is not served over https from
+// one of the logo hosts, so the url of a brand cannot be used to make
+// requests to other hosts.
+func checkLogoURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return errors.New("the logo is not served over https")
+	}
+	for _, h := range logoHosts() {
+		if strings.EqualFold(u.Host, h) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the logo is not served from an allowed host, got %v", u.Host)
+}
+
+/*
+  fetchLogo downloads the logo of a brand, returning the image and its type.
+  Only logos served from the logo hosts are downloaded, up to maxLogoSize,
+  and each logo is cached so it is not downloaded for every certificate.
+*/
+func fetchLogo(logoURL string) ([]byte, string, error) {
+	logoCache.RLock()
+	l, ok := logoCache.logos[logoURL]
+	logoCache.RUnlock()
+	if ok && time.Since(l.fetched) < logoCacheTime {
+		return l.data, l.typ, nil
+	}
+
+	u, err := url.Parse(logoURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkLogoURL(u); err != nil {
+		return nil, "", err
+	}
+	resp, err := logoClient.Get(u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("the logo returned %v", resp.StatusCode)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLogoSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(b) > maxLogoSize {
+		return nil, "", fmt.Errorf("the logo is larger than %v bytes", maxLogoSize)
+	}
+
+	switch http.DetectContentType(b) {
+	case "image/png":
+		l = cachedLogo{b, "PNG", time.Now()}
+	case "image/jpeg":
+		l = cachedLogo{b, "JPG", time.Now()}
+	case "image/gif":
+		l = cachedLogo{b, "GIF", time.Now()}
+	default:
+		return nil, "", errors.New("the logo is not a PNG, JPEG or GIF image")
+	}
+
+	logoCache.Lock()
+	if logoCache.logos == nil || len(logoCache.logos) >= maxCachedLogos {
+		logoCache.logos = map[string]cachedLogo{}
+	}
+	logoCache.logos[logoURL] = l
+	logoCache.Unlock()
+	return l.data, l.typ, nil
+}
+
+/*
+  certTemplate returns the template for the certificate of a document. The
+  branding of the enterprise of the document, or else of its user, is
+  applied to the default template. A failure to load the branding is
+  logged and the default template is used, as the certificate must still
+  be generated.
+*/
+func (lc Lgc) certTemplate(documentID string, db DataCaller) CertTemplate {
+	var b certBranding
+	q := `SELECT branding.logo_url, branding.colour_scheme FROM documents
+          JOIN user ON user.id = documents.user_id
+          LEFT JOIN enterprises ON enterprises.id = documents.enterprise_id
+          JOIN branding ON branding.id = COALESCE(enterprises.branding_id, user.branding_id)
+          WHERE documents.id = ?;`
+	err := db.Get(&b, q, documentID)
+	if err == sql.ErrNoRows {
+		return DefaultCertTemplate()
+	} else if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRCERTTEMPLATE " + documentID, E: err})
+		return DefaultCertTemplate()
+	}
+
+	var logo []byte
+	var logoType string
+	if b.LogoURL.String != "" {
+		logo, logoType, err = fetchLogo(b.LogoURL.String)
+		if err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRCERTTEMPLATE1 " + documentID, E: err})
+		}
+	}
+	return brandedCertTemplate(logo, logoType, b.Colours.String)
+}
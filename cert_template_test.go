@@ -0,0 +1,159 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certUTC is the format of certificates in English and UTC.
+var certUTC, _ = newCertFormat(CertOptions{})
+
+// Test the document section leaves out the fields without a value, which
+// replaces a format for each combination of message, type and status.
+func TestCertLines(t *testing.T) {
+	fields := DefaultCertTemplate().Sections[0].Fields
+	doc := documentDetail{id: "A", title: "Lease", status: "complete", pages: 2, date: "2026-01-01",
+		voidReason: "Typo"}
+
+	data := newCertData(doc, nil, nil, certUTC, time.Now())
+	want := "ID: A\nTitle: Lease\nStatus: complete\nPages: 2\nCreated: 2026-01-01"
+	if got := certLines(fields, data.Document); got != want {
+		t.Errorf("certLines expected %q, got %q.", want, got)
+	}
+
+	doc.status, doc.message, doc.docType = "void", "Please sign", "lease"
+	data = newCertData(doc, nil, nil, certUTC, time.Now())
+	want = "ID: A\nTitle: Lease\nMessage to recipients: Please sign\nStatus: void\nVoid Reason: Typo\nType: lease\nPages: 2\nCreated: 2026-01-01"
+	if got := certLines(fields, data.Document); got != want {
+		t.Errorf("certLines expected %q, got %q.", want, got)
+	}
+
+	// The location is only shown when both coordinates are known.
+	recipients := DefaultCertTemplate().Sections[1].Fields
+	r := recipientDetail{id: "R", email: "a@b.com", sessionid: "S", geolat: -33.8}
+	data = newCertData(doc, []recipientDetail{r}, nil, certUTC, time.Now())
+	if got := certLines(recipients, data.Recipients[0].Values); strings.Contains(got, "Location") ||
+		!strings.HasPrefix(got, "ID: R(a@b.com)") {
+		t.Errorf("certLines returned the wrong recipient details, got %q.", got)
+	}
+}
+
+// Test the colours of a colour scheme are read in order.
+func TestParseColourScheme(t *testing.T) {
+	for _, scheme := range []string{"#1d4f91,#f2f2f2", `{"primary":"1D4F91","secondary":"#F2F2F2"}`} {
+		cs := parseColourScheme(scheme)
+		if len(cs) != 2 || cs[0] != (CertColour{29, 79, 145}) || cs[1] != (CertColour{242, 242, 242}) {
+			t.Errorf("parseColourScheme(%v) returned the wrong colours, got %v.", scheme, cs)
+		}
+	}
+}
+
+// allowLogoServer lets fetchLogo download from the test server, returning a
+// function that restores the logo hosts and client.
+func allowLogoServer(srv *httptest.Server) func() {
+	hosts, client := logoHosts, logoClient
+	host := strings.TrimPrefix(srv.URL, "https://")
+	logoHosts = func() []string { return []string{host} }
+	c := srv.Client()
+	c.CheckRedirect = client.CheckRedirect
+	logoClient = c
+	return func() {
+		logoHosts, logoClient = hosts, client
+	}
+}
+
+// Test the fetchLogo function only downloads logos over https from the logo
+// hosts, limits their size and caches them.
+func TestFetchLogo(t *testing.T) {
+	var logo bytes.Buffer
+	png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	var hits int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		switch r.URL.Path {
+		case "/large":
+			w.Write(make([]byte, maxLogoSize+1))
+		case "/away":
+			http.Redirect(w, r, "https://example.com/logo.png", http.StatusFound)
+		default:
+			w.Write(logo.Bytes())
+		}
+	}))
+	defer srv.Close()
+	defer allowLogoServer(srv)()
+
+	for _, u := range []string{
+		"http" + strings.TrimPrefix(srv.URL, "https") + "/logo",
+		"https://169.254.169.254/latest/meta-data",
+		srv.URL + "/large",
+		srv.URL + "/away",
+	} {
+		if _, _, err := fetchLogo(u); err == nil {
+			t.Errorf("fetchLogo downloaded %v.", u)
+		}
+	}
+
+	hits = 0
+	for i := 0; i < 2; i++ {
+		if b, typ, err := fetchLogo(srv.URL + "/logo"); err != nil || typ != "PNG" || len(b) == 0 {
+			t.Errorf("fetchLogo did not download the logo, got %v %v.", typ, err)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("fetchLogo did not cache the logo, downloaded it %v times.", hits)
+	}
+}
+
+// Test the certTemplate function applies the branding of the document, and
+// the certificate can be rendered with it.
+func TestCertTemplateBranding(t *testing.T) {
+	var logo bytes.Buffer
+	png.Encode(&logo, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(logo.Bytes())
+	}))
+	defer srv.Close()
+	defer allowLogoServer(srv)()
+
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*certBranding) = certBranding{
+				LogoURL: sql.NullString{String: srv.URL + "/logo", Valid: true},
+				Colours: sql.NullString{String: "#1d4f91", Valid: true},
+			}
+			return nil
+		},
+	}
+	lc := Lgc{}
+
+	tmpl := lc.certTemplate("A", db)
+	if tmpl.Logo.Type != "PNG" || len(tmpl.Logo.Data) == 0 {
+		t.Errorf("certTemplate did not use the logo of the brand, got %+v.", tmpl.Logo)
+	}
+	if tmpl.Heading.Colour != (CertColour{29, 79, 145}) || tmpl.RuleColour != DefaultCertTemplate().RuleColour {
+		t.Errorf("certTemplate did not use the colours of the brand, got %+v.", tmpl)
+	}
+
+	doc := documentDetail{id: "A", title: "Lease", status: "void", pages: 2}
+	r := recipientDetail{name: "Jo Bloggs", email: "a@b.com"}
+	data := newCertData(doc, []recipientDetail{r}, []eventDetail{{Date: "2026-01-01", Body: "Sent"}}, certUTC, time.Now())
+	var out bytes.Buffer
+	if err := renderCertificate(tmpl, data).Output(&out); err != nil || out.Len() == 0 {
+		t.Errorf("renderCertificate did not render the certificate, got %v.", err)
+	}
+
+	// Documents without branding use the default template.
+	db.GetMock = func(dest interface{}, query string, args ...interface{}) error {
+		return sql.ErrNoRows
+	}
+	if tmpl := lc.certTemplate("A", db); len(tmpl.Logo.Data) != 0 || tmpl.Heading.Colour != (CertColour{}) {
+		t.Errorf("certTemplate did not return the default template, got %+v.", tmpl)
+	}
+}
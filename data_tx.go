@@ -0,0 +1,58 @@
+package logic
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+)
+
+// DataTx is a DataCaller within a transaction.
+type DataTx interface {
+	DataCaller
+	Commit() error
+	Rollback() error
+}
+
+// TxBeginner is implemented by a DataCaller that can begin a transaction.
+// A *sqlx.DB is also able to begin a transaction, through Beginx.
+type TxBeginner interface {
+	BeginTx() (DataTx, error)
+}
+
+// beginTx begins a transaction on the DataCaller. The returned bool is false
+// if db is already a transaction, in which case statements are run with db.
+// A DataCaller that can neither begin a transaction nor is one returns an
+// error, so a flow that must be atomic is never run without a transaction.
+func beginTx(db DataCaller) (DataTx, bool, error) {
+	switch d := db.(type) {
+	case DataTx:
+		return nil, false, nil
+	case TxBeginner:
+		tx, err := d.BeginTx()
+		return tx, true, err
+	case *sqlx.DB:
+		tx, err := d.Beginx()
+		return tx, true, err
+	}
+	return nil, false, fmt.Errorf("%T cannot begin a transaction", db)
+}
+
+/*
+  withTx runs fn within a transaction, which is committed if fn returns nil
+  and rolled back otherwise. When db is already a transaction fn is run with
+  db, so statements are part of the outer transaction.
+*/
+func withTx(db DataCaller, fn func(tx DataCaller) error) error {
+	tx, ok, err := beginTx(db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fn(db)
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"pleasesign/ecomm"
+	"testing"
+)
+
+// Test the withTx function commits when the function succeeds, and rolls
+// back when it fails.
+func TestWithTx(t *testing.T) {
+	db := &MockTxDb{MockDb: &MockDb{}}
+
+	if err := withTx(db, func(tx DataCaller) error { return nil }); err != nil {
+		t.Errorf("withTx returned an error, got %v.", err)
+	}
+	if db.Begun != 1 || db.Committed != 1 || db.RolledBack != 0 {
+		t.Errorf("withTx did not commit, got %+v.", db)
+	}
+
+	err := withTx(db, func(tx DataCaller) error { return errors.New("failed") })
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("withTx did not return the error, got %v.", err)
+	}
+	if db.Begun != 2 || db.Committed != 1 || db.RolledBack != 1 {
+		t.Errorf("withTx did not roll back, got %+v.", db)
+	}
+
+	// A nested call is part of the outer transaction.
+	withTx(db, func(tx DataCaller) error {
+		return withTx(tx, func(tx DataCaller) error { return nil })
+	})
+	if db.Begun != 3 || db.Committed != 2 {
+		t.Errorf("withTx began a nested transaction, got %+v.", db)
+	}
+
+	// A failed commit is returned.
+	db.CommitMock = func() error { return errors.New("commit failed") }
+	if err := withTx(db, func(tx DataCaller) error { return nil }); err == nil {
+		t.Error("withTx did not return the commit error.")
+	}
+
+	// A DataCaller that cannot begin a transaction is not run without one.
+	ran := false
+	err = withTx(struct{ DataCaller }{db}, func(tx DataCaller) error {
+		ran = true
+		return nil
+	})
+	if err == nil || ran {
+		t.Errorf("withTx ran without a transaction, got %v.", err)
+	}
+}
+
+// Test the EcommNewCustomer function rolls back the user changes and cancels
+// the new subscription when the user cannot be updated.
+func TestEcommNewCustomerRollback(t *testing.T) {
+	mem := NewMemBilling()
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		createCustomerMock: func(email, token, plan string) (string, string, error) {
+			return mem.CreateCustomer(ecomm.CreateCusInp{Email: email, Token: token, Plan: plan})
+		},
+	}
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*string) = "a@b.com"
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if q == `UPDATE user_quota SET quota = ? WHERE user_id = ?;` {
+				return nil, errors.New("quota failed")
+			}
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Billing: mem}
+
+	if err := lc.EcommNewCustomer(db, ls, "tok", "102", nil); err == nil {
+		t.Fatal("EcommNewCustomer did not return the error.")
+	}
+	if db.RolledBack != 1 || db.Committed != 0 {
+		t.Errorf("EcommNewCustomer did not roll back, got %+v.", db)
+	}
+
+	// The only customer is cus_mem1, whose subscription should be cancelled.
+	ev := mem.Events("cus_mem1")
+	if len(ev) == 0 || ev[len(ev)-1].Kind != "customer.subscription.deleted" {
+		t.Errorf("EcommNewCustomer did not cancel the subscription, got %+v.", ev)
+	}
+}
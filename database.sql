@@ -30,6 +30,7 @@ CREATE TABLE IF NOT EXISTS `document_keys` (
   `master_key` varchar(250) DEFAULT NULL,
   `original_key` varchar(250) DEFAULT NULL,
   `certificate_key` varchar(250) DEFAULT NULL,
+  `certificate_sum` varchar(128) DEFAULT NULL COMMENT 'The MD5 of the certificate, checked by /public/verify.',
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=1 DEFAULT CHARSET=latin1;
 
@@ -56,8 +57,8 @@ CREATE TABLE IF NOT EXISTS `pages` (
 CREATE TABLE IF NOT EXISTS `recipients` (
   `id` varchar(250) NOT NULL,
   `document_id` varchar(250) NOT NULL,
-  `first_name` varchar(150) NOT NULL,
-  `last_name` varchar(150) DEFAULT NULL,
+  `first_name` varchar(150) CHARACTER SET utf8mb4 NOT NULL,
+  `last_name` varchar(150) CHARACTER SET utf8mb4 DEFAULT NULL,
   `status` varchar(400) NOT NULL,
   `email` varchar(250) NOT NULL,
   `routing` int(11) DEFAULT NULL,
@@ -124,6 +125,20 @@ CREATE TABLE IF NOT EXISTS `user` (
   `email_verified` tinyint(1) NOT NULL DEFAULT '0',
   `group_active` tinyint(1) NOT NULL DEFAULT '0',
   `active` tinyint(1) NOT NULL DEFAULT '0',
+  `restricted` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Denotes the account is read-only due to failed payments.',
+  `dunning_start` datetime DEFAULT NULL COMMENT 'Denotes when the first unresolved payment failed.',
+  `dunning_step` int(11) NOT NULL DEFAULT '0' COMMENT 'The next step of the dunning schedule for the user.',
+  `trial_end` datetime DEFAULT NULL COMMENT 'When the free trial of the user ends. Kept after the trial so it cannot be repeated.',
+  `trial_plan` varchar(50) DEFAULT NULL COMMENT 'The plan being trialled, NULL once the trial has converted or ended.',
+  `trial_reminded` tinyint(1) NOT NULL DEFAULT '0',
+  `currency` char(3) NOT NULL DEFAULT 'AUD' COMMENT 'The currency the user is billed in.',
+  `tax_id` varchar(20) DEFAULT NULL COMMENT 'The ABN, GST or VAT number of the user.',
+  `tax_id_type` varchar(10) DEFAULT NULL COMMENT 'eg. au_abn, nz_gst, gb_vat or eu_vat.',
+  `billing_interval` varchar(5) NOT NULL DEFAULT 'month' COMMENT 'The interval of the plan the user is billed on, month or year.',
+  `next_interval` varchar(5) NOT NULL DEFAULT 'month' COMMENT 'The interval the user moves to at the downgrade_date.',
+  `admin` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Denotes a support user who can use the administrative API.',
+  `locale` varchar(10) NOT NULL DEFAULT 'en' COMMENT 'The language of the certificates of the documents sent by the user.',
+  `timezone` varchar(64) NOT NULL DEFAULT 'UTC' COMMENT 'The IANA timezone of the times on the certificates of the user.',
   PRIMARY KEY (`id`),
   UNIQUE KEY `email_UNIQUE` (`email`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
@@ -161,6 +176,9 @@ CREATE TABLE IF NOT EXISTS `enterprises` (
   `contact` varchar(250) NOT NULL,
   `branding_id` varchar(32) DEFAULT NULL,
   `seats` int(11) NOT NULL DEFAULT '1',
+  `members` int(11) NOT NULL DEFAULT '0' COMMENT 'The group_active users, each taking a seat.',
+  `tax_id` varchar(20) DEFAULT NULL COMMENT 'The ABN, GST or VAT number of the enterprise.',
+  `tax_id_type` varchar(10) DEFAULT NULL,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=latin1;
 
@@ -262,3 +280,166 @@ CREATE TABLE IF NOT EXISTS `branding` (
   `colour_scheme` varchar(250) DEFAULT NULL,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `plans` (
+  `id` varchar(50) NOT NULL COMMENT 'The plan id used by the ecomm provider.',
+  `name` varchar(100) NOT NULL,
+  `kind` int(11) NOT NULL COMMENT 'The user kind assigned to subscribers of the plan.',
+  `quota` int(11) NOT NULL DEFAULT '0' COMMENT 'The user_quota assigned to subscribers of the plan.',
+  `unmetered` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Whether sending is not limited, the quota is not used.',
+  `tier` int(11) NOT NULL DEFAULT '0' COMMENT 'The rank of the plan, used to determine upgrades and downgrades.',
+  `seats` int(11) NOT NULL DEFAULT '1' COMMENT 'The number of seats included in the plan.',
+  `trial_days` int(11) NOT NULL DEFAULT '0' COMMENT 'The length of a free trial of the plan, 0 for no trial.',
+  `features` varchar(250) NOT NULL DEFAULT '' COMMENT 'Comma separated feature flags, eg. groups,branding.',
+  `overage_price` int(11) NOT NULL DEFAULT '0' COMMENT 'The price of each document sent beyond the quota in cents, 0 to block.',
+  `billing_interval` varchar(5) NOT NULL DEFAULT 'month' COMMENT 'month or year. The yearly plan of a tier assigns the same kind.',
+  `active` tinyint(1) NOT NULL DEFAULT '1',
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- The quotas are FreeQuota, config.T1Lim and config.T2Lim, which the default
+-- plans of the logic package use until this table is loaded.
+INSERT IGNORE INTO `plans` (`id`, `name`, `kind`, `quota`, `unmetered`, `tier`, `seats`, `trial_days`, `features`, `billing_interval`) VALUES
+  ('free', 'Free', 0, 3, 0, 0, 1, 0, '', 'month'),
+  ('101', 'Just You', 1, 10, 0, 1, 1, 14, '', 'month'),
+  ('101y', 'Just You (Yearly)', 1, 10, 0, 1, 1, 14, '', 'year'),
+  ('102', 'Entrepreneur', 2, 50, 0, 2, 1, 14, '', 'month'),
+  ('102y', 'Entrepreneur (Yearly)', 2, 50, 0, 2, 1, 14, '', 'year'),
+  ('103', 'Business Plus', 5, 0, 1, 3, 1, 14, 'groups,branding', 'month'),
+  ('103y', 'Business Plus (Yearly)', 5, 0, 1, 3, 1, 14, 'groups,branding', 'year');
+
+CREATE TABLE IF NOT EXISTS `ecomm_events` (
+  `event_id` varchar(50) NOT NULL COMMENT 'The id of the webhook event sent by the ecomm provider.',
+  `kind` varchar(100) DEFAULT NULL,
+  `s_customer_id` varchar(50) DEFAULT NULL,
+  `received` datetime NOT NULL COMMENT 'Denotes when the event was first delivered.',
+  `claimed` datetime NOT NULL COMMENT 'Denotes when the event was last claimed for processing.',
+  `processed` datetime DEFAULT NULL,
+  `outcome` varchar(20) NOT NULL COMMENT 'processing, processed or failed.',
+  `error` varchar(250) DEFAULT NULL,
+  `attempts` int(11) NOT NULL DEFAULT '0',
+  PRIMARY KEY (`event_id`),
+  KEY `outcome` (`outcome`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `ecomm_dunning` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(32) NOT NULL,
+  `s_customer_id` varchar(50) NOT NULL,
+  `step` int(11) NOT NULL,
+  `action` varchar(20) NOT NULL COMMENT 'remind, final, restrict, downgrade or recovered.',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `enterprise_invites` (
+  `id` varchar(32) NOT NULL COMMENT 'The token sent in the invite link.',
+  `enterprise_id` varchar(32) NOT NULL,
+  `email` varchar(250) NOT NULL,
+  `invited_by` varchar(32) NOT NULL,
+  `created` datetime NOT NULL,
+  `accepted` datetime DEFAULT NULL,
+  `user_id` varchar(32) DEFAULT NULL COMMENT 'The user that accepted the invite.',
+  PRIMARY KEY (`id`),
+  KEY `enterprise_id` (`enterprise_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `ecomm_invoice_pdfs` (
+  `invoice_id` varchar(50) NOT NULL,
+  `user_id` varchar(32) NOT NULL,
+  `bucket_key` varchar(50) NOT NULL,
+  `paid` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Whether the invoice was paid when the PDF was generated.',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`invoice_id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `ecomm_usage` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(32) NOT NULL,
+  `document_id` varchar(32) NOT NULL,
+  `overage` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Whether the document was sent beyond the quota.',
+  `reported` tinyint(1) NOT NULL DEFAULT '0' COMMENT 'Whether the overage has been reported to the billing provider.',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `user_document` (`user_id`,`document_id`),
+  KEY `user_created` (`user_id`,`created`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `billing_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` varchar(32) NOT NULL,
+  `s_customer_id` varchar(50) NOT NULL DEFAULT '',
+  `kind` varchar(50) NOT NULL COMMENT 'eg. subscription.cancelled or subscription.reactivated.',
+  `body` varchar(300) NOT NULL DEFAULT '',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `plan_prices` (
+  `plan_id` varchar(50) NOT NULL,
+  `currency` char(3) NOT NULL COMMENT 'The ISO 4217 code, eg. NZD.',
+  `amount` int(11) NOT NULL COMMENT 'The price per period in cents.',
+  PRIMARY KEY (`plan_id`,`currency`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE IF NOT EXISTS `ecomm_refunds` (
+  `id` varchar(50) NOT NULL COMMENT 'The id of the refund or credit note from the ecomm provider.',
+  `s_customer_id` varchar(50) NOT NULL,
+  `user_id` varchar(32) NOT NULL,
+  `invoice_id` varchar(50) NOT NULL,
+  `kind` varchar(10) NOT NULL COMMENT 'refund or credit.',
+  `amount` int(11) NOT NULL COMMENT 'The amount in cents.',
+  `currency` char(3) NOT NULL,
+  `reason` varchar(500) NOT NULL,
+  `issued_by` varchar(32) NOT NULL COMMENT 'The id of the admin who issued the refund.',
+  `created` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `customer_idx` (`s_customer_id`),
+  KEY `invoice_idx` (`invoice_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- The columns added to existing tables. CREATE TABLE IF NOT EXISTS does not
+-- change a table that already exists, so each column is added when it is
+-- missing, and this file can be run again against an existing database.
+DROP PROCEDURE IF EXISTS `add_column`;
+DELIMITER //
+CREATE PROCEDURE `add_column`(IN tbl VARCHAR(64), IN col VARCHAR(64), IN def VARCHAR(500))
+BEGIN
+  IF NOT EXISTS (SELECT * FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE()
+      AND TABLE_NAME = tbl AND COLUMN_NAME = col) THEN
+    SET @q = CONCAT('ALTER TABLE `', tbl, '` ADD COLUMN `', col, '` ', def);
+    PREPARE stmt FROM @q;
+    EXECUTE stmt;
+    DEALLOCATE PREPARE stmt;
+  END IF;
+END //
+DELIMITER ;
+
+CALL `add_column`('documents', 'certificate_sum', 'varchar(128) DEFAULT NULL COMMENT ''The MD5 of the certificate, checked by /public/verify.'' AFTER `certificate_key`');
+CALL `add_column`('user', 'restricted', 'tinyint(1) NOT NULL DEFAULT ''0'' COMMENT ''Denotes the account is read-only due to failed payments.''');
+CALL `add_column`('user', 'dunning_start', 'datetime DEFAULT NULL COMMENT ''Denotes when the first unresolved payment failed.''');
+CALL `add_column`('user', 'dunning_step', 'int(11) NOT NULL DEFAULT ''0'' COMMENT ''The next step of the dunning schedule for the user.''');
+CALL `add_column`('user', 'trial_end', 'datetime DEFAULT NULL COMMENT ''When the free trial of the user ends. Kept after the trial so it cannot be repeated.''');
+CALL `add_column`('user', 'trial_plan', 'varchar(50) DEFAULT NULL COMMENT ''The plan being trialled, NULL once the trial has converted or ended.''');
+CALL `add_column`('user', 'trial_reminded', 'tinyint(1) NOT NULL DEFAULT ''0''');
+CALL `add_column`('user', 'currency', 'char(3) NOT NULL DEFAULT ''AUD'' COMMENT ''The currency the user is billed in.''');
+CALL `add_column`('user', 'tax_id', 'varchar(20) DEFAULT NULL COMMENT ''The ABN, GST or VAT number of the user.''');
+CALL `add_column`('user', 'tax_id_type', 'varchar(10) DEFAULT NULL COMMENT ''eg. au_abn, nz_gst, gb_vat or eu_vat.''');
+CALL `add_column`('user', 'billing_interval', 'varchar(5) NOT NULL DEFAULT ''month'' COMMENT ''The interval of the plan the user is billed on, month or year.''');
+CALL `add_column`('user', 'next_interval', 'varchar(5) NOT NULL DEFAULT ''month'' COMMENT ''The interval the user moves to at the downgrade_date.''');
+CALL `add_column`('user', 'admin', 'tinyint(1) NOT NULL DEFAULT ''0'' COMMENT ''Denotes a support user who can use the administrative API.''');
+CALL `add_column`('user', 'locale', 'varchar(10) NOT NULL DEFAULT ''en'' COMMENT ''The language of the certificates of the documents sent by the user.''');
+CALL `add_column`('user', 'timezone', 'varchar(64) NOT NULL DEFAULT ''UTC'' COMMENT ''The IANA timezone of the times on the certificates of the user.''');
+CALL `add_column`('enterprises', 'members', 'int(11) NOT NULL DEFAULT ''0'' COMMENT ''The group_active users, each taking a seat.''');
+CALL `add_column`('enterprises', 'tax_id', 'varchar(20) DEFAULT NULL COMMENT ''The ABN, GST or VAT number of the enterprise.''');
+CALL `add_column`('enterprises', 'tax_id_type', 'varchar(10) DEFAULT NULL');
+DROP PROCEDURE `add_column`;
+
+ALTER TABLE `recipients` MODIFY `first_name` varchar(150) CHARACTER SET utf8mb4 NOT NULL,
+  MODIFY `last_name` varchar(150) CHARACTER SET utf8mb4 DEFAULT NULL;
+
+UPDATE `enterprises` SET `members` = (SELECT COUNT(*) FROM `user`
+  WHERE `user`.`enterprise_id` = `enterprises`.`id` AND `user`.`group_active` = 1);
@@ -0,0 +1,273 @@
+package logic
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// auditVersion is the version of the layout of the audit trail.
+const auditVersion = 1
+
+// auditFormat formats the times of the audit trail as RFC 3339 in UTC.
+var auditFormat = certFormat{bundle: certBundles["en"], location: time.UTC, rfc3339: true}
+
+/*
+  DocumentAudit is the audit trail of a document in a machine-readable
+  form. It holds the data of the certificate of authenticity, along with
+  the security sums recorded for the document and its events, so the
+  events can be checked against the sums.
+*/
+type DocumentAudit struct {
+	XMLName    xml.Name `json:"-" xml:"AuditTrail"`
+	Version    int      `xml:"version,attr"`
+	Generated  string   `xml:"generated,attr"`
+	Document   AuditDocument
+	Recipients []AuditRecipient `xml:"Recipients>Recipient"`
+	Events     []AuditEvent     `xml:"Events>Event"`
+	Sums       []AuditSum       `xml:"Sums>Sum"` // The sums of the document, from documents_security.
+}
+
+// AuditDocument holds the details of the document in the audit trail.
+type AuditDocument struct {
+	ID         string
+	Title      string
+	Message    string `json:",omitempty" xml:",omitempty"`
+	Status     string
+	VoidReason string `json:",omitempty" xml:",omitempty"`
+	Type       string `json:",omitempty" xml:",omitempty"`
+	Pages      int
+	Created    string
+}
+
+// AuditRecipient is a recipient of the document and their agreed session.
+type AuditRecipient struct {
+	ID      string
+	Name    string
+	Email   string
+	Signed  string        `json:",omitempty" xml:",omitempty"`
+	Session *AuditSession `json:",omitempty" xml:",omitempty"`
+}
+
+// AuditSession is the session in which a recipient agreed and signed.
+type AuditSession struct {
+	ID             string
+	Agreed         string
+	Authentication string `json:",omitempty" xml:",omitempty"`
+	IPAddress      string
+	Latitude       *float64 `json:",omitempty" xml:",omitempty"`
+	Longitude      *float64 `json:",omitempty" xml:",omitempty"`
+	UserAgent      string
+	// SignatureSHA256 is the hash of the image of the signature.
+	SignatureSHA256 string `json:",omitempty" xml:",omitempty"`
+}
+
+// AuditEvent is an event of the document and its sum from events_security.
+type AuditEvent struct {
+	ID   int
+	Date string
+	Body string
+	Sum  string `json:",omitempty" xml:",omitempty"`
+}
+
+// AuditSum is a sum of the document from documents_security.
+type AuditSum struct {
+	Sum     string `db:"sum"`
+	Date    string `db:"date"`
+	EventID string `db:"event_id" json:",omitempty" xml:",omitempty"`
+}
+
+/*
+  documentAudit collects the audit trail of a document. The details come
+  from the same functions as the certificate of authenticity, so the two
+  always agree. The signatures written to disk by getRecipientDetailCert
+  are hashed and then deleted.
+*/
+func (lc Lgc) documentAudit(documentID string, db DataCaller, now time.Time) (*DocumentAudit, error) {
+	doc, err := lc.getDocumentDetailCert(documentID, db, auditFormat)
+	if err != nil {
+		return nil, err
+	}
+	recipients, err := lc.getRecipientDetailCert(documentID, db, auditFormat)
+	if err != nil {
+		return nil, err
+	}
+	events, err := lc.getEventDetailCert(documentID, db, auditFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &DocumentAudit{
+		Version:   auditVersion,
+		Generated: auditFormat.formatTime(now),
+		Document: AuditDocument{
+			ID:         doc.id,
+			Title:      doc.title,
+			Message:    doc.message,
+			Status:     doc.status,
+			VoidReason: doc.voidReason,
+			Type:       doc.docType,
+			Pages:      doc.pages,
+			Created:    doc.date,
+		},
+	}
+
+	for _, r := range recipients {
+		ar := AuditRecipient{ID: r.id, Name: r.name, Email: r.email, Signed: r.date}
+		if r.sessionid != "" {
+			ar.Session = &AuditSession{
+				ID:             r.sessionid,
+				Agreed:         r.agreed,
+				Authentication: r.security,
+				IPAddress:      r.ip,
+				UserAgent:      r.useragent,
+			}
+			if r.geolat != 0 && r.geolong != 0 {
+				lat, long := r.geolat, r.geolong
+				ar.Session.Latitude, ar.Session.Longitude = &lat, &long
+			}
+		}
+		if r.thumb != "" {
+			b, err := lc.Pvl.ReadFile(r.thumb)
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(b)
+			ar.Session.SignatureSHA256 = hex.EncodeToString(sum[:])
+			if err := lc.Pvl.SecureDelete(r.thumb); err != nil {
+				return nil, err
+			}
+		}
+		out.Recipients = append(out.Recipients, ar)
+	}
+
+	// Match the events to their sums.
+	type eventSum struct {
+		EventID int    `db:"event_id"`
+		Sum     string `db:"sum"`
+	}
+	var sums []eventSum
+	q := `SELECT events_security.event_id, events_security.sum FROM events_security
+          JOIN events ON events.id = events_security.event_id
+          WHERE events.document_id = ?;`
+	if err := db.Select(&sums, q, documentID); err != nil {
+		return nil, err
+	}
+	bySum := make(map[int]string)
+	for _, s := range sums {
+		bySum[s.EventID] = s.Sum
+	}
+	for _, ev := range events {
+		out.Events = append(out.Events, AuditEvent{ID: ev.ID, Date: ev.Date, Body: ev.Body, Sum: bySum[ev.ID]})
+	}
+
+	q = `SELECT sum, date, COALESCE(event_id, '') AS event_id FROM documents_security
+         WHERE document_id = ? ORDER BY date ASC, id ASC;`
+	if err := db.Select(&out.Sums, q, documentID); err != nil {
+		return nil, err
+	}
+	for i := range out.Sums {
+		out.Sums[i].Date = auditFormat.formatDate(out.Sums[i].Date)
+	}
+	return out, nil
+}
+
+// documentOwner is the user and enterprise a document belongs to.
+type documentOwner struct {
+	UserID       string         `db:"user_id"`
+	EnterpriseID sql.NullString `db:"enterprise_id"`
+}
+
+// The output for the GetDocumentAudit function.
+type DocumentAuditFile struct {
+	Name string
+	Body []byte // A zip file.
+}
+
+/*
+  GetDocumentAudit returns the evidence package of a document: a zip file of
+  the audit trail as audit.json and audit.xml. When a CertSigner has been
+  set, each file is accompanied by a detached PKCS#7 signature, eg.
+  audit.json.p7s, which can be checked with
+  `openssl cms -verify -binary -inform DER -in audit.json.p7s -content audit.json`.
+  The document must belong to the current user or their enterprise.
+*/
+func (lc Lgc) GetDocumentAudit(db DataCaller, ls LogicStore, documentID string) (*DocumentAuditFile, error) {
+	var o documentOwner
+	user := ls.GetCurrentUser()
+	q := `SELECT user_id, enterprise_id FROM documents WHERE id = ?;`
+	err := db.Get(&o, q, documentID)
+	if err == sql.ErrNoRows || (err == nil && o.UserID != user.Id &&
+		(o.EnterpriseID.String == "" || o.EnterpriseID.String != user.Enterprise)) {
+		return nil, errors.New("This document does not exist.")
+	} else if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRDOCAUDIT " + documentID, E: err})
+	}
+
+	now := time.Now()
+	audit, err := lc.documentAudit(documentID, db, now)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRDOCAUDIT1 " + documentID, E: err})
+	}
+	body, err := auditPackage(audit, now)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRDOCAUDIT2 " + documentID, E: err})
+	}
+	return &DocumentAuditFile{Name: "audit-" + documentID + ".zip", Body: body}, nil
+}
+
+// auditPackage writes the audit trail as JSON and XML to a zip file, with
+// their signatures when a CertSigner has been set.
+func auditPackage(audit *DocumentAudit, now time.Time) ([]byte, error) {
+	j, err := json.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	x, err := xml.MarshalIndent(audit, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	x = append([]byte(xml.Header), x...)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, b []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	s, _ := certSigner()
+	for _, f := range []struct {
+		name string
+		body []byte
+	}{{"audit.json", j}, {"audit.xml", x}} {
+		if err := add(f.name, f.body); err != nil {
+			return nil, err
+		}
+		if s == nil {
+			continue
+		}
+		digest := sha256.Sum256(f.body)
+		sig, err := signCMS(digest[:], s, now)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(f.name+".p7s", sig); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,120 @@
+package logic
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// auditDb returns a db holding a signed document with one recipient, two
+// events and a sum of the document.
+func auditDb() *MockDb {
+	return &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch v := dest.(type) {
+			case *documentOwner:
+				*v = documentOwner{UserID: "1", EnterpriseID: sql.NullString{String: "E", Valid: true}}
+			case *d:
+				*v = d{Id: "A", Title: "Lease", Status: "complete", Pages: 2, Date: "2026-03-14 09:00:00"}
+			case *Session:
+				*v = Session{Id: "S", Created: "2026-03-14 09:30:00", Ip_address: "10.0.0.1",
+					Geo_lat: sql.NullFloat64{Float64: -33.8, Valid: true}, Geo_long: sql.NullFloat64{Float64: 151.2, Valid: true},
+					User_agent: "Firefox", Security: "email"}
+			default:
+				return sql.ErrNoRows
+			}
+			return nil
+		},
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch v := dest.(type) {
+			case *[]Recipient:
+				*v = []Recipient{{Id: "R", First_name: "Jo", Last_name: "Bloggs", Email: "a@b.com",
+					Complete: sql.NullString{String: "2026-03-14 09:31:00", Valid: true}}}
+			case *[]eventDetail:
+				*v = []eventDetail{{ID: 1, Date: "2026-03-14 09:00:00", Body: "Sent"}, {ID: 2, Date: "2026-03-14 09:31:00", Body: "Signed"}}
+			case *[]AuditSum:
+				*v = []AuditSum{{Sum: "abc", Date: "2026-03-14 09:31:00", EventID: "2"}}
+			}
+			return nil
+		},
+	}
+}
+
+// Test the audit trail holds the details of the certificate, with the
+// times in RFC 3339.
+func TestDocumentAudit(t *testing.T) {
+	lc := Lgc{}
+	audit, err := lc.documentAudit("A", auditDb(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audit.Document.ID != "A" || audit.Document.Created != "2026-03-14T09:00:00Z" {
+		t.Errorf("documentAudit returned the wrong document, got %+v.", audit.Document)
+	}
+	if len(audit.Recipients) != 1 || audit.Recipients[0].Session == nil {
+		t.Fatalf("documentAudit returned the wrong recipients, got %+v.", audit.Recipients)
+	}
+	s := audit.Recipients[0].Session
+	if s.Agreed != "2026-03-14T09:30:00Z" || s.IPAddress != "10.0.0.1" || *s.Latitude != -33.8 {
+		t.Errorf("documentAudit returned the wrong session, got %+v.", s)
+	}
+	if len(audit.Events) != 2 || audit.Events[1].Body != "Signed" || len(audit.Sums) != 1 ||
+		audit.Sums[0].Date != "2026-03-14T09:31:00Z" {
+		t.Errorf("documentAudit returned the wrong events, got %+v %+v.", audit.Events, audit.Sums)
+	}
+}
+
+// Test the evidence package holds the audit trail as JSON and XML, signed
+// when there is a signer, and is only returned to the owner.
+func TestGetDocumentAudit(t *testing.T) {
+	s := testSigner(t)
+	SetCertSigner(s, false)
+	defer SetCertSigner(nil, false)
+
+	lc := Lgc{}
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "2", Enterprise: "E"}
+		},
+	}
+	out, err := lc.GetDocumentAudit(auditDb(), ls, "A")
+	if err != nil {
+		t.Fatalf("GetDocumentAudit returned an error, got %v.", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Body), int64(len(out.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	var fromJSON, fromXML DocumentAudit
+	if err := json.Unmarshal(files["audit.json"], &fromJSON); err != nil || fromJSON.Document.Title != "Lease" {
+		t.Errorf("The JSON audit trail is wrong, got %+v %v.", fromJSON, err)
+	}
+	if err := xml.Unmarshal(files["audit.xml"], &fromXML); err != nil || len(fromXML.Events) != 2 {
+		t.Errorf("The XML audit trail is wrong, got %+v %v.", fromXML, err)
+	}
+	for _, name := range []string{"audit.json", "audit.xml"} {
+		if err := verifyCMS(files[name+".p7s"], files[name], s.Certificates()[0]); err != nil {
+			t.Errorf("The signature of %v did not verify, got %v.", name, err)
+		}
+	}
+
+	// Users outside the enterprise of the document cannot see it.
+	ls.GetCurrentUserMock = func() *UserAuth {
+		return &UserAuth{Id: "3"}
+	}
+	if _, err := lc.GetDocumentAudit(auditDb(), ls, "A"); err == nil {
+		t.Error("GetDocumentAudit returned the audit trail of another user's document.")
+	}
+}
@@ -0,0 +1,111 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"regexp"
+	"strings"
+)
+
+// verifyHashRe matches the hex sums stored for documents and certificates.
+var verifyHashRe = regexp.MustCompile(`^[0-9a-f]{32,128}$`)
+
+/*
+  certVerification returns the link printed on the certificate of a
+  document, the link in its QR code, and the sum of the signed document.
+  The link in the QR code carries the sum, so the page it opens can check
+  it without the document. A failure to find the sum is logged and the
+  link is returned without it, as the certificate must still be generated.
+*/
+func (lc Lgc) certVerification(documentID string, db DataCaller) (string, string, string) {
+	short := config.FrontEnd() + "/verify/" + documentID
+	var sum string
+	q := `SELECT sum FROM documents_security WHERE document_id = ?
+          ORDER BY date DESC, id DESC LIMIT 1;`
+	err := db.Get(&sum, q, documentID)
+	if err != nil && err != sql.ErrNoRows {
+		e.ThrowError(&e.LogInput{M: "ERRCERTVERIFY " + documentID, E: err})
+	}
+	if sum == "" {
+		return short, short, ""
+	}
+	return short, short + "?h=" + sum, sum
+}
+
+// verifyStored is the status of a document and the sum of its certificate.
+type verifyStored struct {
+	Status  string         `db:"status"`
+	CertSum sql.NullString `db:"certificate_sum"`
+}
+
+// The input for the VerifyDocument function.
+type VerifyDocumentInput struct {
+	DocumentID      string
+	Hash            string // The MD5 of the signed document, as on its certificate.
+	CertificateHash string // The MD5 of the certificate, if it is to be checked.
+}
+
+// The output for the VerifyDocument function.
+type VerifyDocumentOutput struct {
+	Valid  bool   // True if every hash given matches.
+	Status string // The status of the document, only when a hash matches.
+}
+
+/*
+  VerifyDocument checks a signed document, or its certificate, is the one
+  stored for the document. The Hash is compared to the latest sum of the
+  document in documents_security, which is the sum of the signed document,
+  and the CertificateHash to the sum of the certificate in document_keys.
+  It is public, so it only returns whether they match, and the status of
+  the document once a hash has matched. A document that does not exist is
+  not valid, the same as a hash that does not match, so the response does
+  not show which documents exist.
+*/
+func (lc Lgc) VerifyDocument(db DataCaller, in *VerifyDocumentInput) (*VerifyDocumentOutput, error) {
+	hash := strings.ToLower(strings.TrimSpace(in.Hash))
+	certHash := strings.ToLower(strings.TrimSpace(in.CertificateHash))
+	if in.DocumentID == "" || (hash == "" && certHash == "") {
+		return nil, errors.New("A document and hash are required.")
+	}
+	for _, h := range []string{hash, certHash} {
+		if h != "" && !verifyHashRe.MatchString(h) {
+			return nil, errors.New("The hash is not valid.")
+		}
+	}
+
+	var s verifyStored
+	q := `SELECT documents.status, document_keys.certificate_sum FROM documents
+          LEFT JOIN document_keys ON document_keys.document_id = documents.id
+          WHERE documents.id = ?;`
+	err := db.Get(&s, q, in.DocumentID)
+	if err == sql.ErrNoRows {
+		return &VerifyDocumentOutput{}, nil
+	} else if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRVERIFYDOC " + in.DocumentID, E: err})
+	}
+
+	var document, certificate bool
+	if hash != "" {
+		var sum string
+		q = `SELECT sum FROM documents_security WHERE document_id = ?
+             ORDER BY date DESC, id DESC LIMIT 1;`
+		err := db.Get(&sum, q, in.DocumentID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, e.ThrowError(&e.LogInput{M: "ERRVERIFYDOC1 " + in.DocumentID, E: err})
+		}
+		document = sum != "" && strings.ToLower(sum) == hash
+	}
+	if certHash != "" {
+		certificate = s.CertSum.String != "" && strings.ToLower(s.CertSum.String) == certHash
+	}
+
+	out := &VerifyDocumentOutput{
+		Valid: (hash == "" || document) && (certHash == "" || certificate),
+	}
+	if document || certificate {
+		out.Status = s.Status
+	}
+	return out, nil
+}
@@ -0,0 +1,98 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyDb returns a db holding a complete document with the sums of its
+// signed document and certificate.
+func verifyDb() *MockDb {
+	return &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			if args[0] != "A" {
+				return sql.ErrNoRows
+			}
+			if strings.Contains(query, "documents_security") {
+				*dest.(*string) = "0CC175B9C0F1B6A831C399E269772661"
+				return nil
+			}
+			*dest.(*verifyStored) = verifyStored{
+				Status:  "complete",
+				CertSum: sql.NullString{String: "92eb5ffee6ae2fec3ad71c777531578f", Valid: true},
+			}
+			return nil
+		},
+	}
+}
+
+// Test the hashes are compared to the latest sum of the document and the
+// sum of its certificate, and the status is only returned once a hash
+// matches.
+func TestVerifyDocument(t *testing.T) {
+	lc := Lgc{}
+	doc, cert := "0cc175b9c0f1b6a831c399e269772661", "92EB5FFEE6AE2FEC3AD71C777531578F"
+	other := "900150983cd24fb0d6963f7d28e17f72"
+	valid, invalid := VerifyDocumentOutput{true, "complete"}, VerifyDocumentOutput{false, "complete"}
+	for _, tc := range []struct {
+		in   VerifyDocumentInput
+		want VerifyDocumentOutput
+	}{
+		{VerifyDocumentInput{DocumentID: "A", Hash: doc}, valid},
+		{VerifyDocumentInput{DocumentID: "A", Hash: doc, CertificateHash: cert}, valid},
+		{VerifyDocumentInput{DocumentID: "A", CertificateHash: cert}, valid},
+		{VerifyDocumentInput{DocumentID: "A", Hash: cert, CertificateHash: cert}, invalid},
+		{VerifyDocumentInput{DocumentID: "A", Hash: doc, CertificateHash: doc}, invalid},
+		// A mismatch and a document that does not exist are the same.
+		{VerifyDocumentInput{DocumentID: "A", Hash: other}, VerifyDocumentOutput{}},
+		{VerifyDocumentInput{DocumentID: "B", Hash: doc}, VerifyDocumentOutput{}},
+	} {
+		out, err := lc.VerifyDocument(verifyDb(), &tc.in)
+		if err != nil {
+			t.Fatalf("VerifyDocument(%+v) returned an error, got %v.", tc.in, err)
+		}
+		if *out != tc.want {
+			t.Errorf("VerifyDocument(%+v) expected %+v, got %+v.", tc.in, tc.want, out)
+		}
+	}
+
+	for _, in := range []VerifyDocumentInput{{DocumentID: "A"}, {DocumentID: "A", Hash: "not a hash"}} {
+		if _, err := lc.VerifyDocument(verifyDb(), &in); err == nil {
+			t.Errorf("VerifyDocument(%+v) did not return an error.", in)
+		}
+	}
+}
+
+// Test the certificate links to the verification with the sum of the
+// document, and draws the QR code.
+func TestCertVerification(t *testing.T) {
+	lc := Lgc{}
+	short, link, sum := lc.certVerification("A", verifyDb())
+	if !strings.HasSuffix(short, "/verify/A") || link != short+"?h="+sum || sum == "" {
+		t.Errorf("certVerification returned the wrong links, got %q %q %q.", short, link, sum)
+	}
+	if short, link, sum := lc.certVerification("B", verifyDb()); link != short || sum != "" {
+		t.Errorf("certVerification returned a sum for a document without one, got %q.", link)
+	}
+
+	tmpl := DefaultCertTemplate()
+	tmpl.Logo = CertLogo{}
+	data := newCertData(documentDetail{id: "A", status: "complete"}, nil, nil, certUTC, time.Now())
+	var plain, withQR bytes.Buffer
+	if err := renderCertificate(tmpl, data).Output(&plain); err != nil {
+		t.Fatal(err)
+	}
+	data.Footer["verify_url"], data.Verify, data.Footer["document_sum"] = short, link, sum
+	if err := renderCertificate(tmpl, data).Output(&withQR); err != nil {
+		t.Fatalf("renderCertificate returned an error, got %v.", err)
+	}
+	if withQR.Len() <= plain.Len() {
+		t.Error("renderCertificate did not draw the QR code.")
+	}
+	if l, ok := tmpl.Verification[1].line(data.Footer); !ok || !strings.HasSuffix(l, sum) {
+		t.Errorf("The verification lines do not show the sum, got %q.", l)
+	}
+}
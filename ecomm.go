@@ -6,7 +6,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"pleasesign/config"
 	"pleasesign/ecomm"
 	e "pleasesign/errlogger"
 	"strconv"
@@ -17,8 +16,9 @@ import (
   EcommNewCustomer will create a new customer for the current user, subscribe
   them to the plan provided, and align their token to the customer.
   This will also update the user Kind to the correct number.
+  If the input has a coupon, it is validated and applied to the subscription.
 */
-func (lc Lgc) EcommNewCustomer(db DataCaller, ls LogicStore, token string, plan string) error {
+func (lc Lgc) EcommNewCustomer(db DataCaller, ls LogicStore, token string, plan string, in *EcommSubInput) error {
 	userID := ls.GetCurrentUser().Id
 
 	// Get the email for the user to save against the Stripe
@@ -31,50 +31,100 @@ func (lc Lgc) EcommNewCustomer(db DataCaller, ls LogicStore, token string, plan
 	}
 
 	// Determine the user kind/plan before updating.
-	// Plan is an abritrary string relating to the plans/kinds of the user.
-	// Set the user quota depending on their new user kind.
-	var k int
-	quota := 0
-	switch plan {
-	case "101":
-		quota = config.T1Lim
-		k = 1
-	case "102":
-		quota = config.T2Lim
-		k = 2
-	case "103":
-		k = 5
-	}
-
-	// Create a customer subscribed to the plan.
-	cID, bEnd, err := ls.createCustomer(em, token, plan)
-	if err != nil {
-		// This is a friendly error returned from Stripe.
+	// Plan is the ecomm plan id, which is looked up in the plan catalog
+	// to find the user kind and quota the plan assigns.
+	p, ok := planCatalog.ByID(plan)
+	if !ok || !p.Paid() {
+		return errors.New("That plan does not exist.")
+	}
+
+	// The customer is billed in the currency of their billing country, which
+	// the plan must be priced in.
+	currency := in.currency()
+	if err := checkPlanCurrency(plan, currency); err != nil {
 		return err
 	}
 
-	// Update the user with their customer_id and user kind.
-	q = `UPDATE user SET s_customer_id=?, kind=?, next_kind=?, current_period_end=?
-          WHERE id=?;`
-	_, err = db.Exec(q, cID, k, k, bEnd, userID)
-	if err != nil {
-		return e.ThrowError(&e.LogInput{M: "Error when creating the new subscription.", E: err})
+	// A business customer may provide a tax id, which must be valid for
+	// their billing country. The tax of the country is applied by the
+	// billing provider.
+	var taxType, taxID string
+	if id := in.taxID(); id != "" {
+		taxType, taxID, err = validateTaxID(in.Country, id)
+		if err != nil {
+			return err
+		}
+	}
+	var tax *ecomm.TaxInp
+	if in != nil && in.Country != "" {
+		tax = taxFor(in.Country, taxType, taxID)
 	}
 
-	// Update the user quota to the relevant amount if they have upgraded
-	// to a 1/2 plan.
-	q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
-	_, err = db.Exec(q, quota, userID)
+	// Create a customer subscribed to the plan, with the coupon if one was
+	// provided.
+	var cID, bEnd string
+	code := in.coupon()
+	if code != "" {
+		if _, err := lc.EcommValidateCoupon(code, plan); err != nil {
+			return err
+		}
+	}
+	if code != "" || currency != defaultCurrency || tax != nil {
+		cID, bEnd, err = lc.createCustomerInp(ecomm.CreateCusInp{
+			Email:    em,
+			Token:    token,
+			Plan:     plan,
+			Coupon:   code,
+			Currency: currency,
+			Tax:      tax,
+		})
+	} else {
+		cID, bEnd, err = ls.createCustomer(em, token, plan)
+	}
 	if err != nil {
-		return e.ThrowError(&e.LogInput{M: "Error when creating the new subscription.", E: err})
+		// This is a friendly error returned from Stripe.
+		return err
 	}
 
-	// If the user is upgrading to a bplus user, create an enterprise record
-	// for their branding/sender settings information.
-	if k == 5 {
-		if err := createGroup(db, userID); err != nil {
-			return e.ThrowError(&e.LogInput{M: "Error when creating the new subscription.", E: err})
+	// The user is updated within a transaction, so they are never left
+	// half-upgraded.
+	err = withTx(db, func(tx DataCaller) error {
+		// Update the user with their customer_id and user kind.
+		q := `UPDATE user SET s_customer_id=?, kind=?, next_kind=?, current_period_end=?,
+          currency=?, billing_interval=?, next_interval=? WHERE id=?;`
+		if _, err := tx.Exec(q, cID, p.Kind, p.Kind, bEnd, currency, p.BillingInterval(),
+			p.BillingInterval(), userID); err != nil {
+			return err
 		}
+
+		// Update the user quota to the amount assigned by the plan.
+		q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+		if _, err := tx.Exec(q, p.Quota, userID); err != nil {
+			return err
+		}
+
+		// If the user is upgrading to a plan with groups (bplus), create an
+		// enterprise record for their branding/sender settings information.
+		if p.HasFeature(FeatureGroups) {
+			if err := createGroup(tx, userID); err != nil {
+				return err
+			}
+		}
+
+		// The tax id is stored after the group is created, so it is stored
+		// against the enterprise of a group owner.
+		if taxID != "" {
+			return storeTaxID(tx, userID, taxType, taxID)
+		}
+		return nil
+	})
+	if err != nil {
+		// The customer has already been subscribed, so cancel the
+		// subscription as the user will not receive the plan.
+		lc.compensate("cancel new subscription for "+cID, func() error {
+			return lc.cancelSubNow(cID)
+		})
+		return e.ThrowError(&e.LogInput{M: "Error when creating the new subscription.", E: err})
 	}
 
 	return nil
@@ -99,6 +149,16 @@ type EcommSubscription struct {
 	LastName       string
 	Email          string
 	Quantity       int
+	Restricted     bool
+	Trial          bool // True while the user is on a free trial.
+	TrialEnd       string
+	Discount       *EcommDiscount // The active discount, nil if there is none.
+	Usage          *EcommUsage    // The usage of the current quota period.
+	Currency       string         // The currency the user is billed in.
+	Interval       string         // The billing interval, month or year.
+	NextInterval   string         // The billing interval at the end of the period.
+	TaxID          string         // The ABN, GST or VAT number of the user or their enterprise.
+	TaxIDType      string
 }
 
 /*
@@ -115,19 +175,47 @@ func (lc Lgc) EcommGetCustomerSub(db DataCaller, ls LogicStore) (*EcommSubscript
 		NextKind       sql.NullString `db:"next_kind"`
 		Kind           string         `db:"kind"`
 		FailedPayments int            `db:"failed_payments"`
+		Restricted     bool           `db:"restricted"`
+		TrialEnd       sql.NullString `db:"trial_end"`
+		TrialPlan      sql.NullString `db:"trial_plan"`
 		FirstName      string         `db:"first_name"`
 		LastName       string         `db:"last_name"`
 		Email          string         `db:"email"`
+		Currency       sql.NullString `db:"currency"`
+		Interval       string         `db:"billing_interval"`
+		NextInterval   string         `db:"next_interval"`
 	}
 	var cus c
 	q := `SELECT first_name, last_name, email, s_customer_id, 
-          next_kind, kind, failed_payments 
-          FROM user WHERE id = ?;`
+          next_kind, kind, failed_payments, restricted, trial_end, trial_plan, currency,
+          billing_interval, next_interval FROM user WHERE id = ?;`
 	err := db.Get(&cus, q, userID)
 	if err != nil {
 		return nil, e.ThrowError(&e.LogInput{M: "ERRGETCUSTOMER1", E: err})
-	} else if cus.CID.String == "" {
-		return &EcommSubscription{}, nil
+	}
+
+	// A user on a free trial has no subscription until they add a card,
+	// so the trial end is returned as the end of the period.
+	trial := cus.TrialPlan.Valid
+	if cus.CID.String == "" {
+		if !trial {
+			return &EcommSubscription{}, nil
+		}
+		usage, err := getUsage(db, userID)
+		if err != nil {
+			return nil, e.ThrowError(&e.LogInput{M: "ERRGETCUSTOMER3", E: err})
+		}
+		nk, _ := strconv.Atoi(cus.NextKind.String)
+		return &EcommSubscription{
+			Next:      nk,
+			CurEnd:    cus.TrialEnd.String,
+			FirstName: cus.FirstName,
+			LastName:  cus.LastName,
+			Email:     cus.Email,
+			Trial:     true,
+			TrialEnd:  cus.TrialEnd.String,
+			Usage:     usage,
+		}, nil
 	}
 
 	// If the user has failed payments, retrieved the latest failure
@@ -151,18 +239,27 @@ func (lc Lgc) EcommGetCustomerSub(db DataCaller, ls LogicStore) (*EcommSubscript
 	}
 
 	// Get the subscription information.
-	sub, err := ecomm.GetSub(cus.CID.String)
+	sub, err := lc.billing().GetSub(cus.CID.String)
 	if err != nil {
 		return nil, e.ThrowError(&e.LogInput{M: "ERRGETCUSTOMER2", E: err})
 	}
+	usage, err := getUsage(db, userID)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRGETCUSTOMER3", E: err})
+	}
+	tax, err := getTaxID(db, userID)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRGETCUSTOMER4", E: err})
+	}
 
 	// The page expects a number, so we need to convert it back.
 	nk, _ := strconv.Atoi(cus.NextKind.String)
 
 	// If the current kind is different to the next kind, return true as
 	// the user will be moving to a different kind at the end of the
-	// billing period. The front end cases this to give feedback to the user.
-	tr := cus.NextKind.String != cus.Kind
+	// billing period, or to a different billing interval. The front end
+	// cases this to give feedback to the user.
+	tr := cus.NextKind.String != cus.Kind || normInterval(cus.NextInterval) != normInterval(cus.Interval)
 	out := &EcommSubscription{
 		Trans:          tr,
 		CurEnd:         sub.CurEnd,
@@ -181,6 +278,16 @@ func (lc Lgc) EcommGetCustomerSub(db DataCaller, ls LogicStore) (*EcommSubscript
 		LastName:       cus.LastName,
 		Email:          cus.Email,
 		Quantity:       int(sub.Quantity),
+		Restricted:     cus.Restricted,
+		Trial:          trial,
+		TrialEnd:       cus.TrialEnd.String,
+		Discount:       toEcommDiscount(sub.Discount),
+		Usage:          usage,
+		Currency:       normCurrency(cus.Currency.String),
+		Interval:       normInterval(cus.Interval),
+		NextInterval:   normInterval(cus.NextInterval),
+		TaxID:          tax.Value,
+		TaxIDType:      tax.Type,
 	}
 
 	return out, nil
@@ -188,8 +295,27 @@ func (lc Lgc) EcommGetCustomerSub(db DataCaller, ls LogicStore) (*EcommSubscript
 
 // Get the customerID and kind for a user.
 type ui struct {
-	CID  sql.NullString `db:"s_customer_id"`
-	Kind string         `db:"kind"`
+	CID      sql.NullString `db:"s_customer_id"`
+	Kind     string         `db:"kind"`
+	Currency sql.NullString `db:"currency"`
+	Interval string         `db:"billing_interval"`
+	CPE      string         `db:"current_period_end"`
+}
+
+// subscribed returns true if the user is already on the plan, which is the
+// plan with the same kind and billing interval.
+func (u ui) subscribed(plan string, p Plan) bool {
+	return u.Kind == plan || (u.Kind == p.Kind && normInterval(u.Interval) == p.BillingInterval())
+}
+
+// changePlan returns the plan a user is changing to. The plan id is looked
+// up first, as the monthly and yearly plans of a tier share a kind.
+func changePlan(plan string, kind string) Plan {
+	if p, ok := planCatalog.ByID(plan); ok {
+		return p
+	}
+	p, _ := planCatalog.ByKind(kind)
+	return p
 }
 
 /*
@@ -198,8 +324,14 @@ type ui struct {
   This does not handle downgrading to free, which is considered cancelling.
   This handles if the customer has not currently got an active subscription,
   and will make a new subscription for them.
+  If the input has a coupon, it is validated before the plan is changed and
+  applied once the change is saved, so a failed change leaves no coupon on
+  the customer. The coupon discounts the invoices after any prorated one.
+  The plan may be the monthly or yearly plan of a tier. Moving to a yearly
+  plan starts a new yearly period now, crediting the rest of the month, and
+  moving from a yearly plan to a monthly plan happens at the end of the year.
 */
-func (lc Lgc) EcommUpdateCustomerSub(db DataCaller, plan string, ls LogicStore) error {
+func (lc Lgc) EcommUpdateCustomerSub(db DataCaller, plan string, ls LogicStore, in *EcommSubInput) error {
 	userID := ls.GetCurrentUser().Id
 
 	// Create a function that will be used when the customer needs to
@@ -210,7 +342,8 @@ func (lc Lgc) EcommUpdateCustomerSub(db DataCaller, plan string, ls LogicStore)
 	}
 
 	var u ui
-	q := `SELECT s_customer_id, kind FROM user WHERE id = ?;`
+	q := `SELECT s_customer_id, kind, currency, billing_interval,
+          IFNULL(current_period_end, '') AS current_period_end FROM user WHERE id = ?;`
 	err := db.Get(&u, q, userID)
 	if err != nil {
 		return e.ThrowError(&e.LogInput{M: "Error updating the subscription.", E: err})
@@ -225,112 +358,130 @@ func (lc Lgc) EcommUpdateCustomerSub(db DataCaller, plan string, ls LogicStore)
 	// getPlan is used to convert to the expected plan that will be
 	// stored in the database.
 	sPlan := ls.getPlan(plan)
+	if sPlan == "" {
+		return errors.New("That plan does not exist.")
+	}
+	p := changePlan(plan, sPlan)
 
 	// If the user is attempting to update to a plan they are already on,
 	// return an error.
-	if u.Kind == plan {
+	if u.subscribed(plan, p) {
 		return errors.New("User is already subscribed to the plan.")
 	}
 
+	// The currency of a customer cannot change, so the plan must be priced
+	// in the currency the user is billed in.
+	if err := checkPlanCurrency(plan, u.Currency.String); err != nil {
+		return err
+	}
+
 	// Determine if the user needs to be prorated (in the case of an upgrade
 	// this will true). This is passed to the ecomm package to ensure the
 	// user is charged accordingly; and is used below to check if
 	// the user is down/up grading when setting the downgrade_date.
-	pro := ls.isProrated(u.Kind, sPlan)
-
-	// Now we can update the customer plan through the ecomm package.
-	cpe, err := ls.updateSub(u.CID.String, plan, pro)
-	if err != nil {
-		return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
+	// A change of billing interval within a tier is prorated when moving to
+	// a yearly plan.
+	pro := intervalProrated(u.Kind, u.Interval, p, ls.isProrated(u.Kind, sPlan))
+
+	// Validate the coupon before the plan is changed.
+	code := in.coupon()
+	if code != "" {
+		if _, err := lc.EcommValidateCoupon(code, plan); err != nil {
+			return err
+		}
 	}
 
-	// Check the user's kind, to determine if they should be updated now,
-	// or after the end of the financial period. See each case for
-	// an explanation. This changes what the kind, next_kind, and downgrade_date
-	// will be set to.
-	var cur string // Denotes the kind to assign to the user.
-	n := sPlan     // The next plan will always be whichever the user has chosen
-	switch u.Kind {
-	case "0":
-		// If the user is currently a 0, they will always be upgrading.
-		// So the kind will become whichever plan the user is upgrading to.
-		cur = sPlan
-	case "1":
-		// If the user is currently a 1, they will always be upgrading.
-		// So the kind will become whichever plan the user is upgrading to.
-		cur = sPlan
+	// Determine if the user should be updated now, or after the end of the
+	// financial period. This changes what the kind, next_kind, and
+	// downgrade_date will be set to.
+	// When upgrading, the kind becomes whichever plan the user is upgrading
+	// to. When downgrading, the user keeps their current kind until the
+	// scheduler moves them to the next kind at the end of the period.
+	pc := planChange(u.Kind, u.Interval, p, pro, u.CPE)
+
+	// Now we can update the customer plan through the ecomm package. A move
+	// from a yearly plan to a monthly plan is left to the scheduler, as the
+	// provider would start the monthly period now.
+	cpe := u.CPE
+	if !pc.AtPeriodEnd {
+		cpe, err = ls.updateSub(u.CID.String, plan, pro)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
+		}
+		if !pro {
+			pc.DowngradeDate = cpe
+		}
+	}
+	if pc.InvoiceNow {
 		// The user is upgrading from a paid plan to a higher rate paid
 		// plan, invoice the customer to pay the prorate immediately.
 		if err := inv(u.CID.String); err != nil {
 			return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
 		}
-	case "2":
-		// If the user is currently a 2, they will either be downgrading to a
-		// 1, or upgrading to a 5.
-		if sPlan == "5" {
-			// So the kind will become whichever plan the user is upgrading to.
-			cur = sPlan
-			// The user is upgrading from a paid plan to a higher rate paid
-			// plan, invoice the customer to pay the prorate immediately.
-			if err := inv(u.CID.String); err != nil {
-				return e.ThrowError(&e.LogInput{M: "Error updating the subscription.", E: err})
+	}
+
+	// The user is updated within a transaction, so they are never left
+	// half-upgraded.
+	err = withTx(db, func(tx DataCaller) error {
+		// If this is an upgrade, we need to remove the downgrade_date to ensure
+		// the user will not be picked up by the scheduler.
+		// We also need to set the new user quota for the user when they upgrade.
+		// Otherwise we do so it will be picked up by the scheduling service.
+		// Update the kind and next_kind of the user to the chosen plan.
+		if pro {
+			q := `UPDATE user SET kind=?, next_kind=?, current_period_end=?, downgrade_date=NULL,
+          billing_interval=?, next_interval=? WHERE id=?;`
+			if _, err := tx.Exec(q, pc.Kind, pc.NextKind, cpe, pc.Interval, pc.NextInterval, userID); err != nil {
+				return err
 			}
-		} else {
-			cur = u.Kind
-		}
-	case "5":
-		// If you're a 5, you're always downgrading.
-		cur = u.Kind
-	}
-
-	// This will be the new quota for the user, and will only
-	// be updated when they are upgrading to a 2 or 3 (and ignored
-	// if they are downgrading).
-	quota := 0
-	if sPlan == "1" {
-		quota = config.T1Lim
-	}
-	if sPlan == "2" {
-		quota = config.T2Lim
-	}
-
-	// If this is an upgrade, we need to remove the downgrade_date to ensure
-	// the user will not be picked up by the scheduler.
-	// We also need to set the new user quota for the user when they upgrade.
-	// Otherwise we do so it will be picked up by the scheduling service.
-	// Update the kind and next_kind of the user to the chosen plan.
-	if pro {
-		q = `UPDATE user SET kind=?, next_kind=?, current_period_end=?, downgrade_date=NULL
-          WHERE id=?;`
-		_, err = db.Exec(q, cur, n, cpe, userID)
-		if err != nil {
-			return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
-		}
 
-		// Update the user quota to the relevant amount if they have upgraded
-		// to a 1 or 2 plan.
-		if cur != "5" {
-			q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
-			_, err = db.Exec(q, quota, userID)
-			if err != nil {
-				return e.ThrowError(&e.LogInput{M: "Error when updating the new subscription.", E: err})
+			// Update the user quota to the amount assigned by the plan they
+			// have upgraded to. Unmetered plans (bplus) do not use the quota.
+			if pc.Quota > 0 {
+				q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+				if _, err := tx.Exec(q, pc.Quota, userID); err != nil {
+					return err
+				}
+			}
+
+		} else {
+			q := `UPDATE user SET kind=?, next_kind=?, current_period_end=?, downgrade_date=?,
+          billing_interval=?, next_interval=? WHERE id=?;`
+			if _, err := tx.Exec(q, pc.Kind, pc.NextKind, cpe, pc.DowngradeDate, pc.Interval,
+				pc.NextInterval, userID); err != nil {
+				return err
 			}
 		}
 
-	} else {
-		q = `UPDATE user SET kind=?, next_kind=?, current_period_end=?, downgrade_date=?
-          WHERE id=?;`
-		_, err = db.Exec(q, cur, n, cpe, cpe, userID)
-		if err != nil {
-			return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
+		// If the user is on a plan with groups (bplus), create an enterprise
+		// record for their branding/sender settings information.
+		if c, _ := planCatalog.ByKind(pc.Kind); c.HasFeature(FeatureGroups) {
+			return createGroup(tx, userID)
 		}
+		return nil
+	})
+	if err != nil {
+		// The subscription has already been changed, so move it back to
+		// the plan the user is still on. Any prorated invoice that was paid
+		// is left for support to refund.
+		if !pc.AtPeriodEnd {
+			lc.compensate("revert subscription for "+u.CID.String, func() error {
+				prev, ok := planCatalog.Variant(u.Kind, u.Interval)
+				if !ok || !prev.Paid() {
+					return lc.cancelSubNow(u.CID.String)
+				}
+				_, err := ls.updateSub(u.CID.String, prev.ID, false)
+				return err
+			})
+		}
+		return e.ThrowError(&e.LogInput{M: "Error when updating the subscription.", E: err})
 	}
 
-	// If the user is upgrading to a bplus user, create an enterprise record
-	// for their branding/sender settings information.
-	if cur == "5" {
-		if err := createGroup(db, userID); err != nil {
-			return e.ThrowError(&e.LogInput{M: "Error when creating the new subscription.", E: err})
+	// The plan has changed, so a failure to apply the coupon is returned
+	// for the user to apply it again.
+	if code != "" {
+		if err := lc.applyCoupon(u.CID.String, code); err != nil {
+			return e.ThrowError(&e.LogInput{M: "The subscription was updated, but the coupon could not be applied.", E: err})
 		}
 	}
 
@@ -351,16 +502,27 @@ func (lc Lgc) EcommCancelCustomerSub(db DataCaller) error {
 		return errors.New("Error when cancelling the subscription.")
 	}
 
-	// Cancel the subscription within the ecomm package.
-	if err := ecomm.CancelSub(cID); err != nil {
+	// Cancel the subscription with the billing provider.
+	if err := lc.billing().CancelSub(cID); err != nil {
 		return e.ThrowError(&e.LogInput{M: "Error when cancelling the subscription.", E: err})
 	}
 
-	// Update the next_kind of the user to the free plan.
-	q := `UPDATE user SET next_kind = 0, downgrade_date = current_period_end 
+	// Update the next_kind of the user to the free plan, and record the
+	// cancellation so it can be undone with EcommReactivateSub.
+	err = withTx(db, func(tx DataCaller) error {
+		q := `UPDATE user SET next_kind = 0, downgrade_date = current_period_end 
           WHERE id = ?;`
-	_, err = db.Exec(q, userID)
+		if _, err := tx.Exec(q, userID); err != nil {
+			return err
+		}
+		return logBillingEvent(tx, userID, cID, billingEventCancelled, "Cancelled at the end of the billing period.")
+	})
 	if err != nil {
+		// The user keeps their plan, so the subscription should not end.
+		lc.compensate("reactivate subscription for "+cID, func() error {
+			_, err := lc.billing().ReactivateSub(cID)
+			return err
+		})
 		return e.ThrowError(&e.LogInput{M: "Error when cancelling the subscription.", E: err})
 	}
 
@@ -368,16 +530,16 @@ func (lc Lgc) EcommCancelCustomerSub(db DataCaller) error {
 }
 
 // The input for the EcommUpdateCustomerInfo function.
-// This input is intended to be expanded upon.
 type EcommUpdateCInput struct {
 	Token string
 }
 
 /*
   EcommUpdateCustomerInfo will take a new token and update this for the customer.
-  This then becomes the default source for that customer, and will retry any
-  failed payments. We need to offer this to users when their card has failed
-  charges.
+  This then becomes the default source for that customer, replacing the
+  previous default card, and will retry any failed payments. We need to offer
+  this to users when their card has failed charges. Further cards are
+  managed with EcommAddPaymentMethod.
 */
 func (lc Lgc) EcommUpdateCustomerInfo(db DataCaller, in *EcommUpdateCInput) error {
 
@@ -387,7 +549,7 @@ func (lc Lgc) EcommUpdateCustomerInfo(db DataCaller, in *EcommUpdateCInput) erro
 	}
 
 	inp := ecomm.UpdateCusInp{CustomerID: cID, Token: in.Token}
-	err = ecomm.UpdateCustomerInfo(inp)
+	err = lc.billing().UpdateCustomerInfo(inp)
 	if err != nil {
 		return e.ThrowError(&e.LogInput{M: "ERRUPDCUSTOMER2", E: err})
 	}
@@ -397,12 +559,17 @@ func (lc Lgc) EcommUpdateCustomerInfo(db DataCaller, in *EcommUpdateCInput) erro
 
 // The output from the EcommGetCustomerInv function.
 type EcommInvoice struct {
-	ID        string
-	Total     int64
-	AmountDue int64
-	Date      string
-	Paid      bool
-	Lines     []EcommLineItem
+	ID               string
+	Total            int64
+	AmountDue        int64
+	Currency         string // The ISO 4217 code of the amounts, eg. AUD.
+	TotalDisplay     string // The total formatted in the currency, eg. NZ$25.00.
+	AmountDueDisplay string
+	Date             string
+	Paid             bool
+	Lines            []EcommLineItem
+	Refunds          []EcommRefund // The refunds and credits issued against the invoice.
+	Refunded         int64         // The total of the refunds and credits.
 }
 type EcommLineItem struct {
 	ID          string
@@ -410,6 +577,8 @@ type EcommLineItem struct {
 	Proration   bool
 	Description string
 	Plan        string
+	Discount    bool // True for the line showing the discount on the invoice.
+	Tax         bool // True for the lines showing the tax on the invoice.
 }
 
 /*
@@ -433,131 +602,85 @@ func (lc Lgc) EcommGetCustomerInv(db DataCaller, ls LogicStore) ([]EcommInvoice,
 		return out, errors.New("Not an existing customer.")
 	}
 
-	inv, err := ecomm.GetCustomerInvoices(cID)
+	inv, err := lc.billing().GetCustomerInvoices(cID)
+	if err != nil {
+		return out, e.ThrowError(&e.LogInput{M: "Error retrieving customer invoices.", E: err})
+	}
+
+	refunds, err := getRefunds(db, cID)
 	if err != nil {
 		return out, e.ThrowError(&e.LogInput{M: "Error retrieving customer invoices.", E: err})
 	}
 
 	// We need to format the invoices to the expected output for controller.
 	for _, i := range inv {
-		in := EcommInvoice{
-			ID:        i.ID,
-			Total:     i.Total,
-			AmountDue: i.Amount,
-			Date:      i.Date,
-			Paid:      i.Paid,
+		ei := toEcommInvoice(i)
+		ei.Refunds = refunds[i.ID]
+		for _, r := range ei.Refunds {
+			ei.Refunded += r.Amount
 		}
-		for _, line := range i.Lines {
-			li := EcommLineItem{
-				ID:          line.ID,
-				Amount:      line.Amount,
-				Proration:   line.Proration,
-				Description: line.Description,
-				Plan:        line.Plan,
-			}
-			in.Lines = append(in.Lines, li)
-		}
-		out = append(out, in)
+		out = append(out, ei)
 	}
 	return out, nil
 }
 
+// toEcommInvoice formats an invoice from the billing provider as expected by
+// the controller.
+func toEcommInvoice(i ecomm.Invoice) EcommInvoice {
+	cur := normCurrency(i.Currency)
+	in := EcommInvoice{
+		ID:               i.ID,
+		Total:            i.Total,
+		AmountDue:        i.Amount,
+		Currency:         cur,
+		TotalDisplay:     formatMoney(i.Total, cur),
+		AmountDueDisplay: formatMoney(i.Amount, cur),
+		Date:             i.Date,
+		Paid:             i.Paid,
+	}
+	for _, line := range i.Lines {
+		li := EcommLineItem{
+			ID:          line.ID,
+			Amount:      line.Amount,
+			Proration:   line.Proration,
+			Description: line.Description,
+			Plan:        line.Plan,
+		}
+		in.Lines = append(in.Lines, li)
+	}
+	if i.Discount != nil && i.DiscountAmount > 0 {
+		in.Lines = append(in.Lines, discountLine(i.Discount, i.DiscountAmount))
+	}
+	for _, t := range i.TaxAmounts {
+		in.Lines = append(in.Lines, taxLine(t))
+	}
+	return in
+}
+
 /*
   EcommHook parses and stores the webhook events sent from the Stripe
   service, and handles user account actions as necessary.
+  Each event is recorded in the ecomm_events ledger before it is actioned,
+  so an event that is delivered more than once is only actioned once. Events
+  that fail are marked as failed in the ledger and can be replayed with
+  EcommReplay.
 */
 func (lc Lgc) EcommHook(db DataCaller, eventID string) {
-	// Get event from the ecomm package, this implicity ensures that the
-	// webhook event sent is legitimate.
-	in, err := ecomm.GetHookEvent(eventID)
+	// Claim the event in the ledger. If the event has already been
+	// processed (or is being processed by another request) it is ignored.
+	ok, err := claimEcommEvent(db, eventID)
 	if err != nil {
-		e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK0", E: err})
+		e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK7", E: err})
 		return
 	}
-
-	// We need a function to generate the sql null string for possible
-	// null values.
-	toNS := func(s string) sql.NullString {
-		return sql.NullString{String: s, Valid: s != ""}
-	}
-
-	// Get the user information for the given customer as we will need this to
-	// perform the required changes.
-	q := `SELECT id, email, first_name FROM user WHERE s_customer_id = ?;`
-	type u struct {
-		ID        string `db:"id"`
-		Email     string `db:"email"`
-		FirstName string `db:"first_name"`
-	}
-	var user u
-	if err := db.Get(&user, q, in.CustomerID); err != nil {
-		e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK2", E: err})
+	if !ok {
 		return
 	}
 
-	// Depending on the kind of the webhook, certain events need to
-	// occur for the user.
-	switch in.Kind {
-	case "customer.subscription.deleted":
-		// Update the user kind to 0 with the given s_customer_id, and remove
-		// the current_period_end.
-		q = `UPDATE user SET kind = 0, current_period_end = NULL WHERE id = ?;`
-		if _, err := db.Exec(q, user.ID); err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK3", E: err})
-			return
-		}
-		// Email the user informing them the account type has been
-		// downgraded to a free account.
-		// TODO create the email event.
-	case "charge.failed":
-		// Write the failure event to the database.
-		q = `INSERT INTO ecomm_failures
-                  (event_id, created, s_customer_id, kind, invoice, failure_message, failure_code)
-                  VALUES (?,?,?,?,?,?,?);`
-
-		if _, err := db.Exec(q,
-			in.ID,
-			in.Created,
-			in.CustomerID,
-			in.Kind,
-			toNS(in.Invoice),
-			toNS(in.FailureMessage),
-			toNS(in.FailureCode),
-		); err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK1", E: err})
-			return
-		}
-
-		// Add to the payment_failed count for the user.
-		q = `UPDATE user SET failed_payments = failed_payments + 1 WHERE id = ?;`
-		if _, err := db.Exec(q, user.ID); err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK3", E: err})
-			return
-		}
-
-		// Email the user informing them of the failed payment.
-		emIn := &buildPaymentFailInput{
-			firstName: user.FirstName,
-			email:     user.Email,
-			db:        db,
-		}
-		if err := lc.Pvl.buildPaymentFailEmail(emIn); err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK4", E: err})
-			return
-		}
-	case "invoice.payment_succeeded":
-		// Update the user failed_payments to 0.
-		// Update the current_period_end to the appropriate end date.
-		sub, err := ecomm.GetSub(in.CustomerID)
-		if err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK5", E: err})
-			return
-		}
-		q = `UPDATE user SET failed_payments = 0, current_period_end = ? WHERE id = ?;`
-		if _, err := db.Exec(q, sub.CurEnd, user.ID); err != nil {
-			e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK6", E: err})
-			return
-		}
+	// Action the event, and record the outcome against the ledger.
+	err = lc.processEcommEvent(db, eventID)
+	if err := finishEcommEvent(db, eventID, err); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK8", E: err})
 	}
 	return
 }
@@ -578,24 +701,46 @@ func getCustomerID(db DataCaller, lc LogicStore) (string, string, error) {
 	return cID.String, userID, nil
 }
 
-// EcommSchedule handles the downgrading of user accounts when they need
-// to be downgraded.
-func (lc Lgc) EcommSchedule(db DataCaller) error {
+/*
+  EcommSchedule handles the downgrading of user accounts when they need
+  to be downgraded, moves users with failed payments through the
+  dunning schedule, ends free trials and reports any unreported usage.
+  The report of the users that were downgraded is returned. A step that
+  fails does not stop the following steps, so the error of each step is
+  recorded in the report instead.
+*/
+func (lc Lgc) EcommSchedule(db DataCaller) (*EcommScheduleReport, error) {
 	now := time.Now()
+	errs := map[string]string{}
+
+	// Action any dunning steps that are due. This is done first, as the
+	// final dunning step downgrades the user.
+	if err := lc.ecommDunning(db, now); err != nil {
+		errs["dunning"] = err.Error()
+	}
+
+	// Remind users whose trials are ending, and convert or downgrade the
+	// users whose trials have ended.
+	if err := lc.ecommTrials(db, now); err != nil {
+		errs["trials"] = err.Error()
+	}
+
+	// Report any overage that could not be reported when it was sent.
+	if err := lc.ecommUsage(db); err != nil {
+		errs["usage"] = err.Error()
+	}
 
 	// A user needs to be downgraded when their downgrade_date
 	// has passed, and their next_kind is different
 	// to their current kind. This occurs when the user has
 	// downgraded their account, and has not yet be downgraded.
-	// Also set the downgrade_date to NULL as this downgrade has been
-	// completed.
-	q := `UPDATE user SET user.kind = user.next_kind, user.downgrade_date = NULL 
-        WHERE user.downgrade_date <= ? AND user.next_kind != user.kind;`
-	_, err := db.Exec(q, now)
+	report, err := lc.ecommDowngrades(db, now)
 	if err != nil {
-		return e.ThrowError(&e.LogInput{M: "ERRDOWNGRADE", E: err})
+		report = &EcommScheduleReport{Failed: map[string]string{}}
+		errs["downgrades"] = err.Error()
 	}
-	return nil
+	report.Errors = errs
+	return report, nil
 }
 
 /*
@@ -605,77 +750,110 @@ func (lc Lgc) EcommSchedule(db DataCaller) error {
   If they are downgrading, we do NOT want to prorate them (they get
   the benefits of a subscription until the end of the billing period).
   A return value of true indicates the user should be prorated.
+  The kinds do not carry the billing interval, so a change between a
+  monthly and a yearly plan is decided by intervalProrated.
 */
 func (lc Lgc) isProrated(uKind string, plan string) bool {
-	// Determine if the user is upgrading or downgrading.
-	var upg bool
-
-	// If the user is 0 or 1, they are always upgrading.
-	if uKind == "0" || uKind == "1" {
-		upg = true
-	} else if uKind == "5" {
-		// If the user is a 5, they are always downgrading.
-		upg = false
-	} else if uKind == "2" {
-		// If the user is a 2, they could either be upgrading to a 5,
-		// or downgrading to a 1.
-		if plan == "5" {
-			upg = true
-		} else {
-			upg = false
-		}
-
-	}
-
-	return upg
+	// Determine if the user is upgrading or downgrading by comparing the
+	// tier of their current kind to the tier of the plan.
+	return planCatalog.IsUpgrade(uKind, plan)
 }
 
 // getPlan returns a string of the plan kind that is stored in the db based
 // on the stripe plan id.
 func (lc Lgc) getPlan(plan string) string {
-	var sPlan string
-	switch plan {
-	case "101":
-		sPlan = "1"
-	case "102":
-		sPlan = "2"
-	case "103":
-		sPlan = "5"
-	}
-	return sPlan
+	p, ok := planCatalog.ByID(plan)
+	if !ok {
+		return ""
+	}
+	return p.Kind
 }
 
-// updateSub wraps the ecomm package update function, and returns any errors or
-// information that is returned from stripe.
-func (lc Lgc) updateSub(customerID string, plan string, pro bool) (string, error) {
-	if config.Context() != "test" {
-		cpe, err := ecomm.UpdateSub(customerID, plan, pro)
-		return cpe, err
-	} else {
-		return "2020-01-01 00:00:00", nil
+// compensate runs an action against the billing provider that undoes a change
+// made before the local changes failed. A failed action is logged so it can
+// be fixed by hand, as the user and provider no longer agree.
+func (lc Lgc) compensate(desc string, action func() error) {
+	if err := action(); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRCOMPENSATE - " + desc, E: err})
 	}
 }
 
-// invoiceCustomer wraps the ecomm package invoice function, and returns any
-// errors that are returned from stripe.
+// updateSub wraps the billing provider update function, and returns any errors
+// or information that is returned from stripe.
+func (lc Lgc) updateSub(customerID string, plan string, pro bool) (string, error) {
+	return lc.billing().UpdateSub(customerID, plan, pro)
+}
+
+// updateQuantity wraps the billing provider function that changes the
+// quantity (number of seats) of the subscription, returning the current
+// period end.
+func (lc Lgc) updateQuantity(customerID string, quantity int, pro bool) (string, error) {
+	return lc.billing().UpdateQuantity(customerID, int64(quantity), pro)
+}
+
+// createTrialCustomer wraps the billing provider create function for
+// customers on a free trial. The subscription is not charged until the trial
+// ends.
+func (lc Lgc) createTrialCustomer(email string, token string, plan string, trialEnd time.Time) (string, string, error) {
+	return lc.billing().CreateTrialCustomer(email, token, plan, trialEnd)
+}
+
+// getCoupon wraps the billing provider coupon function, returning the coupon
+// formatted for the logic.
+func (lc Lgc) getCoupon(code string) (*EcommCoupon, error) {
+	c, err := lc.billing().GetCoupon(code)
+	if err != nil {
+		return nil, err
+	}
+	return &EcommCoupon{
+		Code:             c.ID,
+		Name:             c.Name,
+		PercentOff:       c.PercentOff,
+		AmountOff:        c.AmountOff,
+		Currency:         c.Currency,
+		Duration:         c.Duration,
+		DurationInMonths: c.DurationInMonths,
+		RedeemBy:         c.RedeemBy,
+		Valid:            c.Valid,
+		Plans:            c.Plans,
+	}, nil
+}
+
+// applyCoupon wraps the billing provider function that applies a coupon to
+// the customer. The discount applies to every following invoice.
+func (lc Lgc) applyCoupon(customerID string, code string) error {
+	return lc.billing().ApplyCoupon(customerID, code)
+}
+
+// createCustomerInp wraps the billing provider create function for
+// customers with a coupon or a currency other than the default.
+func (lc Lgc) createCustomerInp(inp ecomm.CreateCusInp) (string, string, error) {
+	return lc.billing().CreateCustomer(inp)
+}
+
+// invoiceCustomer wraps the billing provider invoice function, and returns
+// any errors that are returned from stripe.
 func (lc Lgc) invoiceCustomer(customerID string) error {
-	if config.Context() != "test" {
-		err := ecomm.InvoiceCustomer(customerID)
-		return err
-	} else {
-		return nil
-	}
+	return lc.billing().InvoiceCustomer(customerID)
 }
 
-// createCustomer wraps the ecomm package create function, returning any
+// createCustomer wraps the billing provider create function, returning any
 // data that is returned from ecomm.
 func (lc Lgc) createCustomer(email string, token string, plan string) (string, string, error) {
-	if config.Context() != "test" {
-		customerID, billingEnd, err := ecomm.CreateCustomer(email, token, plan)
-		return customerID, billingEnd, err
-	} else {
-		return "ABC123", "2020-01-01 00:00:00", nil
-	}
+	inp := ecomm.CreateCusInp{Email: email, Token: token, Plan: plan}
+	return lc.billing().CreateCustomer(inp)
+}
+
+// retryPayment wraps the billing provider retry function, which attempts to
+// pay the outstanding invoice for the customer.
+func (lc Lgc) retryPayment(customerID string) error {
+	return lc.billing().RetryPayment(customerID)
+}
+
+// cancelSubNow wraps the billing provider cancel function that ends the
+// subscription immediately, rather than at the end of the billing period.
+func (lc Lgc) cancelSubNow(customerID string) error {
+	return lc.billing().CancelSubNow(customerID)
 }
 
 // createGroup will create a group with default information for the provided
@@ -698,7 +876,7 @@ func createGroup(db DataCaller, userID string) error {
 		if _, err := db.Exec(q, userID); err != nil {
 			return err
 		}
-		return nil
+		return recountMembers(db, bplus.EnterpriseID.String)
 	}
 
 	// Put together the default info for the enterprise record.
@@ -710,21 +888,24 @@ func createGroup(db DataCaller, userID string) error {
 	// The enterprise record is created with a default of 1
 	// seat. This is able to be upgraded when the user purchases
 	// more seats for their enterprise.
+	// The enterprise and user are written within a transaction, so the
+	// enterprise is never created without its owner.
 	id := uniuri.New()
 	name := fmt.Sprintf("%v %v", bplus.FirstName, bplus.LastName)
 	address := bplus.Email
 	contact := fmt.Sprintf("%v - %v", name, bplus.Email)
-	q = `INSERT INTO enterprises (id, name, address, contact, seats) VALUES (?,?,?,?,?);`
-	if _, err := db.Exec(q, id, name, address, contact, 1); err != nil {
-		return err
-	}
+	return withTx(db, func(tx DataCaller) error {
+		q := `INSERT INTO enterprises (id, name, address, contact, seats, members)
+              VALUES (?,?,?,?,?,?);`
+		if _, err := tx.Exec(q, id, name, address, contact, 1, 1); err != nil {
+			return err
+		}
 
-	// Update the user record to align it with the new enterprise_id.
-	// Update the user record to be active within their group. This ensures
-	// the group always has an active member.
-	q = `UPDATE user SET enterprise_id=?, group_active=1 WHERE id=?;`
-	if _, err := db.Exec(q, id, userID); err != nil {
+		// Update the user record to align it with the new enterprise_id.
+		// Update the user record to be active within their group. This ensures
+		// the group always has an active member.
+		q = `UPDATE user SET enterprise_id=?, group_active=1 WHERE id=?;`
+		_, err := tx.Exec(q, id, userID)
 		return err
-	}
-	return nil
+	})
 }
@@ -0,0 +1,178 @@
+package logic
+
+import (
+	"pleasesign/ecomm"
+	"time"
+)
+
+/*
+  BillingProvider is the interface the ecomm logic uses to manage customers,
+  subscriptions and invoices. StripeBilling calls the ecomm package, which
+  is used in production. MemBilling holds everything in memory, so the
+  billing flow can be tested without Stripe. Another provider can be added
+  by implementing this interface and setting it as the Billing of the Lgc.
+*/
+type BillingProvider interface {
+	// CreateCustomer creates a customer with the card token, subscribed to
+	// the plan. The customer id and current period end are returned.
+	CreateCustomer(in ecomm.CreateCusInp) (string, string, error)
+	// CreateTrialCustomer creates a customer subscribed to the plan that is
+	// not charged until the trial ends.
+	CreateTrialCustomer(email string, token string, plan string, trialEnd time.Time) (string, string, error)
+	// UpdateCustomerInfo replaces the card of the customer, and retries any
+	// failed payments.
+	UpdateCustomerInfo(in ecomm.UpdateCusInp) error
+	GetSub(customerID string) (*ecomm.Sub, error)
+	// UpdateSub moves the subscription to the plan, prorating the change if
+	// pro is true. The current period end is returned.
+	UpdateSub(customerID string, plan string, pro bool) (string, error)
+	// PreviewSub returns the next invoice of the customer as if UpdateSub
+	// was called, without changing the subscription. Prorations are the
+	// lines marked as a proration.
+	PreviewSub(customerID string, plan string, pro bool) (*ecomm.Invoice, error)
+	// UpdateQuantity changes the quantity (seats) of the subscription.
+	UpdateQuantity(customerID string, quantity int64, pro bool) (string, error)
+	// CancelSub cancels the subscription at the end of the billing period.
+	CancelSub(customerID string) error
+	// ReactivateSub stops a subscription that was cancelled with CancelSub
+	// from ending. The current period end is returned.
+	ReactivateSub(customerID string) (string, error)
+	// CancelSubNow ends the subscription immediately.
+	CancelSubNow(customerID string) error
+	// InvoiceCustomer invoices and charges any pending amount (prorations).
+	InvoiceCustomer(customerID string) error
+	// RetryPayment attempts to pay the outstanding invoices of the customer.
+	RetryPayment(customerID string) error
+	GetCustomerInvoices(customerID string) ([]ecomm.Invoice, error)
+	// GetHookEvent returns the webhook event, which ensures the event was
+	// sent by the provider.
+	GetHookEvent(eventID string) (*ecomm.HookEvent, error)
+	GetCoupon(code string) (*ecomm.Coupon, error)
+	ApplyCoupon(customerID string, code string) error
+	// ReportUsage records metered usage (overage documents) against the
+	// subscription, which is billed at the end of the billing period at the
+	// metered price of the plan. Usage reported again with the same key is
+	// only counted once, so a report can be retried.
+	ReportUsage(customerID string, quantity int64, at time.Time, key string) error
+	// UpdateTax sets the tax id of the customer and the tax applied to
+	// their following invoices.
+	UpdateTax(customerID string, in ecomm.TaxInp) error
+	// RefundInvoice refunds the amount (in cents) of the payment of the
+	// invoice to the card of the customer. The id of the refund is returned.
+	RefundInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error)
+	// CreditInvoice issues a credit note for the amount against the invoice,
+	// which is added to the balance of the customer and applied to their
+	// following invoices. The id of the credit note is returned.
+	CreditInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error)
+	// ListPaymentMethods returns the cards saved against the customer, with
+	// the default card marked.
+	ListPaymentMethods(customerID string) ([]ecomm.PaymentMethod, error)
+	// AddPaymentMethod saves the card without replacing the default card.
+	// When the bank requires the card to be authenticated (3-D Secure) the
+	// status is requires_action, and the card is saved once the client
+	// secret has been confirmed by the front end.
+	AddPaymentMethod(customerID string, token string) (*ecomm.PaymentSetup, error)
+	// SetDefaultPaymentMethod sets the card charged for the subscription.
+	SetDefaultPaymentMethod(customerID string, paymentMethodID string) error
+	// RemovePaymentMethod detaches the card from the customer.
+	RemovePaymentMethod(customerID string, paymentMethodID string) error
+}
+
+// StripeBilling is the BillingProvider backed by the ecomm package. The
+// ecomm API it relies on is listed in the Readme.
+type StripeBilling struct{}
+
+func (StripeBilling) CreateCustomer(in ecomm.CreateCusInp) (string, string, error) {
+	if in.Coupon == "" && in.Tax == nil && normCurrency(in.Currency) == defaultCurrency {
+		return ecomm.CreateCustomer(in.Email, in.Token, in.Plan)
+	}
+	return ecomm.CreateCustomerInp(in)
+}
+func (StripeBilling) CreateTrialCustomer(email string, token string, plan string, trialEnd time.Time) (string, string, error) {
+	return ecomm.CreateTrialCustomer(email, token, plan, trialEnd)
+}
+func (StripeBilling) UpdateCustomerInfo(in ecomm.UpdateCusInp) error {
+	return ecomm.UpdateCustomerInfo(in)
+}
+func (StripeBilling) GetSub(customerID string) (*ecomm.Sub, error) {
+	return ecomm.GetSub(customerID)
+}
+func (StripeBilling) UpdateSub(customerID string, plan string, pro bool) (string, error) {
+	return ecomm.UpdateSub(customerID, plan, pro)
+}
+func (StripeBilling) PreviewSub(customerID string, plan string, pro bool) (*ecomm.Invoice, error) {
+	return ecomm.PreviewSub(customerID, plan, pro)
+}
+func (StripeBilling) UpdateQuantity(customerID string, quantity int64, pro bool) (string, error) {
+	return ecomm.UpdateQuantity(customerID, quantity, pro)
+}
+func (StripeBilling) CancelSub(customerID string) error {
+	return ecomm.CancelSub(customerID)
+}
+func (StripeBilling) ReactivateSub(customerID string) (string, error) {
+	return ecomm.ReactivateSub(customerID)
+}
+func (StripeBilling) CancelSubNow(customerID string) error {
+	return ecomm.CancelSubNow(customerID)
+}
+func (StripeBilling) InvoiceCustomer(customerID string) error {
+	return ecomm.InvoiceCustomer(customerID)
+}
+func (StripeBilling) RetryPayment(customerID string) error {
+	return ecomm.RetryPayment(customerID)
+}
+func (StripeBilling) GetCustomerInvoices(customerID string) ([]ecomm.Invoice, error) {
+	return ecomm.GetCustomerInvoices(customerID)
+}
+func (StripeBilling) GetHookEvent(eventID string) (*ecomm.HookEvent, error) {
+	return ecomm.GetHookEvent(eventID)
+}
+func (StripeBilling) GetCoupon(code string) (*ecomm.Coupon, error) {
+	return ecomm.GetCoupon(code)
+}
+func (StripeBilling) ApplyCoupon(customerID string, code string) error {
+	return ecomm.ApplyCoupon(customerID, code)
+}
+func (StripeBilling) ReportUsage(customerID string, quantity int64, at time.Time, key string) error {
+	return ecomm.ReportUsage(customerID, quantity, at, key)
+}
+func (StripeBilling) UpdateTax(customerID string, in ecomm.TaxInp) error {
+	return ecomm.UpdateTax(customerID, in)
+}
+func (StripeBilling) RefundInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error) {
+	return ecomm.RefundInvoice(customerID, invoiceID, amount, reason)
+}
+func (StripeBilling) CreditInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error) {
+	return ecomm.CreditInvoice(customerID, invoiceID, amount, reason)
+}
+func (StripeBilling) ListPaymentMethods(customerID string) ([]ecomm.PaymentMethod, error) {
+	return ecomm.ListPaymentMethods(customerID)
+}
+func (StripeBilling) AddPaymentMethod(customerID string, token string) (*ecomm.PaymentSetup, error) {
+	return ecomm.AddPaymentMethod(customerID, token)
+}
+func (StripeBilling) SetDefaultPaymentMethod(customerID string, paymentMethodID string) error {
+	return ecomm.SetDefaultPaymentMethod(customerID, paymentMethodID)
+}
+func (StripeBilling) RemovePaymentMethod(customerID string, paymentMethodID string) error {
+	return ecomm.RemovePaymentMethod(customerID, paymentMethodID)
+}
+
+// billingProvider is the provider used when the Lgc has no Billing.
+var billingProvider BillingProvider = StripeBilling{}
+
+// SetBillingProvider replaces the provider used by the ecomm logic when the
+// Lgc has no Billing. This is called when the API starts
+// (setup.ConfigureLogic), so the test context never calls Stripe.
+func SetBillingProvider(p BillingProvider) {
+	billingProvider = p
+}
+
+// billing returns the provider used by the ecomm logic, which is the
+// Billing of the Lgc, or the provider set by SetBillingProvider.
+func (lc Lgc) billing() BillingProvider {
+	if lc.Billing != nil {
+		return lc.Billing
+	}
+	return billingProvider
+}
@@ -0,0 +1,30 @@
+package logic
+
+import (
+	"time"
+)
+
+// The kinds of events recorded in the billing_events table.
+const (
+	billingEventCancelled   = "subscription.cancelled"
+	billingEventReactivated = "subscription.reactivated"
+)
+
+// BillingEvent is a change to the billing of a user, recorded so support
+// can see what a user did and when.
+type BillingEvent struct {
+	ID         int    `db:"id"`
+	UserID     string `db:"user_id"`
+	CustomerID string `db:"s_customer_id"`
+	Kind       string `db:"kind"`
+	Body       string `db:"body"`
+	Created    string `db:"created"`
+}
+
+// logBillingEvent records a billing event for the user.
+func logBillingEvent(db DataCaller, userID string, customerID string, kind string, body string) error {
+	q := `INSERT INTO billing_events (user_id, s_customer_id, kind, body, created)
+          VALUES (?,?,?,?,?);`
+	_, err := db.Exec(q, userID, customerID, kind, body, time.Now())
+	return err
+}
@@ -0,0 +1,853 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"pleasesign/ecomm"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Card tokens understood by MemBilling, which mirror the Stripe test tokens.
+const (
+	// MemTokenDeclined creates a card that declines every charge.
+	MemTokenDeclined = "tok_chargeDeclined"
+	// MemTokenAuthRequired creates a card that must be authenticated (3-D
+	// Secure) before it is saved by AddPaymentMethod.
+	MemTokenAuthRequired = "tok_threeDSecure2Required"
+)
+
+// The layout of the dates returned by the providers.
+const billingDate = "2006-01-02 15:04:05"
+
+type memCard struct {
+	ID, LastFour, Brand, ExMon, ExYr string
+	Declines                         bool
+}
+
+type memCustomer struct {
+	ID       string
+	Email    string
+	Card     *memCard            // The default card.
+	Cards    []*memCard          // Every saved card, including the default card.
+	Setups   map[string]*memCard // Cards awaiting authentication, by id.
+	Sub      *ecomm.Sub
+	Discount *ecomm.Discount
+	Pending  int64  // Prorations to be invoiced, in cents.
+	Usage    int64  // Metered usage reported in the current period.
+	Currency string // The lower case currency the customer is billed in.
+	Tax      *ecomm.TaxInp
+	Balance  int64            // Credit applied to the following invoices, in cents.
+	Refunded map[string]int64 // The amount refunded or credited by invoice id.
+	Invoices []ecomm.Invoice
+}
+
+/*
+  MemBilling is a BillingProvider that holds the customers, subscriptions,
+  invoices and webhook events in memory. Every change records the events
+  Stripe would send, which can be passed to EcommHook with Events. Charges
+  succeed unless the card was created with MemTokenDeclined, or the card
+  has been set to decline with SetDeclines.
+*/
+type MemBilling struct {
+	mu        sync.Mutex
+	Now       func() time.Time // The clock used for periods, replaceable by tests.
+	prices    map[string]int64
+	usage     map[string]int64
+	reported  map[string]bool
+	customers map[string]*memCustomer
+	coupons   map[string]ecomm.Coupon
+	events    []ecomm.HookEvent
+	seq       int
+}
+
+// NewMemBilling returns an empty MemBilling with every plan priced at 0.
+func NewMemBilling() *MemBilling {
+	return &MemBilling{
+		Now:       time.Now,
+		prices:    map[string]int64{},
+		usage:     map[string]int64{},
+		reported:  map[string]bool{},
+		customers: map[string]*memCustomer{},
+		coupons:   map[string]ecomm.Coupon{},
+	}
+}
+
+// SetPrice sets the price of the plan (per seat) in cents.
+func (m *MemBilling) SetPrice(plan string, cents int64) {
+	m.mu.Lock()
+	m.prices[plan] = cents
+	m.mu.Unlock()
+}
+
+// SetUsagePrice sets the metered price of the plan in cents, which is
+// charged for each unit of usage reported in a period.
+func (m *MemBilling) SetUsagePrice(plan string, cents int64) {
+	m.mu.Lock()
+	m.usage[plan] = cents
+	m.mu.Unlock()
+}
+
+// Usage returns the usage reported for the customer in the current period.
+func (m *MemBilling) Usage(customerID string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return 0
+	}
+	return c.Usage
+}
+
+// AddCoupon makes the coupon available to GetCoupon and ApplyCoupon.
+func (m *MemBilling) AddCoupon(c ecomm.Coupon) {
+	m.mu.Lock()
+	m.coupons[c.ID] = c
+	m.mu.Unlock()
+}
+
+// SetDeclines sets whether the card of the customer declines charges.
+func (m *MemBilling) SetDeclines(customerID string, declines bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if c.Card == nil {
+		return errors.New("The customer does not have a card.")
+	}
+	c.Card.Declines = declines
+	return nil
+}
+
+// Events returns every event recorded for the customer, oldest first.
+func (m *MemBilling) Events(customerID string) []ecomm.HookEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []ecomm.HookEvent
+	for _, ev := range m.events {
+		if ev.CustomerID == customerID {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+/*
+  Renew moves the subscription of the customer into its next billing
+  period, as Stripe does when the period ends. The usage reported in the
+  period is billed with the subscription. A subscription set to cancel at
+  the end of the period is deleted instead.
+*/
+func (m *MemBilling) Renew(customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if c.Sub == nil {
+		return errors.New("The customer does not have a subscription.")
+	}
+	if c.Sub.CancelAtPeriodEnd {
+		c.Sub = nil
+		m.event(c.ID, "customer.subscription.deleted", "", 0)
+		return nil
+	}
+
+	end, err := time.Parse(billingDate, c.Sub.CurEnd)
+	if err != nil {
+		return err
+	}
+	c.Sub.CurEnd = memPeriodEnd(end, c.Sub.Plan)
+	m.invoice(c, m.prices[c.Sub.Plan]*c.Sub.Quantity, "Subscription to "+c.Sub.Plan)
+	if c.Usage > 0 {
+		// The usage is invoiced separately, as an invoice has a single line.
+		m.invoice(c, m.usage[c.Sub.Plan]*c.Usage, fmt.Sprintf("%d x metered usage of %v", c.Usage, c.Sub.Plan))
+		c.Usage = 0
+	}
+	return nil
+}
+
+func (m *MemBilling) CreateCustomer(in ecomm.CreateCusInp) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	card, err := memParseToken(in.Token)
+	if err != nil {
+		return "", "", err
+	}
+	c := m.newCustomer(in.Email, card)
+	if in.Currency != "" {
+		c.Currency = strings.ToLower(in.Currency)
+	}
+	c.Tax = in.Tax
+	if in.Coupon != "" {
+		if err := m.applyCoupon(c, in.Coupon); err != nil {
+			delete(m.customers, c.ID)
+			return "", "", err
+		}
+	}
+	c.Sub = &ecomm.Sub{
+		CurEnd:   memPeriodEnd(m.Now(), in.Plan),
+		Plan:     in.Plan,
+		Quantity: 1,
+	}
+	m.event(c.ID, "customer.subscription.created", "", 0)
+
+	// Stripe does not create the customer when the first payment fails.
+	inv := m.invoice(c, m.prices[in.Plan], "Subscription to "+in.Plan)
+	if !inv.Paid {
+		delete(m.customers, c.ID)
+		return "", "", errors.New("Your card was declined.")
+	}
+	return c.ID, c.Sub.CurEnd, nil
+}
+
+func (m *MemBilling) CreateTrialCustomer(email string, token string, plan string, trialEnd time.Time) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	card, err := memParseToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	c := m.newCustomer(email, card)
+	c.Sub = &ecomm.Sub{CurEnd: trialEnd.Format(billingDate), Plan: plan, Quantity: 1}
+	m.event(c.ID, "customer.subscription.created", "", 0)
+	return c.ID, c.Sub.CurEnd, nil
+}
+
+func (m *MemBilling) UpdateCustomerInfo(in ecomm.UpdateCusInp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(in.CustomerID)
+	if err != nil {
+		return err
+	}
+	card, err := memParseToken(in.Token)
+	if err != nil {
+		return err
+	}
+	// The new card replaces the default card.
+	if c.Card != nil {
+		m.removeCard(c, c.Card.ID)
+	}
+	m.saveCard(c, card)
+	c.Card = card
+	m.event(c.ID, "customer.updated", "", 0)
+	m.retry(c)
+	return nil
+}
+
+func (m *MemBilling) GetSub(customerID string) (*ecomm.Sub, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The subscription is returned along with the card and discount, as
+	// the ecomm package does.
+	out := &ecomm.Sub{}
+	if c.Sub != nil {
+		*out = *c.Sub
+	}
+	if c.Card != nil {
+		out.LastFour = c.Card.LastFour
+		out.Brand = c.Card.Brand
+		out.ExMon = c.Card.ExMon
+		out.ExYr = c.Card.ExYr
+	}
+	out.Discount = c.Discount
+	return out, nil
+}
+
+func (m *MemBilling) UpdateSub(customerID string, plan string, pro bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return "", err
+	}
+	if c.Sub == nil {
+		// The ecomm package creates a new subscription for customers
+		// without an active subscription.
+		c.Sub = &ecomm.Sub{CurEnd: memPeriodEnd(m.Now(), plan), Quantity: 1}
+	}
+	if pro {
+		c.Pending += (m.prices[plan] - m.prices[c.Sub.Plan]) * c.Sub.Quantity
+	}
+	// As with Stripe, a change of billing interval starts a new period now.
+	if memInterval(plan) != memInterval(c.Sub.Plan) {
+		c.Sub.CurEnd = memPeriodEnd(m.Now(), plan)
+	}
+	c.Sub.Plan = plan
+	c.Sub.CancelAtPeriodEnd = false
+	m.event(c.ID, "customer.subscription.updated", "", 0)
+	return c.Sub.CurEnd, nil
+}
+
+func (m *MemBilling) PreviewSub(customerID string, plan string, pro bool) (*ecomm.Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	sub := ecomm.Sub{CurEnd: memPeriodEnd(m.Now(), plan), Quantity: 1}
+	if c.Sub != nil {
+		sub = *c.Sub
+	}
+
+	inv := &ecomm.Invoice{Date: sub.CurEnd}
+	if pro {
+		inv.Lines = append(inv.Lines, ecomm.InvoiceLine{
+			Amount:      (m.prices[plan] - m.prices[sub.Plan]) * sub.Quantity,
+			Proration:   true,
+			Description: "Remaining time on " + plan,
+			Plan:        plan,
+		})
+	}
+	inv.Lines = append(inv.Lines, ecomm.InvoiceLine{
+		Amount:      m.prices[plan] * sub.Quantity,
+		Description: "Subscription to " + plan,
+		Plan:        plan,
+	})
+	for _, li := range inv.Lines {
+		inv.Total += li.Amount
+	}
+	inv.Amount = inv.Total
+	return inv, nil
+}
+
+func (m *MemBilling) UpdateQuantity(customerID string, quantity int64, pro bool) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return "", err
+	}
+	if c.Sub == nil {
+		return "", errors.New("The customer does not have a subscription.")
+	}
+	if pro && quantity > c.Sub.Quantity {
+		c.Pending += m.prices[c.Sub.Plan] * (quantity - c.Sub.Quantity)
+	}
+	c.Sub.Quantity = quantity
+	m.event(c.ID, "customer.subscription.updated", "", 0)
+	return c.Sub.CurEnd, nil
+}
+
+func (m *MemBilling) CancelSub(customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if c.Sub == nil {
+		return errors.New("The customer does not have a subscription.")
+	}
+	c.Sub.CancelAtPeriodEnd = true
+	m.event(c.ID, "customer.subscription.updated", "", 0)
+	return nil
+}
+
+func (m *MemBilling) ReactivateSub(customerID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return "", err
+	}
+	if c.Sub == nil || !c.Sub.CancelAtPeriodEnd {
+		return "", errors.New("The subscription is not set to cancel.")
+	}
+	c.Sub.CancelAtPeriodEnd = false
+	m.event(c.ID, "customer.subscription.updated", "", 0)
+	return c.Sub.CurEnd, nil
+}
+
+func (m *MemBilling) CancelSubNow(customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if c.Sub == nil {
+		return errors.New("The customer does not have a subscription.")
+	}
+	c.Sub = nil
+	m.event(c.ID, "customer.subscription.deleted", "", 0)
+	return nil
+}
+
+func (m *MemBilling) InvoiceCustomer(customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	// Plans are priced at 0 unless set, so there may be nothing to invoice.
+	if c.Pending <= 0 {
+		return nil
+	}
+	amount := c.Pending
+	c.Pending = 0
+	m.invoice(c, amount, "Remaining time on "+c.Sub.Plan)
+	return nil
+}
+
+func (m *MemBilling) RetryPayment(customerID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if !m.retry(c) {
+		return errors.New("Your card was declined.")
+	}
+	return nil
+}
+
+func (m *MemBilling) GetCustomerInvoices(customerID string) ([]ecomm.Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ecomm.Invoice, len(c.Invoices))
+	copy(out, c.Invoices)
+	return out, nil
+}
+
+func (m *MemBilling) GetHookEvent(eventID string) (*ecomm.HookEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ev := range m.events {
+		if ev.ID == eventID {
+			out := ev
+			return &out, nil
+		}
+	}
+	return nil, errors.New("No such event: " + eventID)
+}
+
+func (m *MemBilling) GetCoupon(code string) (*ecomm.Coupon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.coupons[code]
+	if !ok {
+		return nil, errors.New("No such coupon: " + code)
+	}
+	return &c, nil
+}
+
+func (m *MemBilling) ApplyCoupon(customerID string, code string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	return m.applyCoupon(c, code)
+}
+
+func (m *MemBilling) ReportUsage(customerID string, quantity int64, at time.Time, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if c.Sub == nil {
+		return errors.New("The customer does not have a subscription.")
+	}
+	if m.reported[key] {
+		return nil
+	}
+	m.reported[key] = true
+	c.Usage += quantity
+	return nil
+}
+
+func (m *MemBilling) UpdateTax(customerID string, in ecomm.TaxInp) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	c.Tax = &in
+	m.event(c.ID, "customer.updated", "", 0)
+	return nil
+}
+
+func (m *MemBilling) RefundInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, inv, err := m.refundable(customerID, invoiceID, amount)
+	if err != nil {
+		return "", err
+	}
+	if !inv.Paid || amount > inv.Amount-c.Refunded[invoiceID] {
+		return "", errors.New("The amount is more than was paid.")
+	}
+	c.Refunded[invoiceID] += amount
+	m.seq++
+	id := fmt.Sprintf("re_mem%d", m.seq)
+	// Stripe sends the total refunded from the charge.
+	m.event(c.ID, "charge.refunded", invoiceID, c.Refunded[invoiceID])
+	return id, nil
+}
+
+func (m *MemBilling) CreditInvoice(customerID string, invoiceID string, amount int64, reason string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, _, err := m.refundable(customerID, invoiceID, amount)
+	if err != nil {
+		return "", err
+	}
+	c.Refunded[invoiceID] += amount
+	c.Balance += amount
+	m.seq++
+	id := fmt.Sprintf("cn_mem%d", m.seq)
+	m.event(c.ID, "credit_note.created", invoiceID, amount)
+	return id, nil
+}
+
+func (m *MemBilling) ListPaymentMethods(customerID string) ([]ecomm.PaymentMethod, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	var out []ecomm.PaymentMethod
+	for _, card := range c.Cards {
+		out = append(out, ecomm.PaymentMethod{
+			ID:       card.ID,
+			Brand:    card.Brand,
+			LastFour: card.LastFour,
+			ExMon:    card.ExMon,
+			ExYr:     card.ExYr,
+			Default:  card == c.Card,
+		})
+	}
+	return out, nil
+}
+
+func (m *MemBilling) AddPaymentMethod(customerID string, token string) (*ecomm.PaymentSetup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, err
+	}
+	card, err := memParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ecomm.PaymentSetup{Status: setupSucceeded}
+	if token == MemTokenAuthRequired {
+		// The card is held until ConfirmSetup is called, as the front end
+		// does with the client secret.
+		m.seq++
+		card.ID = fmt.Sprintf("pm_mem%d", m.seq)
+		if c.Setups == nil {
+			c.Setups = map[string]*memCard{}
+		}
+		c.Setups[card.ID] = card
+		out.Status = setupRequiresAction
+		out.ClientSecret = fmt.Sprintf("seti_mem%d_secret", m.seq)
+	} else {
+		m.saveCard(c, card)
+	}
+	out.PaymentMethod = ecomm.PaymentMethod{
+		ID:       card.ID,
+		Brand:    card.Brand,
+		LastFour: card.LastFour,
+		ExMon:    card.ExMon,
+		ExYr:     card.ExYr,
+	}
+	return out, nil
+}
+
+// ConfirmSetup saves a card returned by AddPaymentMethod with the status
+// requires_action, as Stripe does once the card has been authenticated.
+func (m *MemBilling) ConfirmSetup(customerID string, paymentMethodID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	card, ok := c.Setups[paymentMethodID]
+	if !ok {
+		return errors.New("No such setup: " + paymentMethodID)
+	}
+	delete(c.Setups, paymentMethodID)
+	c.Cards = append(c.Cards, card)
+	return nil
+}
+
+func (m *MemBilling) SetDefaultPaymentMethod(customerID string, paymentMethodID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	for _, card := range c.Cards {
+		if card.ID == paymentMethodID {
+			c.Card = card
+			m.event(c.ID, "customer.updated", "", 0)
+			return nil
+		}
+	}
+	return errors.New("No such payment method: " + paymentMethodID)
+}
+
+func (m *MemBilling) RemovePaymentMethod(customerID string, paymentMethodID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, err := m.customer(customerID)
+	if err != nil {
+		return err
+	}
+	if !m.removeCard(c, paymentMethodID) {
+		return errors.New("No such payment method: " + paymentMethodID)
+	}
+	if c.Card != nil && c.Card.ID == paymentMethodID {
+		c.Card = nil
+	}
+	return nil
+}
+
+// The functions below expect the lock to be held.
+
+// saveCard gives the card an id and saves it against the customer.
+func (m *MemBilling) saveCard(c *memCustomer, card *memCard) {
+	m.seq++
+	card.ID = fmt.Sprintf("pm_mem%d", m.seq)
+	c.Cards = append(c.Cards, card)
+}
+
+// removeCard removes the saved card, returning false if it does not exist.
+func (m *MemBilling) removeCard(c *memCustomer, id string) bool {
+	for i, card := range c.Cards {
+		if card.ID == id {
+			c.Cards = append(c.Cards[:i], c.Cards[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// refundable returns the invoice of the customer if the amount can be
+// refunded or credited against it.
+func (m *MemBilling) refundable(customerID string, invoiceID string, amount int64) (*memCustomer, ecomm.Invoice, error) {
+	c, err := m.customer(customerID)
+	if err != nil {
+		return nil, ecomm.Invoice{}, err
+	}
+	for _, inv := range c.Invoices {
+		if inv.ID != invoiceID {
+			continue
+		}
+		if amount <= 0 || amount > inv.Total-c.Refunded[invoiceID] {
+			return nil, inv, errors.New("The amount is more than the invoice total.")
+		}
+		if c.Refunded == nil {
+			c.Refunded = map[string]int64{}
+		}
+		return c, inv, nil
+	}
+	return nil, ecomm.Invoice{}, errors.New("No such invoice: " + invoiceID)
+}
+
+func (m *MemBilling) customer(customerID string) (*memCustomer, error) {
+	c, ok := m.customers[customerID]
+	if !ok {
+		return nil, errors.New("No such customer: " + customerID)
+	}
+	return c, nil
+}
+
+func (m *MemBilling) newCustomer(email string, card *memCard) *memCustomer {
+	m.seq++
+	c := &memCustomer{ID: fmt.Sprintf("cus_mem%d", m.seq), Email: email, Card: card, Currency: "aud"}
+	if card != nil {
+		m.saveCard(c, card)
+	}
+	m.customers[c.ID] = c
+	m.event(c.ID, "customer.created", "", 0)
+	return c
+}
+
+func (m *MemBilling) applyCoupon(c *memCustomer, code string) error {
+	cp, ok := m.coupons[code]
+	if !ok {
+		return errors.New("No such coupon: " + code)
+	}
+	if !cp.Valid {
+		return errors.New("Coupon expired: " + code)
+	}
+	d := &ecomm.Discount{Coupon: cp, Start: m.Now().Format(billingDate)}
+	if cp.Duration == "repeating" {
+		d.End = m.Now().AddDate(0, int(cp.DurationInMonths), 0).Format(billingDate)
+	}
+	c.Discount = d
+	return nil
+}
+
+// event records a webhook event for the customer.
+func (m *MemBilling) event(customerID string, kind string, invoice string, amount int64) ecomm.HookEvent {
+	m.seq++
+	ev := ecomm.HookEvent{
+		ID:         fmt.Sprintf("evt_mem%d", m.seq),
+		Created:    m.Now().Format(billingDate),
+		CustomerID: customerID,
+		Kind:       kind,
+		Invoice:    invoice,
+		Amount:     amount,
+	}
+	m.events = append(m.events, ev)
+	return ev
+}
+
+// invoice creates an invoice for the amount, less any discount, and charges
+// the card of the customer. Tax is calculated on the discounted amount, and
+// added to the total unless the tax is included in the price.
+func (m *MemBilling) invoice(c *memCustomer, amount int64, desc string) ecomm.Invoice {
+	m.seq++
+	inv := ecomm.Invoice{
+		ID:       fmt.Sprintf("in_mem%d", m.seq),
+		Total:    amount,
+		Date:     m.Now().Format(billingDate),
+		Currency: c.Currency,
+		Lines: []ecomm.InvoiceLine{{
+			ID:          fmt.Sprintf("ii_mem%d", m.seq),
+			Amount:      amount,
+			Description: desc,
+		}},
+	}
+	if c.Sub != nil {
+		inv.Lines[0].Plan = c.Sub.Plan
+	}
+
+	if d := c.Discount; d != nil {
+		off := d.Coupon.AmountOff
+		if d.Coupon.PercentOff > 0 {
+			off = int64(float64(amount) * d.Coupon.PercentOff / 100)
+		}
+		if off > amount {
+			off = amount
+		}
+		inv.Discount = d
+		inv.DiscountAmount = off
+		inv.Total = amount - off
+		if d.Coupon.Duration == "once" {
+			c.Discount = nil
+		}
+	}
+	if t := c.Tax; t != nil && t.Percent > 0 {
+		tax := taxComponent(inv.Total, t.Percent, t.Inclusive)
+		if !t.Inclusive {
+			inv.Total += tax
+		}
+		inv.TaxAmounts = append(inv.TaxAmounts, ecomm.TaxAmount{
+			Name:      t.Name,
+			Percent:   t.Percent,
+			Inclusive: t.Inclusive,
+			Amount:    tax,
+		})
+	}
+	inv.Amount = inv.Total
+
+	// Credit on the balance of the customer is applied to the amount due.
+	if c.Balance > 0 {
+		applied := c.Balance
+		if applied > inv.Amount {
+			applied = inv.Amount
+		}
+		inv.Amount -= applied
+		c.Balance -= applied
+	}
+
+	inv.Paid = m.charge(c, inv)
+	c.Invoices = append([]ecomm.Invoice{inv}, c.Invoices...)
+	return inv
+}
+
+// charge attempts to pay the amount due on the invoice, recording the
+// events Stripe sends.
+func (m *MemBilling) charge(c *memCustomer, inv ecomm.Invoice) bool {
+	if inv.Amount == 0 {
+		m.event(c.ID, "invoice.payment_succeeded", inv.ID, 0)
+		return true
+	}
+	if c.Card == nil || c.Card.Declines {
+		ev := m.event(c.ID, "charge.failed", inv.ID, inv.Amount)
+		ev.FailureCode, ev.FailureMessage = "card_declined", "Your card was declined."
+		m.events[len(m.events)-1] = ev
+		ev = m.event(c.ID, "invoice.payment_failed", inv.ID, inv.Amount)
+		ev.FailureCode, ev.FailureMessage = "card_declined", "Your card was declined."
+		m.events[len(m.events)-1] = ev
+		return false
+	}
+	m.event(c.ID, "charge.succeeded", inv.ID, inv.Amount)
+	m.event(c.ID, "invoice.payment_succeeded", inv.ID, inv.Amount)
+	return true
+}
+
+// retry attempts to pay every unpaid invoice, returning true if none remain.
+func (m *MemBilling) retry(c *memCustomer) bool {
+	ok := true
+	for i := range c.Invoices {
+		if c.Invoices[i].Paid {
+			continue
+		}
+		if m.charge(c, c.Invoices[i]) {
+			c.Invoices[i].Paid = true
+		} else {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// memInterval returns the billing interval of the plan in the plan catalog.
+func memInterval(plan string) string {
+	p, _ := planCatalog.ByID(plan)
+	return p.BillingInterval()
+}
+
+// memPeriodEnd returns the end of a period of the plan starting at from.
+func memPeriodEnd(from time.Time, plan string) string {
+	if memInterval(plan) == IntervalYear {
+		return from.AddDate(1, 0, 0).Format(billingDate)
+	}
+	return from.AddDate(0, 1, 0).Format(billingDate)
+}
+
+// memParseToken returns the card for a token.
+func memParseToken(token string) (*memCard, error) {
+	if token == "" {
+		return nil, errors.New("A card is required.")
+	}
+	return &memCard{
+		LastFour: "4242",
+		Brand:    "Visa",
+		ExMon:    "12",
+		ExYr:     fmt.Sprint(time.Now().Year() + 3),
+		Declines: token == MemTokenDeclined,
+	}, nil
+}
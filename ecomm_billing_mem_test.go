@@ -0,0 +1,169 @@
+package logic
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"pleasesign/ecomm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test the EcommGetCustomerSub function returns the subscription and card
+// held by the billing provider.
+func TestEcommGetCustomerSubMem(t *testing.T) {
+	mem := NewMemBilling()
+	cID, cpe, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			if uq, ok := dest.(*usageQuota); ok {
+				*uq = usageQuota{Quota: 10, Kind: "2", CID: cID}
+				return nil
+			}
+			// The user and the usage counts are selected into types local
+			// to the functions, so the fields are set by name.
+			d := reflect.ValueOf(dest).Elem()
+			if d.FieldByName("CID").Kind() == reflect.Invalid {
+				return nil
+			}
+			d.FieldByName("CID").Set(reflect.ValueOf(sql.NullString{String: cID, Valid: true}))
+			d.FieldByName("NextKind").Set(reflect.ValueOf(sql.NullString{String: "2", Valid: true}))
+			d.FieldByName("Kind").SetString("2")
+			return nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	sub, err := lc.EcommGetCustomerSub(db, ls)
+	if err != nil {
+		t.Fatalf("EcommGetCustomerSub returned an error, got %v.", err)
+	}
+	if sub.CurEnd != cpe || sub.LastFour != "4242" || sub.Trans || !sub.PayingCustomer {
+		t.Errorf("EcommGetCustomerSub did not return the subscription, got %+v.", sub)
+	}
+}
+
+// Test the EcommHook function actions an event from the billing provider
+// once, updating the current_period_end of the user.
+func TestEcommHookMem(t *testing.T) {
+	mem := NewMemBilling()
+	cID, cpe, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evID string
+	for _, ev := range mem.Events(cID) {
+		if ev.Kind == "invoice.payment_succeeded" {
+			evID = ev.ID
+		}
+	}
+	if evID == "" {
+		t.Fatal("MemBilling did not record the payment.")
+	}
+
+	claimed := false
+	var period interface{}
+	var outcome interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *hookUser:
+				if args[0] != cID {
+					t.Errorf("EcommHook looked up the wrong customer, got %v.", args[0])
+				}
+				*d = hookUser{ID: "1", Kind: "2", NextKind: "2"}
+			case *sql.NullInt64:
+				return sql.ErrNoRows
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			switch {
+			case q == `UPDATE user SET current_period_end = ? WHERE id = ?;`:
+				period = args[0]
+			case q == `UPDATE ecomm_events SET outcome = ?, error = ?, processed = ? WHERE event_id = ?;`:
+				claimed = true
+				outcome = args[0]
+			case strings.HasPrefix(q, "INSERT IGNORE INTO ecomm_events") && !claimed:
+				return driver.RowsAffected(1), nil
+			}
+			return driver.RowsAffected(0), nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	lc.EcommHook(db, evID)
+	if outcome != ecommEventProcessed {
+		t.Errorf("EcommHook did not process the event, got %v.", outcome)
+	}
+	if period != cpe {
+		t.Errorf("EcommHook did not update the current_period_end, got %v wanted %v.", period, cpe)
+	}
+
+	// The event has been processed, so a second delivery is ignored.
+	period = nil
+	lc.EcommHook(db, evID)
+	if period != nil {
+		t.Error("EcommHook actioned the event twice.")
+	}
+}
+
+// Test MemBilling charges and retries a declined card as Stripe would.
+func TestMemBillingDeclined(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("101", 1500)
+	mem.SetPrice("102", 3000)
+	if _, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Token: MemTokenDeclined, Plan: "101"}); err == nil {
+		t.Error("MemBilling created a customer with a declined card.")
+	}
+
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Token: "tok", Plan: "101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.SetDeclines(cID, true)
+	if err := mem.Renew(cID); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.RetryPayment(cID); err == nil {
+		t.Error("MemBilling retried a declined card successfully.")
+	}
+
+	// Updating the card retries the failed invoice.
+	if err := mem.UpdateCustomerInfo(ecomm.UpdateCusInp{CustomerID: cID, Token: "tok"}); err != nil {
+		t.Fatal(err)
+	}
+	inv, _ := mem.GetCustomerInvoices(cID)
+	if len(inv) != 2 || !inv[0].Paid {
+		t.Errorf("MemBilling did not pay the failed invoice, got %+v.", inv)
+	}
+
+	// Upgrading is prorated and invoiced.
+	if _, err := mem.UpdateSub(cID, "102", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.InvoiceCustomer(cID); err != nil {
+		t.Fatal(err)
+	}
+	inv, _ = mem.GetCustomerInvoices(cID)
+	if inv[0].Total != 1500 {
+		t.Errorf("MemBilling did not prorate the upgrade, got %v.", inv[0].Total)
+	}
+
+	// Cancelling ends the subscription when it renews.
+	mem.CancelSub(cID)
+	mem.Renew(cID)
+	ev := mem.Events(cID)
+	if ev[len(ev)-1].Kind != "customer.subscription.deleted" {
+		t.Errorf("MemBilling did not delete the cancelled subscription, got %v.", ev[len(ev)-1].Kind)
+	}
+}
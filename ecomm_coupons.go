@@ -0,0 +1,141 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"pleasesign/ecomm"
+	"strings"
+)
+
+// The input for the EcommNewCustomer and EcommUpdateCustomerSub functions.
+// This input is intended to be expanded upon.
+type EcommSubInput struct {
+	Coupon  string // A coupon or promotion code to apply, if any.
+	Country string // The billing country, which determines the currency and tax.
+	TaxID   string // The ABN, GST or VAT number of a business customer, if any.
+}
+
+// coupon returns the trimmed coupon of the input, which may be nil.
+func (in *EcommSubInput) coupon() string {
+	if in == nil {
+		return ""
+	}
+	return strings.TrimSpace(in.Coupon)
+}
+
+// currency returns the currency for the billing country of the input,
+// which may be nil.
+func (in *EcommSubInput) currency() string {
+	if in == nil {
+		return defaultCurrency
+	}
+	return currencyForCountry(in.Country)
+}
+
+// taxID returns the trimmed tax id of the input, which may be nil.
+func (in *EcommSubInput) taxID() string {
+	if in == nil {
+		return ""
+	}
+	return strings.TrimSpace(in.TaxID)
+}
+
+// The output for the EcommValidateCoupon function.
+type EcommCoupon struct {
+	Code             string
+	Name             string
+	PercentOff       float64
+	AmountOff        int64  // The amount off in cents, if not a percentage.
+	Currency         string // The currency of the amount off.
+	Duration         string // once, repeating or forever.
+	DurationInMonths int64
+	RedeemBy         string
+	Valid            bool
+	Plans            []string // The plan ids the coupon is limited to, if any.
+}
+
+// The active discount on a subscription, returned by EcommGetCustomerSub.
+type EcommDiscount struct {
+	Code       string
+	Name       string
+	PercentOff float64
+	AmountOff  int64
+	End        string // When the discount ends, empty if it does not end.
+}
+
+// Describe returns a friendly description of the discount, eg. "20% off".
+func (c EcommCoupon) Describe() string {
+	if c.PercentOff > 0 {
+		return fmt.Sprintf("%v%% off", c.PercentOff)
+	}
+	return formatMoney(c.AmountOff, c.Currency) + " off"
+}
+
+// checkCoupon returns a friendly error if the coupon cannot be applied to the
+// plan.
+func checkCoupon(c *EcommCoupon, plan string) error {
+	if !c.Valid {
+		return errors.New("That coupon has expired.")
+	}
+	if len(c.Plans) == 0 {
+		return nil
+	}
+	for _, p := range c.Plans {
+		if p == plan {
+			return nil
+		}
+	}
+	return errors.New("That coupon cannot be used with this plan.")
+}
+
+/*
+  EcommValidateCoupon looks the code up with the ecomm package, and returns
+  the coupon if it can be applied to the plan. Codes may be a coupon id or a
+  promotion code. The front end uses this to show the discount before the
+  user subscribes.
+*/
+func (lc Lgc) EcommValidateCoupon(code string, plan string) (*EcommCoupon, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return nil, errors.New("Please enter a coupon code.")
+	}
+	c, err := lc.getCoupon(code)
+	if err != nil {
+		// The ecomm package returns an error for unknown codes.
+		return nil, errors.New("That coupon does not exist.")
+	}
+	if err := checkCoupon(c, plan); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// toEcommDiscount formats a discount from the ecomm package.
+func toEcommDiscount(d *ecomm.Discount) *EcommDiscount {
+	if d == nil {
+		return nil
+	}
+	return &EcommDiscount{
+		Code:       d.Coupon.ID,
+		Name:       d.Coupon.Name,
+		PercentOff: d.Coupon.PercentOff,
+		AmountOff:  d.Coupon.AmountOff,
+		End:        d.End,
+	}
+}
+
+// discountLine returns the line item rendered for the discount on an
+// invoice. The amount is negative, so the lines add up to the total.
+func discountLine(d *ecomm.Discount, amount int64) EcommLineItem {
+	c := EcommCoupon{PercentOff: d.Coupon.PercentOff, AmountOff: d.Coupon.AmountOff, Currency: d.Coupon.Currency}
+	desc := c.Describe()
+	if d.Coupon.Name != "" {
+		desc = d.Coupon.Name + " (" + desc + ")"
+	}
+	return EcommLineItem{
+		ID:          d.Coupon.ID,
+		Amount:      -amount,
+		Description: desc,
+		Discount:    true,
+	}
+}
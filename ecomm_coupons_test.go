@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"pleasesign/ecomm"
+	"testing"
+)
+
+// Test the checkCoupon function validates the coupon against the plan.
+func TestCheckCoupon(t *testing.T) {
+	c := &EcommCoupon{Code: "SALE", Valid: true}
+	if err := checkCoupon(c, "102"); err != nil {
+		t.Errorf("checkCoupon returned an error for a valid coupon, got %v.", err)
+	}
+
+	c.Plans = []string{"101"}
+	err := checkCoupon(c, "102")
+	if err == nil || err.Error() != "That coupon cannot be used with this plan." {
+		t.Errorf("checkCoupon is not validating the plan, got %v.", err)
+	}
+	if err := checkCoupon(c, "101"); err != nil {
+		t.Errorf("checkCoupon returned an error for the coupon plan, got %v.", err)
+	}
+
+	c.Valid = false
+	err = checkCoupon(c, "101")
+	if err == nil || err.Error() != "That coupon has expired." {
+		t.Errorf("checkCoupon is not validating the coupon has expired, got %v.", err)
+	}
+}
+
+// Test the discountLine function renders the discount as a negative line.
+func TestDiscountLine(t *testing.T) {
+	d := &ecomm.Discount{Coupon: ecomm.Coupon{ID: "SALE", Name: "Spring sale", PercentOff: 20}}
+	li := discountLine(d, 500)
+	if li.Amount != -500 || !li.Discount {
+		t.Errorf("discountLine did not render a discount, got %+v.", li)
+	}
+	if li.Description != "Spring sale (20% off)" {
+		t.Errorf("discountLine got description %v.", li.Description)
+	}
+
+	// An amount off is shown in the currency of the coupon.
+	d = &ecomm.Discount{Coupon: ecomm.Coupon{ID: "TENOFF", AmountOff: 1000}}
+	if li := discountLine(d, 1000); li.Description != "A$10.00 off" {
+		t.Errorf("discountLine got description %v.", li.Description)
+	}
+	d.Coupon.Currency = "nzd"
+	if li := discountLine(d, 1000); li.Description != "NZ$10.00 off" {
+		t.Errorf("discountLine got description %v.", li.Description)
+	}
+}
+
+// Test the EcommNewCustomer function creates the customer with the coupon,
+// rather than through the LogicStore, when a coupon is provided.
+func TestEcommNewCustomerCoupon(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("102", 3000)
+	mem.AddCoupon(ecomm.Coupon{ID: "SALE", PercentOff: 20, Duration: "forever", Valid: true})
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		createCustomerMock: func(a, b, c string) (string, string, error) {
+			t.Error("EcommNewCustomer did not create the customer with the coupon.")
+			return "", "", nil
+		},
+	}
+	var cID interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*string) = "a@b.com"
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if cID == nil {
+				cID = args[0]
+			}
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	err := lc.EcommNewCustomer(db, ls, "123ABC", "102", &EcommSubInput{Coupon: " SALE "})
+	if err != nil {
+		t.Errorf("EcommNewCustomer returned an error, got %v.", err)
+	}
+	id, _ := cID.(string)
+	inv, err := mem.GetCustomerInvoices(id)
+	if err != nil || len(inv) != 1 {
+		t.Fatalf("EcommNewCustomer did not save the customer, got %v %v.", cID, err)
+	}
+	if inv[0].Total != 2400 || inv[0].DiscountAmount != 600 {
+		t.Errorf("EcommNewCustomer did not apply the coupon, got %+v.", inv[0])
+	}
+
+	// An unknown coupon is rejected before the customer is created.
+	cID = nil
+	err = lc.EcommNewCustomer(db, ls, "123ABC", "102", &EcommSubInput{Coupon: "NOPE"})
+	if err == nil || err.Error() != "That coupon does not exist." || cID != nil {
+		t.Errorf("EcommNewCustomer is not validating the coupon, got %v.", err)
+	}
+}
+
+// Test the EcommUpdateCustomerSub function only applies the coupon once the
+// plan change is saved.
+func TestEcommUpdateCoupon(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("101", 1500)
+	mem.SetPrice("102", 3000)
+	mem.AddCoupon(ecomm.Coupon{ID: "SALE", PercentOff: 20, Duration: "forever", Valid: true})
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		getPlanMock: func(string) string {
+			return "2"
+		},
+		invoiceCustomerMock: func(string) error {
+			return nil
+		},
+		updateSubMock: func(a, b string, c bool) (string, error) {
+			return mem.UpdateSub(a, b, c)
+		},
+		isProratedMock: func(string, string) bool {
+			return true
+		},
+	}
+	failed := true
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*ui) = ui{CID: sql.NullString{String: cID, Valid: true}, Kind: "1"}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if failed {
+				return nil, errors.New("write failed")
+			}
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	if err := lc.EcommUpdateCustomerSub(db, "102", ls, &EcommSubInput{Coupon: "SALE"}); err == nil {
+		t.Fatal("EcommUpdateCustomerSub did not return the failed write.")
+	}
+	if sub, _ := mem.GetSub(cID); sub.Discount != nil {
+		t.Errorf("EcommUpdateCustomerSub applied the coupon to a failed change, got %+v.", sub.Discount)
+	}
+
+	failed = false
+	if err := lc.EcommUpdateCustomerSub(db, "102", ls, &EcommSubInput{Coupon: "SALE"}); err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := mem.GetSub(cID); sub.Discount == nil || sub.Discount.Coupon.ID != "SALE" {
+		t.Errorf("EcommUpdateCustomerSub did not apply the coupon, got %+v.", sub.Discount)
+	}
+}
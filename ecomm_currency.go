@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The currencies plans can be priced in, as ISO 4217 codes.
+const (
+	CurrencyAUD = "AUD"
+	CurrencyNZD = "NZD"
+	CurrencyGBP = "GBP"
+	CurrencyUSD = "USD"
+)
+
+// defaultCurrency is the currency every plan is priced in. Customers in a
+// country without a currency of its own are billed in it.
+const defaultCurrency = CurrencyAUD
+
+// countryNames maps the other ways a billing country may be entered with
+// the card to its ISO 3166 code.
+var countryNames = map[string]string{
+	"AUS":            "AU",
+	"AUSTRALIA":      "AU",
+	"NZL":            "NZ",
+	"NEW ZEALAND":    "NZ",
+	"GBR":            "GB",
+	"UK":             "GB",
+	"UNITED KINGDOM": "GB",
+	"USA":            "US",
+	"UNITED STATES":  "US",
+}
+
+// countryCode returns the ISO 3166 code of the billing country.
+func countryCode(country string) string {
+	c := strings.ToUpper(strings.TrimSpace(country))
+	if code, ok := countryNames[c]; ok {
+		return code
+	}
+	return c
+}
+
+// countryCurrencies is the currency used for each billing country.
+var countryCurrencies = map[string]string{
+	"AU": CurrencyAUD,
+	"NZ": CurrencyNZD,
+	"GB": CurrencyGBP,
+	"US": CurrencyUSD,
+}
+
+// currencyFormats holds the symbol and name of each currency.
+var currencyFormats = map[string]struct{ symbol, name string }{
+	CurrencyAUD: {"A$", "Australian dollars"},
+	CurrencyNZD: {"NZ$", "New Zealand dollars"},
+	CurrencyGBP: {"£", "British pounds"},
+	CurrencyUSD: {"US$", "US dollars"},
+}
+
+// currencyForCountry returns the currency customers in the billing country
+// are billed in.
+func currencyForCountry(country string) string {
+	if c, ok := countryCurrencies[countryCode(country)]; ok {
+		return c
+	}
+	return defaultCurrency
+}
+
+// normCurrency returns the currency as an upper case code. The providers
+// return lower case codes, and an empty currency is the default currency.
+func normCurrency(currency string) string {
+	if currency == "" {
+		return defaultCurrency
+	}
+	return strings.ToUpper(currency)
+}
+
+// formatMoney formats an amount in cents with the symbol of the currency,
+// eg. NZ$12.50. Unknown currencies are prefixed with their code.
+func formatMoney(cents int64, currency string) string {
+	currency = normCurrency(currency)
+	symbol := currency + " "
+	if f, ok := currencyFormats[currency]; ok {
+		symbol = f.symbol
+	}
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%v%v%d.%02d", sign, symbol, cents/100, cents%100)
+}
+
+// currencyName returns the name of the currency, eg. New Zealand dollars.
+func currencyName(currency string) string {
+	currency = normCurrency(currency)
+	if f, ok := currencyFormats[currency]; ok {
+		return f.name
+	}
+	return currency
+}
+
+// checkPlanCurrency returns a friendly error if the plan is not priced in
+// the currency. Every plan is available in the default currency.
+func checkPlanCurrency(planID string, currency string) error {
+	if normCurrency(currency) == defaultCurrency {
+		return nil
+	}
+	if _, ok := planCatalog.Price(planID, normCurrency(currency)); !ok {
+		return errors.New("That plan is not available in your currency.")
+	}
+	return nil
+}
+
+// The output for the EcommGetPlans function.
+type EcommPlan struct {
+	ID        string
+	Name      string
+	Kind      int
+	Quota     int
+	Unmetered bool  // True if sending is not limited by the quota.
+	Price     int64 // The price in cents, 0 if the price is held by the provider.
+	Currency  string
+	Display   string // The price formatted in the currency, eg. NZ$25.00.
+	Interval  string // The billing interval, month or year.
+	Saving    int64  // For a yearly plan, the saving over paying monthly in cents.
+}
+
+/*
+  EcommGetPlans returns the paid plans available to customers in the billing
+  country, priced in the currency of that country. This is used by the plan
+  page before the user subscribes. Yearly plans include the saving over
+  twelve months of the monthly plan of the same tier, where both are priced.
+*/
+func (lc Lgc) EcommGetPlans(country string) []EcommPlan {
+	currency := currencyForCountry(country)
+	var out []EcommPlan
+	for _, p := range planCatalog.All() {
+		if !p.Paid() || checkPlanCurrency(p.ID, currency) != nil {
+			continue
+		}
+		kind, _ := strconv.Atoi(p.Kind)
+		ep := EcommPlan{
+			ID:        p.ID,
+			Name:      p.Name,
+			Kind:      kind,
+			Quota:     p.Quota,
+			Unmetered: p.Unmetered,
+			Currency:  currency,
+			Interval:  p.BillingInterval(),
+		}
+		if price, ok := planCatalog.Price(p.ID, currency); ok {
+			ep.Price = price
+			ep.Display = formatMoney(price, currency)
+		}
+		if m, ok := planCatalog.Variant(p.Kind, IntervalMonth); ok && ep.Interval == IntervalYear && ep.Price > 0 {
+			if monthly, ok := planCatalog.Price(m.ID, currency); ok && monthly*12 > ep.Price {
+				ep.Saving = monthly*12 - ep.Price
+			}
+		}
+		out = append(out, ep)
+	}
+	return out
+}
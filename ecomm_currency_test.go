@@ -0,0 +1,93 @@
+package logic
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// Test the currencyForCountry and formatMoney functions.
+func TestCurrencyFormat(t *testing.T) {
+	countries := map[string]string{
+		"AU":          CurrencyAUD,
+		"nz":          CurrencyNZD,
+		"New Zealand": CurrencyNZD,
+		"UK":          CurrencyGBP,
+		"US":          CurrencyUSD,
+		"DE":          defaultCurrency,
+		"":            defaultCurrency,
+	}
+	for in, want := range countries {
+		if got := currencyForCountry(in); got != want {
+			t.Errorf("currencyForCountry(%v) expected %v, got %v.", in, want, got)
+		}
+	}
+
+	amounts := []struct {
+		cents    int64
+		currency string
+		want     string
+	}{
+		{2500, "nzd", "NZ$25.00"},
+		{-1050, CurrencyGBP, "-£10.50"},
+		{99, "", "A$0.99"},
+		{100, "JPY", "JPY 1.00"},
+	}
+	for _, a := range amounts {
+		if got := formatMoney(a.cents, a.currency); got != a.want {
+			t.Errorf("formatMoney(%v, %v) expected %v, got %v.", a.cents, a.currency, a.want, got)
+		}
+	}
+}
+
+// Test the EcommNewCustomer function bills the customer in the currency of
+// their billing country, when the plan is priced in that currency.
+func TestEcommNewCustomerCurrency(t *testing.T) {
+	defer planCatalog.setPrices(nil)
+	mem := NewMemBilling()
+
+	var currency interface{}
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*string) = "a@b.com"
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if len(args) == 8 {
+				currency = args[4]
+			}
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	err := lc.EcommNewCustomer(db, ls, "tok", "102", &EcommSubInput{Country: "NZ"})
+	if err == nil || err.Error() != "That plan is not available in your currency." {
+		t.Errorf("EcommNewCustomer subscribed to a plan without a price, got %v.", err)
+	}
+
+	planCatalog.setPrices([]PlanPrice{{PlanID: "102", Currency: CurrencyNZD, Amount: 2900}})
+	if err := lc.EcommNewCustomer(db, ls, "tok", "102", &EcommSubInput{Country: "NZ"}); err != nil {
+		t.Fatalf("EcommNewCustomer returned an error, got %v.", err)
+	}
+	if currency != CurrencyNZD {
+		t.Errorf("EcommNewCustomer did not store the currency, got %v.", currency)
+	}
+
+	// The invoices of the customer are in their currency, with New Zealand
+	// GST added.
+	mem.SetPrice("102", 2900)
+	mem.Renew("cus_mem1")
+	invs, _ := mem.GetCustomerInvoices("cus_mem1")
+	if len(invs) == 0 {
+		t.Fatal("The customer was not invoiced.")
+	}
+	inv := toEcommInvoice(invs[0])
+	if inv.Currency != CurrencyNZD || inv.TotalDisplay != "NZ$33.35" {
+		t.Errorf("The invoice is not in the currency of the customer, got %+v.", inv)
+	}
+}
@@ -0,0 +1,303 @@
+package logic
+
+import (
+	"database/sql"
+	"fmt"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// billingEventDowngraded is recorded when the scheduler moves a user to
+// their next kind.
+const billingEventDowngraded = "subscription.downgraded"
+
+// The output for the EcommSchedule function, which is returned to the
+// caller of /ecomm_schedule.
+type EcommScheduleReport struct {
+	Due        int               // The users due to be downgraded.
+	Downgraded []EcommDowngrade  // The users that were downgraded.
+	Skipped    int               // Users downgraded by another instance, or no longer due.
+	Failed     map[string]string // The error for each user that failed, by user id.
+	// The error of each scheduler step that failed, by step. The other
+	// steps are still run.
+	Errors map[string]string
+}
+
+// EcommDowngrade is a single user downgraded by the scheduler.
+type EcommDowngrade struct {
+	UserID   string
+	FromKind string
+	ToKind   string
+	Interval string // The billing interval after the downgrade.
+	Members  int    // The group members deactivated, for a group owner.
+}
+
+// downgradeUser is the user locked while they are downgraded.
+type downgradeUser struct {
+	ID           string         `db:"id"`
+	Kind         string         `db:"kind"`
+	NextKind     string         `db:"next_kind"`
+	FirstName    string         `db:"first_name"`
+	Email        string         `db:"email"`
+	CID          sql.NullString `db:"s_customer_id"`
+	EnterpriseID sql.NullString `db:"enterprise_id"`
+	Interval     string         `db:"billing_interval"`
+	NextInterval string         `db:"next_interval"`
+}
+
+/*
+  ecommDowngrades moves every user whose downgrade_date has passed to their
+  next_kind and next_interval. This occurs when the user has downgraded,
+  cancelled their account or moved from a yearly plan to a monthly plan.
+  Each user is downgraded in their own transaction, so a failure only
+  affects that user, and the user row is locked so several API instances
+  running the scheduler at once cannot downgrade a user twice.
+*/
+func (lc Lgc) ecommDowngrades(db DataCaller, now time.Time) (*EcommScheduleReport, error) {
+	var ids []string
+	q := `SELECT id FROM user WHERE downgrade_date <= ?
+          AND (next_kind != kind OR next_interval != billing_interval);`
+	if err := db.Select(&ids, q, now); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRDOWNGRADE", E: err})
+	}
+
+	report := &EcommScheduleReport{Due: len(ids), Failed: map[string]string{}}
+	for _, id := range ids {
+		d, err := lc.downgrade(db, id, now)
+		if err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRDOWNGRADE1 " + id, E: err})
+			report.Failed[id] = err.Error()
+			continue
+		}
+		if d == nil {
+			report.Skipped++
+			continue
+		}
+		report.Downgraded = append(report.Downgraded, *d)
+	}
+	return report, nil
+}
+
+// downgradeColumns are the columns of downgradeUser.
+const downgradeColumns = `id, kind, next_kind, first_name, email, s_customer_id, enterprise_id,
+          billing_interval, next_interval`
+
+/*
+  downgrade moves a single user to their next kind with moveUser, and emails
+  them once the downgrade is committed. A nil downgrade is returned if the
+  user is no longer due, as another instance has downgraded them.
+  A move between billing intervals changes the subscription before the user
+  is locked, so the lock is not held while the provider is called, and the
+  subscription is moved back if the downgrade is not committed.
+*/
+func (lc Lgc) downgrade(db DataCaller, userID string, now time.Time) (*EcommDowngrade, error) {
+	var u downgradeUser
+	q := `SELECT ` + downgradeColumns + ` FROM user WHERE id = ? AND downgrade_date <= ?
+          AND (next_kind != kind OR next_interval != billing_interval);`
+	if err := db.Get(&u, q, userID, now); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// A move from a yearly plan to a monthly plan was not made with the
+	// provider when it was requested, as the provider would have started
+	// the monthly period then. It is prorated in case the provider has
+	// already renewed the yearly period, so the renewal is credited.
+	var cpe string
+	if normInterval(u.NextInterval) != normInterval(u.Interval) && u.CID.String != "" {
+		if p, ok := planCatalog.Variant(u.NextKind, u.NextInterval); ok && p.Paid() {
+			end, err := lc.updateSub(u.CID.String, p.ID, true)
+			if err != nil {
+				return nil, err
+			}
+			cpe = end
+		}
+	}
+
+	var out *EcommDowngrade
+	err := withTx(db, func(tx DataCaller) error {
+		q := `SELECT ` + downgradeColumns + ` FROM user WHERE id = ? AND downgrade_date <= ?
+              AND (next_kind != kind OR next_interval != billing_interval) FOR UPDATE;`
+		if err := tx.Get(&u, q, userID, now); err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		body := fmt.Sprintf("Downgraded from kind %v to kind %v, billed each %v.", u.Kind, u.NextKind,
+			normInterval(u.NextInterval))
+		d, err := moveUser(tx, u, u.NextKind, u.NextInterval, billingEventDowngraded, body)
+		if err != nil {
+			return err
+		}
+		if cpe != "" {
+			q = `UPDATE user SET current_period_end = ? WHERE id = ?;`
+			if _, err := tx.Exec(q, cpe, u.ID); err != nil {
+				return err
+			}
+		}
+		out = d
+		return nil
+	})
+	if err != nil && cpe != "" {
+		// The user is still on the yearly plan, so the subscription is
+		// moved back without proration. Any credit issued for the renewal
+		// is left for support to fix.
+		lc.compensate("revert interval for "+u.CID.String, func() error {
+			prev, ok := planCatalog.Variant(u.Kind, u.Interval)
+			if !ok || !prev.Paid() {
+				return fmt.Errorf("no plan for kind %v billed each %v", u.Kind, u.Interval)
+			}
+			_, err := lc.updateSub(u.CID.String, prev.ID, false)
+			return err
+		})
+	}
+	if err != nil || out == nil {
+		return nil, err
+	}
+	lc.emailDowngrade(db, u, out.ToKind)
+	return out, nil
+}
+
+/*
+  downgradeNow moves a user to the free plan immediately, as when their
+  subscription has ended or could not be paid. This is the same move as a
+  scheduled downgrade: the user is locked, moved by moveUser and emailed
+  once the move is committed. reset, which may be nil, is run in the same
+  transaction to clear any other billing state of the user. A nil
+  downgrade is returned if the user is already on the free plan.
+*/
+func (lc Lgc) downgradeNow(db DataCaller, userID string, event string, body string,
+	reset func(tx DataCaller) error) (*EcommDowngrade, error) {
+	var u downgradeUser
+	var out *EcommDowngrade
+	err := withTx(db, func(tx DataCaller) error {
+		q := `SELECT ` + downgradeColumns + ` FROM user WHERE id = ? FOR UPDATE;`
+		if err := tx.Get(&u, q, userID); err != nil {
+			return err
+		}
+		if reset != nil {
+			if err := reset(tx); err != nil {
+				return err
+			}
+		}
+		if u.Kind == "0" && u.NextKind == "0" {
+			return nil
+		}
+		d, err := moveUser(tx, u, "0", IntervalMonth, event, body)
+		if err != nil {
+			return err
+		}
+		out = d
+		return nil
+	})
+	if err != nil || out == nil {
+		return nil, err
+	}
+	lc.emailDowngrade(db, u, out.ToKind)
+	return out, nil
+}
+
+/*
+  moveUser moves a user, locked by the transaction, to the kind and billing
+  interval. The quota of the plan is assigned, and when the user is leaving
+  a plan with groups their group members, seats and outstanding invites are
+  deactivated. A user moved to the free plan no longer has a billing
+  period. The move is recorded as a billing event. Every downgrade is made
+  by moveUser, whether it is scheduled or immediate.
+*/
+func moveUser(tx DataCaller, u downgradeUser, kind string, interval string, event string,
+	body string) (*EcommDowngrade, error) {
+	interval = normInterval(interval)
+	q := `UPDATE user SET kind = ?, next_kind = ?, billing_interval = ?, next_interval = ?,
+          downgrade_date = NULL WHERE id = ?;`
+	if kind == "0" {
+		q = `UPDATE user SET kind = ?, next_kind = ?, billing_interval = ?, next_interval = ?,
+             downgrade_date = NULL, current_period_end = NULL WHERE id = ?;`
+	}
+	if _, err := tx.Exec(q, kind, kind, interval, interval, u.ID); err != nil {
+		return nil, err
+	}
+
+	// Assign the quota of the next plan. Unmetered plans (bplus) do not
+	// use the quota.
+	next, ok := planCatalog.ByKind(kind)
+	if ok && !next.Unmetered {
+		q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+		if _, err := tx.Exec(q, next.Quota, u.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	out := &EcommDowngrade{
+		UserID:   u.ID,
+		FromKind: u.Kind,
+		ToKind:   kind,
+		Interval: interval,
+	}
+	cur, _ := planCatalog.ByKind(u.Kind)
+	if cur.HasFeature(FeatureGroups) && !next.HasFeature(FeatureGroups) && u.EnterpriseID.String != "" {
+		n, err := endGroup(tx, u.EnterpriseID.String)
+		if err != nil {
+			return nil, err
+		}
+		out.Members = n
+	}
+
+	if err := logBillingEvent(tx, u.ID, u.CID.String, event, body); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// emailDowngrade emails a user who has been moved to the kind. The move has
+// been committed, so a failed email is logged rather than returned.
+func (lc Lgc) emailDowngrade(db DataCaller, u downgradeUser, kind string) {
+	template := emailSubUpdated
+	if kind == "0" {
+		template = emailSubDowngraded
+	}
+	err := lc.Pvl.buildBillingEmail(&buildBillingEmailInput{
+		template:  template,
+		firstName: u.FirstName,
+		email:     u.Email,
+		db:        db,
+	})
+	if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRDOWNGRADE2 " + u.ID, E: err})
+	}
+}
+
+/*
+  endGroup deactivates the group of an owner who is leaving a plan with
+  groups. The members are deactivated, the seats are reset to the single
+  seat of the owner and outstanding invites are removed. The owner keeps
+  their enterprise record, so the group can be reactivated by upgrading.
+  The number of members deactivated is returned.
+*/
+func endGroup(db DataCaller, enterpriseID string) (int, error) {
+	active, err := countActiveMembers(db, enterpriseID)
+	if err != nil {
+		return 0, err
+	}
+
+	q := `UPDATE user SET group_active = 0 WHERE enterprise_id = ?;`
+	if _, err := db.Exec(q, enterpriseID); err != nil {
+		return 0, err
+	}
+	q = `UPDATE enterprises SET seats = 1, members = 0 WHERE id = ?;`
+	if _, err := db.Exec(q, enterpriseID); err != nil {
+		return 0, err
+	}
+	q = `DELETE FROM enterprise_invites WHERE enterprise_id = ? AND accepted IS NULL;`
+	if _, err := db.Exec(q, enterpriseID); err != nil {
+		return 0, err
+	}
+
+	// The owner is counted as an active member.
+	if active > 0 {
+		active--
+	}
+	return active, nil
+}
@@ -0,0 +1,179 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the ecommDowngrades function skips users that another instance has
+// already downgraded, and reports users that fail.
+func TestEcommDowngradesSkipped(t *testing.T) {
+	db := &MockTxDb{MockDb: &MockDb{
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]string) = []string{"1", "2"}
+			return nil
+		},
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			// The first user is no longer due once their row is locked.
+			if args[0] == "1" && strings.Contains(query, "FOR UPDATE") {
+				return sql.ErrNoRows
+			}
+			d := dest.(*downgradeUser)
+			*d = downgradeUser{ID: "2", Kind: "2", NextKind: "1"}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(q, "INSERT INTO billing_events") {
+				return nil, sql.ErrConnDone
+			}
+			return nil, nil
+		},
+	}}
+	lc := Lgc{}
+
+	report, err := lc.ecommDowngrades(db, time.Now())
+	if err != nil {
+		t.Fatalf("ecommDowngrades returned an error, got %v.", err)
+	}
+	if report.Due != 2 || report.Skipped != 1 || len(report.Downgraded) != 0 {
+		t.Errorf("ecommDowngrades returned the wrong report, got %+v.", report)
+	}
+	if _, ok := report.Failed["2"]; !ok {
+		t.Errorf("ecommDowngrades did not report the failed user, got %+v.", report)
+	}
+	if db.Committed != 1 || db.RolledBack != 1 {
+		t.Errorf("ecommDowngrades did not downgrade each user in a transaction, got %+v.", db)
+	}
+}
+
+// Test the EcommSchedule function runs every step when a step fails, and
+// reports the error of each step.
+func TestEcommScheduleErrors(t *testing.T) {
+	db := &MockDb{
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			return sql.ErrConnDone
+		},
+	}
+	lc := Lgc{}
+
+	report, err := lc.EcommSchedule(db)
+	if err != nil {
+		t.Fatalf("EcommSchedule returned an error, got %v.", err)
+	}
+	for _, step := range []string{"dunning", "trials", "usage", "downgrades"} {
+		if _, ok := report.Errors[step]; !ok {
+			t.Errorf("EcommSchedule did not report the %v step, got %+v.", step, report)
+		}
+	}
+}
+
+// Test the downgrade function moves the subscription back to the yearly
+// plan when the move to a monthly plan is not committed.
+func TestDowngradeIntervalReverted(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			d := dest.(*downgradeUser)
+			*d = downgradeUser{ID: "1", Kind: "2", NextKind: "2", Interval: IntervalYear,
+				NextInterval: IntervalMonth, CID: sql.NullString{String: cID, Valid: true}}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(q, "INSERT INTO billing_events") {
+				return nil, sql.ErrConnDone
+			}
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Billing: mem}
+
+	if _, err := lc.downgrade(db, "1", time.Now()); err == nil {
+		t.Fatal("downgrade did not return the error.")
+	}
+	if sub, _ := mem.GetSub(cID); sub == nil || sub.Plan != "102y" {
+		t.Errorf("downgrade did not move the subscription back, got %+v.", sub)
+	}
+}
+
+// Test the downgradeNow function moves a business plus owner to the free
+// plan, ending their group and recording the downgrade, and does nothing
+// for a user who is already free.
+func TestDowngradeNow(t *testing.T) {
+	var qs []string
+	user := downgradeUser{ID: "1", Kind: "5", NextKind: "5",
+		EnterpriseID: sql.NullString{String: "ent", Valid: true}}
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *downgradeUser:
+				*d = user
+			case *int:
+				*d = 3
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			f := strings.Fields(strings.NewReplacer(" INTO", "", " FROM", "").Replace(q))
+			qs = append(qs, f[0]+" "+f[1])
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Pvl: &MockPrivateLogic{}}
+
+	var reset bool
+	d, err := lc.downgradeNow(db, "1", billingEventDowngraded, "Ended.", func(tx DataCaller) error {
+		reset = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("downgradeNow returned an error, got %v.", err)
+	}
+	if d == nil || d.ToKind != "0" || d.Members != 2 || !reset {
+		t.Errorf("downgradeNow did not downgrade the owner, got %+v.", d)
+	}
+	want := "UPDATE user,UPDATE user_quota,UPDATE user,UPDATE enterprises,DELETE enterprise_invites," +
+		"INSERT billing_events"
+	if got := strings.Join(qs, ","); got != want {
+		t.Errorf("downgradeNow made the wrong changes, got %v.", got)
+	}
+	if db.Committed != 1 {
+		t.Errorf("downgradeNow did not downgrade in a transaction, got %+v.", db)
+	}
+
+	qs = nil
+	user = downgradeUser{ID: "1", Kind: "0", NextKind: "0"}
+	if d, err := lc.downgradeNow(db, "1", billingEventDowngraded, "Ended.", nil); d != nil || err != nil || len(qs) != 0 {
+		t.Errorf("downgradeNow downgraded a free user, got %+v %v %v.", d, err, qs)
+	}
+}
+
+// Test the endGroup function deactivates every member and returns the
+// number of members other than the owner.
+func TestEndGroup(t *testing.T) {
+	var qs []string
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*int) = 4
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			qs = append(qs, q)
+			return nil, nil
+		},
+	}
+
+	n, err := endGroup(db, "FF")
+	if err != nil || n != 3 {
+		t.Errorf("endGroup expected 3 members, got %v %v.", n, err)
+	}
+	if len(qs) != 3 || !strings.HasPrefix(qs[0], "UPDATE user SET group_active = 0") {
+		t.Errorf("endGroup did not deactivate the group, got %v.", qs)
+	}
+}
@@ -0,0 +1,290 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// The actions that can be taken at each step of the dunning schedule.
+const (
+	// DunningRemind retries the payment and sends the payment failure email.
+	DunningRemind = "remind"
+	// DunningFinal sends the final notice before the account is restricted.
+	DunningFinal = "final"
+	// DunningRestrict restricts the account to read-only; no new documents
+	// can be created until the payment is made.
+	DunningRestrict = "restrict"
+	// DunningDowngrade cancels the subscription and downgrades the user to
+	// a free account.
+	DunningDowngrade = "downgrade"
+	// dunningRecovered is recorded when a payment succeeds during dunning.
+	dunningRecovered = "recovered"
+)
+
+// The Mandrill templates used for the dunning emails.
+const (
+	emailDunningFinal      = "payment-final-notice"
+	emailAccountRestricted = "account-restricted"
+)
+
+// DunningStep is a single step of the dunning schedule.
+type DunningStep struct {
+	After  time.Duration // How long after the first failed payment to act.
+	Action string        // The action to take.
+}
+
+// DefaultDunningSchedule returns the dunning schedule used unless another is
+// set with SetDunningSchedule. The payment failure email is sent as soon as
+// the payment fails, so the first step is a few days later. The account is
+// restricted after a grace period of ten days, and downgraded after three
+// weeks.
+func DefaultDunningSchedule() []DunningStep {
+	day := 24 * time.Hour
+	return []DunningStep{
+		{After: 3 * day, Action: DunningRemind},
+		{After: 6 * day, Action: DunningRemind},
+		{After: 9 * day, Action: DunningFinal},
+		{After: 10 * day, Action: DunningRestrict},
+		{After: 21 * day, Action: DunningDowngrade},
+	}
+}
+
+// dunningSchedule is the schedule used by EcommSchedule.
+var dunningSchedule = DefaultDunningSchedule()
+
+// SetDunningSchedule replaces the dunning schedule. The steps must be in
+// order, and the schedule must end with a downgrade.
+func SetDunningSchedule(steps []DunningStep) error {
+	if len(steps) == 0 || steps[len(steps)-1].Action != DunningDowngrade {
+		return errors.New("The dunning schedule must end with a downgrade.")
+	}
+	for i, s := range steps {
+		switch s.Action {
+		case DunningRemind, DunningFinal, DunningRestrict, DunningDowngrade:
+		default:
+			return errors.New("Unknown dunning action " + s.Action)
+		}
+		if i > 0 && s.After < steps[i-1].After {
+			return errors.New("The dunning schedule must be in order.")
+		}
+	}
+	dunningSchedule = steps
+	return nil
+}
+
+// dunningDue returns the index of each step in the schedule that is due,
+// given the index of the next step for the user and when dunning started.
+func dunningDue(schedule []DunningStep, next int, start time.Time, now time.Time) []int {
+	var out []int
+	for i := next; i < len(schedule); i++ {
+		if start.Add(schedule[i].After).After(now) {
+			break
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// The user information required to action the dunning steps.
+type dunningUser struct {
+	ID           string `db:"id"`
+	Email        string `db:"email"`
+	FirstName    string `db:"first_name"`
+	CID          string `db:"s_customer_id"`
+	DunningStart string `db:"dunning_start"`
+	DunningStep  int    `db:"dunning_step"`
+}
+
+/*
+  ecommDunning actions every dunning step that has become due for users with
+  failed payments. Each step is recorded in ecomm_dunning, and the
+  dunning_step of the user is moved on so the step is not actioned again.
+  An error for one user does not stop the other users being actioned.
+*/
+func (lc Lgc) ecommDunning(db DataCaller, now time.Time) error {
+	var users []dunningUser
+	q := `SELECT id, email, first_name, s_customer_id, dunning_start, dunning_step
+          FROM user WHERE dunning_start IS NOT NULL AND failed_payments > 0
+          AND s_customer_id IS NOT NULL;`
+	if err := db.Select(&users, q); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRDUNNING1", E: err})
+	}
+
+	var failed error
+	for _, u := range users {
+		start, err := time.Parse("2006-01-02 15:04:05", u.DunningStart)
+		if err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRDUNNING2 " + u.ID, E: err})
+			continue
+		}
+		due := dunningDue(dunningSchedule, u.DunningStep, start, now)
+		if len(due) == 0 {
+			continue
+		}
+
+		// When several steps are due (the scheduler has not run for a
+		// while) only the latest step is actioned, so the user is not sent
+		// several emails at once. A restriction that was skipped is still
+		// applied.
+		i := due[len(due)-1]
+		for _, s := range due[:len(due)-1] {
+			if dunningSchedule[s].Action == DunningRestrict && dunningSchedule[i].Action != DunningDowngrade {
+				q = `UPDATE user SET restricted = 1 WHERE id = ?;`
+				if _, err := db.Exec(q, u.ID); err != nil {
+					failed = e.ThrowError(&e.LogInput{M: "ERRDUNNING3 " + u.ID, E: err})
+				}
+			}
+		}
+
+		if err := lc.dunningAction(db, u, dunningSchedule[i]); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRDUNNING4 " + u.ID, E: err})
+			continue
+		}
+		if err := recordDunningStep(db, u.ID, u.CID, i+1, dunningSchedule[i].Action); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRDUNNING5 " + u.ID, E: err})
+		}
+	}
+	return failed
+}
+
+// dunningAction performs the action for a single dunning step.
+func (lc Lgc) dunningAction(db DataCaller, u dunningUser, step DunningStep) error {
+	email := func(template string) error {
+		emIn := &buildBillingEmailInput{
+			template:  template,
+			firstName: u.FirstName,
+			email:     u.Email,
+			db:        db,
+		}
+		return lc.Pvl.buildBillingEmail(emIn)
+	}
+
+	switch step.Action {
+	case DunningRemind:
+		// Retry the payment first, as the user may have fixed their card
+		// without updating it with us. A failed retry sends another
+		// charge.failed webhook, which is ignored as the invoice has
+		// already been recorded.
+		if err := lc.retryPayment(u.CID); err == nil {
+			return nil
+		}
+		emIn := &buildPaymentFailInput{
+			firstName: u.FirstName,
+			email:     u.Email,
+			db:        db,
+		}
+		return lc.Pvl.buildPaymentFailEmail(emIn)
+	case DunningFinal:
+		return email(emailDunningFinal)
+	case DunningRestrict:
+		q := `UPDATE user SET restricted = 1 WHERE id = ?;`
+		if _, err := db.Exec(q, u.ID); err != nil {
+			return err
+		}
+		return email(emailAccountRestricted)
+	case DunningDowngrade:
+		if err := lc.cancelSubNow(u.CID); err != nil {
+			return err
+		}
+		// The user is moved to the free plan the same way as a scheduled
+		// downgrade, and their dunning state is cleared with it.
+		_, err := lc.downgradeNow(db, u.ID, billingEventDowngraded,
+			"Downgraded to the free plan as the outstanding payment was not made.", func(tx DataCaller) error {
+				q := `UPDATE user SET failed_payments = 0, restricted = 0, dunning_start = NULL,
+                      dunning_step = 0 WHERE id = ?;`
+				_, err := tx.Exec(q, u.ID)
+				return err
+			})
+		return err
+	}
+	return nil
+}
+
+// recordDunningStep writes the step to ecomm_dunning, and moves the
+// dunning_step of the user on to the next step. The step is only moved on
+// while the user is still in dunning, as a retried payment that succeeded
+// may already have ended dunning with endDunning.
+func recordDunningStep(db DataCaller, userID string, customerID string, step int, action string) error {
+	q := `INSERT INTO ecomm_dunning (user_id, s_customer_id, step, action, created)
+          VALUES (?,?,?,?,?);`
+	if _, err := db.Exec(q, userID, customerID, step, action, time.Now()); err != nil {
+		return err
+	}
+	if action == DunningDowngrade {
+		return nil
+	}
+	q = `UPDATE user SET dunning_step = ? WHERE id = ? AND dunning_start IS NOT NULL;`
+	_, err := db.Exec(q, step, userID)
+	return err
+}
+
+/*
+  endDunning is used when a payment succeeds. It lifts any restriction on the
+  account and resets the dunning state of the user. If the user was in
+  dunning, the recovery is recorded in ecomm_dunning.
+*/
+func endDunning(db DataCaller, userID string, customerID string) error {
+	var step sql.NullInt64
+	q := `SELECT dunning_step FROM user WHERE id = ? AND dunning_start IS NOT NULL;`
+	err := db.Get(&step, q, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	q = `UPDATE user SET failed_payments = 0, restricted = 0, dunning_start = NULL,
+         dunning_step = 0 WHERE id = ?;`
+	if _, err := db.Exec(q, userID); err != nil {
+		return err
+	}
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	q = `INSERT INTO ecomm_dunning (user_id, s_customer_id, step, action, created)
+         VALUES (?,?,?,?,?);`
+	_, err = db.Exec(q, userID, customerID, step.Int64, dunningRecovered, time.Now())
+	return err
+}
+
+/*
+  EcommRestricted returns true if the account of the user has been
+  restricted by the dunning schedule. Restricted accounts are read-only
+  until the outstanding payment is made.
+*/
+func (lc Lgc) EcommRestricted(db DataCaller, userID string) (bool, error) {
+	var r bool
+	q := `SELECT restricted FROM user WHERE id = ?;`
+	if err := db.Get(&r, q, userID); err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRRESTRICTED", E: err})
+	}
+	return r, nil
+}
+
+// The output for the EcommDunningHistory function.
+type EcommDunningStep struct {
+	Step    int    `db:"step"`
+	Action  string `db:"action"`
+	Created string `db:"created"`
+}
+
+// EcommDunningHistory returns every dunning step recorded for the user, in
+// the order they were taken. This is used by support to see where a
+// customer is in the dunning schedule, and is only available to admins.
+func (lc Lgc) EcommDunningHistory(db DataCaller, ls LogicStore, userID string) ([]EcommDunningStep, error) {
+	admin, err := isAdmin(db, ls.GetCurrentUser().Id)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRDUNNINGHISTORY", E: err})
+	} else if !admin {
+		return nil, errors.New("You do not have permission to view the dunning history.")
+	}
+
+	var out []EcommDunningStep
+	q := `SELECT step, action, created FROM ecomm_dunning WHERE user_id = ?
+          ORDER BY created ASC, id ASC;`
+	if err := db.Select(&out, q, userID); err != nil {
+		return out, e.ThrowError(&e.LogInput{M: "ERRDUNNINGHISTORY", E: err})
+	}
+	return out, nil
+}
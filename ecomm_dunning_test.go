@@ -0,0 +1,157 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the dunningDue function returns the steps that have become due since
+// the last step the user was moved through.
+func TestDunningDue(t *testing.T) {
+	day := 24 * time.Hour
+	schedule := DefaultDunningSchedule()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Nothing is due on the day the payment failed.
+	if due := dunningDue(schedule, 0, start, start.Add(day)); len(due) != 0 {
+		t.Errorf("dunningDue is returning steps before they are due, got %v.", due)
+	}
+
+	// The first reminder is due after three days.
+	due := dunningDue(schedule, 0, start, start.Add(3*day))
+	if len(due) != 1 || due[0] != 0 {
+		t.Errorf("dunningDue is not returning the first reminder, got %v.", due)
+	}
+
+	// Steps the user has already been moved through are not returned.
+	if due := dunningDue(schedule, 1, start, start.Add(3*day)); len(due) != 0 {
+		t.Errorf("dunningDue is returning steps that have been actioned, got %v.", due)
+	}
+
+	// If the scheduler has not run for a while, every missed step is due
+	// and the last of them is the restriction.
+	due = dunningDue(schedule, 1, start, start.Add(11*day))
+	if len(due) != 3 || schedule[due[len(due)-1]].Action != DunningRestrict {
+		t.Errorf("dunningDue is not returning the missed steps, got %v.", due)
+	}
+
+	// The downgrade is the last step.
+	due = dunningDue(schedule, 4, start, start.Add(30*day))
+	if len(due) != 1 || schedule[due[0]].Action != DunningDowngrade {
+		t.Errorf("dunningDue is not returning the downgrade, got %v.", due)
+	}
+}
+
+// Test the SetDunningSchedule function validates the schedule.
+func TestSetDunningSchedule(t *testing.T) {
+	defer SetDunningSchedule(DefaultDunningSchedule())
+
+	err := SetDunningSchedule([]DunningStep{{After: time.Hour, Action: DunningRemind}})
+	if err == nil {
+		t.Error("SetDunningSchedule is accepting a schedule that does not downgrade.")
+	}
+
+	err = SetDunningSchedule([]DunningStep{
+		{After: 2 * time.Hour, Action: DunningRemind},
+		{After: time.Hour, Action: DunningDowngrade},
+	})
+	if err == nil {
+		t.Error("SetDunningSchedule is accepting a schedule that is out of order.")
+	}
+
+	err = SetDunningSchedule([]DunningStep{
+		{After: time.Hour, Action: DunningRestrict},
+		{After: 2 * time.Hour, Action: DunningDowngrade},
+	})
+	if err != nil {
+		t.Errorf("SetDunningSchedule is unexpectedly returning an error: %v", err)
+	}
+	if len(dunningSchedule) != 2 {
+		t.Error("SetDunningSchedule is not replacing the schedule.")
+	}
+}
+
+// Test the EcommDunningHistory function is only available to admins.
+func TestEcommDunningHistory(t *testing.T) {
+	lc := Lgc{}
+	ls := &MockLogic{GetCurrentUserMock: func() *UserAuth { return &UserAuth{Id: "admin"} }}
+	admin := false
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*bool) = admin
+			return nil
+		},
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]EcommDunningStep) = []EcommDunningStep{{Step: 1, Action: DunningRemind}}
+			return nil
+		},
+	}
+
+	if _, err := lc.EcommDunningHistory(db, ls, "1"); err == nil {
+		t.Error("EcommDunningHistory allowed a user who is not an admin.")
+	}
+	admin = true
+	if out, err := lc.EcommDunningHistory(db, ls, "1"); err != nil || len(out) != 1 {
+		t.Errorf("EcommDunningHistory did not return the history, got %v %v.", out, err)
+	}
+}
+
+// Test the final dunning step cancels the subscription and downgrades the
+// user through the shared downgrade, which clears their dunning state and
+// records the downgrade.
+func TestDunningActionDowngrade(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var qs []string
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*downgradeUser) = downgradeUser{ID: "1", Kind: "2", NextKind: "2"}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			qs = append(qs, q)
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Billing: mem, Pvl: &MockPrivateLogic{}}
+
+	u := dunningUser{ID: "1", CID: cID}
+	if err := lc.dunningAction(db, u, DunningStep{Action: DunningDowngrade}); err != nil {
+		t.Fatalf("dunningAction returned an error, got %v.", err)
+	}
+	if sub, _ := mem.GetSub(cID); sub.Plan != "" {
+		t.Errorf("dunningAction did not cancel the subscription, got %+v.", sub)
+	}
+	all := strings.Join(qs, "\n")
+	if !strings.Contains(all, "dunning_start = NULL") || !strings.Contains(all, "INSERT INTO billing_events") {
+		t.Errorf("dunningAction did not downgrade the user, got %v.", all)
+	}
+	if db.Committed != 1 {
+		t.Errorf("dunningAction did not downgrade in a transaction, got %+v.", db)
+	}
+}
+
+// Test the recordDunningStep function only moves the step on while the user
+// is still in dunning.
+func TestRecordDunningStep(t *testing.T) {
+	var qs []string
+	db := &MockDb{
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			qs = append(qs, q)
+			return nil, nil
+		},
+	}
+	if err := recordDunningStep(db, "1", "cus_1", 2, DunningRemind); err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 2 || !strings.Contains(qs[1], "dunning_start IS NOT NULL") {
+		t.Errorf("recordDunningStep moved the step on after dunning ended, got %v.", qs)
+	}
+}
@@ -0,0 +1,25 @@
+package logic
+
+// The Mandrill templates used for billing emails.
+const (
+	emailSubDowngraded   = "subscription-downgraded"
+	emailSubUpdated      = "subscription-updated"
+	emailInvoiceUpcoming = "invoice-upcoming"
+	emailCardExpiring    = "card-expiring"
+	emailChargeRefunded  = "charge-refunded"
+	emailChargeDisputed  = "charge-disputed"
+)
+
+/*
+  buildBillingEmailInput is the input for PrivateLogic.buildBillingEmail,
+  which sends one of the billing templates to the user with the same mailer
+  as buildPaymentFailEmail. The first name of the user and a link to the
+  plan page are always provided to the template, along with any vars.
+*/
+type buildBillingEmailInput struct {
+	template  string            // The Mandrill template to send.
+	firstName string            // The first name of the user.
+	email     string            // The email address of the user.
+	vars      map[string]string // Any extra merge vars used by the template.
+	db        DataCaller
+}
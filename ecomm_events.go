@@ -0,0 +1,175 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// The outcomes recorded against an event in the ecomm_events ledger.
+const (
+	ecommEventProcessing = "processing"
+	ecommEventProcessed  = "processed"
+	ecommEventFailed     = "failed"
+)
+
+// ecommEventStale is how long an event can be processing before it is
+// assumed the request handling it died, and it can be replayed.
+const ecommEventStale = 15 * time.Minute
+
+// EcommEvent is a single webhook event recorded in the ecomm_events ledger.
+type EcommEvent struct {
+	EventID    string         `db:"event_id"`
+	Kind       sql.NullString `db:"kind"`
+	CustomerID sql.NullString `db:"s_customer_id"`
+	Received   string         `db:"received"`
+	Claimed    string         `db:"claimed"`
+	Processed  sql.NullString `db:"processed"`
+	Outcome    string         `db:"outcome"`
+	Error      sql.NullString `db:"error"`
+	Attempts   int            `db:"attempts"`
+}
+
+/*
+  claimEcommEvent records the event in the ledger as processing, and returns
+  true if the caller should action the event.
+  Events that have already been processed, or are being processed, are not
+  claimed. Events that previously failed are claimed again, which is how
+  EcommReplay re-processes them. EcommHook acknowledges every delivery, so
+  Stripe does not redeliver a failed event, and it is only recovered by an
+  admin replay. Both the insert and the update only change a row when the
+  event can be claimed, so two deliveries of the same event cannot both
+  claim it.
+*/
+func claimEcommEvent(db DataCaller, eventID string) (bool, error) {
+	// The event_id is the primary key, so the insert is ignored when the
+	// event is already in the ledger.
+	now := time.Now()
+	q := `INSERT IGNORE INTO ecomm_events (event_id, received, claimed, outcome, attempts)
+          VALUES (?,?,?,?,1);`
+	res, err := db.Exec(q, eventID, now, now, ecommEventProcessing)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err == nil, err
+	}
+
+	return reclaimEcommEvent(db, eventID)
+}
+
+// reclaimEcommEvent marks an event that failed as processing again, and
+// returns true if it was claimed.
+func reclaimEcommEvent(db DataCaller, eventID string) (bool, error) {
+	q := `UPDATE ecomm_events SET outcome = ?, claimed = ?, attempts = attempts + 1,
+          error = NULL WHERE event_id = ? AND outcome = ?;`
+	res, err := db.Exec(q, ecommEventProcessing, time.Now(), eventID, ecommEventFailed)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// finishEcommEvent records the outcome of processing an event in the ledger.
+// A nil procErr marks the event as processed.
+func finishEcommEvent(db DataCaller, eventID string, procErr error) error {
+	outcome := ecommEventProcessed
+	var msg sql.NullString
+	if procErr != nil {
+		outcome = ecommEventFailed
+		msg = sql.NullString{String: procErr.Error(), Valid: true}
+		// The error column holds 250 characters.
+		if len(msg.String) > 250 {
+			msg.String = msg.String[:250]
+		}
+	}
+
+	q := `UPDATE ecomm_events SET outcome = ?, error = ?, processed = ? WHERE event_id = ?;`
+	_, err := db.Exec(q, outcome, msg, time.Now(), eventID)
+	return err
+}
+
+// The output for the EcommReplay function.
+type EcommReplayReport struct {
+	Replayed int
+	Failed   []EcommReplayFailure
+}
+type EcommReplayFailure struct {
+	EventID string
+	Error   string
+}
+
+/*
+  EcommReplay re-processes webhook events that failed. If an eventID is
+  provided only that event is replayed, otherwise every failed event is
+  replayed. An event that has been stuck processing for longer than
+  ecommEventStale is assumed to have failed, and is replayed with them.
+  This is an administrative command that is only available to admins; the
+  report lists the events that failed again so they can be investigated.
+*/
+func (lc Lgc) EcommReplay(db DataCaller, ls LogicStore, eventID string) (*EcommReplayReport, error) {
+	admin, err := isAdmin(db, ls.GetCurrentUser().Id)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY1", E: err})
+	} else if !admin {
+		return nil, errors.New("You do not have permission to replay events.")
+	}
+
+	var events []EcommEvent
+	if eventID != "" {
+		var ev EcommEvent
+		q := `SELECT event_id, outcome, attempts FROM ecomm_events WHERE event_id = ?;`
+		if err := db.Get(&ev, q, eventID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, errors.New("That event does not exist.")
+			}
+			return nil, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY1", E: err})
+		}
+		if ev.Outcome != ecommEventFailed {
+			return nil, errors.New("Only events that failed can be replayed.")
+		}
+		events = append(events, ev)
+	} else {
+		q := `UPDATE ecomm_events SET outcome = ?, error = ? WHERE outcome = ? AND claimed <= ?;`
+		stale := time.Now().Add(-ecommEventStale)
+		_, err := db.Exec(q, ecommEventFailed, "The event was not finished.", ecommEventProcessing, stale)
+		if err != nil {
+			return nil, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY2", E: err})
+		}
+
+		q = `SELECT event_id, outcome, attempts FROM ecomm_events WHERE outcome = ?
+             ORDER BY received ASC;`
+		if err := db.Select(&events, q, ecommEventFailed); err != nil {
+			return nil, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY2", E: err})
+		}
+	}
+
+	out := &EcommReplayReport{}
+	for _, ev := range events {
+		// The event is skipped if it was claimed by a redelivery of the
+		// webhook in the meantime.
+		ok, err := reclaimEcommEvent(db, ev.EventID)
+		if err != nil {
+			return out, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY3", E: err})
+		} else if !ok {
+			continue
+		}
+
+		procErr := lc.processEcommEvent(db, ev.EventID)
+		if err := finishEcommEvent(db, ev.EventID, procErr); err != nil {
+			return out, e.ThrowError(&e.LogInput{M: "ERRECOMMREPLAY4", E: err})
+		}
+
+		out.Replayed++
+		if procErr != nil {
+			out.Failed = append(out.Failed, EcommReplayFailure{
+				EventID: ev.EventID,
+				Error:   procErr.Error(),
+			})
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// eventsDb returns a MockDb for a ledger holding an event with the outcome,
+// where an empty outcome is an event that has not been received. The
+// queries run are appended to qs.
+func eventsDb(outcome string, qs *[]string) *MockDb {
+	return &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *bool:
+				*d = true
+			case *EcommEvent:
+				if outcome == "" {
+					return sql.ErrNoRows
+				}
+				*d = EcommEvent{EventID: "evt_1", Outcome: outcome}
+			}
+			return nil
+		},
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]EcommEvent) = []EcommEvent{{EventID: "evt_1", Outcome: ecommEventFailed}}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			*qs = append(*qs, q)
+			switch {
+			case strings.HasPrefix(q, "INSERT IGNORE INTO ecomm_events"):
+				if outcome == "" {
+					return driver.RowsAffected(1), nil
+				}
+			case strings.Contains(q, "attempts = attempts + 1"):
+				if outcome == ecommEventFailed {
+					return driver.RowsAffected(1), nil
+				}
+			}
+			return driver.RowsAffected(0), nil
+		},
+	}
+}
+
+// Test the claimEcommEvent function only claims events that have not been
+// processed, so a redelivered event is not actioned twice.
+func TestClaimEcommEvent(t *testing.T) {
+	// The first delivery of an event should be inserted into the ledger
+	// and claimed.
+	var qs []string
+	ok, err := claimEcommEvent(eventsDb("", &qs), "evt_1")
+	if err != nil || !ok {
+		t.Errorf("claimEcommEvent is not claiming a new event, got %v %v.", ok, err)
+	}
+	if len(qs) != 1 || !strings.HasPrefix(qs[0], "INSERT IGNORE INTO ecomm_events") {
+		t.Errorf("claimEcommEvent is not inserting the event into the ledger, got %v.", qs)
+	}
+
+	// An event that has been processed, or is processing, should not be
+	// claimed. The update of the ledger is conditional on the event having
+	// failed, so it does not change these events.
+	for _, outcome := range []string{ecommEventProcessed, ecommEventProcessing} {
+		qs = nil
+		ok, err = claimEcommEvent(eventsDb(outcome, &qs), "evt_1")
+		if err != nil || ok {
+			t.Errorf("claimEcommEvent is claiming a %v event.", outcome)
+		}
+		if len(qs) != 2 || !strings.Contains(qs[1], "AND outcome = ?") {
+			t.Errorf("claimEcommEvent is not reclaiming conditionally, got %v.", qs)
+		}
+	}
+
+	// An event that failed should be claimed again.
+	qs = nil
+	ok, err = claimEcommEvent(eventsDb(ecommEventFailed, &qs), "evt_1")
+	if err != nil || !ok {
+		t.Errorf("claimEcommEvent is not claiming a failed event, got %v %v.", ok, err)
+	}
+}
+
+// Test the EcommReplay function only replays events that failed.
+func TestEcommReplay(t *testing.T) {
+	lc := Lgc{}
+	ls := &MockLogic{GetCurrentUserMock: func() *UserAuth { return &UserAuth{Id: "admin"} }}
+
+	for _, outcome := range []string{ecommEventProcessed, ecommEventProcessing} {
+		var qs []string
+		_, err := lc.EcommReplay(eventsDb(outcome, &qs), ls, "evt_1")
+		if err == nil || len(qs) != 0 {
+			t.Errorf("EcommReplay replayed a %v event, got %v %v.", outcome, err, qs)
+		}
+	}
+
+	// Users who are not admins cannot replay events.
+	var qs []string
+	db := eventsDb(ecommEventFailed, &qs)
+	get := db.GetMock
+	db.GetMock = func(dest interface{}, query string, args ...interface{}) error {
+		if _, ok := dest.(*bool); ok {
+			return nil
+		}
+		return get(dest, query, args...)
+	}
+	if _, err := lc.EcommReplay(db, ls, ""); err == nil || len(qs) != 0 {
+		t.Errorf("EcommReplay allowed a user who is not an admin, got %v.", err)
+	}
+}
+
+// Test the finishEcommEvent function records the outcome and error.
+func TestFinishEcommEvent(t *testing.T) {
+	var outcome string
+	var msg sql.NullString
+	db := &MockDb{
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			outcome = args[0].(string)
+			msg = args[1].(sql.NullString)
+			return nil, nil
+		},
+	}
+
+	finishEcommEvent(db, "evt_1", nil)
+	if outcome != ecommEventProcessed || msg.Valid {
+		t.Errorf("finishEcommEvent is not marking the event as processed, got %v %v.", outcome, msg)
+	}
+
+	finishEcommEvent(db, "evt_1", errors.New("ERRECOMMHOOK2"))
+	if outcome != ecommEventFailed || msg.String != "ERRECOMMHOOK2" {
+		t.Errorf("finishEcommEvent is not recording the failure, got %v %v.", outcome, msg)
+	}
+}
@@ -0,0 +1,336 @@
+package logic
+
+import (
+	"database/sql"
+	"fmt"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// hookEvent holds the details of a webhook event retrieved from the ecomm
+// package.
+type hookEvent struct {
+	ID             string
+	Created        string
+	CustomerID     string
+	Kind           string
+	Invoice        string
+	FailureMessage string
+	FailureCode    string
+	Amount         int64 // The amount of the charge/invoice in cents.
+}
+
+// hookUser holds the information of the user that a webhook event is for.
+type hookUser struct {
+	ID        string `db:"id"`
+	Email     string `db:"email"`
+	FirstName string `db:"first_name"`
+	Kind      string `db:"kind"`
+	NextKind  string `db:"next_kind"`
+	Currency  string `db:"currency"` // The currency the user is billed in.
+}
+
+/*
+  processEcommEvent retrieves the event from the ecomm package and performs
+  the user account actions required for the event. Any error is returned so
+  it can be recorded against the event in the ledger.
+*/
+func (lc Lgc) processEcommEvent(db DataCaller, eventID string) error {
+	// Get event from the billing provider, this implicity ensures that the
+	// webhook event sent is legitimate.
+	ev, err := lc.billing().GetHookEvent(eventID)
+	if err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK0", E: err})
+	}
+	in := hookEvent{
+		ID:             ev.ID,
+		Created:        ev.Created,
+		CustomerID:     ev.CustomerID,
+		Kind:           ev.Kind,
+		Invoice:        ev.Invoice,
+		FailureMessage: ev.FailureMessage,
+		FailureCode:    ev.FailureCode,
+		Amount:         ev.Amount,
+	}
+
+	// Record the kind and customer of the event in the ledger, as these
+	// are only known once the event has been retrieved.
+	q := `UPDATE ecomm_events SET kind = ?, s_customer_id = ? WHERE event_id = ?;`
+	if _, err := db.Exec(q, in.Kind, in.CustomerID, eventID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK9", E: err})
+	}
+
+	// Get the user information for the given customer as we will need this to
+	// perform the required changes.
+	q = `SELECT id, email, first_name, kind, next_kind, IFNULL(currency, '') AS currency
+         FROM user WHERE s_customer_id = ?;`
+	var user hookUser
+	if err := db.Get(&user, q, in.CustomerID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK2", E: err})
+	}
+
+	// A function to email the user one of the billing templates.
+	email := func(template string, vars map[string]string) error {
+		emIn := &buildBillingEmailInput{
+			template:  template,
+			firstName: user.FirstName,
+			email:     user.Email,
+			vars:      vars,
+			db:        db,
+		}
+		if err := lc.Pvl.buildBillingEmail(emIn); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK4", E: err})
+		}
+		return nil
+	}
+
+	// Depending on the kind of the webhook, certain events need to
+	// occur for the user.
+	switch in.Kind {
+	case "customer.subscription.deleted":
+		// The subscription has ended, so the user is moved to the free plan
+		// the same way as a scheduled downgrade: the group of a business
+		// plus owner is ended, the downgrade is recorded and the user is
+		// emailed. A user the scheduler has already moved is left as is.
+		_, err := lc.downgradeNow(db, user.ID, billingEventDowngraded,
+			"Downgraded to the free plan as the subscription ended.", nil)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK3", E: err})
+		}
+	case "customer.subscription.updated":
+		// The subscription may have been changed in the Stripe dashboard,
+		// so align the user with the subscription.
+		changed, err := lc.syncEcommSub(db, user, in.CustomerID)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return email(emailSubUpdated, nil)
+		}
+	case "charge.failed", "invoice.payment_failed":
+		// Stripe sends both of these events for most failures, and only
+		// invoice.payment_failed when there was no card to charge. The
+		// failure is only recorded (and emailed) once per invoice.
+		send, err := recordPaymentFailure(db, user, in)
+		if err != nil {
+			return err
+		}
+		if !send {
+			return nil
+		}
+
+		// Email the user informing them of the failed payment.
+		emIn := &buildPaymentFailInput{
+			firstName: user.FirstName,
+			email:     user.Email,
+			db:        db,
+		}
+		if err := lc.Pvl.buildPaymentFailEmail(emIn); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK4", E: err})
+		}
+	case "invoice.payment_succeeded":
+		// Update the current_period_end to the appropriate end date.
+		sub, err := lc.billing().GetSub(in.CustomerID)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK5", E: err})
+		}
+		q = `UPDATE user SET current_period_end = ? WHERE id = ?;`
+		if _, err := db.Exec(q, sub.CurEnd, user.ID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK6", E: err})
+		}
+
+		// The seats of a group are the quantity that has been paid for.
+		if p, ok := planCatalog.ByID(sub.Plan); ok && p.HasFeature(FeatureGroups) {
+			if err := syncSeats(db, user.ID, int(sub.Quantity)); err != nil {
+				return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK12", E: err})
+			}
+		}
+
+		// Update the user failed_payments to 0, and end dunning as the
+		// outstanding payment has been made.
+		if err := endDunning(db, user.ID, in.CustomerID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK6", E: err})
+		}
+	case "invoice.upcoming":
+		// Let the user know their subscription is about to renew.
+		sub, err := lc.billing().GetSub(in.CustomerID)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK5", E: err})
+		}
+		return email(emailInvoiceUpcoming, map[string]string{
+			"amount":  formatMoney(in.Amount, user.Currency),
+			"date":    sub.CurEnd,
+			"invoice": in.Invoice,
+		})
+	case "customer.source.expiring":
+		// Let the user know their card needs to be updated before it
+		// expires and payments start failing.
+		sub, err := lc.billing().GetSub(in.CustomerID)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK5", E: err})
+		}
+		return email(emailCardExpiring, map[string]string{
+			"brand":     sub.Brand,
+			"last_four": sub.LastFour,
+			"expiry":    fmt.Sprintf("%v/%v", sub.ExMon, sub.ExYr),
+		})
+	case "charge.refunded":
+		// Refunds issued through EcommAdminRefund have already been recorded
+		// and emailed with their reason, so only the rest of the refund is
+		// recorded and emailed.
+		amount, err := recordProviderRefund(db, user, in)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK13", E: err})
+		}
+		if amount == 0 {
+			return nil
+		}
+		return email(emailChargeRefunded, map[string]string{
+			"amount":  formatMoney(amount, user.Currency),
+			"invoice": in.Invoice,
+		})
+	case "charge.dispute.created":
+		// A dispute reverses the payment, so it is recorded as a failure
+		// which is shown to the user on the plan page.
+		if in.FailureCode == "" {
+			in.FailureCode = "dispute"
+			in.FailureMessage = "The payment was disputed with your bank."
+		}
+		send, err := recordPaymentFailure(db, user, in)
+		if err != nil {
+			return err
+		}
+		if send {
+			return email(emailChargeDisputed, map[string]string{
+				"amount":  formatMoney(in.Amount, user.Currency),
+				"invoice": in.Invoice,
+			})
+		}
+	}
+	return nil
+}
+
+/*
+  syncEcommSub aligns the kind, next_kind, downgrade_date, current_period_end,
+  billing_interval and quota of the user with their subscription in the
+  ecomm package.
+  This mirrors EcommUpdateCustomerSub and EcommCancelCustomerSub: upgrades
+  apply immediately, while downgrades and cancellations apply at the end of
+  the billing period. Changes made through the API are already reflected in
+  the user, so the returned bool is only true if the user was changed.
+*/
+func (lc Lgc) syncEcommSub(db DataCaller, user hookUser, customerID string) (bool, error) {
+	sub, err := lc.billing().GetSub(customerID)
+	if err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK5", E: err})
+	}
+	p, ok := planCatalog.ByID(sub.Plan)
+	if !ok {
+		return false, e.ThrowError(&e.LogInput{
+			M: "ERRECOMMHOOK10 - unknown plan " + sub.Plan,
+		})
+	}
+
+	kind := user.Kind
+	next := p.Kind
+	upgrade := planCatalog.IsUpgrade(user.Kind, p.Kind)
+	switch {
+	case sub.CancelAtPeriodEnd:
+		// The subscription will end, so the user will become free.
+		next = "0"
+	case upgrade:
+		kind = p.Kind
+	}
+
+	// The user is transitioning if their next kind differs to their kind,
+	// in which case the scheduler moves them at the end of the period.
+	downgrade := sql.NullString{String: sub.CurEnd, Valid: next != kind}
+	q := `UPDATE user SET kind = ?, next_kind = ?, current_period_end = ?, downgrade_date = ?,
+          billing_interval = ? WHERE id = ?;`
+	_, err = db.Exec(q, kind, next, sub.CurEnd, downgrade, p.BillingInterval(), user.ID)
+	if err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK11", E: err})
+	}
+
+	if upgrade {
+		// Unmetered plans (bplus) do not use the quota.
+		if !p.Unmetered {
+			q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+			if _, err := db.Exec(q, p.Quota, user.ID); err != nil {
+				return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK11", E: err})
+			}
+		}
+		if p.HasFeature(FeatureGroups) {
+			if err := createGroup(db, user.ID); err != nil {
+				return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK11", E: err})
+			}
+		}
+	}
+
+	// The quantity may have been changed in the Stripe dashboard, so align
+	// the seats of the group with it.
+	if p.HasFeature(FeatureGroups) && kind == p.Kind {
+		if err := syncSeats(db, user.ID, int(sub.Quantity)); err != nil {
+			return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK12", E: err})
+		}
+	}
+
+	return kind != user.Kind || next != user.NextKind, nil
+}
+
+/*
+  recordPaymentFailure writes the failure to ecomm_failures and increments the
+  failed_payments of the user. A failure is only recorded once per invoice,
+  as several events are sent for the same failure.
+  The returned bool is true if the user should be emailed, which is when the
+  failure was recorded by this event (including when this event is replayed).
+*/
+func recordPaymentFailure(db DataCaller, user hookUser, in hookEvent) (bool, error) {
+	// Check if the failure has already been recorded, either by this
+	// event or by another event for the same invoice.
+	var recorded []string
+	q := `SELECT event_id FROM ecomm_failures
+          WHERE event_id = ? OR (invoice IS NOT NULL AND invoice = ?);`
+	if err := db.Select(&recorded, q, in.ID, in.Invoice); err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK1", E: err})
+	}
+	for _, id := range recorded {
+		if id == in.ID {
+			return true, nil
+		}
+	}
+	if len(recorded) > 0 {
+		return false, nil
+	}
+
+	// We need a function to generate the sql null string for possible
+	// null values.
+	toNS := func(s string) sql.NullString {
+		return sql.NullString{String: s, Valid: s != ""}
+	}
+
+	// Write the failure event to the database.
+	q = `INSERT INTO ecomm_failures
+         (event_id, created, s_customer_id, kind, invoice, failure_message, failure_code)
+         VALUES (?,?,?,?,?,?,?);`
+	if _, err := db.Exec(q,
+		in.ID,
+		in.Created,
+		in.CustomerID,
+		in.Kind,
+		toNS(in.Invoice),
+		toNS(in.FailureMessage),
+		toNS(in.FailureCode),
+	); err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK1", E: err})
+	}
+
+	// Add to the payment_failed count for the user, and start dunning if
+	// this is the first failure.
+	q = `UPDATE user SET failed_payments = failed_payments + 1,
+         dunning_start = COALESCE(dunning_start, ?) WHERE id = ?;`
+	if _, err := db.Exec(q, time.Now(), user.ID); err != nil {
+		return false, e.ThrowError(&e.LogInput{M: "ERRECOMMHOOK3", E: err})
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+)
+
+// Test the recordPaymentFailure function only records a failure once per
+// invoice, as Stripe sends charge.failed and invoice.payment_failed for the
+// same failure.
+func TestRecordPaymentFailure(t *testing.T) {
+	user := hookUser{ID: "1"}
+	in := hookEvent{ID: "evt_2", Kind: "invoice.payment_failed", Invoice: "in_1"}
+
+	// The failure has already been recorded by the charge.failed event, so
+	// nothing should be written and the user should not be emailed again.
+	ecount := 0
+	db := &MockDb{
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]string) = []string{"evt_1"}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			ecount++
+			return nil, nil
+		},
+	}
+	send, err := recordPaymentFailure(db, user, in)
+	if err != nil || send {
+		t.Errorf("recordPaymentFailure is recording a failure twice, got %v %v.", send, err)
+	}
+	if ecount != 0 {
+		t.Errorf("recordPaymentFailure is writing a recorded failure, expected 0 got %v.", ecount)
+	}
+
+	// The event is being replayed, so the failure should not be written
+	// again but the user should be emailed.
+	db.SelectMock = func(dest interface{}, query string, args ...interface{}) error {
+		*dest.(*[]string) = []string{"evt_2"}
+		return nil
+	}
+	send, err = recordPaymentFailure(db, user, in)
+	if err != nil || !send {
+		t.Errorf("recordPaymentFailure is not emailing a replayed failure, got %v %v.", send, err)
+	}
+	if ecount != 0 {
+		t.Errorf("recordPaymentFailure is writing a replayed failure, expected 0 got %v.", ecount)
+	}
+
+	// The failure is new, so it should be written and the failed_payments
+	// of the user incremented.
+	db.SelectMock = func(dest interface{}, query string, args ...interface{}) error {
+		return nil
+	}
+	send, err = recordPaymentFailure(db, user, in)
+	if err != nil || !send {
+		t.Errorf("recordPaymentFailure is not recording a new failure, got %v %v.", send, err)
+	}
+	if ecount != 2 {
+		t.Errorf("recordPaymentFailure is not making the expected db calls, expected 2 got %v.", ecount)
+	}
+}
+
+// Test the customer.subscription.deleted event ends the group of a business
+// plus owner, as a scheduled downgrade does.
+func TestEcommHookSubscriptionDeleted(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "103"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.CancelSubNow(cID)
+	ev := mem.Events(cID)
+
+	var qs []string
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *hookUser:
+				*d = hookUser{ID: "1", Kind: "5", NextKind: "5"}
+			case *downgradeUser:
+				*d = downgradeUser{ID: "1", Kind: "5", NextKind: "5",
+					EnterpriseID: sql.NullString{String: "ent", Valid: true}}
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			qs = append(qs, q)
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Billing: mem, Pvl: &MockPrivateLogic{}}
+
+	if err := lc.processEcommEvent(db, ev[len(ev)-1].ID); err != nil {
+		t.Fatalf("processEcommEvent returned an error, got %v.", err)
+	}
+	all := strings.Join(qs, "\n")
+	if !strings.Contains(all, "UPDATE enterprises") || !strings.Contains(all, "INSERT INTO billing_events") {
+		t.Errorf("processEcommEvent did not end the group of the owner, got %v.", all)
+	}
+	if db.Committed != 1 {
+		t.Errorf("processEcommEvent did not downgrade in a transaction, got %+v.", db)
+	}
+}
@@ -0,0 +1,359 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/jung-kurt/gofpdf"
+	"math"
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"strings"
+	"time"
+)
+
+// InvoiceIssuer holds the business details printed on every invoice.
+type InvoiceIssuer struct {
+	Name    string
+	ABN     string // The Australian Business Number, required on tax invoices.
+	Address string
+	Email   string
+	Country string // The country the business is registered for GST in.
+}
+
+// invoiceIssuer is the issuer used by EcommInvoicePDF.
+var invoiceIssuer = InvoiceIssuer{
+	Name:    "PleaseSign",
+	Email:   "accounts@pleasesign.com.au",
+	Country: "AU",
+}
+
+// SetInvoiceIssuer replaces the business details printed on invoices. This
+// is called when the API starts (setup.ConfigureLogic), as the ABN is not
+// known by default.
+func SetInvoiceIssuer(in InvoiceIssuer) {
+	invoiceIssuer = in
+}
+
+// invoiceParty is the customer an invoice is addressed to.
+type invoiceParty struct {
+	Name    string
+	Address string
+	Email   string
+	Country string
+	TaxID   string // The ABN, GST or VAT number of a business customer.
+}
+
+// gstComponent returns the GST included in an amount, which is one eleventh
+// of the GST inclusive amount, rounded to the nearest cent.
+func gstComponent(cents int64) int64 {
+	return int64(math.Round(float64(cents) / 11))
+}
+
+/*
+  EcommInvoicePDF returns the PDF of the invoice for the current user. The
+  invoice must belong to the customer of the user. The PDF is generated the
+  first time it is requested and stored in the master bucket; later requests
+  return the stored PDF, unless the invoice has since been paid.
+*/
+func (lc Lgc) EcommInvoicePDF(db DataCaller, ls LogicStore, invoiceID string) ([]byte, error) {
+	cID, userID, err := getCustomerID(db, ls)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the invoice.", E: err})
+	} else if cID == "" {
+		return nil, errors.New("Not an existing customer.")
+	}
+
+	// Find the invoice within the invoices of the customer, so a user can
+	// only retrieve their own invoices.
+	invs, err := lc.billing().GetCustomerInvoices(cID)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the invoice.", E: err})
+	}
+	var inv *EcommInvoice
+	for _, i := range invs {
+		if i.ID == invoiceID {
+			out := toEcommInvoice(i)
+			inv = &out
+			break
+		}
+	}
+	if inv == nil {
+		return nil, errors.New("That invoice does not exist.")
+	}
+
+	// Return the stored PDF if the invoice has not changed since it was
+	// generated. An unpaid invoice is regenerated once it is paid.
+	type stored struct {
+		Key  string `db:"bucket_key"`
+		Paid bool   `db:"paid"`
+	}
+	var st stored
+	q := `SELECT bucket_key, paid FROM ecomm_invoice_pdfs WHERE invoice_id = ?;`
+	err = db.Get(&st, q, invoiceID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the invoice.", E: err})
+	}
+	if err == nil && st.Paid == inv.Paid {
+		b, err := lc.Pvl.GetFile(&GetFileInput{
+			Key:    st.Key,
+			Bucket: config.MasterBucket(),
+			EncKey: config.MasterEncryption(),
+		})
+		if err == nil {
+			return b, nil
+		}
+		// Fall through to generate the PDF again if it cannot be retrieved.
+		e.ThrowError(&e.LogInput{M: "ERRINVOICEPDF1 " + invoiceID, E: err})
+	}
+
+	to, err := lc.getInvoiceParty(db, userID, cID)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the invoice.", E: err})
+	}
+	b, err := renderInvoicePDF(*inv, to, invoiceIssuer, config.LogoPath())
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error generating the invoice.", E: err})
+	}
+
+	key := uniuri.New() + ".pdf"
+	if err := lc.Pvl.StoreFile(key, b, config.MasterBucket(), config.MasterEncryption()); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error generating the invoice.", E: err})
+	}
+	q = `INSERT INTO ecomm_invoice_pdfs (invoice_id, user_id, bucket_key, paid, created)
+         VALUES (?,?,?,?,?) ON DUPLICATE KEY UPDATE bucket_key = VALUES(bucket_key),
+         paid = VALUES(paid), created = VALUES(created);`
+	if _, err := db.Exec(q, invoiceID, userID, key, inv.Paid, time.Now()); err != nil {
+		// The PDF can still be returned, it will be generated again next time.
+		e.ThrowError(&e.LogInput{M: "ERRINVOICEPDF2 " + invoiceID, E: err})
+	}
+	return b, nil
+}
+
+/*
+  getInvoiceParty returns who the invoice is addressed to. Users within an
+  enterprise are invoiced to the name, address and tax id of their
+  enterprise, otherwise those of the user are used. The country comes from
+  the billing address held by the billing provider.
+*/
+func (lc Lgc) getInvoiceParty(db DataCaller, userID string, customerID string) (invoiceParty, error) {
+	var out invoiceParty
+
+	var u User
+	q := `SELECT first_name, last_name, email, enterprise_id FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return out, err
+	}
+	out.Name = fmt.Sprintf("%v %v", u.FirstName, u.LastName)
+	out.Email = u.Email
+
+	tax, err := getTaxID(db, userID)
+	if err != nil {
+		return out, err
+	}
+	out.TaxID = tax.Value
+
+	if u.EnterpriseID.String != "" {
+		type ent struct {
+			Name    string `db:"name"`
+			Address string `db:"address"`
+		}
+		var en ent
+		q = `SELECT name, address FROM enterprises WHERE id = ?;`
+		if err := db.Get(&en, q, u.EnterpriseID.String); err != nil {
+			return out, err
+		}
+		out.Name = en.Name
+		out.Address = en.Address
+	}
+
+	sub, err := lc.billing().GetSub(customerID)
+	if err != nil {
+		return out, err
+	}
+	out.Country = sub.Country
+	if out.Address == "" {
+		var parts []string
+		for _, p := range []string{sub.Address, sub.City, sub.PostCode, sub.Country} {
+			if p != "" {
+				parts = append(parts, p)
+			}
+		}
+		out.Address = strings.Join(parts, ", ")
+	}
+	return out, nil
+}
+
+/*
+  renderInvoicePDF draws the invoice with gofpdf, in the same style as the
+  certificate of authenticity. Invoices with tax lines from the billing
+  provider are tax invoices, showing the tax of the customer's country.
+  Older invoices in Australian dollars from an Australian business to an
+  Australian customer are also tax invoices, showing the GST included in the
+  total. An Australian tax invoice is not rendered without the ABN of the
+  issuer. The logo is skipped if logoPath is empty.
+*/
+func renderInvoicePDF(inv EcommInvoice, to invoiceParty, from InvoiceIssuer, logoPath string) ([]byte, error) {
+	var taxLines []EcommLineItem
+	for _, li := range inv.Lines {
+		if li.Tax {
+			taxLines = append(taxLines, li)
+		}
+	}
+	gstFallback := len(taxLines) == 0 && countryCode(from.Country) == "AU" &&
+		countryCode(to.Country) == "AU" && normCurrency(inv.Currency) == CurrencyAUD
+	taxInvoice := gstFallback || len(taxLines) > 0
+	if taxInvoice && countryCode(from.Country) == "AU" && strings.TrimSpace(from.ABN) == "" {
+		return nil, errors.New("An Australian tax invoice requires the ABN of the issuer.")
+	}
+
+	pdf := gofpdf.New("P", "pt", "A4", ".")
+	pdf.AddPage()
+
+	// The core fonts are not UTF-8, so amounts are translated for currency
+	// symbols such as the pound.
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	money := func(cents int64) string {
+		return tr(formatMoney(cents, inv.Currency))
+	}
+
+	// Add the logo to the top left, and the title along the top.
+	if logoPath != "" {
+		pdf.Image(logoPath, 15, 19, -250, -250, false, "", 0, "")
+	}
+	title := "Invoice"
+	if taxInvoice {
+		title = "Tax Invoice"
+	}
+	pdf.SetFont("Helvetica", "B", 23)
+	pdf.SetXY(300, 30)
+	pdf.CellFormat(270, 30, title, "", 1, "R", false, 0, "")
+
+	// Write the issuer details on the right.
+	pdf.SetFont("Helvetica", "", 10)
+	issuer := []string{from.Name}
+	if from.ABN != "" {
+		issuer = append(issuer, "ABN "+from.ABN)
+	}
+	for _, l := range []string{from.Address, from.Email} {
+		if l != "" {
+			issuer = append(issuer, l)
+		}
+	}
+	pdf.SetX(300)
+	pdf.MultiCell(270, 13, strings.Join(issuer, "\n"), "", "R", false)
+
+	// Write who the invoice is to, and the invoice details.
+	pdf.SetY(150)
+	pdf.SetX(30)
+	pdf.SetFont("Helvetica", "B", 12)
+	pdf.CellFormat(270, 17, "Bill To", "", 0, "L", false, 0, "")
+	pdf.CellFormat(270, 17, "Invoice Details", "", 1, "R", false, 0, "")
+
+	status := "Due"
+	if inv.Paid {
+		status = "Paid"
+	}
+	left := []string{to.Name}
+	for _, l := range []string{to.Address, to.Email} {
+		if l != "" {
+			left = append(left, l)
+		}
+	}
+	if to.TaxID != "" {
+		left = append(left, "Tax ID: "+to.TaxID)
+	}
+	right := []string{
+		"Invoice: " + inv.ID,
+		"Date: " + inv.Date,
+		"Status: " + status,
+	}
+	pdf.SetFont("Helvetica", "", 10)
+	y := pdf.GetY()
+	pdf.SetXY(30, y)
+	pdf.MultiCell(270, 13, strings.Join(left, "\n"), "", "L", false)
+	endY := pdf.GetY()
+	pdf.SetXY(300, y)
+	pdf.MultiCell(270, 13, strings.Join(right, "\n"), "", "R", false)
+	if pdf.GetY() > endY {
+		endY = pdf.GetY()
+	}
+
+	// Draw the line items.
+	pdf.SetY(endY + 30)
+	pdf.SetX(30)
+	pdf.SetFillColor(240, 240, 240)
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(420, 20, "Description", "", 0, "L", true, 0, "")
+	pdf.CellFormat(115, 20, "Amount", "", 1, "R", true, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, li := range inv.Lines {
+		if li.Tax {
+			continue
+		}
+		desc := li.Description
+		if li.Proration {
+			desc += " (prorated)"
+		}
+		pdf.SetX(30)
+		pdf.CellFormat(420, 18, desc, "B", 0, "L", false, 0, "")
+		pdf.CellFormat(115, 18, money(li.Amount), "B", 1, "R", false, 0, "")
+	}
+
+	// Write the totals. The subtotal is the sum of the items and discount,
+	// which excludes any tax added to the price.
+	totals := [][2]string{}
+	if len(taxLines) > 0 {
+		var sub int64
+		for _, li := range inv.Lines {
+			if !li.Tax {
+				sub += li.Amount
+			}
+		}
+		totals = append(totals, [2]string{"Subtotal", money(sub)})
+		for _, li := range taxLines {
+			totals = append(totals, [2]string{li.Description, money(li.Amount)})
+		}
+		totals = append(totals, [2]string{"Total", money(inv.Total)})
+	} else if gstFallback {
+		gst := gstComponent(inv.Total)
+		totals = append(totals,
+			[2]string{"Subtotal (excl. GST)", money(inv.Total - gst)},
+			[2]string{"GST (10%)", money(gst)},
+			[2]string{"Total (incl. GST)", money(inv.Total)},
+		)
+	} else {
+		totals = append(totals, [2]string{"Total", money(inv.Total)})
+	}
+	if !inv.Paid {
+		totals = append(totals, [2]string{"Amount Due", money(inv.AmountDue)})
+	}
+	pdf.Ln(10)
+	for i, t := range totals {
+		if i == len(totals)-1 {
+			pdf.SetFont("Helvetica", "B", 10)
+		}
+		pdf.SetX(30)
+		pdf.CellFormat(420, 18, t[0], "", 0, "R", false, 0, "")
+		pdf.CellFormat(115, 18, t[1], "", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(30)
+	pdf.SetX(30)
+	pdf.SetFont("Helvetica", "", 8)
+	note := "All amounts are in " + currencyName(inv.Currency) + "."
+	if !taxInvoice && to.TaxID != "" {
+		note += " Tax to be accounted for by the recipient (reverse charge)."
+	} else if !taxInvoice {
+		note += " No GST has been charged."
+	}
+	pdf.MultiCell(535, 12, note, "", "L", false)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
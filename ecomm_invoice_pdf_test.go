@@ -0,0 +1,84 @@
+package logic
+
+import (
+	"bytes"
+	"database/sql"
+	"pleasesign/ecomm"
+	"testing"
+)
+
+// Test the gstComponent function returns one eleventh of the amount.
+func TestGstComponent(t *testing.T) {
+	tests := map[int64]int64{
+		1100: 100,
+		2900: 264,
+		0:    0,
+		-550: -50,
+	}
+	for in, want := range tests {
+		if got := gstComponent(in); got != want {
+			t.Errorf("gstComponent(%v) expected %v, got %v.", in, want, got)
+		}
+	}
+}
+
+// Test the renderInvoicePDF function renders both a tax invoice and an
+// invoice to an overseas customer.
+func TestRenderInvoicePDF(t *testing.T) {
+	inv := EcommInvoice{
+		ID:    "in_1",
+		Total: 2900,
+		Date:  "1 January 2017",
+		Paid:  true,
+		Lines: []EcommLineItem{{Description: "Pro", Amount: 2900}},
+	}
+	from := InvoiceIssuer{Name: "PleaseSign", ABN: "12 345 678 901", Country: "AU"}
+
+	for _, country := range []string{"Australia", "NZ"} {
+		to := invoiceParty{Name: "Acme", Address: "1 Street", Country: country}
+		b, err := renderInvoicePDF(inv, to, from, "")
+		if err != nil {
+			t.Fatalf("renderInvoicePDF returned an error for %v, got %v.", country, err)
+		}
+		if !bytes.HasPrefix(b, []byte("%PDF")) {
+			t.Errorf("renderInvoicePDF did not render a PDF for %v.", country)
+		}
+	}
+
+	// A tax invoice cannot be issued without the ABN.
+	from.ABN = ""
+	if _, err := renderInvoicePDF(inv, invoiceParty{Country: "AU"}, from, ""); err == nil {
+		t.Error("renderInvoicePDF rendered a tax invoice without an ABN.")
+	}
+	if _, err := renderInvoicePDF(inv, invoiceParty{Country: "NZ"}, from, ""); err != nil {
+		t.Errorf("renderInvoicePDF required an ABN for an invoice, got %v.", err)
+	}
+}
+
+// Test the EcommInvoicePDF function does not return the invoice of another
+// customer.
+func TestEcommInvoicePDFOwner(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*sql.NullString) = sql.NullString{String: cID, Valid: true}
+			return nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	_, err = lc.EcommInvoicePDF(db, ls, "in_other")
+	if err == nil || err.Error() != "That invoice does not exist." {
+		t.Errorf("EcommInvoicePDF returned another invoice, got %v.", err)
+	}
+}
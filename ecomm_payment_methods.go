@@ -0,0 +1,218 @@
+package logic
+
+import (
+	"errors"
+	"pleasesign/ecomm"
+	e "pleasesign/errlogger"
+)
+
+// The kinds of billing event recorded for changes to the saved cards.
+const (
+	billingEventCardAdded   = "payment_method.added"
+	billingEventCardDefault = "payment_method.default"
+	billingEventCardRemoved = "payment_method.removed"
+)
+
+// The statuses of the setup of a card returned by AddPaymentMethod.
+const (
+	setupSucceeded      = "succeeded"
+	setupRequiresAction = "requires_action"
+)
+
+// EcommPaymentMethod is a card saved against the customer.
+type EcommPaymentMethod struct {
+	ID       string
+	Brand    string
+	LastFour string
+	ExMon    string
+	ExYr     string
+	Default  bool // True for the card charged for the subscription.
+}
+
+// toEcommPaymentMethod converts a payment method from the ecomm package.
+func toEcommPaymentMethod(pm ecomm.PaymentMethod) EcommPaymentMethod {
+	return EcommPaymentMethod{
+		ID:       pm.ID,
+		Brand:    pm.Brand,
+		LastFour: pm.LastFour,
+		ExMon:    pm.ExMon,
+		ExYr:     pm.ExYr,
+		Default:  pm.Default,
+	}
+}
+
+// The input for the EcommAddPaymentMethod function.
+type EcommAddPMInput struct {
+	Token   string
+	Default bool // Make the card the default card once it is saved.
+}
+
+// The output for the EcommAddPaymentMethod function.
+type EcommPaymentSetup struct {
+	Method EcommPaymentMethod
+	// RequiresAction is true when the card must be authenticated (3-D
+	// Secure) before it is saved. The front end confirms the setup with
+	// the ClientSecret, and then sets the card as the default if needed.
+	RequiresAction bool
+	ClientSecret   string
+}
+
+// customerCards returns the customer id and user id of the current user
+// along with their saved cards.
+func (lc Lgc) customerCards(db DataCaller, ls LogicStore) (string, string, []ecomm.PaymentMethod, error) {
+	cID, userID, err := getCustomerID(db, ls)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if cID == "" {
+		return "", "", nil, errors.New("This customer does not exist.")
+	}
+	pms, err := lc.billing().ListPaymentMethods(cID)
+	if err != nil {
+		return "", "", nil, e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD1", E: err})
+	}
+	return cID, userID, pms, nil
+}
+
+// findCard returns the saved card with the id.
+func findCard(pms []ecomm.PaymentMethod, id string) (ecomm.PaymentMethod, bool) {
+	for _, pm := range pms {
+		if pm.ID == id {
+			return pm, true
+		}
+	}
+	return ecomm.PaymentMethod{}, false
+}
+
+// EcommGetPaymentMethods returns the cards saved against the current user.
+func (lc Lgc) EcommGetPaymentMethods(db DataCaller, ls LogicStore) ([]EcommPaymentMethod, error) {
+	_, _, pms, err := lc.customerCards(db, ls)
+	if err != nil {
+		return nil, err
+	}
+	out := []EcommPaymentMethod{}
+	for _, pm := range pms {
+		out = append(out, toEcommPaymentMethod(pm))
+	}
+	return out, nil
+}
+
+/*
+  EcommAddPaymentMethod saves another card against the current user without
+  replacing their default card, unless Default is set. When the bank of the
+  card requires the card to be authenticated (SCA), the card is not saved
+  until the front end confirms the returned client secret, after which it
+  can be made the default with EcommSetDefaultPaymentMethod.
+*/
+func (lc Lgc) EcommAddPaymentMethod(db DataCaller, ls LogicStore, in *EcommAddPMInput) (*EcommPaymentSetup, error) {
+	if in.Token == "" {
+		return nil, errors.New("Please provide a card.")
+	}
+	cID, userID, err := getCustomerID(db, ls)
+	if err != nil {
+		return nil, err
+	}
+	if cID == "" {
+		return nil, errors.New("This customer does not exist.")
+	}
+
+	setup, err := lc.billing().AddPaymentMethod(cID, in.Token)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD2", E: err})
+	}
+	out := &EcommPaymentSetup{
+		Method:         toEcommPaymentMethod(setup.PaymentMethod),
+		RequiresAction: setup.Status == setupRequiresAction,
+		ClientSecret:   setup.ClientSecret,
+	}
+	if out.RequiresAction {
+		return out, nil
+	}
+
+	body := out.Method.Brand + " ending in " + out.Method.LastFour
+	if err := logBillingEvent(db, userID, cID, billingEventCardAdded, body); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD3", E: err})
+	}
+	if in.Default {
+		if err := lc.setDefaultCard(db, userID, cID, setup.PaymentMethod); err != nil {
+			return nil, err
+		}
+		out.Method.Default = true
+	}
+	return out, nil
+}
+
+/*
+  EcommSetDefaultPaymentMethod makes the saved card the card charged for the
+  subscription of the current user. As with EcommUpdateCustomerInfo, any
+  failed payments are retried with the card.
+*/
+func (lc Lgc) EcommSetDefaultPaymentMethod(db DataCaller, ls LogicStore, id string) error {
+	cID, userID, pms, err := lc.customerCards(db, ls)
+	if err != nil {
+		return err
+	}
+	pm, ok := findCard(pms, id)
+	if !ok {
+		return errors.New("That card does not exist.")
+	}
+	if pm.Default {
+		return nil
+	}
+	return lc.setDefaultCard(db, userID, cID, pm)
+}
+
+// setDefaultCard sets the default card of the customer, and retries any
+// failed payments. A declined retry is left to the dunning schedule.
+func (lc Lgc) setDefaultCard(db DataCaller, userID string, cID string, pm ecomm.PaymentMethod) error {
+	if err := lc.billing().SetDefaultPaymentMethod(cID, pm.ID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD4", E: err})
+	}
+	body := pm.Brand + " ending in " + pm.LastFour
+	if err := logBillingEvent(db, userID, cID, billingEventCardDefault, body); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD3", E: err})
+	}
+	if err := lc.billing().RetryPayment(cID); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD5 " + cID, E: err})
+	}
+	return nil
+}
+
+/*
+  EcommRemovePaymentMethod removes a saved card from the current user. The
+  default card cannot be removed while the user is subscribed, as their
+  subscription would have nothing to charge; another card must be made the
+  default first.
+*/
+func (lc Lgc) EcommRemovePaymentMethod(db DataCaller, ls LogicStore, id string) error {
+	cID, userID, pms, err := lc.customerCards(db, ls)
+	if err != nil {
+		return err
+	}
+	pm, ok := findCard(pms, id)
+	if !ok {
+		return errors.New("That card does not exist.")
+	}
+
+	if pm.Default {
+		sub, err := lc.billing().GetSub(cID)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD6", E: err})
+		}
+		if sub.Plan != "" && !sub.CancelAtPeriodEnd {
+			if len(pms) == 1 {
+				return errors.New("Please add another card before removing this one.")
+			}
+			return errors.New("Please choose another default card before removing this one.")
+		}
+	}
+
+	if err := lc.billing().RemovePaymentMethod(cID, pm.ID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD7", E: err})
+	}
+	body := pm.Brand + " ending in " + pm.LastFour
+	if err := logBillingEvent(db, userID, cID, billingEventCardRemoved, body); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRPAYMENTMETHOD3", E: err})
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"testing"
+)
+
+// Test a card can be added without replacing the default card, made the
+// default, and the previous card removed.
+func TestEcommPaymentMethods(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	var events []interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*sql.NullString) = sql.NullString{String: cID, Valid: true}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			events = append(events, args[2])
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	pms, err := lc.EcommGetPaymentMethods(db, ls)
+	if err != nil || len(pms) != 1 || !pms[0].Default {
+		t.Fatalf("EcommGetPaymentMethods did not return the card, got %+v %v.", pms, err)
+	}
+	first := pms[0].ID
+
+	setup, err := lc.EcommAddPaymentMethod(db, ls, &EcommAddPMInput{Token: "tok"})
+	if err != nil || setup.RequiresAction || setup.Method.Default {
+		t.Fatalf("EcommAddPaymentMethod did not add the card, got %+v %v.", setup, err)
+	}
+	if pms, _ := lc.EcommGetPaymentMethods(db, ls); len(pms) != 2 || pms[0].ID != first || !pms[0].Default {
+		t.Errorf("EcommAddPaymentMethod replaced the default card, got %+v.", pms)
+	}
+
+	err = lc.EcommRemovePaymentMethod(db, ls, first)
+	if err == nil || err.Error() != "Please choose another default card before removing this one." {
+		t.Errorf("EcommRemovePaymentMethod removed the default card, got %v.", err)
+	}
+
+	if err := lc.EcommSetDefaultPaymentMethod(db, ls, setup.Method.ID); err != nil {
+		t.Fatalf("EcommSetDefaultPaymentMethod returned an error, got %v.", err)
+	}
+	if err := lc.EcommRemovePaymentMethod(db, ls, first); err != nil {
+		t.Fatalf("EcommRemovePaymentMethod returned an error, got %v.", err)
+	}
+	pms, _ = lc.EcommGetPaymentMethods(db, ls)
+	if len(pms) != 1 || pms[0].ID != setup.Method.ID || !pms[0].Default {
+		t.Errorf("The new card is not the only card, got %+v.", pms)
+	}
+
+	if err := lc.EcommSetDefaultPaymentMethod(db, ls, first); err == nil {
+		t.Error("EcommSetDefaultPaymentMethod accepted a removed card.")
+	}
+	want := []interface{}{billingEventCardAdded, billingEventCardDefault, billingEventCardRemoved}
+	if len(events) != len(want) {
+		t.Fatalf("The changes were not recorded, got %v.", events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("Expected the billing event %v, got %v.", want[i], events[i])
+		}
+	}
+}
+
+// Test a card that must be authenticated returns a client secret, and is
+// only saved once the setup has been confirmed.
+func TestEcommAddPaymentMethodSCA(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*sql.NullString) = sql.NullString{String: cID, Valid: true}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	setup, err := lc.EcommAddPaymentMethod(db, ls, &EcommAddPMInput{Token: MemTokenAuthRequired, Default: true})
+	if err != nil {
+		t.Fatalf("EcommAddPaymentMethod returned an error, got %v.", err)
+	}
+	if !setup.RequiresAction || setup.ClientSecret == "" || setup.Method.Default {
+		t.Errorf("EcommAddPaymentMethod did not require authentication, got %+v.", setup)
+	}
+	if err := lc.EcommSetDefaultPaymentMethod(db, ls, setup.Method.ID); err == nil {
+		t.Error("EcommSetDefaultPaymentMethod accepted a card that was not authenticated.")
+	}
+
+	mem.ConfirmSetup(cID, setup.Method.ID)
+	if err := lc.EcommSetDefaultPaymentMethod(db, ls, setup.Method.ID); err != nil {
+		t.Errorf("EcommSetDefaultPaymentMethod returned an error, got %v.", err)
+	}
+}
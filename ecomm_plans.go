@@ -0,0 +1,265 @@
+package logic
+
+import (
+	"errors"
+	"pleasesign/config"
+	"strings"
+	"sync"
+)
+
+// Feature flags that can be assigned to a plan in the plans table.
+const (
+	// FeatureGroups denotes a plan that owns an enterprise record, and
+	// can have group members and seats.
+	FeatureGroups = "groups"
+	// FeatureBranding denotes a plan that can use custom branding.
+	FeatureBranding = "branding"
+)
+
+// The billing intervals a plan can be charged at.
+const (
+	IntervalMonth = "month"
+	IntervalYear  = "year"
+)
+
+// normInterval returns the billing interval, where an empty interval is
+// monthly as every plan was monthly before yearly plans were introduced.
+func normInterval(interval string) string {
+	if interval == IntervalYear {
+		return IntervalYear
+	}
+	return IntervalMonth
+}
+
+// Plan is a single tier that a user can be subscribed to.
+// Plans are stored in the plans table and loaded into the plan catalog,
+// which is used to determine the user kind, quota and whether a plan
+// change is an upgrade or a downgrade. Each tier may have a monthly and a
+// yearly plan, which assign the same kind.
+type Plan struct {
+	ID           string `db:"id"`               // The plan id expected by the ecomm package.
+	Name         string `db:"name"`             // A friendly name for the plan.
+	Kind         string `db:"kind"`             // The user kind assigned to subscribers.
+	Quota        int    `db:"quota"`            // The user_quota assigned to subscribers.
+	Unmetered    bool   `db:"unmetered"`        // True if sending is not limited, the quota is not used.
+	Tier         int    `db:"tier"`             // The rank of the plan, higher is better.
+	Seats        int    `db:"seats"`            // The number of seats included in the plan.
+	TrialDays    int    `db:"trial_days"`       // The length of a free trial, 0 for no trial.
+	Features     string `db:"features"`         // A comma separated list of feature flags.
+	OveragePrice int64  `db:"overage_price"`    // The price of each document beyond the quota in cents, 0 to block.
+	Interval     string `db:"billing_interval"` // The billing interval, month or year.
+}
+
+// BillingInterval returns the interval the plan is billed at.
+func (p Plan) BillingInterval() string {
+	return normInterval(p.Interval)
+}
+
+// HasFeature returns true if the feature flag is assigned to the plan.
+func (p Plan) HasFeature(f string) bool {
+	for _, pf := range strings.Split(p.Features, ",") {
+		if strings.TrimSpace(pf) == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Paid returns true if the plan is billed through the ecomm package.
+// The free plan has a tier of 0.
+func (p Plan) Paid() bool {
+	return p.Tier > 0
+}
+
+// PlanCatalog holds every plan that is available, keyed by both the plan id
+// and the user kind the plan assigns.
+type PlanCatalog struct {
+	mu     sync.RWMutex
+	plans  []Plan
+	byID   map[string]Plan
+	byKind map[string]Plan
+	prices map[string]map[string]int64 // The price of each plan by currency.
+}
+
+// PlanPrice is the price of a plan in a currency, stored in the plan_prices
+// table.
+type PlanPrice struct {
+	PlanID   string `db:"plan_id"`
+	Currency string `db:"currency"`
+	Amount   int64  `db:"amount"` // The price per period in cents.
+}
+
+// NewPlanCatalog builds a catalog from the given plans.
+func NewPlanCatalog(plans []Plan) *PlanCatalog {
+	c := &PlanCatalog{}
+	c.set(plans)
+	return c
+}
+
+// set replaces the plans held by the catalog.
+func (c *PlanCatalog) set(plans []Plan) {
+	byID := make(map[string]Plan, len(plans))
+	byKind := make(map[string]Plan, len(plans))
+	for _, p := range plans {
+		byID[p.ID] = p
+		// Where several plans assign the same kind, the first plan loaded
+		// is used as the plan for that kind.
+		if _, ok := byKind[p.Kind]; !ok {
+			byKind[p.Kind] = p
+		}
+	}
+
+	c.mu.Lock()
+	c.plans = plans
+	c.byID = byID
+	c.byKind = byKind
+	c.mu.Unlock()
+}
+
+// setPrices replaces the prices held by the catalog.
+func (c *PlanCatalog) setPrices(prices []PlanPrice) {
+	byPlan := make(map[string]map[string]int64)
+	for _, p := range prices {
+		if byPlan[p.PlanID] == nil {
+			byPlan[p.PlanID] = make(map[string]int64)
+		}
+		byPlan[p.PlanID][strings.ToUpper(p.Currency)] = p.Amount
+	}
+
+	c.mu.Lock()
+	c.prices = byPlan
+	c.mu.Unlock()
+}
+
+// All returns every plan in the catalog, in the order they were loaded.
+func (c *PlanCatalog) All() []Plan {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]Plan, len(c.plans))
+	copy(out, c.plans)
+	return out
+}
+
+// Price returns the price of the plan in the currency.
+func (c *PlanCatalog) Price(id string, currency string) (int64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.prices[id][currency]
+	return p, ok
+}
+
+// ByID returns the plan with the ecomm plan id provided.
+func (c *PlanCatalog) ByID(id string) (Plan, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.byID[id]
+	return p, ok
+}
+
+// Variant returns the plan that assigns the user kind at the billing
+// interval, eg. the yearly plan of a tier.
+func (c *PlanCatalog) Variant(kind string, interval string) (Plan, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.plans {
+		if p.Kind == kind && p.BillingInterval() == normInterval(interval) {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// ByKind returns the plan that assigns the user kind provided.
+func (c *PlanCatalog) ByKind(kind string) (Plan, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	p, ok := c.byKind[kind]
+	return p, ok
+}
+
+// IsUpgrade returns true if moving from the current kind to the new kind
+// moves the user to a higher tier. Unknown kinds are never an upgrade.
+func (c *PlanCatalog) IsUpgrade(curKind string, newKind string) bool {
+	cur, ok := c.ByKind(curKind)
+	if !ok {
+		return false
+	}
+	n, ok := c.ByKind(newKind)
+	if !ok {
+		return false
+	}
+	return n.Tier > cur.Tier
+}
+
+// FreeQuota is the number of documents a free account can send in each
+// quota period. The quota of the free plan in the plans table takes its
+// place once the catalog is loaded, so this is only used until then.
+const FreeQuota = 3
+
+// freeQuota returns the quota of the free plan, which is assigned when a
+// user is moved to the free plan.
+func freeQuota() int {
+	if p, ok := planCatalog.ByKind("0"); ok {
+		return p.Quota
+	}
+	return FreeQuota
+}
+
+// defaultPlans are the plans that were offered before the plans table was
+// introduced, and match the rows seeded in database.sql (which are checked
+// by TestDefaultPlansSeeded). These are used until the catalog is loaded
+// from the database.
+// The monthly plan of each tier is listed first, so it is the plan for the
+// kind.
+func defaultPlans() []Plan {
+	return []Plan{
+		{ID: "free", Name: "Free", Kind: "0", Quota: FreeQuota, Tier: 0},
+		{ID: "101", Name: "Just You", Kind: "1", Quota: config.T1Lim, Tier: 1, Seats: 1, TrialDays: 14},
+		{ID: "101y", Name: "Just You (Yearly)", Kind: "1", Quota: config.T1Lim, Tier: 1, Seats: 1,
+			TrialDays: 14, Interval: IntervalYear},
+		{ID: "102", Name: "Entrepreneur", Kind: "2", Quota: config.T2Lim, Tier: 2, Seats: 1, TrialDays: 14},
+		{ID: "102y", Name: "Entrepreneur (Yearly)", Kind: "2", Quota: config.T2Lim, Tier: 2, Seats: 1,
+			TrialDays: 14, Interval: IntervalYear},
+		{ID: "103", Name: "Business Plus", Kind: "5", Unmetered: true, Tier: 3, Seats: 1, TrialDays: 14,
+			Features: FeatureGroups + "," + FeatureBranding},
+		{ID: "103y", Name: "Business Plus (Yearly)", Kind: "5", Unmetered: true, Tier: 3, Seats: 1,
+			TrialDays: 14, Features: FeatureGroups + "," + FeatureBranding, Interval: IntervalYear},
+	}
+}
+
+// planCatalog is the catalog used throughout the ecomm logic.
+var planCatalog = NewPlanCatalog(defaultPlans())
+
+/*
+  LoadPlanCatalog reads every active plan from the plans table, and the
+  price of each plan by currency from the plan_prices table, and replaces
+  the catalog used by the ecomm logic. This is called when the API starts
+  (setup.ConfigureLogic), and can be called again to pick up changes to the
+  plans table without a deploy. The current catalog is kept when an error
+  is returned, which the caller logs.
+*/
+func LoadPlanCatalog(db DataCaller) error {
+	var ps []Plan
+	q := `SELECT id, name, kind, quota, unmetered, tier, seats, trial_days, features,
+          overage_price, billing_interval FROM plans WHERE active = 1
+          ORDER BY tier ASC, billing_interval ASC;`
+	if err := db.Select(&ps, q); err != nil {
+		return err
+	}
+
+	// Keep the current catalog if the table has not been populated, as
+	// every subscription change relies on it.
+	if len(ps) == 0 {
+		return errors.New("No plans were found in the plans table.")
+	}
+
+	var prices []PlanPrice
+	q = `SELECT plan_id, currency, amount FROM plan_prices;`
+	if err := db.Select(&prices, q); err != nil {
+		return err
+	}
+
+	planCatalog.set(ps)
+	planCatalog.setPrices(prices)
+	return nil
+}
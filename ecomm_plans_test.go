@@ -0,0 +1,121 @@
+package logic
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// Test the plan catalog derives upgrades and downgrades from the tier of
+// each plan, so a new tier only requires a new plan.
+func TestPlanCatalogIsUpgrade(t *testing.T) {
+	c := NewPlanCatalog([]Plan{
+		{ID: "free", Kind: "0", Tier: 0},
+		{ID: "101", Kind: "1", Tier: 1},
+		{ID: "104", Kind: "3", Tier: 2},
+		{ID: "102", Kind: "2", Tier: 3},
+	})
+
+	// A kind 3 sits between a 1 and a 2.
+	if !c.IsUpgrade("1", "3") {
+		t.Error("IsUpgrade is not treating a move to a higher tier as an upgrade.")
+	}
+	if c.IsUpgrade("2", "3") {
+		t.Error("IsUpgrade is treating a move to a lower tier as an upgrade.")
+	}
+	if !c.IsUpgrade("0", "1") {
+		t.Error("IsUpgrade is not treating a move from free as an upgrade.")
+	}
+
+	// Unknown kinds are never an upgrade.
+	if c.IsUpgrade("1", "9") {
+		t.Error("IsUpgrade is treating an unknown kind as an upgrade.")
+	}
+}
+
+// Test the feature flags are parsed from the plan.
+func TestPlanHasFeature(t *testing.T) {
+	p := Plan{Features: "branding, groups"}
+	if !p.HasFeature(FeatureGroups) || !p.HasFeature(FeatureBranding) {
+		t.Errorf("HasFeature is not finding the flags in %v.", p.Features)
+	}
+	if p.HasFeature("api") {
+		t.Error("HasFeature is finding a flag that is not assigned.")
+	}
+}
+
+// Test the LoadPlanCatalog function replaces the catalog with the plans
+// from the database, and keeps the current catalog when none are returned.
+func TestLoadPlanCatalog(t *testing.T) {
+	defer planCatalog.set(defaultPlans())
+	defer planCatalog.setPrices(nil)
+
+	db := &MockDb{
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]Plan) = []Plan{}
+			return nil
+		},
+	}
+	if err := LoadPlanCatalog(db); err == nil {
+		t.Error("LoadPlanCatalog is not returning an error when no plans exist.")
+	}
+	if _, ok := planCatalog.ByID("101"); !ok {
+		t.Error("LoadPlanCatalog is not keeping the current catalog when no plans exist.")
+	}
+
+	db = &MockDb{
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *[]Plan:
+				*d = []Plan{
+					{ID: "free", Kind: "0", Tier: 0},
+					{ID: "201", Kind: "1", Tier: 1, Quota: 20},
+				}
+			case *[]PlanPrice:
+				*d = []PlanPrice{{PlanID: "201", Currency: "nzd", Amount: 1500}}
+			}
+			return nil
+		},
+	}
+	if err := LoadPlanCatalog(db); err != nil {
+		t.Errorf("LoadPlanCatalog is unexpectedly returning an error: %v", err)
+	}
+	lc := Lgc{}
+	if k := lc.getPlan("201"); k != "1" {
+		t.Errorf("getPlan is not using the loaded catalog. Got %v wanted 1.", k)
+	}
+	if k := lc.getPlan("101"); k != "" {
+		t.Errorf("getPlan is returning a plan that was not loaded. Got %v.", k)
+	}
+	if p, ok := planCatalog.Price("201", CurrencyNZD); !ok || p != 1500 {
+		t.Errorf("LoadPlanCatalog did not load the plan prices, got %v.", p)
+	}
+}
+
+// Test the plans seeded in database.sql match the default plans, whose
+// quotas come from the config.
+func TestDefaultPlansSeeded(t *testing.T) {
+	b, err := ioutil.ReadFile("database.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := regexp.MustCompile(`\('([^']+)', '[^']*', (\d+), (\d+), (\d), (\d+), \d+, \d+, '[^']*', '([^']+)'\)`)
+	rows := row.FindAllStringSubmatch(string(b), -1)
+	if len(rows) != len(defaultPlans()) {
+		t.Fatalf("database.sql seeds %v plans, expected %v.", len(rows), len(defaultPlans()))
+	}
+	for _, r := range rows {
+		p, ok := planCatalog.ByID(r[1])
+		if !ok {
+			t.Errorf("database.sql seeds the plan %v, which is not a default plan.", r[1])
+			continue
+		}
+		quota, _ := strconv.Atoi(r[3])
+		tier, _ := strconv.Atoi(r[5])
+		if r[2] != p.Kind || quota != p.Quota || (r[4] == "1") != p.Unmetered || tier != p.Tier ||
+			r[6] != p.BillingInterval() {
+			t.Errorf("database.sql seeds %v, which does not match the default plan %+v.", r[0], p)
+		}
+	}
+}
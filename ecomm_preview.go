@@ -0,0 +1,205 @@
+package logic
+
+import (
+	"errors"
+	e "pleasesign/errlogger"
+	"strconv"
+)
+
+// planChangeResult is how a user is updated when their plan changes.
+type planChangeResult struct {
+	Kind          string // The kind assigned to the user now.
+	NextKind      string // The kind the user moves to at the end of the period.
+	DowngradeDate string // When the scheduler moves the user, empty for none.
+	Quota         int    // The quota assigned now, 0 if it does not change.
+	InvoiceNow    bool   // True if the proration is invoiced immediately.
+	Interval      string // The billing interval of the user now.
+	NextInterval  string // The billing interval at the end of the period.
+	// AtPeriodEnd is true if the subscription is not changed now, and is
+	// moved to the plan by the scheduler at the end of the period. This is
+	// the case for a move from a yearly plan to a monthly plan.
+	AtPeriodEnd bool
+}
+
+/*
+  planChange returns how a user on the current kind is updated when moving
+  to the plan. Upgrades (pro is true) take effect immediately, and the
+  quota of the new plan is assigned; the proration is only invoiced now when
+  the user was already on a paid plan. Downgrades keep the current kind
+  and interval until the scheduler moves the user at the end of the period
+  (cpe).
+*/
+func planChange(curKind string, curInterval string, p Plan, pro bool, cpe string) planChangeResult {
+	curInterval = normInterval(curInterval)
+	if !pro {
+		return planChangeResult{
+			Kind:          curKind,
+			NextKind:      p.Kind,
+			DowngradeDate: cpe,
+			Interval:      curInterval,
+			NextInterval:  p.BillingInterval(),
+			AtPeriodEnd:   curInterval != p.BillingInterval(),
+		}
+	}
+
+	out := planChangeResult{
+		Kind:         p.Kind,
+		NextKind:     p.Kind,
+		Interval:     p.BillingInterval(),
+		NextInterval: p.BillingInterval(),
+	}
+	// Unmetered plans (bplus) do not use the quota.
+	if !p.Unmetered {
+		out.Quota = p.Quota
+	}
+	if c, ok := planCatalog.ByKind(curKind); ok && c.Paid() {
+		out.InvoiceNow = true
+	}
+	return out
+}
+
+/*
+  intervalProrated returns whether a plan change is prorated once the
+  billing interval is considered. pro is the result of isProrated, which
+  compares the tiers of the plans, and is decided first: an upgrade to a
+  higher tier applies now whatever the interval, and a downgrade to a lower
+  tier waits for the end of the period. Within the same tier, a move from a
+  monthly plan to a yearly plan is prorated, as the provider starts a new
+  yearly period now and credits the unused part of the month, while a move
+  from a yearly plan to a monthly plan is not, as the user has paid for the
+  year.
+*/
+func intervalProrated(curKind string, curInterval string, p Plan, pro bool) bool {
+	if pro {
+		return true
+	}
+	if planCatalog.IsUpgrade(p.Kind, curKind) {
+		return false
+	}
+	return normInterval(curInterval) != p.BillingInterval() && p.BillingInterval() == IntervalYear
+}
+
+// The output for the EcommPreviewPlanChange function.
+type EcommPlanPreview struct {
+	Plan              string
+	Interval          string // The billing interval of the plan.
+	Upgrade           bool
+	Kind              int    // The kind of the user once the plan is changed.
+	NextKind          int    // The kind the user has at the end of the period.
+	DowngradeDate     string // When the user is downgraded, empty for upgrades.
+	ProrationAmount   int64  // The prorated amount for the rest of the period.
+	ChargedNow        bool   // True if the proration is charged immediately.
+	NextInvoiceDate   string
+	NextInvoiceAmount int64
+	CurrentQuota      int
+	Quota             int // The quota once the plan is changed.
+	Lines             []EcommLineItem
+}
+
+/*
+  EcommPreviewPlanChange returns what EcommUpdateCustomerSub would do for
+  the plan, without changing the subscription or the user. The plan page
+  shows this as a confirmation step, so the user knows what they will be
+  charged before they change plan.
+  A change that waits for the end of the period (a move from a yearly plan
+  to a monthly plan) is not previewed with the provider, which would start
+  the new period now. The price of the plan is returned as the next invoice,
+  at the end of the current period.
+*/
+func (lc Lgc) EcommPreviewPlanChange(db DataCaller, plan string, ls LogicStore) (*EcommPlanPreview, error) {
+	userID := ls.GetCurrentUser().Id
+
+	type pu struct {
+		ui
+		Quota int `db:"quota"`
+	}
+	var u pu
+	q := `SELECT u.s_customer_id, u.kind, u.currency, u.billing_interval,
+          IFNULL(u.current_period_end, '') AS current_period_end, IFNULL(q.quota, 0) AS quota
+          FROM user u LEFT JOIN user_quota q ON q.user_id = u.id WHERE u.id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error previewing the subscription.", E: err})
+	}
+	if u.CID.String == "" {
+		return nil, errors.New("Customer was not found for that user.")
+	}
+
+	// The same checks are made as EcommUpdateCustomerSub.
+	sPlan := ls.getPlan(plan)
+	if sPlan == "" {
+		return nil, errors.New("That plan does not exist.")
+	}
+	p := changePlan(plan, sPlan)
+	if u.subscribed(plan, p) {
+		return nil, errors.New("User is already subscribed to the plan.")
+	}
+	if err := checkPlanCurrency(plan, u.Currency.String); err != nil {
+		return nil, err
+	}
+	pro := intervalProrated(u.Kind, u.Interval, p, ls.isProrated(u.Kind, sPlan))
+
+	if pc := planChange(u.Kind, u.Interval, p, pro, u.CPE); pc.AtPeriodEnd {
+		kind, _ := strconv.Atoi(pc.Kind)
+		nk, _ := strconv.Atoi(pc.NextKind)
+		price, _ := planCatalog.Price(plan, normCurrency(u.Currency.String))
+		return &EcommPlanPreview{
+			Plan:              plan,
+			Interval:          p.BillingInterval(),
+			Kind:              kind,
+			NextKind:          nk,
+			DowngradeDate:     pc.DowngradeDate,
+			NextInvoiceDate:   u.CPE,
+			NextInvoiceAmount: price,
+			CurrentQuota:      u.Quota,
+			Quota:             u.Quota,
+			Lines:             []EcommLineItem{{Amount: price, Description: p.Name, Plan: plan}},
+		}, nil
+	}
+
+	upcoming, err := lc.billing().PreviewSub(u.CID.String, plan, pro)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error previewing the subscription.", E: err})
+	}
+	inv := toEcommInvoice(*upcoming)
+
+	// The end of the period is unchanged by a plan change within the same
+	// interval, so the date of the next invoice is used when the user has no
+	// current_period_end.
+	cpe := u.CPE
+	if cpe == "" {
+		cpe = inv.Date
+	}
+	pc := planChange(u.Kind, u.Interval, p, pro, cpe)
+
+	// The page expects the kinds as numbers.
+	kind, _ := strconv.Atoi(pc.Kind)
+	nk, _ := strconv.Atoi(pc.NextKind)
+
+	out := &EcommPlanPreview{
+		Plan:              plan,
+		Interval:          p.BillingInterval(),
+		Upgrade:           pro,
+		Kind:              kind,
+		NextKind:          nk,
+		DowngradeDate:     pc.DowngradeDate,
+		ChargedNow:        pc.InvoiceNow,
+		NextInvoiceDate:   inv.Date,
+		NextInvoiceAmount: inv.Total,
+		CurrentQuota:      u.Quota,
+		Quota:             u.Quota,
+		Lines:             inv.Lines,
+	}
+	if pc.Quota > 0 {
+		out.Quota = pc.Quota
+	}
+	for _, li := range inv.Lines {
+		if li.Proration {
+			out.ProrationAmount += li.Amount
+		}
+	}
+	// A proration charged now is not part of the next invoice.
+	if pc.InvoiceNow {
+		out.NextInvoiceAmount -= out.ProrationAmount
+	}
+	return out, nil
+}
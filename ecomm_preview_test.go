@@ -0,0 +1,195 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"reflect"
+	"testing"
+)
+
+// Test the planChange function for upgrades, downgrades and changes of
+// billing interval.
+func TestPlanChange(t *testing.T) {
+	just, _ := planCatalog.ByKind("1")
+	ent, _ := planCatalog.ByKind("2")
+	entYearly, _ := planCatalog.Variant("2", IntervalYear)
+	justYearly, _ := planCatalog.Variant("1", IntervalYear)
+	bplus, _ := planCatalog.ByKind("5")
+	const m, y = IntervalMonth, IntervalYear
+
+	tests := []struct {
+		cur      string
+		interval string
+		p        Plan
+		pro      bool
+		want     planChangeResult
+	}{
+		// An upgrade from a paid plan is invoiced now.
+		{"1", m, ent, true, planChangeResult{Kind: "2", NextKind: "2", Quota: ent.Quota, InvoiceNow: true,
+			Interval: m, NextInterval: m}},
+		// An upgrade from free is charged when the subscription is created.
+		{"0", "", just, true, planChangeResult{Kind: "1", NextKind: "1", Quota: just.Quota, Interval: m,
+			NextInterval: m}},
+		// Plans without a quota do not change the quota.
+		{"2", m, bplus, true, planChangeResult{Kind: "5", NextKind: "5", InvoiceNow: true, Interval: m,
+			NextInterval: m}},
+		// A downgrade happens at the end of the period.
+		{"2", m, just, false, planChangeResult{Kind: "2", NextKind: "1", DowngradeDate: "2017-02-01",
+			Interval: m, NextInterval: m}},
+		// A move to yearly billing happens now.
+		{"2", m, entYearly, true, planChangeResult{Kind: "2", NextKind: "2", Quota: ent.Quota,
+			InvoiceNow: true, Interval: y, NextInterval: y}},
+		// A move to monthly billing happens at the end of the year.
+		{"2", y, ent, false, planChangeResult{Kind: "2", NextKind: "2", DowngradeDate: "2017-02-01",
+			Interval: y, NextInterval: m, AtPeriodEnd: true}},
+		// An upgrade to a monthly plan from a yearly plan happens now.
+		{"1", y, ent, true, planChangeResult{Kind: "2", NextKind: "2", Quota: ent.Quota, InvoiceNow: true,
+			Interval: m, NextInterval: m}},
+		// A downgrade to a yearly plan happens at the end of the period.
+		{"2", m, justYearly, false, planChangeResult{Kind: "2", NextKind: "1", DowngradeDate: "2017-02-01",
+			Interval: m, NextInterval: y, AtPeriodEnd: true}},
+	}
+	for _, tt := range tests {
+		got := planChange(tt.cur, tt.interval, tt.p, tt.pro, "2017-02-01")
+		if got != tt.want {
+			t.Errorf("planChange(%v, %v) expected %+v, got %+v.", tt.cur, tt.p.ID, tt.want, got)
+		}
+	}
+}
+
+// Test the intervalProrated function decides by the tiers first, and within
+// a tier prorates moves to yearly billing and not moves to monthly billing.
+func TestIntervalProrated(t *testing.T) {
+	just, _ := planCatalog.Variant("1", IntervalMonth)
+	justYearly, _ := planCatalog.Variant("1", IntervalYear)
+	ent, _ := planCatalog.Variant("2", IntervalMonth)
+	entYearly, _ := planCatalog.Variant("2", IntervalYear)
+	const m, y = IntervalMonth, IntervalYear
+
+	tests := []struct {
+		cur, interval string
+		p             Plan
+		pro, want     bool
+	}{
+		// Within a tier, the interval decides.
+		{"2", m, entYearly, false, true},
+		{"2", y, ent, false, false},
+		// Within an interval, the tiers decide.
+		{"2", "", just, false, false},
+		{"1", "", ent, true, true},
+		// An upgrade applies now, even when moving to monthly billing.
+		{"1", y, ent, true, true},
+		// A downgrade waits, even when moving to yearly billing.
+		{"2", m, justYearly, false, false},
+	}
+	for _, tt := range tests {
+		if got := intervalProrated(tt.cur, tt.interval, tt.p, tt.pro); got != tt.want {
+			t.Errorf("intervalProrated(%v, %v, %v) expected %v, got %v.", tt.cur, tt.interval, tt.p.ID,
+				tt.want, got)
+		}
+	}
+}
+
+// Test the EcommPreviewPlanChange function returns the proration of an
+// upgrade without changing the subscription.
+func TestEcommPreviewPlanChange(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("101", 1000)
+	mem.SetPrice("102", 2500)
+	cID, cpe, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		getPlanMock: func(string) string {
+			return "2"
+		},
+		isProratedMock: func(string, string) bool {
+			return true
+		},
+	}
+	currency := ""
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			// The user is selected into a type local to the function, so
+			// the fields are set by name.
+			d := reflect.ValueOf(dest).Elem()
+			d.FieldByName("CID").Set(reflect.ValueOf(sql.NullString{String: cID, Valid: true}))
+			d.FieldByName("Currency").Set(reflect.ValueOf(sql.NullString{String: currency, Valid: currency != ""}))
+			d.FieldByName("Kind").SetString("1")
+			d.FieldByName("CPE").SetString(cpe)
+			d.FieldByName("Quota").SetInt(5)
+			return nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	pr, err := lc.EcommPreviewPlanChange(db, "102", ls)
+	if err != nil {
+		t.Fatalf("EcommPreviewPlanChange returned an error, got %v.", err)
+	}
+	if pr.ProrationAmount != 1500 || !pr.ChargedNow || pr.NextInvoiceAmount != 2500 {
+		t.Errorf("EcommPreviewPlanChange returned the wrong amounts, got %+v.", pr)
+	}
+	if pr.Kind != 2 || pr.NextKind != 2 || pr.NextInvoiceDate != cpe || pr.DowngradeDate != "" {
+		t.Errorf("EcommPreviewPlanChange returned the wrong change, got %+v.", pr)
+	}
+
+	// The subscription has not changed.
+	sub, _ := mem.GetSub(cID)
+	if sub.Plan != "101" {
+		t.Errorf("EcommPreviewPlanChange changed the subscription to %v.", sub.Plan)
+	}
+
+	// The plan must be priced in the currency the user is billed in, as
+	// EcommUpdateCustomerSub requires.
+	currency = CurrencyNZD
+	_, err = lc.EcommPreviewPlanChange(db, "102", ls)
+	if err == nil || err.Error() != "That plan is not available in your currency." {
+		t.Errorf("EcommPreviewPlanChange previewed a plan not priced in the currency, got %v.", err)
+	}
+}
+
+// Test the EcommPreviewPlanChange function does not preview a move from a
+// yearly plan to a monthly plan with the provider.
+func TestEcommPreviewPlanChangePeriodEnd(t *testing.T) {
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		getPlanMock: func(string) string {
+			return "2"
+		},
+		isProratedMock: func(string, string) bool {
+			return false
+		},
+	}
+	cpe := "2018-01-01 00:00:00"
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			d := reflect.ValueOf(dest).Elem()
+			d.FieldByName("CID").Set(reflect.ValueOf(sql.NullString{String: "abc123", Valid: true}))
+			d.FieldByName("Kind").SetString("2")
+			d.FieldByName("Interval").SetString(IntervalYear)
+			d.FieldByName("CPE").SetString(cpe)
+			return nil
+		},
+	}
+	// The provider has no customer, so any preview with it fails.
+	lc := Lgc{Billing: NewMemBilling()}
+
+	pr, err := lc.EcommPreviewPlanChange(db, "102", ls)
+	if err != nil {
+		t.Fatalf("EcommPreviewPlanChange returned an error, got %v.", err)
+	}
+	if pr.Upgrade || pr.ChargedNow || pr.ProrationAmount != 0 {
+		t.Errorf("EcommPreviewPlanChange charged a move to monthly billing now, got %+v.", pr)
+	}
+	if pr.NextInvoiceDate != cpe || pr.DowngradeDate != cpe || pr.Interval != IntervalMonth {
+		t.Errorf("EcommPreviewPlanChange did not move to monthly billing at the end of the year, got %+v.", pr)
+	}
+}
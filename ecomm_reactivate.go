@@ -0,0 +1,89 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// emailSubReactivated is the Mandrill template sent when a user undoes the
+// cancellation of their subscription.
+const emailSubReactivated = "subscription-reactivated"
+
+/*
+  EcommReactivateSub undoes EcommCancelCustomerSub for the current user,
+  before their subscription has ended. The subscription is no longer set to
+  cancel with the billing provider, the next_kind and next_interval of the
+  user are restored to their current kind and interval, and the
+  downgrade_date is cleared, so the scheduler
+  does not downgrade them. The user is not charged, as the subscription
+  continues from the current period.
+*/
+func (lc Lgc) EcommReactivateSub(db DataCaller, ls LogicStore) error {
+	userID := ls.GetCurrentUser().Id
+
+	type ru struct {
+		CID           sql.NullString `db:"s_customer_id"`
+		Kind          string         `db:"kind"`
+		NextKind      sql.NullString `db:"next_kind"`
+		DowngradeDate sql.NullString `db:"downgrade_date"`
+		FirstName     string         `db:"first_name"`
+		Email         string         `db:"email"`
+	}
+	var u ru
+	q := `SELECT s_customer_id, kind, next_kind, downgrade_date, first_name, email
+          FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error when reactivating the subscription.", E: err})
+	}
+	if u.CID.String == "" || u.Kind == "0" {
+		return errors.New("There is no subscription to reactivate.")
+	}
+
+	// Only a cancellation can be undone, which moves the user to the free
+	// kind at the end of the period. A downgrade to another paid plan is
+	// undone by changing plan.
+	if u.NextKind.String != "0" || !u.DowngradeDate.Valid {
+		return errors.New("The subscription has not been cancelled.")
+	}
+	if end, err := time.Parse("2006-01-02 15:04:05", u.DowngradeDate.String); err == nil && !end.After(time.Now()) {
+		return errors.New("The subscription has already ended, please subscribe again.")
+	}
+
+	cpe, err := lc.billing().ReactivateSub(u.CID.String)
+	if err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error when reactivating the subscription.", E: err})
+	}
+
+	err = withTx(db, func(tx DataCaller) error {
+		q := `UPDATE user SET next_kind = kind, next_interval = billing_interval,
+              downgrade_date = NULL WHERE id = ?;`
+		if _, err := tx.Exec(q, userID); err != nil {
+			return err
+		}
+		return logBillingEvent(tx, userID, u.CID.String, billingEventReactivated, "Cancellation undone before the end of the billing period.")
+	})
+	if err != nil {
+		// The user is still moving to free, so the subscription should
+		// still end.
+		lc.compensate("cancel reactivated subscription for "+u.CID.String, func() error {
+			return lc.billing().CancelSub(u.CID.String)
+		})
+		return e.ThrowError(&e.LogInput{M: "Error when reactivating the subscription.", E: err})
+	}
+
+	// The subscription has been reactivated, so a failed email is logged
+	// rather than returned.
+	err = lc.Pvl.buildBillingEmail(&buildBillingEmailInput{
+		template:  emailSubReactivated,
+		firstName: u.FirstName,
+		email:     u.Email,
+		vars:      map[string]string{"period_end": cpe},
+		db:        db,
+	})
+	if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRREACTIVATE1 " + userID, E: err})
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the EcommReactivateSub function only reactivates a subscription that
+// has been cancelled and has not yet ended.
+func TestEcommReactivateSub(t *testing.T) {
+	future := time.Now().AddDate(0, 0, 10).Format("2006-01-02 15:04:05")
+	past := time.Now().AddDate(0, 0, -1).Format("2006-01-02 15:04:05")
+
+	tests := []struct {
+		next, downgrade string
+		want            string
+	}{
+		{"2", "", "The subscription has not been cancelled."},
+		{"1", future, "The subscription has not been cancelled."},
+		{"0", past, "The subscription has already ended, please subscribe again."},
+	}
+	for _, tt := range tests {
+		db := &MockDb{
+			GetMock: func(dest interface{}, query string, args ...interface{}) error {
+				// The user is selected into a type local to the function, so
+				// the fields are set by name.
+				d := reflect.ValueOf(dest).Elem()
+				d.FieldByName("CID").Set(reflect.ValueOf(sql.NullString{String: "cus_1", Valid: true}))
+				d.FieldByName("Kind").SetString("2")
+				d.FieldByName("NextKind").Set(reflect.ValueOf(sql.NullString{String: tt.next, Valid: true}))
+				d.FieldByName("DowngradeDate").Set(reflect.ValueOf(sql.NullString{String: tt.downgrade, Valid: tt.downgrade != ""}))
+				return nil
+			},
+		}
+		ls := &MockLogic{
+			GetCurrentUserMock: func() *UserAuth {
+				return &UserAuth{Id: "1"}
+			},
+		}
+		lc := Lgc{}
+		err := lc.EcommReactivateSub(db, ls)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("EcommReactivateSub expected %v, got %v.", tt.want, err)
+		}
+	}
+}
+
+// Test the EcommReactivateSub function restores the kind and interval the
+// user moves to, so a user who cancelled a yearly plan stays on it.
+func TestEcommReactivateSubRestores(t *testing.T) {
+	mem := NewMemBilling()
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.CancelSub(cID)
+
+	future := time.Now().AddDate(0, 0, 10).Format("2006-01-02 15:04:05")
+	var update string
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			d := reflect.ValueOf(dest).Elem()
+			d.FieldByName("CID").Set(reflect.ValueOf(sql.NullString{String: cID, Valid: true}))
+			d.FieldByName("Kind").SetString("2")
+			d.FieldByName("NextKind").Set(reflect.ValueOf(sql.NullString{String: "0", Valid: true}))
+			d.FieldByName("DowngradeDate").Set(reflect.ValueOf(sql.NullString{String: future, Valid: true}))
+			return nil
+		},
+		ExecMock: func(query string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(query, "UPDATE user") {
+				update = query
+			}
+			return nil, nil
+		},
+	}
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	lc := Lgc{Billing: mem, Pvl: &MockPrivateLogic{}}
+	if err := lc.EcommReactivateSub(db, ls); err != nil {
+		t.Fatalf("EcommReactivateSub returned an error, got %v.", err)
+	}
+	if !strings.Contains(update, "next_kind = kind") || !strings.Contains(update, "next_interval = billing_interval") {
+		t.Errorf("EcommReactivateSub did not restore the next kind and interval, got %v.", update)
+	}
+}
+
+// Test the MemBilling ReactivateSub function stops a cancelled subscription
+// from ending.
+func TestMemBillingReactivateSub(t *testing.T) {
+	mem := NewMemBilling()
+	cID, cpe, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.ReactivateSub(cID); err == nil {
+		t.Error("ReactivateSub reactivated a subscription that was not cancelled.")
+	}
+
+	mem.CancelSub(cID)
+	end, err := mem.ReactivateSub(cID)
+	if err != nil || end != cpe {
+		t.Fatalf("ReactivateSub did not reactivate the subscription, got %v %v.", end, err)
+	}
+	mem.Renew(cID)
+	if sub, _ := mem.GetSub(cID); sub == nil || sub.Plan != "102" {
+		t.Errorf("The reactivated subscription ended, got %+v.", sub)
+	}
+}
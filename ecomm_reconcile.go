@@ -0,0 +1,235 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"pleasesign/ecomm"
+	e "pleasesign/errlogger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// billingEventReconciled is recorded when EcommReconcile repairs a user.
+const billingEventReconciled = "subscription.reconciled"
+
+// The fields of a user that can disagree with their subscription.
+const (
+	MismatchKind      = "kind"
+	MismatchNextKind  = "next_kind"
+	MismatchInterval  = "billing_interval"
+	MismatchPeriodEnd = "current_period_end"
+	MismatchSeats     = "seats"
+	// MismatchCancelledButPaid is a user who has cancelled, or is free,
+	// while their subscription continues to be charged.
+	MismatchCancelledButPaid = "cancelled_but_paid"
+	// MismatchNoSubscription is a user on a paid plan without a
+	// subscription with the billing provider.
+	MismatchNoSubscription = "no_subscription"
+)
+
+// The output for the EcommReconcile function, which is returned to the
+// caller of /ecomm_reconcile.
+type EcommReconcileReport struct {
+	Checked    int               // The users with a customer id.
+	Mismatches []EcommMismatch   // Every field that disagrees with the provider.
+	Repaired   int               // The users that were repaired.
+	Failed     map[string]string // The error for each user that failed, by user id.
+}
+
+// EcommMismatch is a field of a user that disagrees with their subscription.
+type EcommMismatch struct {
+	UserID     string
+	CustomerID string
+	Field      string
+	Local      string // The value held for the user.
+	Provider   string // The value expected from the subscription.
+	Repaired   bool
+}
+
+// reconcileUser is the billing state of a user compared by EcommReconcile.
+type reconcileUser struct {
+	ID           string `db:"id"`
+	Kind         string `db:"kind"`
+	NextKind     string `db:"next_kind"`
+	CPE          string `db:"current_period_end"`
+	Interval     string `db:"billing_interval"`
+	CID          string `db:"s_customer_id"`
+	EnterpriseID string `db:"enterprise_id"`
+	Seats        int    `db:"seats"`
+}
+
+// samePeriodEnd returns true if the period ends are the same time. The
+// database may return the date in another layout to the provider.
+func samePeriodEnd(local string, provider string) bool {
+	if local == provider {
+		return true
+	}
+	l, err := time.Parse(billingDate, local)
+	if err != nil {
+		l, err = time.Parse(time.RFC3339, local)
+	}
+	p, perr := time.Parse(billingDate, provider)
+	return err == nil && perr == nil && l.Equal(p)
+}
+
+/*
+  compareSub returns the fields of the user that disagree with their
+  subscription. The user is expected to match what syncEcommSub would make
+  of the subscription: a user may be on a higher kind than their plan while
+  they wait to be downgraded, but never a lower one. A user who has
+  cancelled or is free while the subscription continues, and a paid user
+  without a subscription, are reported on their own as the other fields
+  cannot be compared.
+*/
+func compareSub(u reconcileUser, sub *ecomm.Sub) ([]EcommMismatch, error) {
+	mismatch := func(field string, local string, provider string) EcommMismatch {
+		return EcommMismatch{
+			UserID:     u.ID,
+			CustomerID: u.CID,
+			Field:      field,
+			Local:      local,
+			Provider:   provider,
+		}
+	}
+
+	if sub.Plan == "" {
+		if u.Kind == "0" {
+			return nil, nil
+		}
+		return []EcommMismatch{mismatch(MismatchNoSubscription, u.Kind, "")}, nil
+	}
+	p, ok := planCatalog.ByID(sub.Plan)
+	if !ok {
+		return nil, fmt.Errorf("unknown plan %v", sub.Plan)
+	}
+	if !sub.CancelAtPeriodEnd && (u.Kind == "0" || u.NextKind == "0") {
+		local := fmt.Sprintf("%v -> %v", u.Kind, u.NextKind)
+		return []EcommMismatch{mismatch(MismatchCancelledButPaid, local, p.Kind)}, nil
+	}
+
+	var out []EcommMismatch
+	if planCatalog.IsUpgrade(u.Kind, p.Kind) {
+		out = append(out, mismatch(MismatchKind, u.Kind, p.Kind))
+	}
+	next := p.Kind
+	if sub.CancelAtPeriodEnd {
+		next = "0"
+	}
+	if u.NextKind != next {
+		out = append(out, mismatch(MismatchNextKind, u.NextKind, next))
+	}
+	if normInterval(u.Interval) != p.BillingInterval() {
+		out = append(out, mismatch(MismatchInterval, u.Interval, p.BillingInterval()))
+	}
+	if !samePeriodEnd(u.CPE, sub.CurEnd) {
+		out = append(out, mismatch(MismatchPeriodEnd, u.CPE, sub.CurEnd))
+	}
+	if p.HasFeature(FeatureGroups) && u.Kind == p.Kind && u.EnterpriseID != "" &&
+		sub.Quantity > 0 && int64(u.Seats) != sub.Quantity {
+		out = append(out, mismatch(MismatchSeats, strconv.Itoa(u.Seats),
+			strconv.FormatInt(sub.Quantity, 10)))
+	}
+	return out, nil
+}
+
+/*
+  EcommReconcile compares every user with a customer id against their
+  subscription with the billing provider, and reports the users whose kind,
+  next_kind, billing_interval, current_period_end or seats disagree, along
+  with users who are charged after cancelling and paid users without a
+  subscription. These occur when a webhook is lost or a change is made in
+  the Stripe dashboard.
+  When repair is true the mismatches are repaired: the user is aligned with
+  the subscription as the webhook would have done, a user who has cancelled
+  has their subscription cancelled at the end of the period, and a paid user
+  without a subscription is moved to the free plan. Each repair is recorded
+  as a billing event.
+  This is an administrative command that is only available to admins. The
+  report is requested with a GET of /ecomm_reconcile, and the repair with a
+  POST.
+*/
+func (lc Lgc) EcommReconcile(db DataCaller, ls LogicStore, repair bool) (*EcommReconcileReport, error) {
+	admin, err := isAdmin(db, ls.GetCurrentUser().Id)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRRECONCILE3", E: err})
+	} else if !admin {
+		return nil, errors.New("You do not have permission to reconcile subscriptions.")
+	}
+
+	var users []reconcileUser
+	q := `SELECT u.id, u.kind, u.next_kind, IFNULL(u.current_period_end, '') AS current_period_end,
+          u.billing_interval, u.s_customer_id, IFNULL(u.enterprise_id, '') AS enterprise_id,
+          IFNULL(ent.seats, 0) AS seats
+          FROM user u LEFT JOIN enterprises ent ON ent.id = u.enterprise_id
+          WHERE u.s_customer_id IS NOT NULL AND u.s_customer_id != '' ORDER BY u.id;`
+	if err := db.Select(&users, q); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRRECONCILE", E: err})
+	}
+
+	report := &EcommReconcileReport{Checked: len(users), Failed: map[string]string{}}
+	for _, u := range users {
+		sub, err := lc.billing().GetSub(u.CID)
+		if err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRRECONCILE1 " + u.ID, E: err})
+			report.Failed[u.ID] = err.Error()
+			continue
+		}
+		ms, err := compareSub(u, sub)
+		if err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRRECONCILE1 " + u.ID, E: err})
+			report.Failed[u.ID] = err.Error()
+			continue
+		}
+		if len(ms) == 0 {
+			continue
+		}
+
+		if repair {
+			if err := lc.repairSub(db, u, ms); err != nil {
+				e.ThrowError(&e.LogInput{M: "ERRRECONCILE2 " + u.ID, E: err})
+				report.Failed[u.ID] = err.Error()
+			} else {
+				for i := range ms {
+					ms[i].Repaired = true
+				}
+				report.Repaired++
+			}
+		}
+		report.Mismatches = append(report.Mismatches, ms...)
+	}
+	return report, nil
+}
+
+// repairSub resolves the mismatches of a single user in a transaction, and
+// records what was repaired as a billing event.
+func (lc Lgc) repairSub(db DataCaller, u reconcileUser, ms []EcommMismatch) error {
+	var fields []string
+	for _, m := range ms {
+		fields = append(fields, fmt.Sprintf("%v %v -> %v", m.Field, m.Local, m.Provider))
+	}
+	body := strings.Join(fields, ", ")
+
+	switch ms[0].Field {
+	case MismatchCancelledButPaid:
+		// The user keeps what they have paid for, and is moved to the free
+		// plan by the subscription.deleted webhook at the end of the period.
+		if err := lc.billing().CancelSub(u.CID); err != nil {
+			return err
+		}
+		return logBillingEvent(db, u.ID, u.CID, billingEventReconciled, body)
+	case MismatchNoSubscription:
+		// The user is moved to the free plan the same way as a scheduled
+		// downgrade, which ends the group of a business plus owner.
+		_, err := lc.downgradeNow(db, u.ID, billingEventReconciled, body, nil)
+		return err
+	}
+
+	return withTx(db, func(tx DataCaller) error {
+		user := hookUser{ID: u.ID, Kind: u.Kind, NextKind: u.NextKind}
+		if _, err := lc.syncEcommSub(tx, user, u.CID); err != nil {
+			return err
+		}
+		return logBillingEvent(tx, u.ID, u.CID, billingEventReconciled, body)
+	})
+}
@@ -0,0 +1,147 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+)
+
+// Test the compareSub function reports the fields that disagree with the
+// subscription, and allows a pending downgrade.
+func TestCompareSub(t *testing.T) {
+	cpe := "2026-11-01 00:00:00"
+	tests := []struct {
+		name string
+		user reconcileUser
+		sub  ecomm.Sub
+		want []string
+	}{
+		{"matching", reconcileUser{Kind: "2", NextKind: "2", CPE: cpe, Interval: IntervalMonth},
+			ecomm.Sub{Plan: "102", CurEnd: cpe, Quantity: 1}, nil},
+		{"pending downgrade", reconcileUser{Kind: "2", NextKind: "1", CPE: cpe, Interval: IntervalMonth},
+			ecomm.Sub{Plan: "101", CurEnd: cpe, Quantity: 1}, nil},
+		{"missed upgrade", reconcileUser{Kind: "1", NextKind: "1", CPE: cpe, Interval: IntervalMonth},
+			ecomm.Sub{Plan: "102y", CurEnd: "2027-11-01 00:00:00", Quantity: 1},
+			[]string{MismatchKind, MismatchNextKind, MismatchInterval, MismatchPeriodEnd}},
+		{"seats", reconcileUser{Kind: "5", NextKind: "5", CPE: cpe, Interval: IntervalMonth,
+			EnterpriseID: "FF", Seats: 3}, ecomm.Sub{Plan: "103", CurEnd: cpe, Quantity: 5},
+			[]string{MismatchSeats}},
+		{"cancelled but paid", reconcileUser{Kind: "2", NextKind: "0", CPE: cpe, Interval: IntervalMonth},
+			ecomm.Sub{Plan: "102", CurEnd: cpe, Quantity: 1}, []string{MismatchCancelledButPaid}},
+		{"no subscription", reconcileUser{Kind: "2", NextKind: "2", CPE: cpe, Interval: IntervalMonth},
+			ecomm.Sub{}, []string{MismatchNoSubscription}},
+	}
+	for _, tc := range tests {
+		ms, err := compareSub(tc.user, &tc.sub)
+		if err != nil {
+			t.Errorf("%v: compareSub returned an error, got %v.", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, m := range ms {
+			got = append(got, m.Field)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v: compareSub expected %v, got %v.", tc.name, tc.want, got)
+		}
+	}
+}
+
+// Test the EcommReconcile function cancels the subscription of a user who
+// has cancelled but is still subscribed, and reports users that fail.
+func TestEcommReconcile(t *testing.T) {
+	mem := NewMemBilling()
+	cID, cpe, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []interface{}
+	admin := true
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*bool) = admin
+			return nil
+		},
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*[]reconcileUser) = []reconcileUser{
+				{ID: "1", Kind: "2", NextKind: "0", CPE: cpe, Interval: IntervalMonth, CID: cID},
+				{ID: "2", Kind: "2", NextKind: "2", CID: "cus_missing"},
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(q, "INSERT INTO billing_events") {
+				events = append(events, args[2])
+			}
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Billing: mem}
+	ls := &MockLogic{GetCurrentUserMock: func() *UserAuth { return &UserAuth{Id: "admin"} }}
+
+	report, err := lc.EcommReconcile(db, ls, false)
+	if err != nil {
+		t.Fatalf("EcommReconcile returned an error, got %v.", err)
+	}
+	if report.Checked != 2 || len(report.Mismatches) != 1 || report.Repaired != 0 {
+		t.Errorf("EcommReconcile returned the wrong report, got %+v.", report)
+	}
+	if _, ok := report.Failed["2"]; !ok {
+		t.Errorf("EcommReconcile did not report the failed user, got %+v.", report)
+	}
+	if sub, _ := mem.GetSub(cID); sub.CancelAtPeriodEnd {
+		t.Error("EcommReconcile repaired the subscription without repair.")
+	}
+
+	report, err = lc.EcommReconcile(db, ls, true)
+	if err != nil {
+		t.Fatalf("EcommReconcile returned an error, got %v.", err)
+	}
+	if report.Repaired != 1 || !report.Mismatches[0].Repaired {
+		t.Errorf("EcommReconcile did not repair the user, got %+v.", report)
+	}
+	if sub, _ := mem.GetSub(cID); !sub.CancelAtPeriodEnd {
+		t.Error("EcommReconcile did not cancel the subscription.")
+	}
+	if len(events) != 1 || events[0] != billingEventReconciled {
+		t.Errorf("EcommReconcile did not record the repair, got %v.", events)
+	}
+
+	// Users who are not admins cannot reconcile subscriptions.
+	admin = false
+	if _, err := lc.EcommReconcile(db, ls, false); err == nil {
+		t.Error("EcommReconcile allowed a user who is not an admin.")
+	}
+}
+
+// Test a paid user without a subscription is repaired through the shared
+// downgrade, which ends the group of a business plus owner.
+func TestRepairSubNoSubscription(t *testing.T) {
+	var qs []string
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *downgradeUser:
+				*d = downgradeUser{ID: "1", Kind: "5", NextKind: "5",
+					EnterpriseID: sql.NullString{String: "ent", Valid: true}}
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			qs = append(qs, q)
+			return nil, nil
+		},
+	}}
+	lc := Lgc{Pvl: &MockPrivateLogic{}}
+
+	u := reconcileUser{ID: "1", Kind: "5", CID: "cus_1", EnterpriseID: "ent"}
+	ms := []EcommMismatch{{UserID: "1", Field: MismatchNoSubscription}}
+	if err := lc.repairSub(db, u, ms); err != nil {
+		t.Fatalf("repairSub returned an error, got %v.", err)
+	}
+	if all := strings.Join(qs, "\n"); !strings.Contains(all, "UPDATE enterprises") {
+		t.Errorf("repairSub did not end the group of the owner, got %v.", all)
+	}
+}
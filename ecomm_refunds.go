@@ -0,0 +1,297 @@
+package logic
+
+import (
+	"github.com/dchest/uniuri"
+
+	"database/sql"
+	"errors"
+	"fmt"
+	e "pleasesign/errlogger"
+	"strings"
+	"time"
+)
+
+// The kinds of refund that can be issued against an invoice.
+const (
+	// RefundKindRefund returns the amount to the card of the customer.
+	RefundKindRefund = "refund"
+	// RefundKindCredit adds the amount to the balance of the customer,
+	// which is applied to their following invoices.
+	RefundKindCredit = "credit"
+)
+
+// The kinds of billing event recorded for refunds and credits.
+const (
+	billingEventRefunded = "invoice.refunded"
+	billingEventCredited = "invoice.credited"
+)
+
+// The Mandrill templates sent when a refund or credit is issued.
+const (
+	emailInvoiceRefunded = "invoice-refunded"
+	emailInvoiceCredited = "invoice-credited"
+)
+
+// The input for the EcommAdminRefund function.
+type EcommRefundInput struct {
+	UserID    string // The user the invoice was issued to.
+	InvoiceID string
+	Kind      string // refund or credit.
+	Amount    int64  // The amount in cents, 0 for the rest of the invoice.
+	Reason    string // Why the refund was issued, which is sent to the customer.
+}
+
+// EcommRefund is a refund or credit issued against an invoice, stored in the
+// ecomm_refunds table.
+type EcommRefund struct {
+	ID        string `db:"id"` // The id of the refund or credit note from the provider.
+	InvoiceID string `db:"invoice_id"`
+	Kind      string `db:"kind"`
+	Amount    int64  `db:"amount"`
+	Currency  string `db:"currency"`
+	Reason    string `db:"reason"`
+	IssuedBy  string `db:"issued_by"` // The id of the admin who issued it, empty for the provider.
+	Created   string `db:"created"`
+	Display   string `db:"-"` // The amount formatted in the currency.
+}
+
+// isAdmin returns true if the user may use the administrative API.
+func isAdmin(db DataCaller, userID string) (bool, error) {
+	var admin bool
+	q := `SELECT admin FROM user WHERE id = ?;`
+	err := db.Get(&admin, q, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return admin, err
+}
+
+/*
+  EcommAdminRefund issues a full or partial refund, or an account credit,
+  against an invoice of a user. This is used by support and is only
+  available to admins. The refund is made with the billing provider,
+  recorded in the ecomm_refunds table so it is shown with the invoice by
+  EcommGetCustomerInv, and the customer is emailed with the reason.
+  The refunds and credits of an invoice cannot exceed its total. The refund
+  is recorded as pending, with the refunds of the invoice locked, before it
+  is issued. Concurrent refunds therefore cannot both take what remains of
+  the invoice, and the charge.refunded webhook counts the refund as issued
+  even when it arrives before the refund is confirmed.
+*/
+func (lc Lgc) EcommAdminRefund(db DataCaller, ls LogicStore, in *EcommRefundInput) (*EcommRefund, error) {
+	adminID := ls.GetCurrentUser().Id
+	admin, err := isAdmin(db, adminID)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+	} else if !admin {
+		return nil, errors.New("You do not have permission to issue refunds.")
+	}
+
+	if in.Kind != RefundKindRefund && in.Kind != RefundKindCredit {
+		return nil, errors.New("Please choose a refund or a credit.")
+	}
+	in.Reason = strings.TrimSpace(in.Reason)
+	if in.Reason == "" {
+		return nil, errors.New("Please provide a reason.")
+	}
+	if in.Amount < 0 {
+		return nil, errors.New("The amount cannot be negative.")
+	}
+
+	type ru struct {
+		CID       sql.NullString `db:"s_customer_id"`
+		FirstName string         `db:"first_name"`
+		Email     string         `db:"email"`
+	}
+	var u ru
+	q := `SELECT s_customer_id, first_name, email FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, in.UserID); err == sql.ErrNoRows {
+		return nil, errors.New("That user does not exist.")
+	} else if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+	}
+	if u.CID.String == "" {
+		return nil, errors.New("Not an existing customer.")
+	}
+
+	// The invoice must belong to the customer.
+	invs, err := lc.billing().GetCustomerInvoices(u.CID.String)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+	}
+	var inv *EcommInvoice
+	for _, i := range invs {
+		if i.ID == in.InvoiceID {
+			out := toEcommInvoice(i)
+			inv = &out
+			break
+		}
+	}
+	if inv == nil {
+		return nil, errors.New("That invoice does not exist.")
+	}
+	if in.Kind == RefundKindRefund && !inv.Paid {
+		return nil, errors.New("Only a paid invoice can be refunded, please issue a credit instead.")
+	}
+
+	out := &EcommRefund{
+		ID:        "pending_" + uniuri.New(),
+		InvoiceID: inv.ID,
+		Kind:      in.Kind,
+		Currency:  inv.Currency,
+		Reason:    in.Reason,
+		IssuedBy:  adminID,
+		Created:   time.Now().Format("2006-01-02 15:04:05"),
+	}
+	err = withTx(db, func(tx DataCaller) error {
+		var issued int64
+		q := `SELECT IFNULL(SUM(amount), 0) FROM ecomm_refunds WHERE invoice_id = ? FOR UPDATE;`
+		if err := tx.Get(&issued, q, inv.ID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+		}
+		remaining := inv.Total - issued
+		if in.Amount == 0 {
+			in.Amount = remaining
+		}
+		if remaining <= 0 {
+			return errors.New("The invoice has already been refunded.")
+		} else if in.Amount > remaining {
+			return fmt.Errorf("Only %v of the invoice can be refunded.", formatMoney(remaining, inv.Currency))
+		}
+
+		out.Amount = in.Amount
+		out.Display = formatMoney(in.Amount, inv.Currency)
+		q = `INSERT INTO ecomm_refunds (id, s_customer_id, user_id, invoice_id, kind, amount,
+             currency, reason, issued_by, created) VALUES (?,?,?,?,?,?,?,?,?,?);`
+		_, err := tx.Exec(q, out.ID, u.CID.String, in.UserID, out.InvoiceID, out.Kind, out.Amount,
+			out.Currency, out.Reason, out.IssuedBy, out.Created)
+		if err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	if in.Kind == RefundKindRefund {
+		id, err = lc.billing().RefundInvoice(u.CID.String, inv.ID, in.Amount, in.Reason)
+	} else {
+		id, err = lc.billing().CreditInvoice(u.CID.String, inv.ID, in.Amount, in.Reason)
+	}
+	if err != nil {
+		// The refund was not issued, so the pending refund is removed.
+		q := `DELETE FROM ecomm_refunds WHERE id = ?;`
+		if _, derr := db.Exec(q, out.ID); derr != nil {
+			e.ThrowError(&e.LogInput{M: "ERRREFUND3 " + out.ID, E: derr})
+		}
+		return nil, e.ThrowError(&e.LogInput{M: "Error issuing the refund.", E: err})
+	}
+
+	// The refund cannot be undone, so a failure to confirm it is logged to
+	// be fixed by hand rather than returned. The pending refund is still
+	// counted against the invoice.
+	pending := out.ID
+	out.ID = id
+	err = withTx(db, func(tx DataCaller) error {
+		q := `UPDATE ecomm_refunds SET id = ? WHERE id = ?;`
+		if _, err := tx.Exec(q, out.ID, pending); err != nil {
+			return err
+		}
+		kind := billingEventRefunded
+		if in.Kind == RefundKindCredit {
+			kind = billingEventCredited
+		}
+		body := fmt.Sprintf("%v of invoice %v by %v: %v", out.Display, out.InvoiceID, adminID, out.Reason)
+		return logBillingEvent(tx, in.UserID, u.CID.String, kind, body)
+	})
+	if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRREFUND1 " + out.ID, E: err})
+	}
+
+	template := emailInvoiceRefunded
+	if in.Kind == RefundKindCredit {
+		template = emailInvoiceCredited
+	}
+	err = lc.Pvl.buildBillingEmail(&buildBillingEmailInput{
+		template:  template,
+		firstName: u.FirstName,
+		email:     u.Email,
+		vars: map[string]string{
+			"amount":  out.Display,
+			"invoice": out.InvoiceID,
+			"reason":  out.Reason,
+		},
+		db: db,
+	})
+	if err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRREFUND2 " + out.ID, E: err})
+	}
+	return out, nil
+}
+
+// getRefunds returns the refunds and credits issued to the customer, keyed
+// by the invoice they were issued against.
+func getRefunds(db DataCaller, customerID string) (map[string][]EcommRefund, error) {
+	var rs []EcommRefund
+	q := `SELECT id, invoice_id, kind, amount, currency, reason, issued_by, created
+          FROM ecomm_refunds WHERE s_customer_id = ? ORDER BY created ASC;`
+	if err := db.Select(&rs, q, customerID); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]EcommRefund)
+	for _, r := range rs {
+		r.Display = formatMoney(r.Amount, r.Currency)
+		out[r.InvoiceID] = append(out[r.InvoiceID], r)
+	}
+	return out, nil
+}
+
+// refundsIssued returns the amount refunded to the card against the invoice
+// that has been recorded in the ecomm_refunds table.
+func refundsIssued(db DataCaller, invoiceID string) (int64, error) {
+	var issued int64
+	q := `SELECT IFNULL(SUM(amount), 0) FROM ecomm_refunds WHERE invoice_id = ? AND kind = ?;`
+	err := db.Get(&issued, q, invoiceID, RefundKindRefund)
+	return issued, err
+}
+
+/*
+  recordProviderRefund records a refund that was made outside the API, eg.
+  from the Stripe dashboard, so it is shown with the invoice and counted
+  against what can still be refunded. refunded is the total refunded against
+  the invoice, so only the amount that has not been recorded is added. The
+  id of the webhook event is used as the id of the refund, so a replay of
+  the event does not record it twice. The amount added is returned, which
+  is 0 when every refund was issued by EcommAdminRefund.
+*/
+func recordProviderRefund(db DataCaller, user hookUser, in hookEvent) (int64, error) {
+	var amount int64
+	err := withTx(db, func(tx DataCaller) error {
+		issued, err := refundsIssued(tx, in.Invoice)
+		if err != nil {
+			return err
+		}
+		if amount = in.Amount - issued; amount <= 0 {
+			amount = 0
+			return nil
+		}
+
+		var currency string
+		q := `SELECT currency FROM user WHERE id = ?;`
+		if err := tx.Get(&currency, q, user.ID); err != nil {
+			return err
+		}
+		q = `INSERT IGNORE INTO ecomm_refunds (id, s_customer_id, user_id, invoice_id, kind, amount,
+             currency, reason, issued_by, created) VALUES (?,?,?,?,?,?,?,?,?,?);`
+		_, err = tx.Exec(q, in.ID, in.CustomerID, user.ID, in.Invoice, RefundKindRefund, amount,
+			normCurrency(currency), "Refunded by the ecomm provider.", "", time.Now())
+		if err != nil {
+			return err
+		}
+		body := fmt.Sprintf("%v of invoice %v by the ecomm provider", formatMoney(amount, currency), in.Invoice)
+		return logBillingEvent(tx, user.ID, in.CustomerID, billingEventRefunded, body)
+	})
+	return amount, err
+}
@@ -0,0 +1,187 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test the EcommAdminRefund function is only available to admins, and
+// validates the amount against what has already been refunded.
+func TestEcommAdminRefundValidation(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("102", 2900)
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invs, _ := mem.GetCustomerInvoices(cID)
+
+	admin := false
+	var issued int64 = 2000
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "admin"}
+		},
+	}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *bool:
+				*d = admin
+			case *int64:
+				*d = issued
+			default:
+				// The user is selected into a type local to the function, so
+				// the customer is set by name.
+				reflect.ValueOf(dest).Elem().FieldByName("CID").Set(
+					reflect.ValueOf(sql.NullString{String: cID, Valid: true}))
+			}
+			return nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+	in := &EcommRefundInput{UserID: "1", InvoiceID: invs[0].ID, Kind: RefundKindRefund, Reason: "Duplicate"}
+
+	if _, err := lc.EcommAdminRefund(db, ls, in); err == nil || err.Error() != "You do not have permission to issue refunds." {
+		t.Errorf("EcommAdminRefund allowed a user who is not an admin, got %v.", err)
+	}
+
+	admin = true
+	in.Amount = 1000
+	if _, err := lc.EcommAdminRefund(db, ls, in); err == nil || err.Error() != "Only A$9.00 of the invoice can be refunded." {
+		t.Errorf("EcommAdminRefund refunded more than the invoice, got %v.", err)
+	}
+
+	in.Reason = " "
+	if _, err := lc.EcommAdminRefund(db, ls, in); err == nil || err.Error() != "Please provide a reason." {
+		t.Errorf("EcommAdminRefund issued a refund without a reason, got %v.", err)
+	}
+}
+
+// Test a refund is recorded as pending before it is issued, and the pending
+// refund is removed when the refund cannot be issued.
+func TestEcommAdminRefundPending(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("102", 2900)
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invs, _ := mem.GetCustomerInvoices(cID)
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "admin"}
+		},
+	}
+	var queries []string
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *bool:
+				*d = true
+			case *int64:
+				if !strings.Contains(query, "FOR UPDATE") {
+					t.Errorf("EcommAdminRefund did not lock the refunds of the invoice.")
+				}
+				*d = 0
+			default:
+				reflect.ValueOf(dest).Elem().FieldByName("CID").Set(
+					reflect.ValueOf(sql.NullString{String: cID, Valid: true}))
+			}
+			return nil
+		},
+		ExecMock: func(query string, args ...interface{}) (sql.Result, error) {
+			queries = append(queries, strings.Fields(query)[0])
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem, Pvl: &MockPrivateLogic{}}
+
+	in := &EcommRefundInput{UserID: "1", InvoiceID: invs[0].ID, Kind: RefundKindRefund, Amount: 1000, Reason: "Duplicate"}
+	if _, err := lc.EcommAdminRefund(db, ls, in); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(queries, ","); !strings.HasPrefix(got, "INSERT,UPDATE") {
+		t.Errorf("EcommAdminRefund did not record the refund as pending before confirming it, got %v.", got)
+	}
+
+	// The provider has already refunded part of the invoice, so refunding
+	// the rest of it fails.
+	queries = nil
+	in.Amount = 0
+	if _, err := lc.EcommAdminRefund(db, ls, in); err == nil {
+		t.Fatal("EcommAdminRefund refunded more than was paid.")
+	}
+	if got := strings.Join(queries, ","); got != "INSERT,DELETE" {
+		t.Errorf("EcommAdminRefund did not remove the pending refund, got %v.", got)
+	}
+}
+
+// Test the MemBilling applies a credit to the next invoice, and does not
+// refund more than was paid.
+func TestMemBillingCredit(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("102", 2900)
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invs, _ := mem.GetCustomerInvoices(cID)
+
+	if _, err := mem.RefundInvoice(cID, invs[0].ID, 3000, "Too much"); err == nil {
+		t.Error("RefundInvoice refunded more than was paid.")
+	}
+	if _, err := mem.CreditInvoice(cID, invs[0].ID, 900, "Outage"); err != nil {
+		t.Fatal(err)
+	}
+	mem.Renew(cID)
+	invs, _ = mem.GetCustomerInvoices(cID)
+	if invs[0].Total != 2900 || invs[0].Amount != 2000 {
+		t.Errorf("The credit was not applied to the next invoice, got %+v.", invs[0])
+	}
+}
+
+// Test a refund made outside the API is recorded, less the refunds that
+// were issued by EcommAdminRefund.
+func TestRecordProviderRefund(t *testing.T) {
+	var issued int64
+	var recorded []interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *int64:
+				*d = issued
+			case *string:
+				*d = "nzd"
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.Contains(q, "INSERT IGNORE INTO ecomm_refunds") {
+				recorded = args
+			}
+			return nil, nil
+		},
+	}
+	user := hookUser{ID: "1"}
+	in := hookEvent{ID: "evt_1", CustomerID: "cus_1", Invoice: "in_1", Amount: 1500}
+
+	issued = 500
+	amount, err := recordProviderRefund(db, user, in)
+	if err != nil || amount != 1000 {
+		t.Errorf("recordProviderRefund expected 1000, got %v %v.", amount, err)
+	}
+	if recorded == nil || recorded[0] != "evt_1" || recorded[5] != int64(1000) || recorded[6] != "NZD" {
+		t.Errorf("recordProviderRefund did not record the refund, got %v.", recorded)
+	}
+
+	// Every refund was issued by EcommAdminRefund.
+	issued, recorded = 1500, nil
+	if amount, err := recordProviderRefund(db, user, in); err != nil || amount != 0 || recorded != nil {
+		t.Errorf("recordProviderRefund recorded a refund that was issued, got %v %v.", amount, recorded)
+	}
+}
@@ -0,0 +1,372 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/dchest/uniuri"
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"strings"
+	"time"
+)
+
+// The Mandrill template used to invite a user into an enterprise.
+const emailGroupInvite = "group-invite"
+
+// groupOwner holds the information of the user that owns an enterprise.
+type groupOwner struct {
+	ID           string         `db:"id"`
+	FirstName    string         `db:"first_name"`
+	LastName     string         `db:"last_name"`
+	CID          sql.NullString `db:"s_customer_id"`
+	Kind         string         `db:"kind"`
+	EnterpriseID sql.NullString `db:"enterprise_id"`
+	GroupActive  bool           `db:"group_active"`
+}
+
+/*
+  getGroupOwner returns the current user if they own an enterprise. The owner
+  of an enterprise is the user paying for the plan with groups, so only they
+  can change the seats and members of the enterprise.
+*/
+func getGroupOwner(db DataCaller, ls LogicStore) (*groupOwner, error) {
+	var o groupOwner
+	q := `SELECT id, first_name, last_name, s_customer_id, kind, enterprise_id
+          FROM user WHERE id = ?;`
+	if err := db.Get(&o, q, ls.GetCurrentUser().Id); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "ERRGROUPOWNER", E: err})
+	}
+
+	p, _ := planCatalog.ByKind(o.Kind)
+	if o.CID.String == "" || o.EnterpriseID.String == "" || !p.HasFeature(FeatureGroups) {
+		return nil, errors.New("Only the owner of a business plus group can manage the group.")
+	}
+	return &o, nil
+}
+
+// countActiveMembers returns the number of group_active users within the
+// enterprise. Each active member takes up a seat.
+func countActiveMembers(db DataCaller, enterpriseID string) (int, error) {
+	var n int
+	q := `SELECT COUNT(*) FROM user WHERE enterprise_id = ? AND group_active = 1;`
+	err := db.Get(&n, q, enterpriseID)
+	return n, err
+}
+
+// recountMembers sets the members of the enterprise to the number of
+// group_active users. This is called whenever members are deactivated, or
+// the owner is activated, so activateMember can compare the members with the
+// seats of the enterprise.
+func recountMembers(db DataCaller, enterpriseID string) error {
+	q := `UPDATE enterprises SET members = (SELECT COUNT(*) FROM user
+          WHERE enterprise_id = ? AND group_active = 1) WHERE id = ?;`
+	_, err := db.Exec(q, enterpriseID, enterpriseID)
+	return err
+}
+
+/*
+  EcommUpdateSeats changes the number of seats for the enterprise of the
+  current user. The seats and the quantity of the subscription both change
+  immediately. Added seats are prorated and invoiced now. Removed seats are
+  not credited, so the lower quantity is first charged at the next renewal.
+  Seats cannot be reduced below the number of active members.
+*/
+func (lc Lgc) EcommUpdateSeats(db DataCaller, ls LogicStore, seats int) error {
+	o, err := getGroupOwner(db, ls)
+	if err != nil {
+		return err
+	}
+	if seats < 1 {
+		return errors.New("A group must have at least one seat.")
+	}
+
+	var cur int
+	q := `SELECT seats FROM enterprises WHERE id = ?;`
+	if err := db.Get(&cur, q, o.EnterpriseID.String); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the seats.", E: err})
+	}
+	if seats == cur {
+		return errors.New("The group already has that many seats.")
+	}
+
+	active, err := countActiveMembers(db, o.EnterpriseID.String)
+	if err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the seats.", E: err})
+	}
+	if seats < active {
+		return errors.New("Remove members from the group before removing their seats.")
+	}
+
+	// Update the quantity of the subscription. Seats that are added are
+	// prorated, and the customer is invoiced for them immediately. Seats
+	// that are removed are not prorated, as the period has been paid for.
+	add := seats > cur
+	if _, err := lc.updateQuantity(o.CID.String, seats, add); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the seats.", E: err})
+	}
+	if add {
+		if err := lc.invoiceCustomer(o.CID.String); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error updating the seats.", E: err})
+		}
+	}
+
+	q = `UPDATE enterprises SET seats = ? WHERE id = ?;`
+	if _, err := db.Exec(q, seats, o.EnterpriseID.String); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the seats.", E: err})
+	}
+	return nil
+}
+
+/*
+  EcommInviteMember invites the email into the enterprise of the current
+  user. The invitee is emailed a link containing the invite token, which is
+  accepted with EcommAcceptInvite once they have signed up or logged in.
+*/
+func (lc Lgc) EcommInviteMember(db DataCaller, ls LogicStore, email string) error {
+	o, err := getGroupOwner(db, ls)
+	if err != nil {
+		return err
+	}
+	email = strings.TrimSpace(strings.ToLower(email))
+	if email == "" {
+		return errors.New("Please provide an email to invite.")
+	}
+
+	// Do not invite users who are already active within the group.
+	var n int
+	q := `SELECT COUNT(*) FROM user WHERE email = ? AND enterprise_id = ? AND group_active = 1;`
+	if err := db.Get(&n, q, email, o.EnterpriseID.String); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error inviting the member.", E: err})
+	}
+	if n > 0 {
+		return errors.New("That user is already a member of the group.")
+	}
+
+	token := uniuri.NewLen(32)
+	q = `INSERT INTO enterprise_invites (id, enterprise_id, email, invited_by, created)
+         VALUES (?,?,?,?,?);`
+	if _, err := db.Exec(q, token, o.EnterpriseID.String, email, o.ID, time.Now()); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error inviting the member.", E: err})
+	}
+
+	emIn := &buildBillingEmailInput{
+		template: emailGroupInvite,
+		email:    email,
+		vars: map[string]string{
+			"inviter":     o.FirstName + " " + o.LastName,
+			"invite_link": config.FrontEnd() + "/group/join?token=" + token,
+		},
+		db: db,
+	}
+	if err := lc.Pvl.buildBillingEmail(emIn); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error inviting the member.", E: err})
+	}
+	return nil
+}
+
+/*
+  EcommAcceptInvite adds the current user to the enterprise they were invited
+  to. The invite must have been sent to the email of the current user, and
+  there must be a free seat within the enterprise. The invite is accepted in
+  the same transaction as the seat is taken, so it cannot be accepted twice.
+*/
+func (lc Lgc) EcommAcceptInvite(db DataCaller, ls LogicStore, token string) error {
+	userID := ls.GetCurrentUser().Id
+
+	return withTx(db, func(tx DataCaller) error {
+		type inv struct {
+			EnterpriseID string         `db:"enterprise_id"`
+			Email        string         `db:"email"`
+			Accepted     sql.NullString `db:"accepted"`
+		}
+		var in inv
+		q := `SELECT enterprise_id, email, accepted FROM enterprise_invites WHERE id = ? FOR UPDATE;`
+		if err := tx.Get(&in, q, token); err != nil {
+			if err == sql.ErrNoRows {
+				return errors.New("This invite does not exist.")
+			}
+			return e.ThrowError(&e.LogInput{M: "Error accepting the invite.", E: err})
+		}
+		if in.Accepted.Valid {
+			return errors.New("This invite has already been accepted.")
+		}
+
+		var u User
+		q = `SELECT first_name, last_name, email, enterprise_id FROM user WHERE id = ?;`
+		if err := tx.Get(&u, q, userID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error accepting the invite.", E: err})
+		}
+		if strings.ToLower(u.Email) != in.Email {
+			return errors.New("This invite was sent to a different email.")
+		}
+		if u.EnterpriseID.String != "" && u.EnterpriseID.String != in.EnterpriseID {
+			return errors.New("You are already a member of another group.")
+		}
+
+		if err := activateMember(tx, in.EnterpriseID, userID); err != nil {
+			return err
+		}
+
+		q = `UPDATE enterprise_invites SET accepted = ?, user_id = ? WHERE id = ?;`
+		if _, err := tx.Exec(q, time.Now(), userID, token); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error accepting the invite.", E: err})
+		}
+		return nil
+	})
+}
+
+/*
+  activateMember makes the user an active member of the enterprise, as long
+  as the enterprise has a free seat and the user is not already an active
+  member of it. The enterprise is locked while the seat is taken, so
+  concurrent invites cannot take the same seat. tx must be a transaction.
+*/
+func activateMember(tx DataCaller, enterpriseID string, userID string) error {
+	var ent struct {
+		Seats   int `db:"seats"`
+		Members int `db:"members"`
+	}
+	q := `SELECT seats, members FROM enterprises WHERE id = ? FOR UPDATE;`
+	if err := tx.Get(&ent, q, enterpriseID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the member.", E: err})
+	}
+
+	var active int
+	q = `SELECT COUNT(*) FROM user WHERE id = ? AND enterprise_id = ? AND group_active = 1;`
+	if err := tx.Get(&active, q, userID, enterpriseID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the member.", E: err})
+	}
+	if active > 0 {
+		return errors.New("You are already a member of this group.")
+	}
+	if ent.Members >= ent.Seats {
+		return errors.New("There are no free seats in this group.")
+	}
+
+	q = `UPDATE user SET enterprise_id = ?, group_active = 1 WHERE id = ?;`
+	if _, err := tx.Exec(q, enterpriseID, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the member.", E: err})
+	}
+	q = `UPDATE enterprises SET members = members + 1 WHERE id = ?;`
+	if _, err := tx.Exec(q, enterpriseID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the member.", E: err})
+	}
+	return nil
+}
+
+/*
+  EcommRemoveMember removes the user from the enterprise of the current user,
+  which frees their seat. The owner cannot remove themselves; they must
+  cancel or downgrade their plan instead.
+*/
+func (lc Lgc) EcommRemoveMember(db DataCaller, ls LogicStore, userID string) error {
+	o, err := getGroupOwner(db, ls)
+	if err != nil {
+		return err
+	}
+	if userID == o.ID {
+		return errors.New("The owner of a group cannot be removed.")
+	}
+
+	err = withTx(db, func(tx DataCaller) error {
+		q := `UPDATE user SET enterprise_id = NULL, group_active = 0
+              WHERE id = ? AND enterprise_id = ?;`
+		if _, err := tx.Exec(q, userID, o.EnterpriseID.String); err != nil {
+			return err
+		}
+		return recountMembers(tx, o.EnterpriseID.String)
+	})
+	if err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error removing the member.", E: err})
+	}
+	return nil
+}
+
+// The output for the EcommGetGroup function.
+type EcommGroup struct {
+	Seats   int
+	Members []EcommGroupMember
+	Invites []EcommGroupInvite
+}
+type EcommGroupMember struct {
+	ID        string `db:"id"`
+	FirstName string `db:"first_name"`
+	LastName  string `db:"last_name"`
+	Email     string `db:"email"`
+	Active    bool   `db:"group_active"`
+}
+type EcommGroupInvite struct {
+	Email   string `db:"email"`
+	Created string `db:"created"`
+}
+
+// EcommGetGroup returns the seats, members and outstanding invites for the
+// enterprise of the current user.
+func (lc Lgc) EcommGetGroup(db DataCaller, ls LogicStore) (*EcommGroup, error) {
+	o, err := getGroupOwner(db, ls)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &EcommGroup{}
+	q := `SELECT seats FROM enterprises WHERE id = ?;`
+	if err := db.Get(&out.Seats, q, o.EnterpriseID.String); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the group.", E: err})
+	}
+	q = `SELECT id, first_name, last_name, email, group_active FROM user
+         WHERE enterprise_id = ? ORDER BY first_name ASC;`
+	if err := db.Select(&out.Members, q, o.EnterpriseID.String); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the group.", E: err})
+	}
+	q = `SELECT email, created FROM enterprise_invites
+         WHERE enterprise_id = ? AND accepted IS NULL ORDER BY created DESC;`
+	if err := db.Select(&out.Invites, q, o.EnterpriseID.String); err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error retrieving the group.", E: err})
+	}
+	return out, nil
+}
+
+/*
+  syncSeats sets the seats of the enterprise owned by the user to the
+  quantity of their subscription, as the quantity can be changed in the
+  Stripe dashboard. If the seats have been reduced below the number of active
+  members, the members who joined most recently are deactivated. The owner is
+  never deactivated.
+*/
+func syncSeats(db DataCaller, userID string, quantity int) error {
+	var ent sql.NullString
+	q := `SELECT enterprise_id FROM user WHERE id = ?;`
+	if err := db.Get(&ent, q, userID); err != nil {
+		return err
+	}
+	if ent.String == "" || quantity < 1 {
+		return nil
+	}
+
+	q = `UPDATE enterprises SET seats = ? WHERE id = ?;`
+	if _, err := db.Exec(q, quantity, ent.String); err != nil {
+		return err
+	}
+
+	active, err := countActiveMembers(db, ent.String)
+	if err != nil || active <= quantity {
+		return err
+	}
+
+	var ids []string
+	q = `SELECT user.id FROM user
+         LEFT JOIN enterprise_invites ON enterprise_invites.user_id = user.id
+         AND enterprise_invites.enterprise_id = user.enterprise_id
+         WHERE user.enterprise_id = ? AND user.group_active = 1 AND user.id != ?
+         ORDER BY enterprise_invites.accepted DESC LIMIT ?;`
+	if err := db.Select(&ids, q, ent.String, userID, active-quantity); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		q = `UPDATE user SET group_active = 0 WHERE id = ?;`
+		if _, err := db.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return recountMembers(db, ent.String)
+}
@@ -0,0 +1,180 @@
+package logic
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"pleasesign/ecomm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ownerMock returns the Get mock for a business plus owner with the given
+// customer, seats and active members.
+func ownerMock(customerID string, seats int, active int) func(dest interface{}, query string, args ...interface{}) error {
+	return func(dest interface{}, query string, args ...interface{}) error {
+		switch d := dest.(type) {
+		case *groupOwner:
+			*d = groupOwner{
+				ID:           "1",
+				CID:          sql.NullString{String: customerID, Valid: true},
+				Kind:         "5",
+				EnterpriseID: sql.NullString{String: "FF", Valid: true},
+			}
+		case *int:
+			if query == `SELECT seats FROM enterprises WHERE id = ?;` {
+				*d = seats
+			} else {
+				*d = active
+			}
+		}
+		return nil
+	}
+}
+
+// Test the EcommUpdateSeats function validates the seats, and updates the
+// enterprise when the seats change.
+func TestEcommUpdateSeats(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("103", 2000)
+	cID, _, _ := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "103"})
+	if _, err := mem.UpdateQuantity(cID, 3, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	var seats interface{}
+	db := &MockDb{
+		GetMock: ownerMock(cID, 3, 3),
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			seats = args[0]
+			return nil, nil
+		},
+	}
+	lc := Lgc{Billing: mem}
+
+	// There are three active members, so the seats cannot be reduced.
+	err := lc.EcommUpdateSeats(db, ls, 2)
+	if err == nil || err.Error() != "Remove members from the group before removing their seats." {
+		t.Errorf("EcommUpdateSeats is removing seats from active members, got %v.", err)
+	}
+	if err := lc.EcommUpdateSeats(db, ls, 3); err == nil {
+		t.Error("EcommUpdateSeats is not validating the seats are changing.")
+	}
+
+	if err := lc.EcommUpdateSeats(db, ls, 5); err != nil {
+		t.Errorf("EcommUpdateSeats returned an error adding seats, got %v.", err)
+	}
+	if seats != 5 {
+		t.Errorf("EcommUpdateSeats did not update the enterprise, got %v wanted 5.", seats)
+	}
+
+	// The added seats should be prorated and invoiced immediately.
+	sub, _ := mem.GetSub(cID)
+	inv, _ := mem.GetCustomerInvoices(cID)
+	if sub.Quantity != 5 || len(inv) != 2 || inv[0].Total != 4000 {
+		t.Errorf("EcommUpdateSeats did not invoice the seats, got %v seats and invoices %+v.", sub.Quantity, inv)
+	}
+
+	// A user without a plan with groups cannot manage seats.
+	db.GetMock = func(dest interface{}, query string, args ...interface{}) error {
+		*dest.(*groupOwner) = groupOwner{
+			CID:  sql.NullString{String: "cus_1", Valid: true},
+			Kind: "2",
+		}
+		return nil
+	}
+	if err := lc.EcommUpdateSeats(db, ls, 5); err == nil {
+		t.Error("EcommUpdateSeats is allowing users without a group to manage seats.")
+	}
+}
+
+// Test the activateMember function only activates the member when a seat is
+// free, and the user is not already an active member.
+func TestActivateMember(t *testing.T) {
+	seats, members, active := 2, 2, 0
+	var locked, activated bool
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *int:
+				*d = active
+			default:
+				locked = strings.Contains(query, "FOR UPDATE")
+				v := reflect.ValueOf(dest).Elem()
+				v.FieldByName("Seats").SetInt(int64(seats))
+				v.FieldByName("Members").SetInt(int64(members))
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(q, "UPDATE enterprises SET members = members + 1") {
+				members++
+			} else {
+				activated = true
+			}
+			return driver.RowsAffected(1), nil
+		},
+	}
+	err := activateMember(db, "FF", "2")
+	if err == nil || err.Error() != "There are no free seats in this group." {
+		t.Errorf("activateMember is not enforcing the seat limit, got %v.", err)
+	}
+	if activated || !locked {
+		t.Errorf("activateMember activated a member without a seat, or did not lock the enterprise.")
+	}
+
+	seats, active = 3, 1
+	err = activateMember(db, "FF", "2")
+	if err == nil || err.Error() != "You are already a member of this group." {
+		t.Errorf("activateMember activated an active member again, got %v.", err)
+	}
+
+	active = 0
+	if err := activateMember(db, "FF", "2"); err != nil {
+		t.Errorf("activateMember returned an error with a free seat, got %v.", err)
+	}
+	if !activated || members != 3 {
+		t.Errorf("activateMember did not activate the member, got %v %v.", activated, members)
+	}
+}
+
+// Test the syncSeats function deactivates the members over the quantity of
+// the subscription.
+func TestSyncSeats(t *testing.T) {
+	var deactivated []interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *sql.NullString:
+				*d = sql.NullString{String: "FF", Valid: true}
+			case *int:
+				*d = 4
+			}
+			return nil
+		},
+		SelectMock: func(dest interface{}, query string, args ...interface{}) error {
+			if args[2] != 2 {
+				t.Errorf("syncSeats is deactivating the wrong number of members, got %v.", args[2])
+			}
+			*dest.(*[]string) = []string{"3", "4"}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if q == `UPDATE user SET group_active = 0 WHERE id = ?;` {
+				deactivated = append(deactivated, args[0])
+			}
+			return nil, nil
+		},
+	}
+	if err := syncSeats(db, "1", 2); err != nil {
+		t.Errorf("syncSeats returned an error, got %v.", err)
+	}
+	if len(deactivated) != 2 {
+		t.Errorf("syncSeats did not deactivate the members, got %v.", deactivated)
+	}
+}
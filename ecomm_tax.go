@@ -0,0 +1,306 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"pleasesign/ecomm"
+	e "pleasesign/errlogger"
+	"strings"
+)
+
+// The types of tax ids, which are the types expected by the ecomm package.
+const (
+	TaxIDABN   = "au_abn" // An Australian Business Number.
+	TaxIDNZGST = "nz_gst" // A New Zealand GST (IRD) number.
+	TaxIDGBVAT = "gb_vat" // A United Kingdom VAT number.
+	TaxIDEUVAT = "eu_vat" // A VAT number from a member of the European Union.
+)
+
+// taxRate is the tax charged to customers in a country.
+type taxRate struct {
+	Name      string
+	Percent   float64
+	Inclusive bool // True if the tax is included in the price of the plan.
+}
+
+// taxRates holds the tax charged by billing country. Plans are priced in
+// Australian dollars including GST, while the GST and VAT of other
+// countries is added to the price.
+var taxRates = map[string]taxRate{
+	"AU": {Name: "GST", Percent: 10, Inclusive: true},
+	"NZ": {Name: "GST", Percent: 15},
+	"GB": {Name: "VAT", Percent: 20},
+}
+
+// euCountries are the members of the European Union, whose VAT numbers are
+// prefixed with the country code (EL for Greece).
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "CY": true, "CZ": true, "DE": true,
+	"DK": true, "EE": true, "EL": true, "ES": true, "FI": true, "FR": true,
+	"GR": true, "HR": true, "HU": true, "IE": true, "IT": true, "LT": true,
+	"LU": true, "LV": true, "MT": true, "NL": true, "PL": true, "PT": true,
+	"RO": true, "SE": true, "SI": true, "SK": true,
+}
+
+// digitsOnly removes spaces, dashes and dots from a tax id, and returns
+// false if anything other than digits remain.
+func digitsOnly(id string) (string, bool) {
+	id = strings.NewReplacer(" ", "", "-", "", ".", "").Replace(id)
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return id, false
+		}
+	}
+	return id, id != ""
+}
+
+// validABN returns true if the ABN has 11 digits and a valid checksum.
+func validABN(abn string) bool {
+	if len(abn) != 11 {
+		return false
+	}
+	weights := []int{10, 1, 3, 5, 7, 9, 11, 13, 15, 17, 19}
+	sum := 0
+	for i, r := range abn {
+		d := int(r - '0')
+		if i == 0 {
+			d--
+		}
+		sum += d * weights[i]
+	}
+	return sum%89 == 0
+}
+
+// validIRD returns true if the IRD number has 9 digits and a valid check
+// digit. NZ GST numbers are the IRD number of the business.
+func validIRD(ird string) bool {
+	if len(ird) != 9 || ird < "010000000" || ird > "150000000" {
+		return false
+	}
+	check := func(weights []int) int {
+		sum := 0
+		for i, w := range weights {
+			sum += int(ird[i]-'0') * w
+		}
+		if sum%11 == 0 {
+			return 0
+		}
+		return 11 - sum%11
+	}
+	c := check([]int{3, 2, 7, 6, 5, 4, 3, 2})
+	if c == 10 {
+		c = check([]int{7, 4, 3, 2, 5, 2, 7, 6})
+	}
+	return c != 10 && c == int(ird[8]-'0')
+}
+
+/*
+  validateTaxID checks the format of a tax id for the billing country, and
+  returns its type and the tax id in a normalised form. ABNs and NZ GST
+  numbers have their checksum verified; VAT numbers are checked against
+  their format only.
+*/
+func validateTaxID(country string, id string) (string, string, error) {
+	code := countryCode(country)
+	id = strings.ToUpper(strings.TrimSpace(id))
+
+	switch {
+	case code == "AU":
+		abn, ok := digitsOnly(id)
+		if !ok || !validABN(abn) {
+			return "", "", errors.New("Please enter a valid ABN.")
+		}
+		return TaxIDABN, abn, nil
+	case code == "NZ":
+		// 8 digit IRD numbers are padded to 9 digits.
+		ird, ok := digitsOnly(id)
+		if len(ird) == 8 {
+			ird = "0" + ird
+		}
+		if !ok || !validIRD(ird) {
+			return "", "", errors.New("Please enter a valid GST number.")
+		}
+		return TaxIDNZGST, ird, nil
+	case code == "GB":
+		vat, ok := digitsOnly(strings.TrimPrefix(strings.Replace(id, " ", "", -1), "GB"))
+		if !ok || (len(vat) != 9 && len(vat) != 12) {
+			return "", "", errors.New("Please enter a valid VAT number.")
+		}
+		return TaxIDGBVAT, "GB" + vat, nil
+	case euCountries[code]:
+		vat := strings.NewReplacer(" ", "", "-", "", ".", "").Replace(id)
+		prefix := code
+		if code == "GR" {
+			prefix = "EL"
+		}
+		if !strings.HasPrefix(vat, prefix) || len(vat) < 4 || len(vat) > 14 {
+			return "", "", errors.New("Please enter a valid VAT number.")
+		}
+		for _, r := range vat[2:] {
+			if (r < '0' || r > '9') && (r < 'A' || r > 'Z') {
+				return "", "", errors.New("Please enter a valid VAT number.")
+			}
+		}
+		return TaxIDEUVAT, vat, nil
+	}
+	return "", "", errors.New("Tax numbers are not supported for your country.")
+}
+
+/*
+  taxFor returns the tax the billing provider should apply to a customer in
+  the billing country. Business customers outside of the country of the
+  invoice issuer who provide a tax id account for the tax themselves
+  (reverse charge), so their tax id is passed on without a rate. nil is
+  returned when there is nothing to apply.
+*/
+func taxFor(country string, idType string, id string) *ecomm.TaxInp {
+	code := countryCode(country)
+	in := &ecomm.TaxInp{Country: code, IDType: idType, ID: id}
+	rate, ok := taxRates[code]
+	if ok && (id == "" || code == countryCode(invoiceIssuer.Country)) {
+		in.Name = rate.Name
+		in.Percent = rate.Percent
+		in.Inclusive = rate.Inclusive
+	}
+	if in.Percent == 0 && in.ID == "" {
+		return nil
+	}
+	return in
+}
+
+// taxComponent returns the tax of an amount at the percent. Inclusive tax
+// is the part of the amount that is tax, otherwise it is the tax added to
+// the amount.
+func taxComponent(amount int64, percent float64, inclusive bool) int64 {
+	if inclusive {
+		return int64(math.Round(float64(amount) * percent / (100 + percent)))
+	}
+	return int64(math.Round(float64(amount) * percent / 100))
+}
+
+// taxLine is the line showing tax on an invoice returned by
+// EcommGetCustomerInv.
+func taxLine(t ecomm.TaxAmount) EcommLineItem {
+	desc := fmt.Sprintf("%v (%v%%)", t.Name, t.Percent)
+	if t.Inclusive {
+		desc = fmt.Sprintf("Includes %v (%v%%)", t.Name, t.Percent)
+	}
+	return EcommLineItem{
+		Amount:      t.Amount,
+		Description: desc,
+		Tax:         true,
+	}
+}
+
+// The input for the EcommUpdateTaxID function.
+type EcommTaxInput struct {
+	Country string // The billing country the tax id is registered in.
+	TaxID   string
+}
+
+// The output for the EcommUpdateTaxID function.
+type EcommTaxID struct {
+	Type          string
+	Value         string
+	Country       string
+	TaxName       string  // eg. GST, empty if no tax is charged.
+	Percent       float64 // The tax charged to the customer.
+	ReverseCharge bool    // True if the customer accounts for the tax.
+}
+
+/*
+  EcommUpdateTaxID validates and stores the tax id (ABN, GST or VAT number)
+  of the current user, and passes it to the billing provider along with the
+  tax rate of the country. The tax id of a user within an enterprise is
+  stored against the enterprise, as the enterprise is who is invoiced, and
+  can only be changed by the owner of the enterprise. The tax id is stored
+  before it is passed to the billing provider, and is not kept if the
+  provider refuses it.
+*/
+func (lc Lgc) EcommUpdateTaxID(db DataCaller, ls LogicStore, in *EcommTaxInput) (*EcommTaxID, error) {
+	typ, id, err := validateTaxID(in.Country, in.TaxID)
+	if err != nil {
+		return nil, err
+	}
+	cID, userID, err := getCustomerID(db, ls)
+	if err != nil {
+		return nil, e.ThrowError(&e.LogInput{M: "Error updating the tax number.", E: err})
+	}
+
+	tax := taxFor(in.Country, typ, id)
+	err = withTx(db, func(tx DataCaller) error {
+		if err := storeTaxID(tx, userID, typ, id); err != nil {
+			return err
+		}
+		if cID != "" {
+			if err := lc.billing().UpdateTax(cID, *tax); err != nil {
+				return e.ThrowError(&e.LogInput{M: "Error updating the tax number.", E: err})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &EcommTaxID{
+		Type:          typ,
+		Value:         id,
+		Country:       tax.Country,
+		TaxName:       tax.Name,
+		Percent:       tax.Percent,
+		ReverseCharge: tax.Percent == 0 && taxRates[tax.Country].Percent > 0,
+	}, nil
+}
+
+/*
+  storeTaxID stores the tax id against the enterprise of the user, or the
+  user if they are not an active member of an enterprise (such as the
+  former owner of a group that has ended). The tax id of an enterprise is
+  printed on the invoices of the owner, so only the owner (the user paying
+  for the plan with groups, as for getGroupOwner) can set it, and other
+  members are refused with a friendly error.
+*/
+func storeTaxID(db DataCaller, userID string, typ string, id string) error {
+	var u groupOwner
+	q := `SELECT id, first_name, last_name, s_customer_id, kind, enterprise_id, group_active
+          FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the tax number.", E: err})
+	}
+	if u.EnterpriseID.String != "" && u.GroupActive {
+		p, _ := planCatalog.ByKind(u.Kind)
+		if u.CID.String == "" || !p.HasFeature(FeatureGroups) {
+			return errors.New("Only the owner of a business plus group can change the tax number of the group.")
+		}
+		q = `UPDATE enterprises SET tax_id = ?, tax_id_type = ? WHERE id = ?;`
+		if _, err := db.Exec(q, id, typ, u.EnterpriseID.String); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error updating the tax number.", E: err})
+		}
+		return nil
+	}
+	q = `UPDATE user SET tax_id = ?, tax_id_type = ? WHERE id = ?;`
+	if _, err := db.Exec(q, id, typ, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error updating the tax number.", E: err})
+	}
+	return nil
+}
+
+// userTaxID is the tax id of a user, or of their enterprise.
+type userTaxID struct {
+	Type  string `db:"tax_id_type"`
+	Value string `db:"tax_id"`
+}
+
+// getTaxID returns the tax id of the user, preferring the tax id of their
+// enterprise while they are an active member of it.
+func getTaxID(db DataCaller, userID string) (userTaxID, error) {
+	var t userTaxID
+	q := `SELECT IFNULL(NULLIF(ent.tax_id, ''), IFNULL(u.tax_id, '')) AS tax_id,
+          IF(IFNULL(ent.tax_id, '') != '', ent.tax_id_type, IFNULL(u.tax_id_type, '')) AS tax_id_type
+          FROM user u LEFT JOIN enterprises ent ON ent.id = u.enterprise_id AND u.group_active = 1
+          WHERE u.id = ?;`
+	err := db.Get(&t, q, userID)
+	return t, err
+}
@@ -0,0 +1,165 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+)
+
+// Test the validateTaxID function accepts valid tax ids for each country,
+// normalising them, and rejects invalid tax ids.
+func TestValidateTaxID(t *testing.T) {
+	valid := []struct {
+		country, id, typ, want string
+	}{
+		{"AU", "51 824 753 556", TaxIDABN, "51824753556"},
+		{"Australia", "51824753556", TaxIDABN, "51824753556"},
+		{"NZ", "49-091-850", TaxIDNZGST, "049091850"},
+		{"NZ", "136410132", TaxIDNZGST, "136410132"},
+		{"UK", "gb 123 4567 89", TaxIDGBVAT, "GB123456789"},
+		{"GB", "123456789", TaxIDGBVAT, "GB123456789"},
+		{"DE", "DE 123456789", TaxIDEUVAT, "DE123456789"},
+		{"GR", "EL123456789", TaxIDEUVAT, "EL123456789"},
+	}
+	for _, v := range valid {
+		typ, id, err := validateTaxID(v.country, v.id)
+		if err != nil || typ != v.typ || id != v.want {
+			t.Errorf("validateTaxID(%v, %v) expected %v %v, got %v %v %v.", v.country, v.id, v.typ, v.want, typ, id, err)
+		}
+	}
+
+	invalid := []struct {
+		country, id string
+	}{
+		{"AU", "51 824 753 557"},
+		{"AU", "5182475355"},
+		{"NZ", "136410133"},
+		{"NZ", "9125568"},
+		{"GB", "GB1234"},
+		{"DE", "FR123456789"},
+		{"US", "12-3456789"},
+	}
+	for _, v := range invalid {
+		if _, _, err := validateTaxID(v.country, v.id); err == nil {
+			t.Errorf("validateTaxID(%v, %v) accepted an invalid tax id.", v.country, v.id)
+		}
+	}
+}
+
+// Test the taxFor function applies the tax of the country, and reverse
+// charges overseas businesses with a tax id.
+func TestTaxFor(t *testing.T) {
+	if tax := taxFor("Australia", TaxIDABN, "51824753556"); tax == nil || tax.Percent != 10 || !tax.Inclusive {
+		t.Errorf("taxFor did not apply GST to an Australian business, got %+v.", tax)
+	}
+	if tax := taxFor("NZ", "", ""); tax == nil || tax.Percent != 15 || tax.Inclusive {
+		t.Errorf("taxFor did not add GST for a New Zealand customer, got %+v.", tax)
+	}
+	if tax := taxFor("NZ", TaxIDNZGST, "136410132"); tax == nil || tax.Percent != 0 || tax.ID != "136410132" {
+		t.Errorf("taxFor did not reverse charge a New Zealand business, got %+v.", tax)
+	}
+	if tax := taxFor("US", "", ""); tax != nil {
+		t.Errorf("taxFor applied tax to a customer without tax, got %+v.", tax)
+	}
+}
+
+// Test the storeTaxID function stores the tax id of an enterprise for its
+// owner, and refuses the other members.
+func TestStoreTaxID(t *testing.T) {
+	tests := []struct {
+		user    groupOwner
+		want    string // The table updated, empty if refused.
+		wantErr string
+	}{
+		{groupOwner{ID: "1", Kind: "2"}, "user", ""},
+		{groupOwner{ID: "1", Kind: "5", CID: sql.NullString{String: "cus_1", Valid: true},
+			EnterpriseID: sql.NullString{String: "ent", Valid: true}, GroupActive: true}, "enterprises", ""},
+		{groupOwner{ID: "2", Kind: "2", EnterpriseID: sql.NullString{String: "ent", Valid: true},
+			GroupActive: true}, "", "Only the owner of a business plus group can change the tax number of the group."},
+		// The former owner of a group that has ended.
+		{groupOwner{ID: "1", Kind: "2", CID: sql.NullString{String: "cus_1", Valid: true},
+			EnterpriseID: sql.NullString{String: "ent", Valid: true}}, "user", ""},
+	}
+	for _, tt := range tests {
+		var updated string
+		db := &MockDb{
+			GetMock: func(dest interface{}, query string, args ...interface{}) error {
+				*dest.(*groupOwner) = tt.user
+				return nil
+			},
+			ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+				updated = strings.Fields(q)[1]
+				return nil, nil
+			},
+		}
+		err := storeTaxID(db, tt.user.ID, TaxIDABN, "51824753556")
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("storeTaxID expected %v, got %v.", tt.wantErr, err)
+		}
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("storeTaxID returned an error, got %v.", err)
+		}
+		if updated != tt.want {
+			t.Errorf("storeTaxID updated %v, expected %v.", updated, tt.want)
+		}
+	}
+}
+
+// Test the EcommUpdateTaxID function does not keep a tax id the billing
+// provider refuses.
+func TestEcommUpdateTaxIDRollback(t *testing.T) {
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *sql.NullString:
+				*d = sql.NullString{String: "cus_missing", Valid: true}
+			case *groupOwner:
+				*d = groupOwner{ID: "1", Kind: "2"}
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			return nil, nil
+		},
+	}}
+	// The customer is unknown to the provider, so the tax id is refused.
+	lc := Lgc{Billing: NewMemBilling()}
+
+	if _, err := lc.EcommUpdateTaxID(db, ls, &EcommTaxInput{Country: "AU", TaxID: "51824753556"}); err == nil {
+		t.Fatal("EcommUpdateTaxID did not return the error of the provider.")
+	}
+	if db.Committed != 0 || db.RolledBack != 1 {
+		t.Errorf("EcommUpdateTaxID kept the refused tax id, got %+v.", db)
+	}
+}
+
+// Test the MemBilling adds exclusive tax to the invoice total, and the tax
+// is returned as a line of the invoice.
+func TestMemBillingTax(t *testing.T) {
+	mem := NewMemBilling()
+	mem.SetPrice("102", 2900)
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.UpdateTax(cID, *taxFor("NZ", "", "")); err != nil {
+		t.Fatal(err)
+	}
+	mem.Renew(cID)
+
+	invs, _ := mem.GetCustomerInvoices(cID)
+	inv := toEcommInvoice(invs[0])
+	if inv.Total != 3335 {
+		t.Errorf("The tax was not added to the invoice, got %v.", inv.Total)
+	}
+	last := inv.Lines[len(inv.Lines)-1]
+	if !last.Tax || last.Amount != 435 || last.Description != "GST (15%)" {
+		t.Errorf("The invoice does not have a tax line, got %+v.", inv.Lines)
+	}
+}
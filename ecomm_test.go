@@ -96,7 +96,7 @@ func TestEcommUpdate1(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommUpdateCustomerSub(db, "123", ls)
+	err := lc.EcommUpdateCustomerSub(db, "123", ls, nil)
 	if err.Error() != "Customer was not found for that user." {
 		t.Error("EcommUpdateCustomerSub not validating the customer exists.")
 	}
@@ -128,7 +128,7 @@ func TestEcommUpdate2(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommUpdateCustomerSub(db, "123", ls)
+	err := lc.EcommUpdateCustomerSub(db, "123", ls, nil)
 	if err.Error() != "User is already subscribed to the plan." {
 		t.Error("EcommUpdateCustomerSub not validating the customer plan is changing.")
 	}
@@ -198,7 +198,7 @@ func TestEcommUpdate3(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommUpdateCustomerSub(db, "103", ls)
+	err := lc.EcommUpdateCustomerSub(db, "103", ls, nil)
 	if err != nil {
 		t.Error("EcommUpdateCustomerSub is unexpectedly returning an error.")
 	}
@@ -272,7 +272,7 @@ func TestEcommUpdate4(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommUpdateCustomerSub(db, "102", ls)
+	err := lc.EcommUpdateCustomerSub(db, "102", ls, nil)
 	if err != nil {
 		t.Error("EcommUpdateCustomerSub is unexpectedly returning an error.")
 	}
@@ -285,6 +285,57 @@ func TestEcommUpdate4(t *testing.T) {
 	}
 }
 
+// Test the EcommUpdateCustomerSub function moves a yearly user to the
+// monthly plan of their tier at the end of the year, without changing the
+// subscription now.
+func TestEcommUpdateInterval(t *testing.T) {
+	u := ui{
+		CID:      sql.NullString{String: "abc123", Valid: true},
+		Kind:     "2",
+		Interval: IntervalYear,
+		CPE:      "2018-01-01 00:00:00",
+	}
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+		getPlanMock: func(string) string {
+			return "2"
+		},
+		updateSubMock: func(a, b string, c bool) (string, error) {
+			t.Error("updateSub was called for a move to monthly billing.")
+			return "", nil
+		},
+		isProratedMock: func(string, string) bool {
+			return false
+		},
+	}
+	var args []interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, a ...interface{}) error {
+			*dest.(*ui) = u
+			return nil
+		},
+		ExecMock: func(q string, a ...interface{}) (sql.Result, error) {
+			args = a
+			return nil, nil
+		},
+	}
+	lc := Lgc{}
+
+	if err := lc.EcommUpdateCustomerSub(db, "102y", ls, nil); err == nil {
+		t.Error("EcommUpdateCustomerSub is allowing a change to the current plan.")
+	}
+	if err := lc.EcommUpdateCustomerSub(db, "102", ls, nil); err != nil {
+		t.Fatalf("EcommUpdateCustomerSub returned an error, got %v.", err)
+	}
+	// kind, next_kind, current_period_end, downgrade_date, billing_interval,
+	// next_interval, id.
+	if len(args) != 7 || args[3] != u.CPE || args[4] != IntervalYear || args[5] != IntervalMonth {
+		t.Errorf("EcommUpdateCustomerSub did not schedule the move to monthly billing, got %v.", args)
+	}
+}
+
 // Test the EcommNewCustomer function passes the correct arguments to the
 // ecomm package, and makes the expected number of db calls when the
 // payments were successful.
@@ -326,7 +377,7 @@ func TestEcommNewCustomer1(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommNewCustomer(db, ls, "123ABC", "102")
+	err := lc.EcommNewCustomer(db, ls, "123ABC", "102", nil)
 	if err != nil {
 		t.Error("EcommNewCustomer is returning an error unexpectedly.")
 	}
@@ -381,7 +432,7 @@ func TestEcommNewCustomer2(t *testing.T) {
 	}
 	lc := Lgc{}
 
-	err := lc.EcommNewCustomer(db, ls, "123ABC", "103")
+	err := lc.EcommNewCustomer(db, ls, "123ABC", "103", nil)
 	if err != nil {
 		t.Error("EcommNewCustomer is returning an error unexpectedly.")
 	}
@@ -443,15 +494,16 @@ func TestEcommNewCustomer3(t *testing.T) {
 		},
 	}
 	lc := Lgc{}
-	err := lc.EcommNewCustomer(db, ls, "123ABC", "103")
+	err := lc.EcommNewCustomer(db, ls, "123ABC", "103", nil)
 	if err != nil {
 		t.Error("EcommNewCustomer is returning an error unexpectedly.")
 	}
-	// There should only be 3 exec calls made, as the user already had
-	// an enterprise record assigned to them. The last request will be updating
-	// the user to have a group_active of 1.
-	if ecount != 3 {
-		t.Errorf("EcommNewCustomer is not making expected number of db calls, expected 3 got %v.", ecount)
+	// There should only be 4 exec calls made, as the user already had
+	// an enterprise record assigned to them. The last requests will be
+	// updating the user to have a group_active of 1, and recounting the
+	// members of the enterprise.
+	if ecount != 4 {
+		t.Errorf("EcommNewCustomer is not making expected number of db calls, expected 4 got %v.", ecount)
 	}
 	if count != 2 {
 		t.Errorf("EcommNewCustomer is not making expected number of db retrieval calls, expected 2 got %v", count)
@@ -0,0 +1,223 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// The Mandrill templates used for the trial emails.
+const (
+	emailTrialEnding    = "trial-ending"
+	emailTrialConverted = "trial-converted"
+	emailTrialEnded     = "trial-ended"
+)
+
+// trialReminder is how long before the end of a trial the user is reminded
+// to add a card.
+const trialReminder = 3 * 24 * time.Hour
+
+// The trial information of a user.
+type trialUser struct {
+	ID        string         `db:"id"`
+	Email     string         `db:"email"`
+	FirstName string         `db:"first_name"`
+	CID       sql.NullString `db:"s_customer_id"`
+	TrialEnd  sql.NullString `db:"trial_end"`
+	TrialPlan sql.NullString `db:"trial_plan"`
+	// The enterprise of the user, which is only selected for ended trials.
+	EnterpriseID sql.NullString `db:"enterprise_id"`
+}
+
+/*
+  EcommStartTrial starts a free trial of the plan for the current user. The
+  user is given the kind and quota of the plan until the end of the trial,
+  without a card. A user can only trial once, and only before they become a
+  customer.
+*/
+func (lc Lgc) EcommStartTrial(db DataCaller, ls LogicStore, plan string) error {
+	userID := ls.GetCurrentUser().Id
+
+	p, ok := planCatalog.ByID(plan)
+	if !ok || !p.Paid() {
+		return errors.New("That plan does not exist.")
+	}
+	if p.TrialDays <= 0 {
+		return errors.New("That plan does not have a free trial.")
+	}
+
+	var u trialUser
+	q := `SELECT id, email, first_name, s_customer_id, trial_end, trial_plan
+          FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error starting the trial.", E: err})
+	}
+	if u.CID.String != "" {
+		return errors.New("Only new customers can start a free trial.")
+	}
+	if u.TrialEnd.Valid {
+		return errors.New("A free trial has already been used on this account.")
+	}
+
+	// The trial ends at the end of the last day, so the current_period_end
+	// shown on the plan page is the trial end.
+	end := time.Now().AddDate(0, 0, p.TrialDays).Format("2006-01-02 15:04:05")
+	q = `UPDATE user SET kind = ?, next_kind = ?, current_period_end = ?, trial_end = ?,
+         trial_plan = ?, trial_reminded = 0 WHERE id = ?;`
+	if _, err := db.Exec(q, p.Kind, p.Kind, end, end, p.ID, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error starting the trial.", E: err})
+	}
+
+	if !p.Unmetered {
+		q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+		if _, err := db.Exec(q, p.Quota, userID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error starting the trial.", E: err})
+		}
+	}
+	if p.HasFeature(FeatureGroups) {
+		if err := createGroup(db, userID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "Error starting the trial.", E: err})
+		}
+	}
+	return nil
+}
+
+/*
+  EcommAddTrialCard adds a card for the current user during their trial. The
+  customer is created with a subscription to the trial plan that begins
+  charging when the trial ends, so the trial converts to a paid plan
+  automatically.
+*/
+func (lc Lgc) EcommAddTrialCard(db DataCaller, ls LogicStore, token string) error {
+	userID := ls.GetCurrentUser().Id
+
+	var u trialUser
+	q := `SELECT id, email, first_name, s_customer_id, trial_end, trial_plan
+          FROM user WHERE id = ?;`
+	if err := db.Get(&u, q, userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the card.", E: err})
+	}
+	if u.CID.String != "" {
+		return errors.New("A card has already been added.")
+	}
+	if !u.TrialPlan.Valid {
+		return errors.New("There is no free trial on this account.")
+	}
+	end, err := time.Parse("2006-01-02 15:04:05", u.TrialEnd.String)
+	if err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the card.", E: err})
+	}
+
+	cID, cpe, err := lc.createTrialCustomer(u.Email, token, u.TrialPlan.String, end)
+	if err != nil {
+		// This is a friendly error returned from Stripe.
+		return err
+	}
+
+	// The user is billed at the interval of the trial plan once it converts.
+	p, _ := planCatalog.ByID(u.TrialPlan.String)
+	q = `UPDATE user SET s_customer_id = ?, current_period_end = ?, billing_interval = ?,
+         next_interval = ? WHERE id = ?;`
+	if _, err := db.Exec(q, cID, cpe, p.BillingInterval(), p.BillingInterval(), userID); err != nil {
+		return e.ThrowError(&e.LogInput{M: "Error adding the card.", E: err})
+	}
+	return nil
+}
+
+/*
+  ecommTrials is run by EcommSchedule. Users whose trial is about to end
+  without a card are reminded to add one. Once a trial has ended, users with
+  a card are converted (their subscription was created by
+  EcommAddTrialCard), and users without a card are downgraded to free.
+  An error for one user does not stop the other users being actioned.
+*/
+func (lc Lgc) ecommTrials(db DataCaller, now time.Time) error {
+	email := func(u trialUser, template string, vars map[string]string) error {
+		return lc.Pvl.buildBillingEmail(&buildBillingEmailInput{
+			template:  template,
+			firstName: u.FirstName,
+			email:     u.Email,
+			vars:      vars,
+			db:        db,
+		})
+	}
+
+	var failed error
+
+	// Remind the users without a card that their trial is ending.
+	var remind []trialUser
+	q := `SELECT id, email, first_name, s_customer_id, trial_end, trial_plan FROM user
+          WHERE trial_plan IS NOT NULL AND s_customer_id IS NULL AND trial_reminded = 0
+          AND trial_end > ? AND trial_end <= ?;`
+	if err := db.Select(&remind, q, now, now.Add(trialReminder)); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRTRIAL1", E: err})
+	}
+	for _, u := range remind {
+		vars := map[string]string{"date": u.TrialEnd.String}
+		if err := email(u, emailTrialEnding, vars); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRTRIAL2 " + u.ID, E: err})
+			continue
+		}
+		q = `UPDATE user SET trial_reminded = 1 WHERE id = ?;`
+		if _, err := db.Exec(q, u.ID); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRTRIAL2 " + u.ID, E: err})
+		}
+	}
+
+	// End the trials that have expired. The trial_end is kept so the user
+	// cannot trial again.
+	var ended []trialUser
+	q = `SELECT id, email, first_name, s_customer_id, trial_end, trial_plan, enterprise_id
+         FROM user WHERE trial_plan IS NOT NULL AND trial_end <= ?;`
+	if err := db.Select(&ended, q, now); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRTRIAL3", E: err})
+	}
+	for _, u := range ended {
+		if err := lc.endTrial(db, u); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRTRIAL4 " + u.ID, E: err})
+			continue
+		}
+		template := emailTrialEnded
+		if u.CID.String != "" {
+			template = emailTrialConverted
+		}
+		if err := email(u, template, nil); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: "ERRTRIAL5 " + u.ID, E: err})
+		}
+	}
+	return failed
+}
+
+/*
+  endTrial converts the trial of a user with a card, or downgrades a user
+  without a card to the free plan. The group of a user trialling a plan with
+  groups is deactivated, as it is when a subscription is cancelled.
+*/
+func (lc Lgc) endTrial(db DataCaller, u trialUser) error {
+	if u.CID.String != "" {
+		q := `UPDATE user SET trial_plan = NULL WHERE id = ?;`
+		_, err := db.Exec(q, u.ID)
+		return err
+	}
+
+	return withTx(db, func(tx DataCaller) error {
+		q := `UPDATE user SET kind = 0, next_kind = 0, current_period_end = NULL,
+              downgrade_date = NULL, trial_plan = NULL WHERE id = ?;`
+		if _, err := tx.Exec(q, u.ID); err != nil {
+			return err
+		}
+		q = `UPDATE user_quota SET quota = ? WHERE user_id = ?;`
+		if _, err := tx.Exec(q, freeQuota(), u.ID); err != nil {
+			return err
+		}
+
+		p, _ := planCatalog.ByID(u.TrialPlan.String)
+		if p.HasFeature(FeatureGroups) && u.EnterpriseID.String != "" {
+			if _, err := endGroup(tx, u.EnterpriseID.String); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
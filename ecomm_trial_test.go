@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// Test the EcommStartTrial function only allows a single trial for users
+// that are not yet customers.
+func TestEcommStartTrial(t *testing.T) {
+	ls := &MockLogic{
+		GetCurrentUserMock: func() *UserAuth {
+			return &UserAuth{Id: "1"}
+		},
+	}
+	u := trialUser{ID: "1"}
+	var kind, end interface{}
+	db := &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			*dest.(*trialUser) = u
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if kind == nil {
+				kind, end = args[0], args[2]
+			}
+			return nil, nil
+		},
+	}
+	lc := Lgc{}
+
+	if err := lc.EcommStartTrial(db, ls, "free"); err == nil {
+		t.Error("EcommStartTrial is allowing a trial of the free plan.")
+	}
+
+	if err := lc.EcommStartTrial(db, ls, "102"); err != nil {
+		t.Errorf("EcommStartTrial returned an error, got %v.", err)
+	}
+	if kind != "2" {
+		t.Errorf("EcommStartTrial did not assign the kind of the plan, got %v.", kind)
+	}
+	want := time.Now().AddDate(0, 0, 14).Format("2006-01-02")
+	if s, _ := end.(string); len(s) < 10 || s[:10] != want {
+		t.Errorf("EcommStartTrial set the wrong trial end, got %v wanted %v.", end, want)
+	}
+
+	// The user has already trialled.
+	u.TrialEnd = sql.NullString{String: "2020-01-01 00:00:00", Valid: true}
+	err := lc.EcommStartTrial(db, ls, "102")
+	if err == nil || err.Error() != "A free trial has already been used on this account." {
+		t.Errorf("EcommStartTrial is allowing a second trial, got %v.", err)
+	}
+
+	// The user is already a customer.
+	u = trialUser{CID: sql.NullString{String: "cus_1", Valid: true}}
+	if err := lc.EcommStartTrial(db, ls, "102"); err == nil {
+		t.Error("EcommStartTrial is allowing customers to trial.")
+	}
+}
+
+// Test the endTrial function converts users with a card, and downgrades
+// users without one.
+func TestEndTrial(t *testing.T) {
+	var queries []string
+	db := &MockDb{
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			queries = append(queries, q)
+			return nil, nil
+		},
+	}
+	lc := Lgc{}
+
+	u := trialUser{ID: "1", CID: sql.NullString{String: "cus_1", Valid: true}}
+	if err := lc.endTrial(db, u); err != nil {
+		t.Errorf("endTrial returned an error, got %v.", err)
+	}
+	if len(queries) != 1 {
+		t.Errorf("endTrial is downgrading a converted trial, got %v.", queries)
+	}
+
+	queries = nil
+	u.CID = sql.NullString{}
+	if err := lc.endTrial(db, u); err != nil {
+		t.Errorf("endTrial returned an error, got %v.", err)
+	}
+	if len(queries) != 2 {
+		t.Errorf("endTrial did not downgrade the user and quota, got %v.", queries)
+	}
+
+	// The group of a business plus trial is deactivated.
+	queries = nil
+	db.GetMock = func(dest interface{}, query string, args ...interface{}) error { return nil }
+	u.TrialPlan = sql.NullString{String: "103", Valid: true}
+	u.EnterpriseID = sql.NullString{String: "FF", Valid: true}
+	if err := lc.endTrial(db, u); err != nil {
+		t.Errorf("endTrial returned an error, got %v.", err)
+	}
+	if len(queries) != 5 || queries[2] != `UPDATE user SET group_active = 0 WHERE enterprise_id = ?;` {
+		t.Errorf("endTrial did not deactivate the group, got %v.", queries)
+	}
+}
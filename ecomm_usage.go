@@ -0,0 +1,181 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	e "pleasesign/errlogger"
+	"time"
+)
+
+// EcommUsage is the usage of the current quota period, returned with the
+// subscription by EcommGetCustomerSub.
+type EcommUsage struct {
+	PeriodStart  string // When the quota was last reset.
+	Used         int    // The documents sent in the period, including overage.
+	Quota        int    // The documents included in the plan.
+	Overage      int    // The documents sent beyond the quota.
+	OveragePrice int64  // The price of each document beyond the quota, in cents.
+	OverageCost  int64  // The cost of the overage so far, in cents.
+	Unlimited    bool   // True for plans that are not metered.
+}
+
+// usageQuota is the quota and plan of a user, used to meter their usage.
+type usageQuota struct {
+	Quota      int    `db:"quota"`
+	QuotaReset string `db:"quota_reset"`
+	Kind       string `db:"kind"`
+	CID        string `db:"s_customer_id"`
+}
+
+// unmetered returns true if the plan of the user is not metered (bplus).
+func (u usageQuota) unmetered() bool {
+	p, ok := planCatalog.ByKind(u.Kind)
+	return ok && p.Unmetered
+}
+
+/*
+  getUsage returns the usage of the user since their quota was last reset.
+  The quota period is the same period reset by /resetQuotas, so the usage
+  is counted from user_quota.quota_reset.
+*/
+func getUsage(db DataCaller, userID string) (*EcommUsage, error) {
+	var uq usageQuota
+	q := `SELECT q.quota, q.quota_reset, u.kind, IFNULL(u.s_customer_id, '') AS s_customer_id
+          FROM user_quota q JOIN user u ON u.id = q.user_id WHERE q.user_id = ?;`
+	if err := db.Get(&uq, q, userID); err != nil {
+		return nil, err
+	}
+	out := &EcommUsage{
+		PeriodStart: uq.QuotaReset,
+		Quota:       uq.Quota,
+		Unlimited:   uq.unmetered(),
+	}
+
+	type c struct {
+		Used    int `db:"used"`
+		Overage int `db:"overage"`
+	}
+	var cnt c
+	q = `SELECT COUNT(*) AS used, IFNULL(SUM(overage), 0) AS overage FROM ecomm_usage
+         WHERE user_id = ? AND created >= ?;`
+	if err := db.Get(&cnt, q, userID, uq.QuotaReset); err != nil {
+		return nil, err
+	}
+	out.Used = cnt.Used
+	out.Overage = cnt.Overage
+
+	if p, ok := planCatalog.ByKind(uq.Kind); ok {
+		out.OveragePrice = p.OveragePrice
+		out.OverageCost = p.OveragePrice * int64(cnt.Overage)
+	}
+	return out, nil
+}
+
+/*
+  EcommRecordUsage records a document sent by the user against their quota.
+  This is called when a document is sent. A document sent beyond the quota
+  is recorded as overage when the plan allows paid overage, and reported to
+  the billing provider as metered usage; otherwise the user is blocked and
+  a friendly error is returned. A document is only counted once, so sending
+  a reminder for a document does not use the quota again.
+*/
+func (lc Lgc) EcommRecordUsage(db DataCaller, userID string, documentID string) error {
+	var overage bool
+	var cID string
+	err := withTx(db, func(tx DataCaller) error {
+		// Lock the quota of the user, so concurrent sends cannot both use
+		// the last document of the quota.
+		var uq usageQuota
+		q := `SELECT q.quota, q.quota_reset, u.kind, IFNULL(u.s_customer_id, '') AS s_customer_id
+              FROM user_quota q JOIN user u ON u.id = q.user_id WHERE q.user_id = ? FOR UPDATE;`
+		if err := tx.Get(&uq, q, userID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRUSAGE1", E: err})
+		}
+		cID = uq.CID
+
+		var counted int
+		q = `SELECT COUNT(*) FROM ecomm_usage WHERE user_id = ? AND document_id = ?;`
+		if err := tx.Get(&counted, q, userID, documentID); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRUSAGE2", E: err})
+		}
+		if counted > 0 {
+			return nil
+		}
+
+		if !uq.unmetered() {
+			var used int
+			q = `SELECT COUNT(*) FROM ecomm_usage WHERE user_id = ? AND created >= ?;`
+			if err := tx.Get(&used, q, userID, uq.QuotaReset); err != nil {
+				return e.ThrowError(&e.LogInput{M: "ERRUSAGE3", E: err})
+			}
+			if used >= uq.Quota {
+				// Overage is only available to paying customers on a plan
+				// with an overage price.
+				p, _ := planCatalog.ByKind(uq.Kind)
+				if p.OveragePrice == 0 || uq.CID == "" {
+					return errors.New("You have reached the document limit for your plan.")
+				}
+				overage = true
+			}
+		}
+
+		q = `INSERT INTO ecomm_usage (user_id, document_id, overage, reported, created)
+             VALUES (?,?,?,0,?);`
+		if _, err := tx.Exec(q, userID, documentID, overage, time.Now()); err != nil {
+			return e.ThrowError(&e.LogInput{M: "ERRUSAGE4", E: err})
+		}
+		return nil
+	})
+	if err != nil || !overage {
+		return err
+	}
+
+	// The usage has been recorded, so the document can be sent even if the
+	// provider cannot be reached. Unreported usage is reported again by the
+	// scheduler.
+	if err := lc.reportUsage(db, userID, documentID, cID); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRUSAGE5 " + userID, E: err})
+	}
+	return nil
+}
+
+// reportUsage reports a document sent beyond the quota to the billing
+// provider, and marks it as reported. A document is only recorded once for
+// each user, so the user and document identify the report; when the usage
+// was reported but could not be marked, the retry is not counted again.
+func (lc Lgc) reportUsage(db DataCaller, userID string, documentID string, customerID string) error {
+	key := fmt.Sprintf("usage-%v-%v", userID, documentID)
+	if err := lc.billing().ReportUsage(customerID, 1, time.Now(), key); err != nil {
+		return err
+	}
+	q := `UPDATE ecomm_usage SET reported = 1 WHERE user_id = ? AND document_id = ?;`
+	_, err := db.Exec(q, userID, documentID)
+	return err
+}
+
+// unreportedUsage is overage that has not been reported to the provider.
+type unreportedUsage struct {
+	UserID     string `db:"user_id"`
+	DocumentID string `db:"document_id"`
+	CID        string `db:"s_customer_id"`
+}
+
+// ecommUsage reports any overage that could not be reported when the
+// document was sent.
+func (lc Lgc) ecommUsage(db DataCaller) error {
+	var us []unreportedUsage
+	q := `SELECT g.user_id, g.document_id, u.s_customer_id FROM ecomm_usage g
+          JOIN user u ON u.id = g.user_id
+          WHERE g.overage = 1 AND g.reported = 0 AND u.s_customer_id IS NOT NULL;`
+	if err := db.Select(&us, q); err != nil {
+		return e.ThrowError(&e.LogInput{M: "ERRUSAGE6", E: err})
+	}
+
+	var failed error
+	for _, u := range us {
+		if err := lc.reportUsage(db, u.UserID, u.DocumentID, u.CID); err != nil {
+			failed = e.ThrowError(&e.LogInput{M: fmt.Sprintf("ERRUSAGE7 %v %v", u.UserID, u.DocumentID), E: err})
+		}
+	}
+	return failed
+}
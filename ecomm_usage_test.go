@@ -0,0 +1,123 @@
+package logic
+
+import (
+	"database/sql"
+	"pleasesign/ecomm"
+	"strings"
+	"testing"
+)
+
+// usageDb returns a MockDb for a user with the quota and plan kind, that has
+// already sent used documents in the period.
+func usageDb(uq usageQuota, used int, inserted *bool) *MockDb {
+	return &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			switch d := dest.(type) {
+			case *usageQuota:
+				*d = uq
+			case *int:
+				if strings.Contains(query, "document_id = ?") {
+					*d = 0
+				} else {
+					*d = used
+				}
+			}
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if strings.HasPrefix(q, "INSERT INTO ecomm_usage") {
+				*inserted = true
+			}
+			return nil, nil
+		},
+	}
+}
+
+// Test the EcommRecordUsage function records usage within the quota, and
+// blocks the user when the plan has no overage price.
+func TestEcommRecordUsage(t *testing.T) {
+	lc := Lgc{}
+
+	var inserted bool
+	db := usageDb(usageQuota{Quota: 10, Kind: "1"}, 3, &inserted)
+	if err := lc.EcommRecordUsage(db, "1", "doc"); err != nil {
+		t.Errorf("EcommRecordUsage returned an error within the quota, got %v.", err)
+	}
+	if !inserted {
+		t.Error("EcommRecordUsage did not record the usage.")
+	}
+
+	inserted = false
+	db = usageDb(usageQuota{Quota: 10, Kind: "1", CID: "cus_1"}, 10, &inserted)
+	err := lc.EcommRecordUsage(db, "1", "doc")
+	if err == nil || err.Error() != "You have reached the document limit for your plan." {
+		t.Errorf("EcommRecordUsage did not block the user, got %v.", err)
+	}
+	if inserted {
+		t.Error("EcommRecordUsage recorded usage beyond the quota.")
+	}
+
+	// Unmetered plans are not limited.
+	db = usageDb(usageQuota{Quota: 0, Kind: "5"}, 100, &inserted)
+	if err := lc.EcommRecordUsage(db, "1", "doc"); err != nil {
+		t.Errorf("EcommRecordUsage metered an unmetered plan, got %v.", err)
+	}
+
+	// Free accounts can send the free quota, and are then blocked.
+	db = usageDb(usageQuota{Quota: FreeQuota, Kind: "0"}, FreeQuota-1, &inserted)
+	if err := lc.EcommRecordUsage(db, "1", "doc"); err != nil {
+		t.Errorf("EcommRecordUsage blocked a free account within the quota, got %v.", err)
+	}
+	db = usageDb(usageQuota{Quota: FreeQuota, Kind: "0"}, FreeQuota, &inserted)
+	if err := lc.EcommRecordUsage(db, "1", "doc"); err == nil {
+		t.Error("EcommRecordUsage did not block a free account beyond the quota.")
+	}
+}
+
+// Test the EcommRecordUsage function reports overage to the billing
+// provider when the plan has an overage price.
+func TestEcommRecordUsageOverage(t *testing.T) {
+	defer planCatalog.set(defaultPlans())
+	plans := defaultPlans()
+	for i := range plans {
+		if plans[i].Kind == "2" {
+			plans[i].OveragePrice = 50
+		}
+	}
+	planCatalog.set(plans)
+
+	mem := NewMemBilling()
+	mem.SetUsagePrice("102", 50)
+	cID, _, err := mem.CreateCustomer(ecomm.CreateCusInp{Email: "a@b.com", Token: "tok", Plan: "102"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inserted bool
+	db := usageDb(usageQuota{Quota: 10, Kind: "2", CID: cID}, 10, &inserted)
+	lc := Lgc{Billing: mem}
+	if err := lc.EcommRecordUsage(db, "1", "doc"); err != nil {
+		t.Fatalf("EcommRecordUsage returned an error for overage, got %v.", err)
+	}
+	if !inserted || mem.Usage(cID) != 1 {
+		t.Errorf("EcommRecordUsage did not report the overage, got %v.", mem.Usage(cID))
+	}
+
+	// Reporting the same document again, as the scheduler does when the
+	// usage could not be marked as reported, is not counted twice.
+	if err := lc.reportUsage(db, "1", "doc", cID); err != nil {
+		t.Fatal(err)
+	}
+	if mem.Usage(cID) != 1 {
+		t.Errorf("The usage was reported twice, got %v.", mem.Usage(cID))
+	}
+
+	// The overage is billed when the subscription renews.
+	if err := mem.Renew(cID); err != nil {
+		t.Fatal(err)
+	}
+	invs, _ := mem.GetCustomerInvoices(cID)
+	if len(invs) == 0 || invs[0].Total != 50 {
+		t.Errorf("The overage was not invoiced, got %+v.", invs)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/dchest/uniuri"
-	"github.com/jung-kurt/gofpdf"
 	"pleasesign/config"
 	e "pleasesign/errlogger"
 	"time"
@@ -27,209 +26,57 @@ func (Lgc) createCertAuth(documentID string, db DataCaller, lc Lgc) error {
 		lc.Pvl.buildSecurityFailEmail(emIn)
 	}
 
-	err := lc.genpdf(documentID, db, lc)
-	return err
+	// Sign the completed master document if required, before the
+	// certificate is generated so the certificate carries the sum of the
+	// signed document. As for the certificate, a failure to sign is logged
+	// rather than returned, as the certificate must still be generated.
+	if s, master := certSigner(); s != nil && master {
+		if err := lc.signMasterDocument(documentID, db, s); err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRSIGNMASTER " + documentID, E: err})
+		}
+	}
+
+	return lc.genpdf(documentID, db, lc)
 }
 
 /*
   Genpdf creates the certificate of authenticity for a document, either in the
-  complete or void stage.
+  complete or void stage. The layout comes from the template of the
+  document, which carries the branding of its enterprise, and is rendered
+  in the language and timezone of the sender. The certificate links to the
+  public verification of the document with a QR code.
 */
 func (Lgc) genpdf(documentID string, db DataCaller, lc Lgc) error {
-	// Instantiate the pdf maker to be used.
-	pdf := gofpdf.New("P", "pt", "A4", ".")
-
-	// Add a new page straight away.
-	pdf.AddPage()
-
-	////PAGE 1
-	// Draw the grey background at the top.
-	// Add the logo to the top left.
-	lp := config.LogoPath()
-	pdf.Image(lp, 15, 19, -250, -250, false, "", 0, "")
-	// Create the Certificate of Authenticity and v1 text along the top.
-	pdf.SetFont("Helvetica", "B", 23)
-	pdf.WriteAligned(0, 39, "                                 Certificate of Authenticity", "C")
-	pdf.Ln(25)
-	pdf.SetFont("Helvetica", "", 20)
-	pdf.WriteAligned(0, 39, "                                    v1", "C")
-
-	// Move down to beneath the top banner and reset the font.
-	pdf.SetY(122)
-	pdf.SetFont("Helvetica", "", 18)
-	pdf.SetTextColor(0, 0, 0)
-
-	// Fill in the document details.
-	currX := pdf.GetX()
-	pdf.SetX(currX + 15)
-	pdf.WriteAligned(0, 10, "Document Details", "L")
-	pdf.Ln(20)
+	f := lc.certFormat(documentID, db)
 
 	// Get the document information from the db.
-	doc, err := lc.getDocumentDetailCert(documentID, db)
+	doc, err := lc.getDocumentDetailCert(documentID, db, f)
 	if err != nil {
 		return e.ThrowError(&e.LogInput{
 			M: err.Error() + " " + documentID,
 		})
 	}
 
-	// Construct the formatted string from the document details retrieved.
-	// Ensure the status of the document is checked as this will change
-	// the text that will be written (and that was returned by the db call above.)
-	var txtStr string
-	if doc.status != "void" {
-		switch {
-		case doc.docType == "" && doc.message == "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nStatus: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.status, doc.pages, doc.date)
-		case doc.docType == "" && doc.message != "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nMessage to recipients: %v\nStatus: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.message, doc.status, doc.pages, doc.date)
-		case doc.docType != "" && doc.message == "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nStatus: %v\nType: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.status, doc.docType, doc.pages, doc.date)
-		case doc.docType != "" && doc.message != "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nMessage to recipients: %v\nStatus: %v\nType: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.message, doc.status, doc.docType, doc.pages, doc.date)
-		}
-	} else {
-		switch {
-		case doc.docType == "" && doc.message == "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nStatus: %v\nVoid Reason: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.status, doc.voidReason, doc.pages, doc.date)
-		case doc.docType == "" && doc.message != "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nMessage to recipients: %v\nStatus: %v\nVoid Reason: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.message, doc.status, doc.voidReason, doc.pages, doc.date)
-		case doc.docType != "" && doc.message == "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nStatus: %v\nVoid Reason: %v\nType: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.status, doc.voidReason, doc.docType, doc.pages, doc.date)
-		case doc.docType != "" && doc.message != "":
-			txtStr = fmt.Sprintf("ID: %v\nTitle: %v\nMessage to recipients: %v\nStatus: %v\nVoid Reason: %v\nType: %v\nPages: %v\nCreated: %v",
-				doc.id, doc.title, doc.message, doc.status, doc.voidReason, doc.docType, doc.pages, doc.date)
-		}
-	}
-	// Write the string that was formatted above.
-	pdf.SetFont("Helvetica", "", 12)
-	pdf.SetX(currX + 20)
-	pdf.MultiCell(0, 17, string(txtStr), "", "", false)
-
-	// Draw the line to seperate document details from recipient details.
-	pdf.Ln(20)
-	currY := pdf.GetY()
-	pdf.SetDrawColor(200, 200, 200)
-	pdf.Line(0, currY, 595, currY)
-	pdf.Ln(20)
-
-	// Fill in the recipient details heading.
-	pdf.SetFont("Helvetica", "", 18)
-	pdf.SetX(currX + 15)
-	pdf.WriteAligned(0, 10, "Recipient Details", "L")
-	pdf.Ln(20)
-
-	// Retrieve the recipients for the document, and loop through them
-	// to write to the page. Within the next section there is a lot
-	// of string formatting that handle what has been returned from the
-	// database - due to the certificate being for either a completed
-	// document or a voided document.
-	// The thumbnail of the signature is also drawn on the page during
-	// this process.
-	recipients, err := lc.getRecipientDetailCert(documentID, db)
+	// Retrieve the recipients for the document. The thumbnail of the
+	// signature of each recipient is written to disk, to be drawn on
+	// the page.
+	recipients, err := lc.getRecipientDetailCert(documentID, db, f)
 	if err != nil {
 		return e.ThrowError(&e.LogInput{
 			M: err.Error() + " " + documentID,
 		})
 	}
 
-	for i, r := range recipients {
-		pdf.SetFont("Helvetica", "", 12)
-		pdf.SetX(currX + 20)
-		pdf.WriteAligned(0, 20, r.name, "L")
-		pdf.SetFont("Helvetica", "", 10)
-		// If there was no session the below information
-		// is not relevant and will all be blank.
-		if r.sessionid != "" {
-			// Check that the thumbnail exists before drawing the thumbnail.
-			if r.thumb != "" {
-				// Print the signature on the page at the current position if
-				// the recipient has a valid session.
-				pdf.SetX(325)
-				currX, currY := pdf.GetXY()
-				pdf.Image(r.thumb, currX+21, currY+12, 140, 0, false, "", 0, "")
-			}
-			pdf.Ln(20)
-			currX = pdf.GetX()
-			pdf.SetX(currX + 20)
-			var newTxtStr string
-			if r.thumb == "" {
-				if r.geolat == 0 || r.geolong == 0 {
-					newTxtStr = fmt.Sprintf("ID: %v(%v)\nAuthentication: %v\nSession ID: %v\nIP address: %v\nBrowser: %v\n", r.id, r.email, r.security, r.sessionid, r.ip, r.useragent)
-				} else {
-					newTxtStr = fmt.Sprintf("ID: %v(%v)\nAuthentication: %v\nSession ID: %v\nIP address: %v\nLocation signed: %v, %v\nBrowser: %v",
-						r.id, r.email, r.security, r.sessionid, r.ip, r.geolong, r.geolat, r.useragent)
-				}
-			} else {
-				if r.geolat == 0 || r.geolong == 0 {
-					newTxtStr = fmt.Sprintf("ID: %v(%v)\nAuthentication: %v\nDate signed: %v UTC\nSession ID: %v\nIP address: %v\nBrowser: %v\n", r.id, r.email, r.security, r.date, r.sessionid, r.ip, r.useragent)
-				} else {
-					newTxtStr = fmt.Sprintf("ID: %v(%v)\nAuthentication: %v\nDate signed: %v UTC\nSession ID: %v\nIP address: %v\nLocation signed: %v, %v\nBrowser: %v",
-						r.id, r.email, r.security, r.date, r.sessionid, r.ip, r.geolong, r.geolat, r.useragent)
-				}
-			}
-			pdf.MultiCell(0, 17, string(newTxtStr), "", "", false)
-
-		} else {
-			// This is the case when the recipient did not have a
-			// valid session, ie the document has been voided and
-			// it simply needs to list the potential recipient
-			// and their email. The recipient's name has been printed
-			// already so just their email is formatted and written
-			// to the certificate.
-			pdf.Ln(20)
-			currX = pdf.GetX()
-			pdf.SetX(currX + 20)
-			newTxtStr := fmt.Sprintf("%v", r.email)
-			pdf.MultiCell(0, 17, string(newTxtStr), "", "", false)
-		}
-
-		// If we are not at the last of the recipients, move down 30 to create room to
-		// print the next recipient.
-		if i+1 != len(recipients) {
-			pdf.Ln(30)
-		}
-	}
-
-	// Draw the line to seperate recipient details from event details.
-	currY = pdf.GetY()
-	pdf.SetDrawColor(200, 200, 200)
-	pdf.Line(0, currY+20, 595, currY+20)
-	pdf.Ln(40)
-
-	// Fill in the event details
-	pdf.SetFont("Helvetica", "", 16)
-	pdf.SetX(currX + 15)
-	pdf.WriteAligned(0, 10, "Document Events", "L")
-	pdf.Ln(20)
-
-	pdf.SetFont("Helvetica", "", 10)
-	events, err := lc.getEventDetailCert(documentID, db)
+	events, err := lc.getEventDetailCert(documentID, db, f)
 	if err != nil {
 		return e.ThrowError(&e.LogInput{
 			M: err.Error() + " " + documentID,
 		})
 	}
-	for _, event := range events {
-		pdf.SetX(currX + 20)
-		newTxtStr := fmt.Sprintf("%v - %v", event.Date, event.Body)
-		pdf.MultiCell(500, 12, string(newTxtStr), "", "", false)
-		pdf.Ln(5)
-	}
 
-	pdf.Ln(20)
-	pdf.SetFont("Helvetica", "", 8)
-	pdf.WriteAligned(0, 10, "All times on this document are in UTC.", "L")
-	pdf.Ln(10)
-	newTxtStr := fmt.Sprintf("Certificate generated on %v.", time.Now().UTC().Format("2006-01-02 15:04:05"))
-	pdf.MultiCell(500, 12, string(newTxtStr), "", "", false)
+	data := newCertData(doc, recipients, events, f, time.Now())
+	data.Footer["verify_url"], data.Verify, data.Footer["document_sum"] = lc.certVerification(documentID, db)
+	pdf := renderCertificate(f.localise(lc.certTemplate(documentID, db)), data)
 
 	///// Output the pdf to disk.
 	directory := config.WorkDir() + uniuri.New() + ".pdf"
@@ -273,7 +120,13 @@ func (Lgc) genpdf(documentID string, db DataCaller, lc Lgc) error {
 
 /*
   uploadDocumentCertificate will take a filepath, and upload the file to s3.
-  It also updates the document_keys record to include the certificate key.
+  It also updates the document_keys record to include the certificate key
+  and the sum of the certificate, which VerifyDocument checks against.
+  When a CertSigner has been set the certificate is signed before it is
+  uploaded, so any change to it can be detected. A failure to sign is
+  logged and the certificate is uploaded unsigned, the same as the master
+  document, so a signer that cannot be reached never stops a document
+  from completing; VerifyDocument still checks the sum of the certificate.
 */
 func (lc Lgc) uploadDocumentCertificate(filepath string, documentID string, db DataCaller) error {
 	// Get the filebytes for passing through to the uploading.
@@ -281,6 +134,18 @@ func (lc Lgc) uploadDocumentCertificate(filepath string, documentID string, db D
 	if err != nil {
 		return err
 	}
+	if s, _ := certSigner(); s != nil {
+		signed, err := signPDF(b, s, pdfSignInput{
+			Name:   "PleaseSign",
+			Reason: "Certificate of Authenticity for document " + documentID,
+			Time:   time.Now(),
+		})
+		if err != nil {
+			e.ThrowError(&e.LogInput{M: "ERRSIGNCERT " + documentID, E: err})
+		} else {
+			b = signed
+		}
+	}
 
 	// Generate a key, and upload the file to s3. Afterwards, update
 	// the document_keys record with the certificate key.
@@ -292,11 +157,84 @@ func (lc Lgc) uploadDocumentCertificate(filepath string, documentID string, db D
 		return err
 	}
 
-	q := `UPDATE document_keys SET certificate_key = ? WHERE document_id = ?;`
-	_, err = db.Exec(q, key, documentID)
+	sum := fmt.Sprintf("%x", lc.genMd5Sum(b))
+	q := `UPDATE document_keys SET certificate_key = ?, certificate_sum = ?
+          WHERE document_id = ?;`
+	_, err = db.Exec(q, key, sum, documentID)
 	return err
 }
 
+/*
+  signMasterDocument signs the completed master document of a document, and
+  stores the signed document in place of the master document. The sum of
+  the signed document is added to documents_security, as the latest sum of
+  the document. Voided documents are not signed. The key and the sum are
+  saved together, and the unsigned master document is only deleted once
+  they are saved.
+*/
+func (lc Lgc) signMasterDocument(documentID string, db DataCaller, s CertSigner) error {
+	type mk struct {
+		Key    sql.NullString `db:"master_key"`
+		Status string         `db:"status"`
+	}
+	var m mk
+	q := `SELECT document_keys.master_key, documents.status FROM document_keys
+          JOIN documents ON documents.id = document_keys.document_id
+          WHERE document_keys.document_id = ?;`
+	if err := db.Get(&m, q, documentID); err != nil {
+		return err
+	}
+	if m.Status == "void" || m.Key.String == "" {
+		return nil
+	}
+
+	b, err := lc.Pvl.GetFile(&GetFileInput{
+		Key:    m.Key.String,
+		Bucket: config.MasterBucket(),
+		EncKey: config.MasterEncryption(),
+	})
+	if err != nil {
+		return err
+	}
+	b, err = signPDF(b, s, pdfSignInput{
+		Name:   "PleaseSign",
+		Reason: "Completed document " + documentID,
+		Time:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	key := uniuri.New() + ".pdf"
+	if err := lc.Pvl.StoreFile(key, b, config.MasterBucket(), config.MasterEncryption()); err != nil {
+		return err
+	}
+	err = withTx(db, func(tx DataCaller) error {
+		q := `UPDATE document_keys SET master_key = ? WHERE document_id = ?;`
+		if _, err := tx.Exec(q, key, documentID); err != nil {
+			return err
+		}
+		q = `INSERT INTO documents_security (document_id, sum, date) VALUES (?, ?, ?);`
+		_, err := tx.Exec(q, documentID, fmt.Sprintf("%x", lc.genMd5Sum(b)), time.Now().UTC().Format(certDateLayout))
+		return err
+	})
+	if err != nil {
+		// The unsigned master document is kept, so the signed one is not
+		// needed.
+		if derr := lc.Pvl.DeleteFile(key, config.MasterBucket()); derr != nil {
+			e.ThrowError(&e.LogInput{M: "ERRSIGNMASTER2 " + key, E: derr})
+		}
+		return err
+	}
+
+	// A failure to delete the unsigned master document leaves an unused
+	// object, so it is logged rather than returned.
+	if err := lc.Pvl.DeleteFile(m.Key.String, config.MasterBucket()); err != nil {
+		e.ThrowError(&e.LogInput{M: "ERRSIGNMASTER3 " + m.Key.String, E: err})
+	}
+	return nil
+}
+
 type documentDetail struct {
 	id         string
 	title      string
@@ -324,7 +262,7 @@ type d struct {
   getDocumentDetail is used to retrieve and format the document information
   as expected by the report.
 */
-func (lc Lgc) getDocumentDetailCert(documentID string, db DataCaller) (documentDetail, error) {
+func (lc Lgc) getDocumentDetailCert(documentID string, db DataCaller, f certFormat) (documentDetail, error) {
 	var out documentDetail
 	var doc d
 
@@ -341,7 +279,7 @@ func (lc Lgc) getDocumentDetailCert(documentID string, db DataCaller) (documentD
 	out.title = doc.Title
 	out.status = doc.Status
 	out.pages = doc.Pages
-	out.date = doc.Date
+	out.date = f.formatDate(doc.Date)
 
 	if doc.Message.String != "" {
 		out.message = doc.Message.String
@@ -357,26 +295,30 @@ func (lc Lgc) getDocumentDetailCert(documentID string, db DataCaller) (documentD
 }
 
 type eventDetail struct {
+	ID   int
 	Date string
 	Body string
 }
 
 /*
   getEventDetailCert pulls all of the events for the document and formats
-  them as expected by the report.
+  them as expected by the report, with the dates in the format.
 */
-func (lc Lgc) getEventDetailCert(documentID string, db DataCaller) ([]eventDetail, error) {
+func (lc Lgc) getEventDetailCert(documentID string, db DataCaller, f certFormat) ([]eventDetail, error) {
 	// Retrieve the event details for the document from the db, scanned into
 	// the events.
 	var events []eventDetail
 
-	q := `SELECT created AS 'date', body FROM events WHERE document_id = ? 
+	q := `SELECT id, created AS 'date', body FROM events WHERE document_id = ? 
           ORDER BY created ASC;`
 
 	err := db.Select(&events, q, documentID)
 	if err != nil {
 		return events, err
 	}
+	for i := range events {
+		events[i].Date = f.formatDate(events[i].Date)
+	}
 
 	return events, nil
 }
@@ -388,6 +330,7 @@ type recipientDetail struct {
 	security  string
 	date      string
 	sessionid string
+	agreed    string // When the session was agreed.
 	ip        string
 	thumb     string
 	geolat    float64
@@ -397,9 +340,9 @@ type recipientDetail struct {
 
 /*
   getRecipientDetailCert is used to format the expected recipient information
-  for the report.
+  for the report, with the date signed in the format.
 */
-func (lc Lgc) getRecipientDetailCert(documentID string, db DataCaller) ([]recipientDetail, error) {
+func (lc Lgc) getRecipientDetailCert(documentID string, db DataCaller, f certFormat) ([]recipientDetail, error) {
 	var out []recipientDetail
 
 	// We need to retrieve all of the active recipients from the database
@@ -425,7 +368,7 @@ func (lc Lgc) getRecipientDetailCert(documentID string, db DataCaller) ([]recipi
 			email: recipient.Email,
 		}
 		if recipient.Complete.String != "" {
-			r.date = recipient.Complete.String
+			r.date = f.formatDate(recipient.Complete.String)
 		}
 
 		// Get the session, and map the returned values to the recipient's output.
@@ -437,6 +380,7 @@ func (lc Lgc) getRecipientDetailCert(documentID string, db DataCaller) ([]recipi
 		}
 		if recSession.Id != "" {
 			r.sessionid = recSession.Id
+			r.agreed = f.formatDate(recSession.Created)
 		}
 		if recSession.Ip_address != "" {
 			r.ip = recSession.Ip_address
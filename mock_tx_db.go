@@ -0,0 +1,72 @@
+package logic
+
+import (
+	"database/sql"
+	"errors"
+)
+
+/*
+  MockTxDb is a MockDb that supports transactions. Statements within a
+  transaction are passed to the MockDb, and the number of transactions
+  begun, committed and rolled back are counted so tests can check a flow is
+  atomic. CommitMock can be set to make the commit fail.
+*/
+type MockTxDb struct {
+	*MockDb
+	CommitMock func() error
+
+	Begun      int
+	Committed  int
+	RolledBack int
+}
+
+func (m *MockTxDb) BeginTx() (DataTx, error) {
+	m.Begun++
+	return &mockTx{db: m}, nil
+}
+
+// BeginTx lets a MockDb be used by flows that run in a transaction. The
+// transaction is not counted, use a MockTxDb to check a flow is atomic.
+func (m *MockDb) BeginTx() (DataTx, error) {
+	return &mockTx{db: &MockTxDb{MockDb: m}}, nil
+}
+
+// mockTx is a transaction begun by a MockTxDb.
+type mockTx struct {
+	db   *MockTxDb
+	done bool
+}
+
+func (t *mockTx) Get(dest interface{}, query string, args ...interface{}) error {
+	return t.db.Get(dest, query, args...)
+}
+func (t *mockTx) Select(dest interface{}, query string, args ...interface{}) error {
+	return t.db.Select(dest, query, args...)
+}
+func (t *mockTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.db.Exec(query, args...)
+}
+
+func (t *mockTx) Commit() error {
+	if t.done {
+		return errors.New("Transaction has already been committed or rolled back.")
+	}
+	t.done = true
+	if t.db.CommitMock != nil {
+		if err := t.db.CommitMock(); err != nil {
+			t.db.RolledBack++
+			return err
+		}
+	}
+	t.db.Committed++
+	return nil
+}
+
+func (t *mockTx) Rollback() error {
+	if t.done {
+		return errors.New("Transaction has already been committed or rolled back.")
+	}
+	t.done = true
+	t.db.RolledBack++
+	return nil
+}
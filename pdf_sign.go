@@ -0,0 +1,402 @@
+package logic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The object identifiers used in the CMS signature.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// The structures of a CMS (PKCS#7) SignedData, as defined by RFC 5652.
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContent
+	Certificates     asn1.RawValue
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+type cmsEncapContent struct {
+	ContentType asn1.ObjectIdentifier
+}
+type cmsSignerInfo struct {
+	Version            int
+	SID                cmsIssuerSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+type cmsIssuerSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// cmsSet returns the DER encodings as a SET, or with the tag when the SET
+// is implicitly tagged. The encodings are sorted as DER requires.
+func cmsSet(class int, tag int, items [][]byte) asn1.RawValue {
+	sort.Slice(items, func(i, j int) bool { return bytes.Compare(items[i], items[j]) < 0 })
+	return asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: bytes.Join(items, nil)}
+}
+
+// cmsAttr returns the DER encoding of a signed attribute with one value.
+func cmsAttr(typ asn1.ObjectIdentifier, value interface{}) ([]byte, error) {
+	v, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsAttribute{Type: typ, Values: cmsSet(0, asn1.TagSet, [][]byte{v})})
+}
+
+/*
+  signCMS returns a detached CMS SignedData over the SHA-256 digest of the
+  content. The digest, content type and signing time are signed attributes,
+  and the certificates of the signer are embedded so a reader can verify
+  the signature without fetching them.
+*/
+func signCMS(digest []byte, s CertSigner, at time.Time) ([]byte, error) {
+	certs := s.Certificates()
+	if len(certs) == 0 {
+		return nil, errors.New("the signer has no certificate")
+	}
+
+	var sigAlg pkix.AlgorithmIdentifier
+	switch s.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSASHA256}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	var attrs [][]byte
+	for _, a := range []struct {
+		typ   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidMessageDigest, digest},
+		{oidSigningTime, at.UTC()},
+	} {
+		der, err := cmsAttr(a.typ, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, der)
+	}
+
+	// The signature is over the attributes encoded as a SET, while they are
+	// stored with the implicit tag of the SignerInfo.
+	signed, err := asn1.Marshal(cmsSet(0, asn1.TagSet, attrs))
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(signed)
+	sig, err := s.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw [][]byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw)
+	}
+	sha := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd, err := asn1.Marshal(cmsSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha},
+		EncapContentInfo: cmsEncapContent{ContentType: oidData},
+		// The chain keeps its order, so it is not sorted as a SET.
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true,
+			Bytes: bytes.Join(raw, nil)},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                cmsIssuerSerial{Issuer: asn1.RawValue{FullBytes: certs[0].RawIssuer}, Serial: certs[0].SerialNumber},
+			DigestAlgorithm:    sha,
+			SignedAttrs:        cmsSet(asn1.ClassContextSpecific, 0, attrs),
+			SignatureAlgorithm: sigAlg,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// The input for the signPDF function.
+type pdfSignInput struct {
+	Name   string // Who signed the PDF, shown by the reader.
+	Reason string
+	Time   time.Time
+}
+
+// pdfTrailer is the trailer of the last revision of a PDF.
+type pdfTrailer struct {
+	xref int    // The offset of the cross-reference section.
+	size int    // One more than the highest object number.
+	root int    // The object number of the catalog.
+	info string // The /Info entry, empty if there is none.
+	id   string // The /ID entry, empty if there is none.
+}
+
+var (
+	pdfSizeRe  = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfRootRe  = regexp.MustCompile(`/Root\s+(\d+)\s+0\s+R`)
+	pdfInfoRe  = regexp.MustCompile(`/Info\s+\d+\s+0\s+R`)
+	pdfIDRe    = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+	pdfPagesRe = regexp.MustCompile(`/Pages\s+(\d+)\s+0\s+R`)
+	pdfKidsRe  = regexp.MustCompile(`/Kids\s*\[\s*(\d+)\s+0\s+R`)
+	pdfTypeRe  = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfAnnotRe = regexp.MustCompile(`/Annots\s*\[`)
+)
+
+// readPDFTrailer reads the trailer of the last revision of the PDF, which
+// is either a trailer dictionary or the dictionary of a cross-reference
+// stream.
+func readPDFTrailer(b []byte) (pdfTrailer, error) {
+	var t pdfTrailer
+	i := bytes.LastIndex(b, []byte("startxref"))
+	if i < 0 {
+		return t, errors.New("the PDF has no startxref")
+	}
+	fields := strings.Fields(string(b[i+len("startxref"):]))
+	if len(fields) == 0 {
+		return t, errors.New("the PDF has no startxref")
+	}
+	xref, err := strconv.Atoi(fields[0])
+	if err != nil || xref >= len(b) {
+		return t, errors.New("the PDF has an invalid startxref")
+	}
+	t.xref = xref
+
+	dict := string(b[xref:i])
+	if strings.HasPrefix(dict, "xref") {
+		j := strings.Index(dict, "trailer")
+		if j < 0 {
+			return t, errors.New("the PDF has no trailer")
+		}
+		dict = dict[j:]
+	} else if j := strings.Index(dict, "stream"); j >= 0 {
+		dict = dict[:j]
+	}
+
+	m := pdfSizeRe.FindStringSubmatch(dict)
+	r := pdfRootRe.FindStringSubmatch(dict)
+	if m == nil || r == nil {
+		return t, errors.New("the PDF trailer has no /Size or /Root")
+	}
+	t.size, _ = strconv.Atoi(m[1])
+	t.root, _ = strconv.Atoi(r[1])
+	t.info = pdfInfoRe.FindString(dict)
+	t.id = pdfIDRe.FindString(dict)
+	return t, nil
+}
+
+// pdfObject returns the dictionary of the object, from the last revision
+// that defines it. Objects within object streams cannot be read.
+func pdfObject(b []byte, num int) (string, error) {
+	re := regexp.MustCompile(`(?:^|\s)` + strconv.Itoa(num) + `\s+0\s+obj\b`)
+	locs := re.FindAllIndex(b, -1)
+	if locs == nil {
+		return "", fmt.Errorf("object %v not found", num)
+	}
+	body := b[locs[len(locs)-1][1]:]
+	end := bytes.Index(body, []byte("endobj"))
+	if end < 0 {
+		return "", fmt.Errorf("object %v has no endobj", num)
+	}
+	dict := strings.TrimSpace(string(body[:end]))
+	if !strings.HasPrefix(dict, "<<") || !strings.HasSuffix(dict, ">>") {
+		return "", fmt.Errorf("object %v is not a dictionary", num)
+	}
+	return dict, nil
+}
+
+// pdfFirstPage returns the object number and dictionary of the first page.
+func pdfFirstPage(b []byte, catalog string) (int, string, error) {
+	m := pdfPagesRe.FindStringSubmatch(catalog)
+	if m == nil {
+		return 0, "", errors.New("the catalog has no pages")
+	}
+	num, _ := strconv.Atoi(m[1])
+	for depth := 0; depth < 32; depth++ {
+		obj, err := pdfObject(b, num)
+		if err != nil {
+			return 0, "", err
+		}
+		if !pdfTypeRe.MatchString(obj) {
+			return num, obj, nil
+		}
+		k := pdfKidsRe.FindStringSubmatch(obj)
+		if k == nil {
+			return 0, "", errors.New("the PDF has no pages")
+		}
+		num, _ = strconv.Atoi(k[1])
+	}
+	return 0, "", errors.New("the page tree is too deep")
+}
+
+// pdfAddEntry adds the entry to the end of the dictionary.
+func pdfAddEntry(dict string, entry string) string {
+	i := strings.LastIndex(dict, ">>")
+	return strings.TrimRight(dict[:i], " \r\n") + "\n" + entry + "\n>>"
+}
+
+// pdfString returns the text as a PDF literal string.
+func pdfString(s string) string {
+	return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s) + ")"
+}
+
+/*
+  signPDF adds an invisible signature to the PDF as an incremental update,
+  so the original bytes are unchanged. The signature is a detached CMS
+  (PKCS#7) signature over every byte of the file other than the signature
+  itself, so readers such as Adobe Reader show the PDF as signed and any
+  later change to the PDF is detected.
+  The update adds the signature field to the AcroForm of the catalog and
+  to the annotations of the first page. PDFs that already have a form, or
+  whose catalog is within an object stream, are not supported.
+*/
+func signPDF(b []byte, s CertSigner, in pdfSignInput) ([]byte, error) {
+	t, err := readPDFTrailer(b)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := pdfObject(b, t.root)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(catalog, "/AcroForm") {
+		return nil, errors.New("the PDF already has a form")
+	}
+	pageNum, page, err := pdfFirstPage(b, catalog)
+	if err != nil {
+		return nil, err
+	}
+	if loc := pdfAnnotRe.FindStringIndex(page); loc != nil {
+		page = page[:loc[1]] + fmt.Sprintf("%d 0 R ", t.size+1) + page[loc[1]:]
+	} else if strings.Contains(page, "/Annots") {
+		return nil, errors.New("the page annotations are not supported")
+	} else {
+		page = pdfAddEntry(page, fmt.Sprintf("/Annots [%d 0 R]", t.size+1))
+	}
+
+	// The signature is written as zeros, and replaced once the byte range
+	// has been hashed. The space reserved allows for the chain.
+	reserve := 4096
+	for _, c := range s.Certificates() {
+		reserve += len(c.Raw)
+	}
+	rangeFmt := "[0 %-10d %-10d %-10d]"
+
+	var buf bytes.Buffer
+	buf.Write(b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	sigNum, widgetNum, formNum := t.size, t.size+1, t.size+2
+	offsets := map[int]int{}
+
+	offsets[sigNum] = buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /adbe.pkcs7.detached\n", sigNum)
+	fmt.Fprintf(&buf, "/Name %v /Reason %v /M %v\n/ByteRange ", pdfString(in.Name), pdfString(in.Reason),
+		pdfString(in.Time.UTC().Format("D:20060102150405Z")))
+	rangePos := buf.Len()
+	fmt.Fprintf(&buf, rangeFmt, 0, 0, 0)
+	buf.WriteString("\n/Contents ")
+	contentsStart := buf.Len()
+	buf.WriteString("<" + strings.Repeat("0", reserve*2) + ">")
+	contentsEnd := buf.Len()
+	buf.WriteString(" >>\nendobj\n")
+
+	write := func(num int, dict string) {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%v\nendobj\n", num, dict)
+	}
+	write(widgetNum, fmt.Sprintf("<< /Type /Annot /Subtype /Widget /FT /Sig /T %v /V %d 0 R /P %d 0 R /Rect [0 0 0 0] /F 132 >>",
+		pdfString(fmt.Sprintf("Signature%d", sigNum)), sigNum, pageNum))
+	write(formNum, fmt.Sprintf("<< /Fields [%d 0 R] /SigFlags 3 >>", widgetNum))
+	write(t.root, pdfAddEntry(catalog, fmt.Sprintf("/AcroForm %d 0 R", formNum)))
+	write(pageNum, page)
+
+	// The cross-reference section lists the new and updated objects, in
+	// runs of consecutive object numbers.
+	var nums []int
+	for n := range offsets {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	xref := buf.Len()
+	buf.WriteString("xref\n")
+	for i := 0; i < len(nums); {
+		j := i
+		for j+1 < len(nums) && nums[j+1] == nums[j]+1 {
+			j++
+		}
+		fmt.Fprintf(&buf, "%d %d\n", nums[i], j-i+1)
+		for _, n := range nums[i : j+1] {
+			fmt.Fprintf(&buf, "%010d 00000 n \n", offsets[n])
+		}
+		i = j + 1
+	}
+	trailer := fmt.Sprintf("/Size %d /Root %d 0 R /Prev %d", t.size+3, t.root, t.xref)
+	for _, entry := range []string{t.info, t.id} {
+		if entry != "" {
+			trailer += " " + entry
+		}
+	}
+	fmt.Fprintf(&buf, "trailer\n<< %v >>\nstartxref\n%d\n%%%%EOF\n", trailer, xref)
+
+	out := buf.Bytes()
+	copy(out[rangePos:], fmt.Sprintf(rangeFmt, contentsStart, contentsEnd, len(out)-contentsEnd))
+
+	h := sha256.New()
+	h.Write(out[:contentsStart])
+	h.Write(out[contentsEnd:])
+	sig, err := signCMS(h.Sum(nil), s, in.Time)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) > reserve {
+		return nil, errors.New("the signature is larger than the space reserved")
+	}
+	copy(out[contentsStart+1:], strings.ToUpper(hex.EncodeToString(sig)))
+	return out, nil
+}
@@ -0,0 +1,233 @@
+package logic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"github.com/jung-kurt/gofpdf"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner returns a PEMSigner with a new key and self-signed certificate.
+func testSigner(t *testing.T) *PEMSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "PleaseSign Test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	s, err := NewPEMSigner(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// verifyPDFSignature checks the signature of a PDF signed by signPDF covers
+// the byte range and was made by the certificate.
+func verifyPDFSignature(b []byte, cert *x509.Certificate) error {
+	m := regexp.MustCompile(`/ByteRange \[0 (\d+)\s+(\d+)\s+(\d+)\s*\]`).FindSubmatch(b)
+	if m == nil {
+		return errBadSig("no byte range")
+	}
+	start, _ := strconv.Atoi(string(m[1]))
+	end, _ := strconv.Atoi(string(m[2]))
+	rest, _ := strconv.Atoi(string(m[3]))
+	if end+rest != len(b) || b[start] != '<' || b[end-1] != '>' {
+		return errBadSig("the byte range does not cover the file")
+	}
+
+	der, err := hex.DecodeString(string(b[start+1 : end-1]))
+	if err != nil {
+		return err
+	}
+	return verifyCMS(der, append(append([]byte{}, b[:start]...), b[end:]...), cert)
+}
+
+// verifyCMS checks a detached signature made by signCMS covers the content
+// and was made by the certificate.
+func verifyCMS(der []byte, content []byte, cert *x509.Certificate) error {
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return err
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return err
+	}
+	si := sd.SignerInfos[0]
+
+	var attrs []cmsAttribute
+	set := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	if _, err := asn1.UnmarshalWithParams(set, &attrs, "set"); err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write(content)
+	var digest []byte
+	for _, a := range attrs {
+		if a.Type.Equal(oidMessageDigest) {
+			asn1.Unmarshal(a.Values.Bytes, &digest)
+		}
+	}
+	if !bytes.Equal(digest, h.Sum(nil)) {
+		return errBadSig("the digest does not match")
+	}
+	sum := sha256.Sum256(set)
+	return rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], si.Signature)
+}
+
+type errBadSig string
+
+func (e errBadSig) Error() string { return string(e) }
+
+// Test the signPDF function appends a signature over the whole PDF, and
+// that changing the PDF invalidates it.
+func TestSignPDF(t *testing.T) {
+	s := testSigner(t)
+
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "", 12)
+	pdf.Cell(0, 12, "Certificate of Authenticity")
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal(err)
+	}
+	orig := buf.Bytes()
+
+	signed, err := signPDF(orig, s, pdfSignInput{Name: "PleaseSign", Reason: "Test (1)", Time: time.Now()})
+	if err != nil {
+		t.Fatalf("signPDF returned an error, got %v.", err)
+	}
+	if !bytes.HasPrefix(signed, orig) {
+		t.Error("signPDF changed the original PDF.")
+	}
+	if err := verifyPDFSignature(signed, s.Certificates()[0]); err != nil {
+		t.Errorf("The signature did not verify, got %v.", err)
+	}
+
+	// The new revision adds the signature form to the catalog.
+	tr, err := readPDFTrailer(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catalog, err := pdfObject(signed, tr.root); err != nil || !strings.Contains(catalog, "/AcroForm") {
+		t.Errorf("The catalog has no signature form, got %v %v.", catalog, err)
+	}
+	if _, err := signPDF(signed, s, pdfSignInput{Time: time.Now()}); err == nil {
+		t.Error("signPDF signed a PDF that already has a form.")
+	}
+
+	tampered := append([]byte{}, signed...)
+	i := bytes.Index(tampered, []byte("Certificate"))
+	if i < 0 {
+		// The content stream is compressed, so change the header instead.
+		i = 5
+	}
+	tampered[i] ^= 1
+	if err := verifyPDFSignature(tampered, s.Certificates()[0]); err == nil {
+		t.Error("The signature verified after the PDF was changed.")
+	}
+}
+
+// Test the NewPEMSigner function rejects a key that does not match the
+// certificate.
+func TestNewPEMSignerMismatch(t *testing.T) {
+	a := testSigner(t)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.Certificates()[0].Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(other)})
+	if _, err := NewPEMSigner(certPEM, keyPEM); err == nil {
+		t.Error("NewPEMSigner accepted a key that does not match the certificate.")
+	}
+}
+
+// masterFiles is the PrivateLogic used by TestSignMasterDocument, which
+// returns the master document and records the deleted objects.
+type masterFiles struct {
+	MockPrivateLogic
+	pdf     []byte
+	deleted []string
+}
+
+func (m *masterFiles) GetFile(in *GetFileInput) ([]byte, error) {
+	return m.pdf, nil
+}
+
+func (m *masterFiles) DeleteFile(key string, bucket string) error {
+	m.deleted = append(m.deleted, key)
+	return nil
+}
+
+// Test the signMasterDocument function saves the signed master document in
+// one transaction, and only deletes the unsigned master document once it is
+// saved.
+func TestSignMasterDocument(t *testing.T) {
+	pdf := gofpdf.New("P", "pt", "A4", "")
+	pdf.AddPage()
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal(err)
+	}
+	pvl := &masterFiles{pdf: buf.Bytes()}
+	lc := Lgc{Pvl: pvl}
+
+	var failed bool
+	db := &MockTxDb{MockDb: &MockDb{
+		GetMock: func(dest interface{}, query string, args ...interface{}) error {
+			v := reflect.ValueOf(dest).Elem()
+			v.FieldByName("Key").Set(reflect.ValueOf(sql.NullString{String: "old.pdf", Valid: true}))
+			v.FieldByName("Status").SetString("complete")
+			return nil
+		},
+		ExecMock: func(q string, args ...interface{}) (sql.Result, error) {
+			if failed && strings.HasPrefix(q, "INSERT INTO documents_security") {
+				return nil, errors.New("insert failed")
+			}
+			return nil, nil
+		},
+	}}
+
+	if err := lc.signMasterDocument("1", db, testSigner(t)); err != nil {
+		t.Fatalf("signMasterDocument returned an error, got %v.", err)
+	}
+	if db.Committed != 1 || len(pvl.deleted) != 1 || pvl.deleted[0] != "old.pdf" {
+		t.Errorf("signMasterDocument did not replace the master document, got %+v %v.", db, pvl.deleted)
+	}
+
+	// The unsigned master document is kept when the signed one is not saved.
+	failed, pvl.deleted = true, nil
+	if err := lc.signMasterDocument("1", db, testSigner(t)); err == nil {
+		t.Fatal("signMasterDocument did not return the failed insert.")
+	}
+	if db.RolledBack != 1 || len(pvl.deleted) != 1 || pvl.deleted[0] == "old.pdf" {
+		t.Errorf("signMasterDocument deleted the master document of a failed save, got %v.", pvl.deleted)
+	}
+}
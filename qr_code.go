@@ -0,0 +1,433 @@
+package logic
+
+import (
+	"errors"
+)
+
+/*
+  qrCode is a QR code symbol, encoded in byte mode at error correction
+  level M, which recovers from 15% of the symbol being damaged. Versions 1
+  to 10 are supported, up to 213 bytes, which is plenty for a link.
+*/
+type qrCode struct {
+	size     int
+	modules  [][]bool // Dark modules, indexed by row then column.
+	function [][]bool // Modules of the function patterns, which are not masked.
+}
+
+// The codewords of each version at level M, from version 1.
+var (
+	qrTotalCodewords = []int{26, 44, 70, 100, 134, 172, 196, 242, 292, 346}
+	qrECCPerBlock    = []int{10, 16, 26, 18, 24, 16, 18, 22, 22, 26}
+	qrBlocks         = []int{1, 1, 1, 2, 2, 4, 4, 4, 5, 5}
+)
+
+// qrAlignment are the centres of the alignment patterns of each version.
+var qrAlignment = [][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// qrDataCodewords returns the number of data codewords of the version.
+func qrDataCodewords(version int) int {
+	return qrTotalCodewords[version-1] - qrECCPerBlock[version-1]*qrBlocks[version-1]
+}
+
+// qrCountBits returns the length of the byte count of the version.
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// newQRCode encodes the bytes in the smallest version they fit in.
+func newQRCode(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= len(qrTotalCodewords); version++ {
+		if 4+qrCountBits(version)+len(data)*8 <= qrDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > len(qrTotalCodewords) {
+		return nil, errors.New("the data is too long for a QR code")
+	}
+
+	// Write the mode, count and data, then the terminator and padding.
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>uint(i)&1 == 1)
+		}
+	}
+	put(0x4, 4)
+	put(len(data), qrCountBits(version))
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	n := qrDataCodewords(version)
+	codewords := make([]byte, 0, n)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < n; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	q := &qrCode{size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrInterleave(version, codewords))
+
+	// Use the mask with the lowest penalty.
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+// set sets a module of a function pattern.
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws the finder, timing and alignment patterns, and
+// reserves the format and version areas.
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// The finder patterns, with their separators, in three corners.
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				d := qrMax(qrAbs(dx), qrAbs(dy))
+				q.set(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+
+	// The alignment patterns, except where they overlap the finders.
+	pos := qrAlignment[version-1]
+	last := len(pos) - 1
+	for i, cy := range pos {
+		for j, cx := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, qrMax(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormat(0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// qrFormatBits returns the format information of level M with the mask.
+func qrFormatBits(mask int) int {
+	data := mask // Level M is 00.
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// drawFormat draws both copies of the format information, and the dark
+// module beside the bottom left finder.
+func (q *qrCode) drawFormat(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>uint(i)&1 == 1 }
+	for i := 0; i < 6; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords places the codewords in the zigzag order, upwards and
+// downwards in columns of two from the right, skipping the timing column.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>uint(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// qrMasked returns whether the mask inverts the module.
+func qrMasked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+// applyMask inverts the data modules of the mask. Applying it twice undoes
+// it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.function[y][x] && qrMasked(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+/*
+  penalty scores the symbol by the rules of the specification: runs of five
+  or more modules, 2x2 blocks, patterns that look like a finder, and an
+  imbalance of dark and light modules.
+*/
+func (q *qrCode) penalty() int {
+	at := func(x, y int, rows bool) bool {
+		if rows {
+			return q.modules[y][x]
+		}
+		return q.modules[x][y]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+
+	p, dark := 0, 0
+	for _, rows := range []bool{true, false} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, rows) == at(x-1, y, rows) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += 3 + run - 5
+				}
+				run = 1
+			}
+
+			// A finder pattern with four light modules on either side,
+			// where the outside of the symbol is light.
+			light := func(from, to int) bool {
+				for x := from; x < to; x++ {
+					if x >= 0 && x < q.size && at(x, y, rows) {
+						return false
+					}
+				}
+				return true
+			}
+			for x := 0; x+7 <= q.size; x++ {
+				match := true
+				for i, v := range finder {
+					if at(x+i, y, rows) != v {
+						match = false
+						break
+					}
+				}
+				if match && (light(x-4, x) || light(x+7, x+11)) {
+					p += 40
+				}
+			}
+		}
+	}
+
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if q.modules[y-1][x] == c && q.modules[y][x-1] == c && q.modules[y-1][x-1] == c {
+					p += 3
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	p += qrAbs(dark*20-total*10) / total * 10
+	return p
+}
+
+/*
+  qrInterleave splits the data codewords into the blocks of the version,
+  adds the error correction codewords of each block, and interleaves them.
+  The later blocks hold one more data codeword when the codewords do not
+  divide evenly.
+*/
+func qrInterleave(version int, data []byte) []byte {
+	numBlocks := qrBlocks[version-1]
+	eccLen := qrECCPerBlock[version-1]
+	total := qrTotalCodewords[version-1]
+	numShort := numBlocks - total%numBlocks
+	shortLen := total / numBlocks
+
+	divisor := qrRSDivisor(eccLen)
+	var blocks [][]byte
+	k := 0
+	for i := 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := append([]byte{}, dat...)
+		if i < numShort {
+			block = append(block, 0)
+		}
+		blocks = append(blocks, append(block, qrRSRemainder(dat, divisor)...))
+	}
+
+	var out []byte
+	for i := 0; i < len(blocks[0]); i++ {
+		for j, block := range blocks {
+			// Skip the padding of the short blocks.
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// qrRSDivisor returns the generator polynomial of the degree for the
+// Reed-Solomon code, without its leading term.
+func qrRSDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = qrMultiply(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return out
+}
+
+// qrRSRemainder returns the error correction codewords of the data.
+func qrRSRemainder(data, divisor []byte) []byte {
+	out := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i, d := range divisor {
+			out[i] ^= qrMultiply(d, factor)
+		}
+	}
+	return out
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrAbs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func qrMax(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,161 @@
+package logic
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Test the error correction and format information against the examples
+// of the specification.
+func TestQRCodeTables(t *testing.T) {
+	// HELLO WORLD at version 1-M.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrRSRemainder(data, qrRSDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("qrRSRemainder expected %v, got %v.", want, got)
+	}
+
+	for mask, want := range []string{"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+		"100010111111001", "100000011001110", "100111110010111", "100101010100000"} {
+		if got := fmt.Sprintf("%015b", qrFormatBits(mask)); got != want {
+			t.Errorf("qrFormatBits(%v) expected %v, got %v.", mask, want, got)
+		}
+	}
+
+	// The version information of version 7, read from the top right.
+	q, err := newQRCode(bytes.Repeat([]byte("a"), 110))
+	if err != nil || q.size != 45 {
+		t.Fatalf("newQRCode did not use version 7, got %v %v.", q, err)
+	}
+	v := 0
+	for i := 17; i >= 0; i-- {
+		v <<= 1
+		if q.modules[i/3][q.size-11+i%3] {
+			v |= 1
+		}
+	}
+	if got := fmt.Sprintf("%018b", v); got != "000111110010010100" {
+		t.Errorf("The version information expected 000111110010010100, got %v.", got)
+	}
+}
+
+// qrDecode reads the bytes back from a symbol, checking the format
+// information and error correction.
+func qrDecode(q *qrCode) ([]byte, error) {
+	version := (q.size - 17) / 4
+
+	// Read the first copy of the format information.
+	var pos [][2]int
+	for i := 0; i < 6; i++ {
+		pos = append(pos, [2]int{8, i})
+	}
+	pos = append(pos, [2]int{8, 7}, [2]int{8, 8}, [2]int{7, 8})
+	for i := 9; i < 15; i++ {
+		pos = append(pos, [2]int{14 - i, 8})
+	}
+	format := 0
+	for i, p := range pos {
+		if q.modules[p[1]][p[0]] {
+			format |= 1 << uint(i)
+		}
+	}
+	mask := (format ^ 0x5412) >> 10 & 7
+	if qrFormatBits(mask) != format {
+		return nil, fmt.Errorf("the format information %015b is not level M", format)
+	}
+
+	q.applyMask(mask)
+	defer q.applyMask(mask)
+	var raw []byte
+	var b byte
+	n := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] {
+					continue
+				}
+				b <<= 1
+				if q.modules[y][x] {
+					b |= 1
+				}
+				if n++; n%8 == 0 {
+					raw = append(raw, b)
+				}
+			}
+		}
+	}
+
+	// Split the codewords back into their blocks and check each block.
+	numBlocks, eccLen, total := qrBlocks[version-1], qrECCPerBlock[version-1], qrTotalCodewords[version-1]
+	numShort, shortLen := numBlocks-total%numBlocks, total/numBlocks
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i <= shortLen; i++ {
+		for j := range blocks {
+			// The short blocks are padded to the length of the long ones.
+			if i == shortLen-eccLen && j < numShort {
+				blocks[j] = append(blocks[j], 0)
+				continue
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+	var data []byte
+	for j, block := range blocks {
+		n := shortLen - eccLen
+		if j >= numShort {
+			n++
+		}
+		ecc := block[len(block)-eccLen:]
+		if !bytes.Equal(qrRSRemainder(block[:n], qrRSDivisor(eccLen)), ecc) {
+			return nil, fmt.Errorf("block %v has the wrong error correction", j)
+		}
+		data = append(data, block[:n]...)
+	}
+
+	if data[0]>>4 != 0x4 {
+		return nil, fmt.Errorf("the mode %x is not byte mode", data[0]>>4)
+	}
+	var length, start int
+	if version < 10 {
+		length = int(data[0]&0xF)<<4 | int(data[1]>>4)
+		start = 1
+	} else {
+		length = int(data[0]&0xF)<<12 | int(data[1])<<4 | int(data[2]>>4)
+		start = 2
+	}
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = data[start+i]<<4 | data[start+i+1]>>4
+	}
+	return out, nil
+}
+
+// Test links of each length can be read back from the symbol.
+func TestQRCodeRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 14, 60, 106, 107, 150, 213} {
+		in := []byte("https://app.pleasesign.com.au/verify/" + strings.Repeat("x", n))[:n]
+		q, err := newQRCode(in)
+		if err != nil {
+			t.Fatalf("newQRCode(%v bytes) returned an error, got %v.", n, err)
+		}
+		got, err := qrDecode(q)
+		if err != nil || !bytes.Equal(got, in) {
+			t.Errorf("The %v byte symbol decoded to %q, %v.", n, got, err)
+		}
+	}
+	if _, err := newQRCode(make([]byte, 214)); err == nil {
+		t.Error("newQRCode encoded more than version 10 holds.")
+	}
+}
@@ -0,0 +1,38 @@
+package setup
+
+import (
+	"io/ioutil"
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"pleasesign/logic"
+)
+
+// Sets the signer used for certificates of authenticity. In the live context
+// the key is held in KMS, otherwise the key is read from a PEM file. The
+// certificate chain is always read from a PEM file. Certificates are left
+// unsigned when no key is configured.
+func ConfigureCertSigner(context string) {
+	if config.CertSigningKey() == "" {
+		return
+	}
+
+	var signer logic.CertSigner
+	var err error
+	if context == "live" {
+		var certPEM []byte
+		certPEM, err = ioutil.ReadFile(config.CertSigningCert())
+		if err == nil {
+			signer, err = logic.NewKMSSigner(config.CertSigningKey(), certPEM)
+		}
+	} else {
+		signer, err = logic.LoadPEMSigner(config.CertSigningCert(), config.CertSigningKey())
+	}
+	if err != nil {
+		e.ThrowError(&e.LogInput{
+			M: "Unable to load the certificate signing key.",
+			E: err,
+		})
+		return
+	}
+	logic.SetCertSigner(signer, config.CertSignMaster())
+}
@@ -0,0 +1,32 @@
+package setup
+
+import (
+	"pleasesign/config"
+	e "pleasesign/errlogger"
+	"pleasesign/logic"
+)
+
+// Prepares the logic package once the database is connected. This is
+// called when the API starts, after the database connection is opened with
+// the password from DecPass. The plan catalog is loaded from the plans
+// table; when it cannot be loaded the default plans are kept, which match
+// the plans seeded in database.sql. The ABN and address printed on invoices
+// are read from the config, and the certificate signer is loaded for the
+// context. The test context bills with a MemBilling, so Stripe is never
+// called outside of production and staging.
+func ConfigureLogic(context string, d logic.DataCaller) {
+	if context == "test" {
+		logic.SetBillingProvider(logic.NewMemBilling())
+	}
+	if err := logic.LoadPlanCatalog(d); err != nil {
+		e.ThrowError(&e.LogInput{M: "Unable to load the plans, the default plans are used.", E: err})
+	}
+	ConfigureCertSigner(context)
+	logic.SetInvoiceIssuer(logic.InvoiceIssuer{
+		Name:    "PleaseSign",
+		ABN:     config.InvoiceABN(),
+		Address: config.InvoiceAddress(),
+		Email:   "accounts@pleasesign.com.au",
+		Country: "AU",
+	})
+}
@@ -67,6 +67,29 @@ func retrieveUserAuth(db logic.DataCaller, r *http.Request) *logic.UserAuth {
 
 	return &ua
 }
+
+// restrictedAllowed are the routes that can still be used to make changes
+// while an account is restricted, so the user can pay what they owe. Each
+// route is allowed for a single method, or any method if empty, as some
+// routes also make changes that are not needed to pay.
+var restrictedAllowed = map[string]string{
+	"/key":                         "",
+	"/user/newSub":                 "POST",
+	"/user/updatePlan":             "PUT",
+	"/user/updatePlanInfo":         "PUT",
+	"/user/paymentMethods":         "POST",
+	"/user/paymentMethods/default": "PUT",
+	"/user/trialCard":              "POST",
+	"/user/reactivate":             "PUT",
+}
+
+// isRestrictedAllowed returns true if the request can be made while the
+// account is restricted.
+func isRestrictedAllowed(r *http.Request) bool {
+	m, ok := restrictedAllowed[r.URL.Path]
+	return ok && (m == "" || m == r.Method)
+}
+
 func AuthenticateHandler(ua *logic.UserAuth, d logic.DataCaller, db logic.DataStore, lgc logic.Lgc) http.Handler {
 	h := func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "OPTIONS" {
@@ -105,6 +128,7 @@ func AuthenticateHandler(ua *logic.UserAuth, d logic.DataCaller, db logic.DataSt
 			r.URL.Path == "/password/new" ||
 			r.URL.Path == "/resetQuotas" ||
 			r.URL.Path == "/public/verification" ||
+			r.URL.Path == "/public/verify" ||
 			r.URL.Path == "/email_hook" ||
 			r.URL.Path == "/ecomm_hook" ||
 			r.URL.Path == "/ecomm_schedule" ||
@@ -162,6 +186,22 @@ func AuthenticateHandler(ua *logic.UserAuth, d logic.DataCaller, db logic.DataSt
 		}
 		lgc.CurrentUser = ua
 
+		// If the account has been restricted due to failed payments, the
+		// account is read-only. Only the requests needed to pay the
+		// outstanding invoice are allowed.
+		if r.Method != "GET" && !isRestrictedAllowed(r) {
+			restricted, err := lgc.EcommRestricted(d, ua.Id)
+			if err == nil && restricted {
+				eI := &controller.ErrorNowInput{
+					Writer:    w,
+					ErrString: "Your account has been restricted due to failed payments, please update your payment details.",
+					Code:      402,
+				}
+				controller.ErrorNow(eI)
+				return
+			}
+		}
+
 		// we want to return a user object so that our routes
 		// can identify who is running them.
 		Forward(d, db, lgc).ServeHTTP(w, r)
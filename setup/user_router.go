@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"pleasesign/controller"
 	"pleasesign/logic"
+	"strings"
 )
 
 func Forward(d logic.DataCaller, db logic.DataStore, logicController logic.Lgc) http.Handler {
@@ -43,6 +44,8 @@ func Forward(d logic.DataCaller, db logic.DataStore, logicController logic.Lgc)
 			controller.PostSignature(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/public/void" && r.Method == "POST":
 			controller.VoidDocumentPublic(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/public/verify" && r.Method == "GET":
+			controller.VerifyDocument(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/public/verification" && r.Method == "POST":
 			controller.VerifyEmail(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/void" && r.Method == "POST":
@@ -57,6 +60,8 @@ func Forward(d logic.DataCaller, db logic.DataStore, logicController logic.Lgc)
 			controller.GetDocumentSigned(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/documentCertificate" && r.Method == "GET":
 			controller.GetDocumentCertificate(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/documentAudit" && r.Method == "GET":
+			controller.GetDocumentAudit(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/documentOriginal" && r.Method == "GET":
 			controller.GetDocumentOriginal(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/recipient" && r.Method == "POST":
@@ -85,20 +90,66 @@ func Forward(d logic.DataCaller, db logic.DataStore, logicController logic.Lgc)
 			controller.Emailhook(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/newSub" && r.Method == "POST":
 			controller.EcommNewCustomer(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/plans" && r.Method == "GET":
+			controller.EcommGetPlans(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/plan" && r.Method == "GET":
 			controller.EcommGetCustomerSub(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/trial" && r.Method == "POST":
+			controller.EcommStartTrial(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/trialCard" && r.Method == "POST":
+			controller.EcommAddTrialCard(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/coupon" && r.Method == "GET":
+			controller.EcommValidateCoupon(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/updatePlan" && r.Method == "PUT":
 			controller.EcommUpdateCustomerSub(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/updatePlan/preview" && r.Method == "GET":
+			controller.EcommPreviewPlanChange(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/reactivate" && r.Method == "PUT":
+			controller.EcommReactivateSub(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/updatePlanInfo" && r.Method == "PUT":
 			controller.EcommUpdateCustomerInfo(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/paymentMethods" && r.Method == "GET":
+			controller.EcommGetPaymentMethods(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/paymentMethods" && r.Method == "POST":
+			controller.EcommAddPaymentMethod(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/paymentMethods" && r.Method == "DELETE":
+			controller.EcommRemovePaymentMethod(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/paymentMethods/default" && r.Method == "PUT":
+			controller.EcommSetDefaultPaymentMethod(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/certificateOptions" && r.Method == "PUT":
+			controller.UpdateCertOptions(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/taxId" && r.Method == "PUT":
+			controller.EcommUpdateTaxID(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/invoices" && r.Method == "GET":
 			controller.EcommGetCustomerInvoices(d, logicController).ServeHTTP(w, r)
+		case strings.HasPrefix(r.URL.Path, "/user/invoices/") && strings.HasSuffix(r.URL.Path, "/pdf") && r.Method == "GET":
+			controller.EcommInvoicePDF(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/group" && r.Method == "GET":
+			controller.EcommGetGroup(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/group/seats" && r.Method == "PUT":
+			controller.EcommUpdateSeats(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/group/invite" && r.Method == "POST":
+			controller.EcommInviteMember(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/group/accept" && r.Method == "POST":
+			controller.EcommAcceptInvite(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/user/group/member" && r.Method == "DELETE":
+			controller.EcommRemoveMember(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/signature_link" && r.Method == "GET":
 			controller.UserSignatureGet(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/admin/refund" && r.Method == "POST":
+			controller.EcommAdminRefund(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/admin/dunning" && r.Method == "GET":
+			controller.EcommDunningHistory(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/ecomm_hook" && r.Method == "POST":
 			controller.EcommWebHook(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/ecomm_schedule" && r.Method == "GET":
 			controller.EcommSchedule(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/ecomm_replay" && r.Method == "POST":
+			controller.EcommReplay(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/ecomm_reconcile" && r.Method == "GET":
+			controller.EcommReconcile(d, logicController).ServeHTTP(w, r)
+		case r.URL.Path == "/ecomm_reconcile" && r.Method == "POST":
+			controller.EcommReconcileRepair(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/recipient/sign_link" && r.Method == "GET":
 			controller.GenSigningLink(d, logicController).ServeHTTP(w, r)
 		case r.URL.Path == "/user/branding" && r.Method == "GET":